@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// adminIdleTimeout closes admin connections that send nothing for this long.
+const adminIdleTimeout = 5 * time.Minute
+
+// AdminCommandFunc runs an admin command. source identifies the connection
+// the command came from, for logging; args are the words after the command name.
+type AdminCommandFunc func(source string, args []string) (string, error)
+
+type adminCommand struct {
+	usage string
+	run   AdminCommandFunc
+}
+
+// AdminServer accepts line based commands on a Unix socket, e.g.
+//
+//	echo "forwarding off" | nc -U /run/wg-knot/admin.sock
+//
+// Each line is one command; each reply is one or more lines, the first
+// starting with "ok" or "error".
+type AdminServer struct {
+	listener    net.Listener
+	path        string
+	logger      LoggerInterface
+	mu          sync.RWMutex
+	commands    map[string]adminCommand
+	connections atomic.Uint64
+}
+
+// NewAdminServer listens on the Unix socket at path, replacing a stale socket
+// left by a previous run. The socket is only accessible to the owner.
+func NewAdminServer(path string, logger LoggerInterface) (*AdminServer, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	a := &AdminServer{
+		listener: listener,
+		path:     path,
+		logger:   logger,
+		commands: make(map[string]adminCommand),
+	}
+	a.Handle("help", "help", func(source string, args []string) (string, error) {
+		return a.usage(), nil
+	})
+	return a, nil
+}
+
+// Handle registers a command. usage is shown by the help command.
+func (a *AdminServer) Handle(name, usage string, run AdminCommandFunc) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.commands[name] = adminCommand{usage: usage, run: run}
+}
+
+func (a *AdminServer) usage() string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	usages := make([]string, 0, len(a.commands))
+	for _, command := range a.commands {
+		usages = append(usages, command.usage)
+	}
+	sort.Strings(usages)
+	return "commands:\n  " + strings.Join(usages, "\n  ")
+}
+
+// Run accepts connections until ctx is cancelled, then removes the socket.
+func (a *AdminServer) Run(ctx context.Context) {
+	context.AfterFunc(ctx, func() {
+		a.listener.Close()
+	})
+	defer os.Remove(a.path)
+
+	for {
+		conn, err := a.listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil && !errors.Is(err, net.ErrClosed) {
+				a.logger.Error("Admin socket accept failed: %v", err)
+			}
+			return
+		}
+		go a.serve(conn, fmt.Sprintf("admin#%d", a.connections.Add(1)))
+	}
+}
+
+func (a *AdminServer) serve(conn net.Conn, source string) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(adminIdleTimeout))
+		if !scanner.Scan() {
+			return
+		}
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		reply := a.execute(source, fields[0], fields[1:])
+		if _, err := conn.Write([]byte(reply + "\n")); err != nil {
+			return
+		}
+	}
+}
+
+func (a *AdminServer) execute(source, name string, args []string) string {
+	a.mu.RLock()
+	command, exists := a.commands[name]
+	a.mu.RUnlock()
+	if !exists {
+		return fmt.Sprintf("error unknown command %q, try help", name)
+	}
+
+	output, err := command.run(source, args)
+	if err != nil {
+		return "error " + err.Error()
+	}
+	if output == "" {
+		return "ok"
+	}
+	return "ok " + output
+}
+
+// registerAdminCommands adds the relay's runtime commands to admin.
+func registerAdminCommands(admin *AdminServer, pm *PeerManager, workerPool *WorkerPool, bufferPool *BufferPool, state *StateReporter, logger *Logger) {
+	admin.Handle("loglevel", "loglevel [debug|info|warning|error]", func(source string, args []string) (string, error) {
+		if len(args) == 0 {
+			return GetLogLevelName(logger.Level()), nil
+		}
+		level := GetLogLevel(args[0])
+		if len(args) != 1 || GetLogLevelName(level) != args[0] {
+			return "", fmt.Errorf("usage: loglevel [debug|info|warning|error]")
+		}
+		logger.SetLevel(level)
+		// Logged at error level so the change is visible whatever the new level.
+		logger.Error("Log level changed to %s by %s", args[0], source)
+		return args[0], nil
+	})
+
+	// Serializes updates so that changing one list never reverts a
+	// concurrent change of the other.
+	var cidrMu sync.Mutex
+	admin.Handle("cidrs", "cidrs [allow|deny <cidr,...|none>]", func(source string, args []string) (string, error) {
+		cidrMu.Lock()
+		defer cidrMu.Unlock()
+
+		current := pm.SourceFilter()
+		if current == nil {
+			current = &SourceFilter{}
+		}
+		if len(args) == 0 {
+			return current.String(), nil
+		}
+		if len(args) != 2 || (args[0] != "allow" && args[0] != "deny") {
+			return "", fmt.Errorf("usage: cidrs [allow|deny <cidr,...|none>]")
+		}
+
+		var values []string
+		if args[1] != "none" {
+			values = strings.Split(args[1], ",")
+		}
+		prefixes, err := parsePrefixes(values)
+		if err != nil {
+			return "", err
+		}
+
+		updated := current.WithDeny(prefixes)
+		if args[0] == "allow" {
+			updated = current.WithAllow(prefixes)
+		}
+		pm.SetSourceFilter(updated)
+		logger.Warning("Source CIDR lists changed by %s: %s", source, updated)
+		return updated.String(), nil
+	})
+
+	admin.Handle("reset", "reset stats", func(source string, args []string) (string, error) {
+		if len(args) != 1 || args[0] != "stats" {
+			return "", fmt.Errorf("usage: reset stats")
+		}
+		last := pm.Stats().Reset()
+		bufferPool.ResetStats()
+		workerPool.latency.Reset()
+		logger.Warning("Statistics reset by %s, counters were: %s", source, last)
+		return "stats reset", nil
+	})
+
+	admin.Handle("forwarding", "forwarding [on|off]", func(source string, args []string) (string, error) {
+		if len(args) == 0 {
+			if pm.ForwardingEnabled() {
+				return "forwarding on", nil
+			}
+			return "forwarding off", nil
+		}
+		switch args[0] {
+		case "on":
+			pm.SetForwardingEnabled(true)
+			logger.Warning("Forwarding enabled by %s", source)
+		case "off":
+			pm.SetForwardingEnabled(false)
+			logger.Warning("Forwarding disabled by %s, now in standby", source)
+		default:
+			return "", fmt.Errorf("usage: forwarding [on|off]")
+		}
+		return "forwarding " + args[0], nil
+	})
+
+	admin.Handle("state", "state", func(source string, args []string) (string, error) {
+		if len(args) != 0 {
+			return "", fmt.Errorf("usage: state")
+		}
+		return state.JSON()
+	})
+}
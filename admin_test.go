@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testAdmin is an AdminServer with the relay's commands, and a client
+// connection to it.
+type testAdmin struct {
+	pm         *PeerManager
+	bufferPool *BufferPool
+	logger     *Logger
+	conn       net.Conn
+	replies    *bufio.Reader
+}
+
+func newTestAdmin(t *testing.T) *testAdmin {
+	t.Helper()
+	// Unix socket paths are short, so the socket does not go in t.TempDir.
+	dir, err := os.MkdirTemp("", "wgk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	logger := NewLogger(LogLevelError)
+	captureOutput(logger)
+	admin, err := NewAdminServer(filepath.Join(dir, "admin.sock"), logger)
+	if err != nil {
+		t.Fatalf("NewAdminServer: %v", err)
+	}
+	pm, _ := newTestPeerManager(t, &captureSender{})
+	workerPool := NewWorkerPool(WorkerPoolConfig{MaxWorkers: 1}, pm.HandlePacket, logger)
+	bufferPool := NewBufferPool(4, 1500)
+	state := NewStateReporter(pm, workerPool, bufferPool, &Config{}, nil, time.Now())
+	registerAdminCommands(admin, pm, workerPool, bufferPool, state, logger)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go admin.Run(ctx)
+
+	conn, err := net.Dial("unix", filepath.Join(dir, "admin.sock"))
+	if err != nil {
+		t.Fatalf("dial admin socket: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testAdmin{pm: pm, bufferPool: bufferPool, logger: logger, conn: conn, replies: bufio.NewReader(conn)}
+}
+
+// run sends one command line and returns the first line of the reply.
+func (a *testAdmin) run(t *testing.T, line string) string {
+	t.Helper()
+	if _, err := a.conn.Write([]byte(line + "\n")); err != nil {
+		t.Fatalf("write %q: %v", line, err)
+	}
+	a.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply, err := a.replies.ReadString('\n')
+	if err != nil {
+		t.Fatalf("reply to %q: %v", line, err)
+	}
+	return strings.TrimSuffix(reply, "\n")
+}
+
+func TestAdminResetStats(t *testing.T) {
+	admin := newTestAdmin(t)
+	output := captureOutput(admin.logger)
+	admin.logger.SetLevel(LogLevelWarning)
+	learnInitiator(t, admin.pm, "192.0.2.1:51820", SenderID{1})
+	admin.bufferPool.Get()
+
+	if reply := admin.run(t, "reset"); !strings.HasPrefix(reply, "error usage") {
+		t.Errorf("reset without an argument replied %q, want a usage error", reply)
+	}
+	if reply := admin.run(t, "reset stats"); reply != "ok stats reset" {
+		t.Fatalf("reset stats replied %q", reply)
+	}
+
+	if received := admin.pm.Stats().Snapshot().Received[MessageTypeInitiation-1]; received != 0 {
+		t.Errorf("initiations received after reset = %d, want 0", received)
+	}
+	if stats := admin.bufferPool.Stats(); stats.Misses != 0 {
+		t.Errorf("buffer pool after reset: %s, want no misses", stats)
+	}
+	if peers, exists := peerCounts(t, admin.pm, SenderID{1}); peers != 1 || !exists {
+		t.Error("reset stats removed peer state")
+	}
+	if log := output.String(); !strings.Contains(log, "Statistics reset by admin#1") {
+		t.Errorf("log %q does not record who reset the statistics", log)
+	}
+}
+
+func TestAdminLogLevel(t *testing.T) {
+	admin := newTestAdmin(t)
+
+	if reply := admin.run(t, "loglevel"); reply != "ok error" {
+		t.Errorf("loglevel replied %q, want the current level", reply)
+	}
+	if reply := admin.run(t, "loglevel debug"); reply != "ok debug" {
+		t.Errorf("loglevel debug replied %q", reply)
+	}
+	if level := admin.logger.Level(); level != LogLevelDebug {
+		t.Errorf("log level = %d, want debug", level)
+	}
+
+	for _, line := range []string{"loglevel verbose", "loglevel debug info"} {
+		if reply := admin.run(t, line); !strings.HasPrefix(reply, "error") {
+			t.Errorf("%q replied %q, want an error", line, reply)
+		}
+	}
+	if level := admin.logger.Level(); level != LogLevelDebug {
+		t.Errorf("invalid commands changed the log level to %d", level)
+	}
+}
+
+func TestAdminCIDRs(t *testing.T) {
+	admin := newTestAdmin(t)
+	allowedAddr := testAddr(t, "192.0.2.1:51820")
+	deniedAddr := testAddr(t, "192.0.2.129:51820")
+	outsideAddr := testAddr(t, "198.51.100.1:51820")
+
+	if reply := admin.run(t, "cidrs allow 192.0.2.0/24"); !strings.HasPrefix(reply, "ok") {
+		t.Fatalf("cidrs allow replied %q", reply)
+	}
+	if reply := admin.run(t, "cidrs deny 192.0.2.128/25"); !strings.HasPrefix(reply, "ok") {
+		t.Fatalf("cidrs deny replied %q", reply)
+	}
+
+	// Changing the deny list kept the allow list.
+	filter := admin.pm.SourceFilter()
+	if !filter.Allowed(allowedAddr) || filter.Allowed(deniedAddr) || filter.Allowed(outsideAddr) {
+		t.Errorf("filter %s: allowed=%v denied=%v outside=%v, want true false false",
+			filter, filter.Allowed(allowedAddr), filter.Allowed(deniedAddr), filter.Allowed(outsideAddr))
+	}
+
+	// Invalid input leaves the filter untouched.
+	for _, line := range []string{"cidrs allow 192.0.2.0/33", "cidrs block 192.0.2.0/24", "cidrs allow"} {
+		if reply := admin.run(t, line); !strings.HasPrefix(reply, "error") {
+			t.Errorf("%q replied %q, want an error", line, reply)
+		}
+	}
+	if admin.pm.SourceFilter() != filter {
+		t.Error("invalid commands replaced the source filter")
+	}
+
+	if reply := admin.run(t, "cidrs allow none"); !strings.HasPrefix(reply, "ok") {
+		t.Fatalf("cidrs allow none replied %q", reply)
+	}
+	filter = admin.pm.SourceFilter()
+	if !filter.Allowed(outsideAddr) || filter.Allowed(deniedAddr) {
+		t.Errorf("after clearing the allow list: outside=%v denied=%v, want true false", filter.Allowed(outsideAddr), filter.Allowed(deniedAddr))
+	}
+}
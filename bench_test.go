@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// slowSender is a PacketSender whose sends take a fixed time, standing in for
+// a blocking WriteToUDP.
+type slowSender struct {
+	delay time.Duration
+}
+
+func (s slowSender) SendPacket(to *net.UDPAddr, payload []byte) error {
+	time.Sleep(s.delay)
+	return nil
+}
+
+// addBenchReceivers stores count receiver entries and returns their IDs.
+func addBenchReceivers(b *testing.B, pm *PeerManager, count int) []ReceiverID {
+	b.Helper()
+	publicKeyA, _ := testKeys(b)
+	addr := testAddr(b, "192.0.2.1:51820")
+	receiverIDs := make([]ReceiverID, count)
+	for i := range receiverIDs {
+		binary.LittleEndian.PutUint32(receiverIDs[i][:], uint32(i+1))
+		if err := pm.AddPeer(context.Background(), receiverIDs[i], addr, publicKeyA); err != nil {
+			b.Fatalf("AddPeer: %v", err)
+		}
+	}
+	return receiverIDs
+}
+
+// BenchmarkForwardPacketToReceiverSlowSend forwards from many goroutines through
+// a sender that blocks. Since the send happens outside the lock, ns/op drops as
+// parallelism grows instead of staying at the send delay.
+func BenchmarkForwardPacketToReceiverSlowSend(b *testing.B) {
+	pm, _ := newTestPeerManager(b, slowSender{delay: 20 * time.Microsecond})
+	receiverIDs := addBenchReceivers(b, pm, 64)
+	payload := make([]byte, 64)
+	payload[0] = MessageTypeTransport
+	ctx := context.Background()
+
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if err := pm.ForwardPacketToReceiver(ctx, receiverIDs[i%len(receiverIDs)], payload); err != nil {
+				b.Errorf("ForwardPacketToReceiver: %v", err)
+				return
+			}
+			i++
+		}
+	})
+}
+
+// benchmarkStoreContention mixes AddPeer and ForwardPacketToReceiver calls from
+// many goroutines against a PeerManager backed by store.
+func benchmarkStoreContention(b *testing.B, store PeerStore) {
+	publicKeyA, publicKeyB := testKeys(b)
+	pm := NewPeerManagerWithStore(store, &captureSender{}, []PublicKeyPair{{PublicKey1: publicKeyA, PublicKey2: publicKeyB}}, NewLogger(LogLevelError), time.Minute)
+	receiverIDs := addBenchReceivers(b, pm, 1024)
+	addr := testAddr(b, "192.0.2.2:51820")
+	payload := make([]byte, 64)
+	payload[0] = MessageTypeTransport
+	ctx := context.Background()
+
+	b.SetParallelism(8)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			receiverID := receiverIDs[i%len(receiverIDs)]
+			if i%4 == 0 {
+				pm.AddPeer(ctx, receiverID, addr, publicKeyA)
+			} else {
+				pm.ForwardPacketToReceiver(ctx, receiverID, payload)
+			}
+			i++
+		}
+	})
+}
+
+// BenchmarkPeerStoreContention compares the single-mutex memory store with the
+// sharded store under a mix of adds and forwards from many goroutines.
+func BenchmarkPeerStoreContention(b *testing.B) {
+	b.Run("single-mutex", func(b *testing.B) {
+		benchmarkStoreContention(b, NewMemoryStore())
+	})
+	b.Run("sharded", func(b *testing.B) {
+		benchmarkStoreContention(b, NewShardedStore(16))
+	})
+}
+
+// BenchmarkReadHeavyLookups measures GetPeerByReceiverID from many goroutines.
+// Lookups share the read lock, so they only wait on the occasional writer.
+func BenchmarkReadHeavyLookups(b *testing.B) {
+	for _, writeEvery := range []int{0, 100} {
+		name := "reads-only"
+		if writeEvery > 0 {
+			name = "one-write-per-100"
+		}
+		b.Run(name, func(b *testing.B) {
+			publicKeyA, _ := testKeys(b)
+			pm, _ := newTestPeerManager(b, &captureSender{})
+			receiverIDs := addBenchReceivers(b, pm, 1024)
+			addr := testAddr(b, "192.0.2.2:51820")
+			ctx := context.Background()
+
+			b.SetParallelism(8)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					receiverID := receiverIDs[i%len(receiverIDs)]
+					if writeEvery > 0 && i%writeEvery == 0 {
+						pm.AddPeer(ctx, receiverID, addr, publicKeyA)
+					} else {
+						pm.GetPeerByReceiverID(ctx, receiverID)
+					}
+					i++
+				}
+			})
+		})
+	}
+}
+
+// packetSizeMix approximates relay traffic: mostly transport packets, some
+// keepalives and the occasional handshake.
+var packetSizeMix = []int{1420, 1420, 1420, 1420, 32, 32, 148, 92, 64, 1420}
+
+// BenchmarkBufferPoolSizeClasses holds a batch of buffers for the packet size
+// mix, as queued jobs do, and reports the bytes held per packet.
+func BenchmarkBufferPoolSizeClasses(b *testing.B) {
+	const batch = 256
+	pools := []struct {
+		name string
+		bp   *BufferPool
+		get  func(bp *BufferPool, n int) []byte
+	}{
+		{"single-class", NewBufferPool(batch, 1500), func(bp *BufferPool, n int) []byte { return bp.Get()[:n] }},
+		{"size-classes", NewBufferPoolWithClasses(batch, 1500, []int{64, 92, 148}), (*BufferPool).GetSize},
+	}
+
+	for _, pool := range pools {
+		b.Run(pool.name, func(b *testing.B) {
+			pool.bp.Prefill()
+			held := make([][]byte, batch)
+			heldBytes := 0
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				heldBytes = 0
+				for i := range held {
+					held[i] = pool.get(pool.bp, packetSizeMix[i%len(packetSizeMix)])
+					heldBytes += cap(held[i])
+				}
+				for _, buf := range held {
+					pool.bp.Put(buf)
+				}
+			}
+			b.ReportMetric(float64(heldBytes)/batch, "held-B/packet")
+		})
+	}
+}
+
+// discardSender drops packets at the very end of the send path, unlike
+// NullPacketSender, which makes PeerManager skip the send path altogether.
+type discardSender struct{}
+
+func (discardSender) SendPacket(to *net.UDPAddr, payload []byte) error {
+	return nil
+}
+
+// BenchmarkCheckMAC1AndGetPublicKey verifies an initiation addressed to the
+// last configured key, the worst case for a scan over every mac1 key.
+func BenchmarkCheckMAC1AndGetPublicKey(b *testing.B) {
+	for _, pairs := range []int{1, 10, 100, 1000} {
+		b.Run(fmt.Sprintf("pairs=%d", pairs), func(b *testing.B) {
+			pm := newManyKeysPeerManager(b, NewMemoryStore(), pairs)
+			last := pairs - 1
+			packet := mustBuildInitiation(b, PublicKey{1, byte(last), byte(last >> 8), byte(last >> 16)}, SenderID{1, 2, 3, 4})
+			ctx := context.Background()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				if _, err := pm.CheckMAC1AndGetPublicKey(ctx, packet); err != nil {
+					b.Fatalf("CheckMAC1AndGetPublicKey: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkHandlePacket handles each message type of an established session
+// between A and B. Handshake packets repeat sender IDs the relay already
+// knows, as retransmissions do.
+func BenchmarkHandlePacket(b *testing.B) {
+	publicKeyA, publicKeyB := testKeys(b)
+	addrA := testAddr(b, "192.0.2.1:51820")
+	addrB := testAddr(b, "198.51.100.1:51820")
+	initiation := mustBuildInitiation(b, publicKeyB, SenderID{0xa1})
+	response := mustBuildResponse(b, publicKeyA, SenderID{0xb1}, ReceiverID{0xa1})
+	cookieReply := make([]byte, 64)
+	cookieReply[0] = MessageTypeCookieReply
+	copy(cookieReply[4:8], []byte{0xa1})
+	transport := make([]byte, 1420)
+	transport[0] = MessageTypeTransport
+	copy(transport[4:8], []byte{0xb1})
+
+	packets := []struct {
+		name    string
+		from    *net.UDPAddr
+		payload []byte
+	}{
+		{"initiation", addrA, initiation},
+		{"response", addrB, response},
+		{"cookie-reply", addrB, cookieReply},
+		{"transport", addrA, transport},
+	}
+
+	for _, packet := range packets {
+		b.Run(packet.name, func(b *testing.B) {
+			pm, _ := newTestPeerManager(b, discardSender{})
+			ctx := context.Background()
+			for _, setup := range [][]byte{initiation, response} {
+				from := addrA
+				if setup[0] == MessageTypeResponse {
+					from = addrB
+				}
+				if err := pm.HandlePacket(ctx, from, setup); err != nil {
+					b.Fatalf("handshake: %v", err)
+				}
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				if err := pm.HandlePacket(ctx, packet.from, packet.payload); err != nil {
+					b.Fatalf("HandlePacket: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkBufferPoolContention gets and puts receive buffers from many
+// goroutines, with a pool smaller than the number of goroutines and with one
+// larger than it, and reports the share of gets that had to allocate.
+func BenchmarkBufferPoolContention(b *testing.B) {
+	for _, poolSize := range []int{4, 1024} {
+		b.Run(fmt.Sprintf("pool=%d", poolSize), func(b *testing.B) {
+			bp := NewBufferPool(poolSize, 1500)
+			bp.Prefill()
+
+			b.SetParallelism(8)
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					buf := bp.Get()
+					buf[0] = MessageTypeTransport
+					bp.Put(buf)
+				}
+			})
+			b.StopTimer()
+			stats := bp.Stats()
+			b.ReportMetric(float64(stats.Misses)/float64(stats.Hits+stats.Misses), "miss-rate")
+		})
+	}
+}
+
+// BenchmarkWorkerPoolSubmit submits packets from many sources as fast as the
+// receive loop would, and reports the share Submit had to drop because the
+// queues were full.
+func BenchmarkWorkerPoolSubmit(b *testing.B) {
+	for _, affinity := range []string{WorkerAffinityNone, WorkerAffinitySource} {
+		b.Run(affinity, func(b *testing.B) {
+			handler := func(ctx context.Context, addr *net.UDPAddr, payload []byte) error { return nil }
+			wp := NewWorkerPool(WorkerPoolConfig{MaxWorkers: 8, Affinity: affinity}, handler, NewLogger(LogLevelError))
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			wp.Start(ctx)
+
+			addrs := make([]*net.UDPAddr, 256)
+			for i := range addrs {
+				addrs[i] = &net.UDPAddr{IP: net.IPv4(192, 0, 2, byte(i)), Port: 51820}
+			}
+			payload := make([]byte, 148)
+			payload[0] = MessageTypeInitiation
+			dropped := 0
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := range b.N {
+				if !wp.Submit(addrs[i%len(addrs)], payload) {
+					dropped++
+				}
+			}
+			b.StopTimer()
+			wp.Shutdown()
+			b.ReportMetric(float64(dropped)/float64(b.N), "dropped/op")
+		})
+	}
+}
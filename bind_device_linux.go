@@ -0,0 +1,36 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// BindToDevice restricts conn to the network interface named device with
+// SO_BINDTODEVICE, so traffic only enters and leaves through that interface.
+func BindToDevice(conn *net.UDPConn, device string) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, device)
+	})
+	if err != nil {
+		return err
+	}
+
+	if errors.Is(sockErr, syscall.EPERM) {
+		return fmt.Errorf("binding to device %s requires CAP_NET_RAW: %v", device, sockErr)
+	}
+	if sockErr != nil {
+		return fmt.Errorf("failed to bind to device %s: %v", device, sockErr)
+	}
+
+	return nil
+}
@@ -0,0 +1,38 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func listenLoopback(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestBindToDevice(t *testing.T) {
+	err := BindToDevice(listenLoopback(t), "lo")
+	if err != nil && !strings.Contains(err.Error(), "requires CAP_NET_RAW") {
+		t.Errorf("BindToDevice(lo) = %v, want nil or a privilege error", err)
+	}
+}
+
+// TestBindToDeviceUnknownInterface shows the option reaches the socket: the
+// kernel rejects an interface that does not exist.
+func TestBindToDeviceUnknownInterface(t *testing.T) {
+	err := BindToDevice(listenLoopback(t), "wgk-missing0")
+	if err == nil {
+		t.Fatal("BindToDevice succeeded for an interface that does not exist")
+	}
+	if !strings.Contains(err.Error(), "wgk-missing0") {
+		t.Errorf("error %q does not name the device", err)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// BindToDevice is only supported on Linux.
+func BindToDevice(conn *net.UDPConn, device string) error {
+	return fmt.Errorf("bind_device is only supported on Linux")
+}
@@ -1,31 +1,198 @@
 package main
 
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// bufferPoolMissRateWarning is the miss rate above which the pool is considered undersized.
+	bufferPoolMissRateWarning = 0.5
+	// bufferPoolMissRateIntervals is how many consecutive intervals must exceed the miss rate before warning.
+	bufferPoolMissRateIntervals = 3
+)
+
 type BufferPool struct {
-	pool       chan []byte
+	// classes are ordered by size; the last one holds receive buffers of bufferSize.
+	classes    []bufferClass
 	bufferSize int
+
+	hits     atomic.Uint64
+	misses   atomic.Uint64
+	returned atomic.Uint64
+	dropped  atomic.Uint64
+}
+
+type bufferClass struct {
+	size int
+	pool chan []byte
+}
+
+// BufferPoolStats counts Get and Put outcomes since the pool was created.
+type BufferPoolStats struct {
+	Hits     uint64
+	Misses   uint64
+	Returned uint64
+	Dropped  uint64
 }
 
 func NewBufferPool(poolSize int, bufferSize int) *BufferPool {
-	return &BufferPool{
-		pool:       make(chan []byte, poolSize),
-		bufferSize: bufferSize,
+	return NewBufferPoolWithClasses(poolSize, bufferSize, nil)
+}
+
+// NewBufferPoolWithClasses creates a pool that, besides receive buffers of
+// bufferSize, keeps smaller buffers of each of classSizes for GetSize, so that
+// a 92-byte handshake response does not hold on to a 1500-byte buffer.
+// Each class keeps up to poolSize buffers.
+func NewBufferPoolWithClasses(poolSize int, bufferSize int, classSizes []int) *BufferPool {
+	sizes := make([]int, 0, len(classSizes)+1)
+	for _, size := range classSizes {
+		if size > 0 && size < bufferSize {
+			sizes = append(sizes, size)
+		}
+	}
+	sort.Ints(sizes)
+	sizes = slices.Compact(append(sizes, bufferSize))
+
+	bp := &BufferPool{bufferSize: bufferSize}
+	for _, size := range sizes {
+		bp.classes = append(bp.classes, bufferClass{size: size, pool: make(chan []byte, poolSize)})
 	}
+	return bp
 }
 
+// Prefill allocates buffers until every class is full so that early traffic
+// does not hit the allocation path. It returns the number of buffers added.
+func (bp *BufferPool) Prefill() int {
+	added := 0
+	for _, class := range bp.classes {
+	fill:
+		for {
+			select {
+			case class.pool <- make([]byte, class.size):
+				added++
+			default:
+				break fill
+			}
+		}
+	}
+	return added
+}
+
+// Get returns a receive buffer of bufferSize bytes.
 func (bp *BufferPool) Get() []byte {
+	return bp.get(&bp.classes[len(bp.classes)-1])
+}
+
+// GetSize returns a buffer of length n from the smallest class that fits it.
+// Without size classes, or when n exceeds every class, it allocates exactly n
+// bytes, which Put then ignores.
+func (bp *BufferPool) GetSize(n int) []byte {
+	if len(bp.classes) > 1 {
+		for i := range bp.classes {
+			if bp.classes[i].size >= n {
+				return bp.get(&bp.classes[i])[:n]
+			}
+		}
+	}
+	return make([]byte, n)
+}
+
+func (bp *BufferPool) get(class *bufferClass) []byte {
 	select {
-	case buf := <-bp.pool:
+	case buf := <-class.pool:
+		bp.hits.Add(1)
 		return buf
 	default:
-		return make([]byte, bp.bufferSize)
+		bp.misses.Add(1)
+		return make([]byte, class.size)
 	}
 }
 
+// Put returns buf to the class matching its capacity. Buffers that did not
+// come from the pool are ignored.
 func (bp *BufferPool) Put(buf []byte) {
-	select {
-	case bp.pool <- buf:
-		// Return buffer to pool
-	default:
-		// Do nothing if the pool is full (buffer will be collected by GC)
+	for i := range bp.classes {
+		class := &bp.classes[i]
+		if cap(buf) != class.size {
+			continue
+		}
+
+		select {
+		case class.pool <- buf[:class.size]:
+			// Return buffer to pool
+			bp.returned.Add(1)
+		default:
+			// Do nothing if the pool is full (buffer will be collected by GC)
+			bp.dropped.Add(1)
+		}
+		return
+	}
+}
+
+// ClassSizes returns the buffer sizes kept by the pool, smallest first.
+func (bp *BufferPool) ClassSizes() []int {
+	sizes := make([]int, len(bp.classes))
+	for i, class := range bp.classes {
+		sizes[i] = class.size
+	}
+	return sizes
+}
+
+func (bp *BufferPool) Stats() BufferPoolStats {
+	return BufferPoolStats{
+		Hits:     bp.hits.Load(),
+		Misses:   bp.misses.Load(),
+		Returned: bp.returned.Load(),
+		Dropped:  bp.dropped.Load(),
+	}
+}
+
+// ResetStats zeroes the counters returned by Stats.
+func (bp *BufferPool) ResetStats() {
+	bp.hits.Store(0)
+	bp.misses.Store(0)
+	bp.returned.Store(0)
+	bp.dropped.Store(0)
+}
+
+func (s BufferPoolStats) String() string {
+	return fmt.Sprintf("hits=%d misses=%d returned=%d dropped=%d", s.Hits, s.Misses, s.Returned, s.Dropped)
+}
+
+// MonitorMissRate warns when the share of Get calls that had to allocate stays
+// above bufferPoolMissRateWarning for several consecutive intervals.
+func (bp *BufferPool) MonitorMissRate(ctx context.Context, interval time.Duration, logger LoggerInterface) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last := bp.Stats()
+	highIntervals := 0
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			current := bp.Stats()
+			hits := since(current.Hits, last.Hits)
+			misses := since(current.Misses, last.Misses)
+			last = current
+
+			if hits+misses == 0 || float64(misses)/float64(hits+misses) <= bufferPoolMissRateWarning {
+				highIntervals = 0
+				continue
+			}
+
+			highIntervals++
+			if highIntervals == bufferPoolMissRateIntervals {
+				logger.Warning("Buffer pool miss rate is high (%d of %d gets allocated), consider raising pool_size", misses, hits+misses)
+				highIntervals = 0
+			}
+		}
 	}
 }
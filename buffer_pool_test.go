@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestBufferPoolPrefill(t *testing.T) {
+	bp := NewBufferPool(8, 1500)
+	if added := bp.Prefill(); added != 8 {
+		t.Fatalf("Prefill added %d buffers, want 8", added)
+	}
+	if added := bp.Prefill(); added != 0 {
+		t.Errorf("second Prefill added %d buffers, want 0", added)
+	}
+
+	for i := range 8 {
+		if buf := bp.Get(); len(buf) != 1500 {
+			t.Fatalf("Get %d returned %d bytes, want 1500", i, len(buf))
+		}
+	}
+	if stats := bp.Stats(); stats.Hits != 8 || stats.Misses != 0 {
+		t.Errorf("after draining the prefilled pool: %s, want 8 hits and no misses", stats)
+	}
+
+	bp.Get()
+	if stats := bp.Stats(); stats.Misses != 1 {
+		t.Errorf("Get on an exhausted pool: %s, want 1 miss", stats)
+	}
+}
+
+func TestBufferPoolPrefilledGetDoesNotAllocate(t *testing.T) {
+	bp := NewBufferPool(8, 1500)
+	bp.Prefill()
+
+	allocs := testing.AllocsPerRun(100, func() {
+		bp.Put(bp.Get())
+	})
+	if allocs != 0 {
+		t.Errorf("Get and Put allocated %.1f times per run, want 0", allocs)
+	}
+}
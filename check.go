@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+)
+
+// RunConfigCheck validates config without opening sockets and prints a summary.
+// It returns the process exit code.
+func RunConfigCheck(config *Config) int {
+	exitCode := ExitOK
+
+	for _, warning := range config.Warnings {
+		fmt.Printf("Warning: %s\n", warning)
+	}
+
+	publicKeyPairList, err := LoadPublicKeyPairsFromConfig(config.KeyPairs)
+	if err != nil {
+		fmt.Printf("Key pairs: %v\n", err)
+		exitCode = ExitConfigError
+	}
+
+	if _, err := LoadUpstreamsFromConfig(config.Server.Upstreams); err != nil {
+		fmt.Printf("Upstreams: %v\n", err)
+		exitCode = ExitConfigError
+	}
+
+	if _, err := ParseSourceFilter(config.Server.AllowCIDRs, config.Server.DenyCIDRs); err != nil {
+		fmt.Printf("CIDR lists: %v\n", err)
+		exitCode = ExitConfigError
+	}
+
+	if _, err := ParseDumpFilter(config.Server.DebugDumpFilter); err != nil {
+		fmt.Printf("Debug dump filter: %v\n", err)
+		exitCode = ExitConfigError
+	}
+
+	if config.Server.DebugSampleRate < 0 {
+		fmt.Printf("Debug sample rate: must not be negative, got %d\n", config.Server.DebugSampleRate)
+		exitCode = ExitConfigError
+	}
+
+	if config.Server.PeerMaxLifetime < 0 {
+		fmt.Printf("Peer max lifetime: must not be negative, got %v\n", config.Server.PeerMaxLifetime)
+		exitCode = ExitConfigError
+	}
+
+	if err := ValidateForwardTTL(config.Server.ForwardTTL); err != nil {
+		fmt.Printf("Forward TTL: %v\n", err)
+		exitCode = ExitConfigError
+	}
+
+	if t := config.WorkerPool.QueueFullThreshold; t < 0 || t > 1 {
+		fmt.Printf("Queue full threshold: must be between 0 and 1, got %v\n", t)
+		exitCode = ExitConfigError
+	}
+
+	if config.Server.BreakerFailures < 0 {
+		fmt.Printf("Circuit breaker: breaker_failures must not be negative, got %d\n", config.Server.BreakerFailures)
+		exitCode = ExitConfigError
+	}
+
+	if _, err := LoadForwardOverridesFromConfig(config.ForwardOverrides); err != nil {
+		fmt.Printf("Forward overrides: %v\n", err)
+		exitCode = ExitConfigError
+	}
+
+	if _, err := LoadProtocolFromConfig(config.Protocol); err != nil {
+		fmt.Printf("Protocol: %v\n", err)
+		exitCode = ExitConfigError
+	}
+
+	if _, err := ParseWorkerAffinity(config.WorkerPool.Affinity); err != nil {
+		fmt.Printf("Worker affinity: %v\n", err)
+		exitCode = ExitConfigError
+	}
+
+	if err := ValidateTransport(config.Server.Transport); err != nil {
+		fmt.Printf("Transport: %v\n", err)
+		exitCode = ExitConfigError
+	}
+
+	if _, err := ParseUnverifiedPolicy(config.Server.UnverifiedPolicy); err != nil {
+		fmt.Printf("Unverified policy: %v\n", err)
+		exitCode = ExitConfigError
+	}
+
+	if _, err := ParseSenderIDCollisionPolicy(config.Server.SenderIDCollision); err != nil {
+		fmt.Printf("Sender ID collision: %v\n", err)
+		exitCode = ExitConfigError
+	}
+
+	if config.Metrics.Prometheus && config.Server.HealthListen == "" {
+		fmt.Println("Metrics: prometheus needs server.health_listen to serve /metrics")
+		exitCode = ExitConfigError
+	}
+
+	listeners, err := LoadListenersFromConfig(config.Server, config.Listeners)
+	if err != nil {
+		fmt.Printf("Listeners: %v\n", err)
+		exitCode = ExitConfigError
+	}
+
+	if len(publicKeyPairList) == 0 {
+		fmt.Println("Key pairs: no valid public key pairs configured")
+		exitCode = ExitNoUsableKeys
+	}
+
+	for _, listener := range listeners {
+		fmt.Printf("Listen address:  %s\n", listener)
+	}
+	fmt.Printf("Key pairs:       %d valid of %d configured\n", len(publicKeyPairList), len(config.KeyPairs))
+	fmt.Printf("Peer expiration: %v\n", config.Server.PeerExpiration)
+	fmt.Printf("Buffer pool:     size=%d, buffer size=%d bytes\n", config.BufferPool.PoolSize, config.BufferPool.BufferSize)
+	fmt.Printf("Worker pool:     max workers=%d\n", config.WorkerPool.MaxWorkers)
+
+	if exitCode != ExitOK {
+		fmt.Println("Configuration check failed")
+		return exitCode
+	}
+
+	fmt.Println("Configuration OK")
+	return ExitOK
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultBreakerCooldown is how long a destination is skipped once its
+// breaker opens.
+const DefaultBreakerCooldown = 30 * time.Second
+
+type breakerState struct {
+	failures  int
+	openUntil time.Time
+	lastSeen  time.Time
+}
+
+// CircuitBreaker stops sending to a destination address after threshold
+// consecutive send failures. Once the
+// cooldown has passed one packet is let through as a probe: success closes
+// the breaker, failure opens it for another cooldown.
+type CircuitBreaker struct {
+	sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	states    map[netip.AddrPort]*breakerState
+	lastSweep time.Time
+	// tracked mirrors len(states) so that Success, called for every packet
+	// sent, skips the lock while no destination is failing.
+	tracked atomic.Int64
+}
+
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	if cooldown <= 0 {
+		cooldown = DefaultBreakerCooldown
+	}
+	return &CircuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		states:    make(map[netip.AddrPort]*breakerState),
+	}
+}
+
+// Allow reports whether a packet may be sent to key.
+func (cb *CircuitBreaker) Allow(key netip.AddrPort, now time.Time) bool {
+	cb.Lock()
+	defer cb.Unlock()
+
+	state, exists := cb.states[key]
+	if !exists || state.failures < cb.threshold {
+		return true
+	}
+	if now.Before(state.openUntil) {
+		return false
+	}
+	// Half open: hold back everything but this probe until its result is in.
+	state.openUntil = now.Add(cb.cooldown)
+	return true
+}
+
+// Success records a successful send to key and reports whether it closed an
+// open breaker.
+func (cb *CircuitBreaker) Success(key netip.AddrPort) (closed bool) {
+	if cb.tracked.Load() == 0 {
+		return false
+	}
+
+	cb.Lock()
+	defer cb.Unlock()
+
+	state, exists := cb.states[key]
+	if !exists {
+		return false
+	}
+	delete(cb.states, key)
+	cb.tracked.Store(int64(len(cb.states)))
+	return state.failures >= cb.threshold
+}
+
+// Failure records a failed send to key and reports whether it opened the
+// breaker, which it does once per run of failures.
+func (cb *CircuitBreaker) Failure(key netip.AddrPort, now time.Time) (opened bool) {
+	cb.Lock()
+	defer cb.Unlock()
+
+	cb.sweep(now)
+
+	state, exists := cb.states[key]
+	if !exists {
+		state = &breakerState{}
+		cb.states[key] = state
+		cb.tracked.Store(int64(len(cb.states)))
+	}
+	state.failures++
+	state.lastSeen = now
+	if state.failures >= cb.threshold {
+		state.openUntil = now.Add(cb.cooldown)
+	}
+	return state.failures == cb.threshold
+}
+
+// sweep forgets destinations that have not failed for a while, such as peers
+// that went away while their breaker was open.
+func (cb *CircuitBreaker) sweep(now time.Time) {
+	idle := max(cb.cooldown*2, rateLimiterIdleTimeout)
+	if now.Sub(cb.lastSweep) < idle {
+		return
+	}
+	for key, state := range cb.states {
+		if now.Sub(state.lastSeen) >= idle {
+			delete(cb.states, key)
+		}
+	}
+	cb.tracked.Store(int64(len(cb.states)))
+	cb.lastSweep = now
+}
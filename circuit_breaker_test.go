@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerOpensAndCloses(t *testing.T) {
+	cb := NewCircuitBreaker(3, 10*time.Second)
+	key := netip.MustParseAddrPort("192.0.2.1:51820")
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for i := 1; i <= 3; i++ {
+		if !cb.Allow(key, now) {
+			t.Fatalf("breaker open after %d failures, want closed below the threshold", i-1)
+		}
+		if opened := cb.Failure(key, now); opened != (i == 3) {
+			t.Errorf("Failure %d reported opened=%v", i, opened)
+		}
+	}
+	if cb.Allow(key, now.Add(5*time.Second)) {
+		t.Error("breaker allows sending during the cooldown")
+	}
+
+	// After the cooldown one probe is let through, and only one.
+	now = now.Add(10 * time.Second)
+	if !cb.Allow(key, now) {
+		t.Fatal("breaker holds back the probe after the cooldown")
+	}
+	if cb.Allow(key, now) {
+		t.Error("breaker allows a second packet while the probe is outstanding")
+	}
+
+	// A failed probe reopens the breaker without reporting it again.
+	if cb.Failure(key, now) {
+		t.Error("failed probe reported as opening the breaker")
+	}
+	if cb.Allow(key, now.Add(5*time.Second)) {
+		t.Error("breaker allows sending after a failed probe")
+	}
+
+	now = now.Add(10 * time.Second)
+	if !cb.Allow(key, now) {
+		t.Fatal("breaker holds back the second probe")
+	}
+	if !cb.Success(key) {
+		t.Error("successful probe did not report closing the breaker")
+	}
+	if !cb.Allow(key, now) || cb.Success(key) {
+		t.Error("breaker not fully closed after a successful probe")
+	}
+}
+
+func TestCircuitBreakerForwarding(t *testing.T) {
+	sender := &captureSender{err: errors.New("host unreachable")}
+	pm, clock := newTestPeerManager(t, sender)
+	pm.SetCircuitBreaker(NewCircuitBreaker(3, 10*time.Second))
+	to := testAddr(t, "192.0.2.1:51820")
+	ctx := context.Background()
+
+	// Distinct payloads so that the loop detector stays out of the way.
+	forward := func(i int) error {
+		return pm.ForwardPacket(ctx, to, transportPacket(ReceiverID{byte(i)}))
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := forward(i); err == nil {
+			t.Fatalf("send %d succeeded, want the sender's error", i)
+		}
+	}
+	for i := 3; i < 8; i++ {
+		if err := forward(i); err != nil {
+			t.Errorf("send %d with the breaker open: %v, want a silent drop", i, err)
+		}
+	}
+	if got := pm.Stats().Snapshot().BreakerOpen; got != 5 {
+		t.Errorf("BreakerOpen = %d, want 5", got)
+	}
+
+	// The destination recovers; the probe after the cooldown closes the breaker.
+	sender.Lock()
+	sender.err = nil
+	sender.Unlock()
+	clock.Advance(10 * time.Second)
+	for i := 8; i < 11; i++ {
+		if err := forward(i); err != nil {
+			t.Fatalf("send %d after recovery: %v", i, err)
+		}
+	}
+	if got := len(sender.Sent()); got != 3 {
+		t.Errorf("sent %d packets after recovery, want 3", got)
+	}
+	if got := pm.Stats().Snapshot().BreakerOpen; got != 5 {
+		t.Errorf("BreakerOpen = %d after recovery, want still 5", got)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+)
+
+// DefaultCleanupInterval is how often expired peers are removed.
+const DefaultCleanupInterval = 10 * time.Second
+
+// runCleanupLoop calls pm.CleanupPeers every interval until ctx is cancelled.
+// With a non-zero jitter each wait is randomized by up to ±jitter (a fraction
+// of interval), but never below half of interval, so instances started
+// together do not scan in lockstep. The first run is delayed by an additional
+// grace so that peers restored at startup can receive traffic before they are
+// considered expired.
+func runCleanupLoop(ctx context.Context, pm *PeerManager, interval, grace time.Duration, jitter float64, logger LoggerInterface) {
+	timer := time.NewTimer(max(grace, 0) + jitteredInterval(interval, jitter))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			if err := pm.CleanupPeers(); err != nil {
+				logger.Error("Failed to cleanup peers: %v", err)
+			}
+			timer.Reset(jitteredInterval(interval, jitter))
+		}
+	}
+}
+
+func jitteredInterval(interval time.Duration, jitter float64) time.Duration {
+	if jitter <= 0 {
+		return interval
+	}
+	if jitter > 1 {
+		jitter = 1
+	}
+
+	factor := 1 + jitter*(2*rand.Float64()-1)
+	// A jitter close to 1 could otherwise shrink the wait to zero and turn
+	// the loop into a busy loop.
+	return max(time.Duration(float64(interval)*factor), interval/2)
+}
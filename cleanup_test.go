@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// waitForCleanup polls until pm has run a cleanup and returns how long that took.
+func waitForCleanup(t *testing.T, pm *PeerManager, started time.Time) time.Duration {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for pm.LastCleanup().At.IsZero() {
+		if time.Now().After(deadline) {
+			t.Fatal("cleanup did not run")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return time.Since(started)
+}
+
+func TestRunCleanupLoopStartupGrace(t *testing.T) {
+	tests := []struct {
+		name  string
+		grace time.Duration
+	}{
+		{"no grace", 0},
+		{"grace", 200 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pm, clock := newTestPeerManager(t, &captureSender{})
+			learnInitiator(t, pm, "192.0.2.1:51820", SenderID{1})
+			// The peer is already past its expiration when the loop starts.
+			clock.Advance(2 * time.Minute)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			started := time.Now()
+			go runCleanupLoop(ctx, pm, 10*time.Millisecond, tt.grace, 0, NewLogger(LogLevelError))
+
+			if tt.grace > 0 {
+				time.Sleep(tt.grace / 2)
+				if !pm.LastCleanup().At.IsZero() {
+					t.Fatal("cleanup ran during the startup grace")
+				}
+				if peers, _ := peerCounts(t, pm, SenderID{1}); peers != 1 {
+					t.Fatal("peer removed during the startup grace")
+				}
+			}
+
+			if elapsed := waitForCleanup(t, pm, started); elapsed < tt.grace {
+				t.Errorf("first cleanup after %v, want at least the %v grace", elapsed, tt.grace)
+			}
+			if peers, exists := peerCounts(t, pm, SenderID{1}); peers != 0 || exists {
+				t.Error("expired peer not removed by the first cleanup")
+			}
+		})
+	}
+}
+
+func TestJitteredIntervalBounds(t *testing.T) {
+	const interval = 10 * time.Second
+	tests := []struct {
+		name     string
+		jitter   float64
+		min, max time.Duration
+	}{
+		{"no jitter", 0, interval, interval},
+		{"small jitter", 0.1, 9 * time.Second, 11 * time.Second},
+		// A jitter equal to the interval would otherwise reach zero.
+		{"jitter equals interval", 1, interval / 2, 2 * interval},
+		{"jitter above interval", 3, interval / 2, 2 * interval},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for range 1000 {
+				if got := jitteredInterval(interval, tt.jitter); got < tt.min || got > tt.max {
+					t.Fatalf("jitteredInterval(%v, %v) = %v, want between %v and %v", interval, tt.jitter, got, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
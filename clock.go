@@ -0,0 +1,14 @@
+package main
+
+import "time"
+
+// Clock provides the current time so expiration logic can be tested deterministically.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
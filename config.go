@@ -4,7 +4,9 @@ import (
 	"encoding/base64"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
+	"runtime"
 	"strconv"
 	"strings"
 	"time"
@@ -15,92 +17,393 @@ import (
 
 const (
 	DefaultConfigPath = "./setting.conf"
-	DefaultMaxWorkers = 100
+	DefaultEnvPrefix  = "WG_KNOT_"
+
+	// EnvPrefixVariable names the environment variable that overrides DefaultEnvPrefix.
+	EnvPrefixVariable = "WG_KNOT_ENV_PREFIX"
 	DefaultBufferSize = 1500
-	DefaultPoolSize   = 1000
+
+	// Worker and buffer pool sizes left at zero are derived from the CPU count.
+	DefaultWorkersPerCPU = 16
+	DefaultBuffersPerCPU = 128
+
+	DefaultCookieReplyThreshold = 1000
+
+	configFetchTimeout = 10 * time.Second
 )
 
 type Config struct {
-	Server     ServerConfig     `toml:"server"`
-	KeyPairs   []KeyPairConfig  `toml:"keypairs"`
+	Server   ServerConfig    `toml:"server"`
+	KeyPairs []KeyPairConfig `toml:"keypairs"`
+	// ForwardOverrides replace learned peer addresses with static ones.
+	ForwardOverrides []ForwardOverrideConfig `toml:"forward_overrides"`
+	// Listeners replace server.listen_address, port and proxy_protocol with
+	// several sockets, each with its own settings.
+	Listeners  []ListenerConfig `toml:"listeners"`
 	BufferPool BufferPoolConfig `toml:"buffer_pool"`
 	WorkerPool WorkerPoolConfig `toml:"worker_pool"`
+	Protocol   ProtocolConfig   `toml:"protocol"`
+	Metrics    MetricsConfig    `toml:"metrics"`
+
+	// CheckOnly is set by -check: validate the configuration and exit.
+	CheckOnly bool `toml:"-"`
+	// Derived lists the settings computed from the machine because they were
+	// left unset, for logging.
+	Derived []string `toml:"-"`
+	// Warnings lists settings that were ignored because they are malformed,
+	// for logging once the logger exists.
+	Warnings []string `toml:"-"`
+	// GenConfig is set by -genconfig: print an example configuration and exit.
+	GenConfig bool `toml:"-"`
+	// MaxPackets and RunFor are set by -maxpackets and -runfor: shut down
+	// after receiving that many datagrams or running that long, for
+	// reproducible test and benchmark runs.
+	MaxPackets uint64        `toml:"-"`
+	RunFor     time.Duration `toml:"-"`
 }
 
 type ServerConfig struct {
-	ListenAddress  string        `toml:"listen_address"`
-	Port           int           `toml:"port"`
-	LogLevel       string        `toml:"log_level"`
-	PeerExpiration time.Duration `toml:"peer_expiration"`
+	ListenAddress string `toml:"listen_address"`
+	// Transport is how peers reach the relay: TransportUDP, or TransportQUIC
+	// once it is implemented.
+	Transport string `toml:"transport"`
+	// BindDevice restricts the socket to one network interface (Linux only).
+	BindDevice    string `toml:"bind_device"`
+	Port          int    `toml:"port"`
+	LogLevel      string `toml:"log_level"`
+	LogFormat     string `toml:"log_format"`
+	LogTimeFormat string `toml:"log_time_format"`
+	LogUTC        bool   `toml:"log_utc"`
+	// LogSplitSource logs packet source addresses as src_ip and src_port
+	// fields instead of one src field.
+	LogSplitSource bool `toml:"log_split_source"`
+	// DebugDumpFilter lists source IPs and sender IDs whose packets are hex
+	// dumped at debug level, or "all". Empty disables dumps.
+	DebugDumpFilter string `toml:"debug_dump_filter"`
+	// DebugSampleRate logs the per-packet debug messages of one in every
+	// DebugSampleRate packets; 0 disables them.
+	DebugSampleRate int           `toml:"debug_sample_rate"`
+	PeerExpiration  time.Duration `toml:"peer_expiration"`
+	// ReceiverExpiration is the lifetime of receiver ID entries; 0 uses PeerExpiration.
+	ReceiverExpiration time.Duration `toml:"receiver_expiration"`
+	StateFile          string        `toml:"state_file"`
+	StatsInterval      time.Duration `toml:"stats_interval"`
+	ProxyProtocol      bool          `toml:"proxy_protocol"`
+	StrictKeys         bool          `toml:"strict_keys"`
+	PassUnknown        bool          `toml:"pass_unknown"`
+	// UnverifiedPolicy is UnverifiedPolicyDrop, or
+	// UnverifiedPolicyForwardByReceiver to route handshake responses whose
+	// mac1 matches no configured key by their receiver ID.
+	UnverifiedPolicy string `toml:"unverified_policy"`
+	// StrictReserved drops Type1-3 messages whose reserved header bytes are not zero.
+	StrictReserved bool    `toml:"strict_reserved"`
+	CleanupJitter  float64 `toml:"cleanup_jitter"`
+	// CleanupGrace delays the first peer cleanup after startup.
+	CleanupGrace    time.Duration `toml:"cleanup_grace"`
+	PeerStoreShards int           `toml:"peer_store_shards"`
+	// ReceiveOnly learns peers and logs packets but never sends anything.
+	ReceiveOnly bool `toml:"receive_only"`
+	// ForwardingEnabled false starts the relay in warm standby, which learns
+	// peers without forwarding until enabled through the admin socket.
+	ForwardingEnabled bool `toml:"forwarding_enabled"`
+	// AdminSocket is the path of the Unix socket accepting admin commands;
+	// empty disables it.
+	AdminSocket string `toml:"admin_socket"`
+
+	// PeerMaxLifetime removes peers and receiver ID entries this long after
+	// they were first learned, however active; 0 disables it.
+	PeerMaxLifetime time.Duration `toml:"peer_max_lifetime"`
+
+	// ForwardTTL is the IP TTL / IPv6 hop limit of sent packets, 1-255;
+	// 0 keeps the system default.
+	ForwardTTL int `toml:"forward_ttl"`
+
+	// LearnFromTransport updates a peer's address from its transport packets,
+	// following peers that roam mid-session.
+	LearnFromTransport bool `toml:"learn_from_transport"`
+
+	// ForwardRateLimit caps packets per second sent to each destination; 0 disables it.
+	ForwardRateLimit float64 `toml:"forward_rate_limit"`
+	ForwardRateBurst int     `toml:"forward_rate_burst"`
+
+	// FanoutGap spaces the copies of an initiation forwarded to several peers
+	// of a key at least this far apart; 0 sends them at once.
+	FanoutGap time.Duration `toml:"fanout_gap"`
+
+	// GlobalRateLimit caps the packets per second the relay processes in
+	// total, whatever their source; 0 disables it.
+	GlobalRateLimit float64 `toml:"global_rate_limit"`
+	GlobalRateBurst int     `toml:"global_rate_burst"`
+
+	// BreakerFailures pauses forwarding to a destination for BreakerCooldown
+	// after this many consecutive send failures; 0 disables it.
+	BreakerFailures int           `toml:"breaker_failures"`
+	BreakerCooldown time.Duration `toml:"breaker_cooldown"`
+
+	// MaxTrackedSources bounds the per-address state kept by the forward rate
+	// limiter and the loop detector together: both share one LRU table, and
+	// the least recently used entries of either are evicted when it is full.
+	// Learned peers are not counted: peer expiration and MemoryLimitMB bound them.
+	MaxTrackedSources int `toml:"max_tracked_sources"`
+
+	// Upstreams are relays that packets for unknown receiver IDs are copied to
+	// when UpstreamForwarding is enabled.
+	UpstreamForwarding bool     `toml:"upstream_forwarding"`
+	Upstreams          []string `toml:"upstreams"`
+
+	// AllowCIDRs, when not empty, limits the sources packets are accepted
+	// from; DenyCIDRs rejects sources and takes precedence.
+	AllowCIDRs []string `toml:"allow_cidrs"`
+	DenyCIDRs  []string `toml:"deny_cidrs"`
+
+	// LoopDetectionWindow drops a payload forwarded to the same destination
+	// twice within the window; 0 disables loop detection.
+	LoopDetectionWindow time.Duration `toml:"loop_detection_window"`
+
+	// TracingEndpoint is an OTLP/HTTP traces URL, e.g. http://localhost:4318/v1/traces.
+	// Empty disables tracing.
+	TracingEndpoint    string `toml:"tracing_endpoint"`
+	TracingServiceName string `toml:"tracing_service_name"`
+
+	// ShutdownDrain keeps relaying existing tunnels for this long after a
+	// shutdown signal while new handshake initiations are dropped.
+	ShutdownDrain time.Duration `toml:"shutdown_drain"`
+	// MemoryLimitMB sheds load above this much memory in MiB; 0 disables it.
+	MemoryLimitMB       int           `toml:"memory_limit_mb"`
+	MemoryCheckInterval time.Duration `toml:"memory_check_interval"`
+	// HealthListen is the TCP address serving /healthz and /readyz; empty disables it.
+	HealthListen string `toml:"health_listen"`
+	// HealthMinPeers fails /readyz when the receiver entries stay below it for
+	// longer than HealthMinPeersGrace, once the relay has had that many.
+	HealthMinPeers      int           `toml:"health_min_peers"`
+	HealthMinPeersGrace time.Duration `toml:"health_min_peers_grace"`
+	// HealthMaxDropRate fails /readyz when more than this fraction of the
+	// packets received in a HealthDropWindow is dropped.
+	HealthMaxDropRate float64       `toml:"health_max_drop_rate"`
+	HealthDropWindow  time.Duration `toml:"health_drop_window"`
+
+	// PendingTimeout holds Type3/4 packets for unknown receiver IDs this long
+	// in case a handshake response teaching the receiver arrives late; 0
+	// disables holding. PendingMaxPackets bounds the packets held.
+	PendingTimeout    time.Duration `toml:"pending_timeout"`
+	PendingMaxPackets int           `toml:"pending_max_packets"`
+
+	// TapFile and TapAddress mirror one in every TapSample received packets
+	// to a pcap file and/or a UDP collector; both empty disables the tap.
+	TapFile    string `toml:"tap_file"`
+	TapAddress string `toml:"tap_address"`
+	TapSample  int    `toml:"tap_sample"`
+
+	// SenderIDCollision is SenderIDCollisionKeep (default) or SenderIDCollisionReplace.
+	SenderIDCollision string `toml:"sender_id_collision"`
+
+	// CookieReply enables WireGuard cookie replies once more than
+	// CookieReplyThreshold handshakes per second are received.
+	CookieReply          bool `toml:"cookie_reply"`
+	CookieReplyThreshold int  `toml:"cookie_reply_threshold"`
 }
 
 type KeyPairConfig struct {
+	Name string `toml:"name"`
 	Key1 string `toml:"key1"`
 	Key2 string `toml:"key2"`
+	// Expiration overrides server.peer_expiration for this pair's peers when set.
+	Expiration time.Duration `toml:"expiration"`
+	// SenderIDs restricts the sender IDs of handshake initiations for this
+	// pair to IDs and ranges such as "0a1b2c3d" or "00000000-0000ffff".
+	SenderIDs []string `toml:"sender_ids"`
+	// Persistent keeps this pair's peers learned by public key however long
+	// they are idle, e.g. for always-on servers.
+	Persistent bool `toml:"persistent"`
+}
+
+// ForwardOverrideConfig selects a peer by sender ID (8 hex digits) or by its
+// public key and names the address packets for it are sent to.
+type ForwardOverrideConfig struct {
+	SenderID  string `toml:"sender_id"`
+	PublicKey string `toml:"public_key"`
+	Address   string `toml:"address"`
+}
+
+// ListenerConfig is one socket the relay receives packets on. An empty
+// address uses server.listen_address.
+type ListenerConfig struct {
+	Address       string   `toml:"address"`
+	Port          int      `toml:"port"`
+	ProxyProtocol bool     `toml:"proxy_protocol"`
+	AllowCIDRs    []string `toml:"allow_cidrs"`
+	DenyCIDRs     []string `toml:"deny_cidrs"`
+}
+
+// ProtocolConfig overrides the WireGuard wire constants for protocol variants.
+// Empty and zero values keep the standard WireGuard ones.
+type ProtocolConfig struct {
+	MAC1Label       string `toml:"mac1_label"`
+	TypeInitiation  int    `toml:"type_initiation"`
+	TypeResponse    int    `toml:"type_response"`
+	TypeCookieReply int    `toml:"type_cookie_reply"`
+	TypeTransport   int    `toml:"type_transport"`
+}
+
+// MetricsConfig selects where metrics are exported. Prometheus metrics are
+// served on /metrics of server.health_listen.
+type MetricsConfig struct {
+	Prometheus    bool          `toml:"prometheus"`
+	StatsDAddress string        `toml:"statsd_address"`
+	StatsDPrefix  string        `toml:"statsd_prefix"`
+	Interval      time.Duration `toml:"interval"`
 }
 
 type BufferPoolConfig struct {
-	PoolSize   int `toml:"pool_size"`
-	BufferSize int `toml:"buffer_size"`
+	PoolSize   int  `toml:"pool_size"`
+	BufferSize int  `toml:"buffer_size"`
+	Prefill    bool `toml:"prefill"`
+	// SizeClasses are smaller buffer sizes used to hold received packets
+	// while they are handled, e.g. [64, 148].
+	SizeClasses []int `toml:"size_classes"`
 }
 
 type WorkerPoolConfig struct {
-	MaxWorkers int `toml:"max_workers"`
+	MaxWorkers     int           `toml:"max_workers"`
+	HandlerTimeout time.Duration `toml:"handler_timeout"`
+	// ErrorLogInterval collapses repeated packet errors into one summary per
+	// interval; 0 logs every error.
+	ErrorLogInterval time.Duration `toml:"error_log_interval"`
+	// SlowThreshold warns when a packet takes longer than this from being
+	// queued to being handled; 0 disables the warning.
+	SlowThreshold time.Duration `toml:"slow_threshold"`
+	// QueueFullThreshold logs an error when more than this fraction of the
+	// packets received over QueueFullWindow were dropped because the worker
+	// queue was full; 0 disables it.
+	QueueFullThreshold float64       `toml:"queue_full_threshold"`
+	QueueFullWindow    time.Duration `toml:"queue_full_window"`
+	// Affinity is WorkerAffinityNone for one shared queue, or
+	// WorkerAffinitySource to handle each source address on one worker.
+	Affinity string `toml:"affinity"`
 }
 
 func LoadConfig() (*Config, error) {
+	return LoadConfigFromArgs(os.Args[1:])
+}
+
+// LoadConfigFromArgs loads the configuration with args as the command line
+// arguments, without the program name. It uses its own flag set, so it can be
+// called more than once; -h returns flag.ErrHelp after printing the usage.
+func LoadConfigFromArgs(args []string) (*Config, error) {
 	config := &Config{
 		Server: ServerConfig{
 			ListenAddress:  "0.0.0.0",
+			Transport:      TransportUDP,
 			Port:           52820,
 			LogLevel:       "info",
+			LogFormat:      LogFormatText,
 			PeerExpiration: 3 * time.Minute,
+
+			DebugSampleRate:      1,
+			CookieReplyThreshold: DefaultCookieReplyThreshold,
+			MaxTrackedSources:    DefaultMaxTrackedSources,
+			PendingMaxPackets:    DefaultPendingMaxPackets,
+			ForwardingEnabled:    true,
+			MemoryCheckInterval:  DefaultMemoryCheckInterval,
+			HealthDropWindow:     DefaultHealthDropWindow,
+			BreakerCooldown:      DefaultBreakerCooldown,
 		},
 		BufferPool: BufferPoolConfig{
-			PoolSize:   DefaultPoolSize,
 			BufferSize: DefaultBufferSize,
 		},
 		WorkerPool: WorkerPoolConfig{
-			MaxWorkers: DefaultMaxWorkers,
+			ErrorLogInterval: DefaultErrorLogInterval,
+			QueueFullWindow:  DefaultQueueFullWindow,
+			Affinity:         WorkerAffinityNone,
+		},
+		Metrics: MetricsConfig{
+			StatsDPrefix: "wg_knot.",
+			Interval:     DefaultMetricsInterval,
 		},
 	}
 
-	configFilePath := os.Getenv("WG_KNOT_CONFIG_FILE")
-	if configFilePath == "" {
-		configFilePath = DefaultConfigPath
+	flags := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	configFileFlag := flags.String("configfile", "", "Path to configuration file, \"-\" for stdin, or an http(s):// URL (default "+DefaultConfigPath+")")
+	envPrefixFlag := flags.String("envprefix", "", "Prefix of the environment variables to read (default "+DefaultEnvPrefix+")")
+	listenAddressFlag := flags.String("listen", "", "IP address to listen on")
+	portFlag := flags.Int("port", 0, "Port to listen on")
+	logLevelFlag := flags.String("loglevel", "", "Log level (debug, info, warning, error)")
+	logFormatFlag := flags.String("logformat", "", "Log format (text, json)")
+	peerExpirationFlag := flags.Duration("peerexpiration", 0, "Peer expiration duration (e.g. 3m, 1h)")
+	poolSizeFlag := flags.Int("poolsize", 0, "Buffer pool size")
+	bufferSizeFlag := flags.Int("buffersize", 0, "Buffer size")
+	maxWorkersFlag := flags.Int("maxworkers", 0, "Maximum number of worker goroutines")
+	handlerTimeoutFlag := flags.Duration("handlertimeout", 0, "Maximum time spent handling a single packet (0 disables)")
+	statsIntervalFlag := flags.Duration("statsinterval", 0, "Interval between packet statistics summaries (0 disables)")
+	proxyProtocolFlag := flags.Bool("proxyprotocol", false, "Expect a PROXY protocol v2 header on every received packet")
+	strictKeysFlag := flags.Bool("strictkeys", false, "Refuse to start when any configured key is invalid")
+	checkFlag := flags.Bool("check", false, "Validate the configuration and key pairs, then exit")
+	stateFileFlag := flags.String("statefile", "", "Path to the file used to persist peers across restarts")
+	genConfigFlag := flags.Bool("genconfig", false, "Print a commented example configuration to stdout, then exit")
+	maxPacketsFlag := flags.Uint64("maxpackets", 0, "Shut down after receiving this many datagrams and print statistics (0 disables)")
+	runForFlag := flags.Duration("runfor", 0, "Shut down after running this long and print statistics (0 disables)")
+
+	if err := flags.Parse(args); err != nil {
+		return nil, err
 	}
 
-	configFileFlag := flag.String("configfile", configFilePath, "Path to configuration file")
-	listenAddressFlag := flag.String("listen", "", "IP address to listen on")
-	portFlag := flag.Int("port", 0, "Port to listen on")
-	logLevelFlag := flag.String("loglevel", "", "Log level (debug, info, warning, error)")
-	peerExpirationFlag := flag.Duration("peerexpiration", 0, "Peer expiration duration (e.g. 3m, 1h)")
-	poolSizeFlag := flag.Int("poolsize", 0, "Buffer pool size")
-	bufferSizeFlag := flag.Int("buffersize", 0, "Buffer size")
-	maxWorkersFlag := flag.Int("maxworkers", 0, "Maximum number of worker goroutines")
+	if *genConfigFlag {
+		config.GenConfig = true
+		return config, nil
+	}
 
-	flag.Parse()
+	envPrefix := os.Getenv(EnvPrefixVariable)
+	if *envPrefixFlag != "" {
+		envPrefix = *envPrefixFlag
+	}
+	if envPrefix == "" {
+		envPrefix = DefaultEnvPrefix
+	}
 
-	configFilePath = *configFileFlag
+	configFilePath := *configFileFlag
+	if configFilePath == "" {
+		configFilePath = getEnvString(envPrefix+"CONFIG_FILE", DefaultConfigPath)
+	}
 
-	fileExists := true
-	if _, err := os.Stat(configFilePath); os.IsNotExist(err) {
-		fileExists = false
-		if configFilePath == DefaultConfigPath {
-			fmt.Println("Default configuration file not found. Please specify configuration using environment variables or command line arguments.")
-		} else {
-			return nil, fmt.Errorf("specified configuration file %s not found", configFilePath)
+	// emptyFile is set when the configuration file exists but sets nothing,
+	// e.g. because it was truncated.
+	emptyFile := false
+	switch {
+	case configFilePath == "-":
+		if _, err := toml.NewDecoder(os.Stdin).Decode(config); err != nil {
+			return nil, fmt.Errorf("failed to load configuration from stdin: %v", err)
 		}
-	}
 
-	if fileExists {
-		_, err := toml.DecodeFile(configFilePath, config)
-		if err != nil {
-			return nil, fmt.Errorf("failed to load configuration file: %v", err)
+	case strings.HasPrefix(configFilePath, "http://") || strings.HasPrefix(configFilePath, "https://"):
+		if err := decodeConfigURL(configFilePath, config); err != nil {
+			return nil, err
+		}
+
+	default:
+		fileExists := true
+		if _, err := os.Stat(configFilePath); os.IsNotExist(err) {
+			fileExists = false
+			if configFilePath == DefaultConfigPath {
+				fmt.Println("Default configuration file not found. Please specify configuration using environment variables or command line arguments.")
+			} else {
+				return nil, fmt.Errorf("specified configuration file %s not found", configFilePath)
+			}
+		}
+
+		if fileExists {
+			metaData, err := toml.DecodeFile(configFilePath, config)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load configuration file: %v", err)
+			}
+			emptyFile = len(metaData.Keys()) == 0
 		}
 	}
 
-	loadFromEnvironment(config)
+	loadFromEnvironment(config, envPrefix)
+
+	if emptyFile && len(config.KeyPairs) == 0 {
+		return nil, fmt.Errorf("configuration file %s is empty: it sets no options and no key pairs (generate one with -genconfig)", configFilePath)
+	}
 
 	if *listenAddressFlag != "" {
 		config.Server.ListenAddress = *listenAddressFlag
@@ -114,6 +417,10 @@ func LoadConfig() (*Config, error) {
 		config.Server.LogLevel = *logLevelFlag
 	}
 
+	if *logFormatFlag != "" {
+		config.Server.LogFormat = *logFormatFlag
+	}
+
 	if *poolSizeFlag != 0 {
 		config.BufferPool.PoolSize = *poolSizeFlag
 	}
@@ -126,13 +433,78 @@ func LoadConfig() (*Config, error) {
 		config.WorkerPool.MaxWorkers = *maxWorkersFlag
 	}
 
+	if *handlerTimeoutFlag != 0 {
+		config.WorkerPool.HandlerTimeout = *handlerTimeoutFlag
+	}
+
 	if *peerExpirationFlag != 0 {
 		config.Server.PeerExpiration = *peerExpirationFlag
 	}
 
+	if *statsIntervalFlag != 0 {
+		config.Server.StatsInterval = *statsIntervalFlag
+	}
+
+	if *proxyProtocolFlag {
+		config.Server.ProxyProtocol = true
+	}
+
+	if *strictKeysFlag {
+		config.Server.StrictKeys = true
+	}
+
+	if *stateFileFlag != "" {
+		config.Server.StateFile = *stateFileFlag
+	}
+
+	config.CheckOnly = *checkFlag
+	config.MaxPackets = *maxPacketsFlag
+	config.RunFor = *runForFlag
+
+	applyDerivedDefaults(config, runtime.NumCPU())
+
 	return config, nil
 }
 
+// applyDerivedDefaults sizes the worker and buffer pools from numCPU when the
+// configuration leaves them at zero.
+func applyDerivedDefaults(config *Config, numCPU int) {
+	if numCPU < 1 {
+		numCPU = 1
+	}
+
+	if config.WorkerPool.MaxWorkers <= 0 {
+		config.WorkerPool.MaxWorkers = numCPU * DefaultWorkersPerCPU
+		config.Derived = append(config.Derived, fmt.Sprintf("max_workers=%d (%d CPUs x %d)", config.WorkerPool.MaxWorkers, numCPU, DefaultWorkersPerCPU))
+	}
+
+	if config.BufferPool.PoolSize <= 0 {
+		config.BufferPool.PoolSize = numCPU * DefaultBuffersPerCPU
+		config.Derived = append(config.Derived, fmt.Sprintf("pool_size=%d (%d CPUs x %d)", config.BufferPool.PoolSize, numCPU, DefaultBuffersPerCPU))
+	}
+}
+
+// decodeConfigURL fetches a TOML configuration over HTTP(S) and decodes it into config.
+func decodeConfigURL(url string, config *Config) error {
+	client := &http.Client{Timeout: configFetchTimeout}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return fmt.Errorf("failed to fetch configuration from %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch configuration from %s: %s", url, resp.Status)
+	}
+
+	if _, err := toml.NewDecoder(resp.Body).Decode(config); err != nil {
+		return fmt.Errorf("failed to load configuration from %s: %v", url, err)
+	}
+
+	return nil
+}
+
 func getEnvInt(key string, defaultVal int) int {
 	val := os.Getenv(key)
 	if val == "" {
@@ -155,44 +527,204 @@ func getEnvString(key string, defaultVal string) string {
 	return val
 }
 
-func getEnvDuration(key string, defaultVal time.Duration) time.Duration {
+// getEnvStrings splits a comma-separated variable, skipping empty items.
+func getEnvStrings(key string, defaultVal []string) []string {
 	val := os.Getenv(key)
 	if val == "" {
 		return defaultVal
 	}
 
-	duration, err := time.ParseDuration(val)
+	var values []string
+	for _, item := range strings.Split(val, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			values = append(values, item)
+		}
+	}
+	return values
+}
+
+func getEnvFloat(key string, defaultVal float64) float64 {
+	val := os.Getenv(key)
+	if val == "" {
+		return defaultVal
+	}
+
+	floatVal, err := strconv.ParseFloat(val, 64)
 	if err != nil {
 		return defaultVal
 	}
 
-	return duration
+	return floatVal
 }
 
-func loadFromEnvironment(config *Config) {
-	config.Server.ListenAddress = getEnvString("WG_KNOT_LISTEN_ADDRESS", config.Server.ListenAddress)
-	config.Server.Port = getEnvInt("WG_KNOT_PORT", config.Server.Port)
+func getEnvBool(key string, defaultVal bool) bool {
+	val := os.Getenv(key)
+	if val == "" {
+		return defaultVal
+	}
 
-	config.Server.LogLevel = getEnvString("WG_KNOT_LOG_LEVEL", config.Server.LogLevel)
-	config.Server.PeerExpiration = getEnvDuration("WG_KNOT_PEER_EXPIRATION", config.Server.PeerExpiration)
+	boolVal, err := strconv.ParseBool(val)
+	if err != nil {
+		return defaultVal
+	}
 
-	config.BufferPool.PoolSize = getEnvInt("WG_KNOT_POOL_SIZE", config.BufferPool.PoolSize)
-	config.BufferPool.BufferSize = getEnvInt("WG_KNOT_BUFFER_SIZE", config.BufferPool.BufferSize)
+	return boolVal
+}
+
+func getEnvDuration(key string, defaultVal time.Duration) time.Duration {
+	val := os.Getenv(key)
+	if val == "" {
+		return defaultVal
+	}
+
+	duration, err := time.ParseDuration(val)
+	if err != nil {
+		return defaultVal
+	}
 
-	config.WorkerPool.MaxWorkers = getEnvInt("WG_KNOT_MAX_WORKERS", config.WorkerPool.MaxWorkers)
+	return duration
+}
 
-	if val := os.Getenv("WG_KNOT_KEY_PAIRS"); val != "" {
+// loadFromEnvironment overrides config with environment variables named prefix + suffix,
+// e.g. WG_KNOT_PORT with the default prefix.
+func loadFromEnvironment(config *Config, prefix string) {
+	config.Server.ListenAddress = getEnvString(prefix+"LISTEN_ADDRESS", config.Server.ListenAddress)
+	config.Server.Port = getEnvInt(prefix+"PORT", config.Server.Port)
+	config.Server.Transport = getEnvString(prefix+"TRANSPORT", config.Server.Transport)
+	config.Server.BindDevice = getEnvString(prefix+"BIND_DEVICE", config.Server.BindDevice)
+
+	config.Server.LogLevel = getEnvString(prefix+"LOG_LEVEL", config.Server.LogLevel)
+	config.Server.LogFormat = getEnvString(prefix+"LOG_FORMAT", config.Server.LogFormat)
+	config.Server.LogTimeFormat = getEnvString(prefix+"LOG_TIME_FORMAT", config.Server.LogTimeFormat)
+	config.Server.LogUTC = getEnvBool(prefix+"LOG_UTC", config.Server.LogUTC)
+	config.Server.LogSplitSource = getEnvBool(prefix+"LOG_SPLIT_SOURCE", config.Server.LogSplitSource)
+	config.Server.DebugDumpFilter = getEnvString(prefix+"DEBUG_DUMP_FILTER", config.Server.DebugDumpFilter)
+	config.Server.DebugSampleRate = getEnvInt(prefix+"DEBUG_SAMPLE_RATE", config.Server.DebugSampleRate)
+	config.Server.PeerExpiration = getEnvDuration(prefix+"PEER_EXPIRATION", config.Server.PeerExpiration)
+	config.Server.ReceiverExpiration = getEnvDuration(prefix+"RECEIVER_EXPIRATION", config.Server.ReceiverExpiration)
+	config.Server.PeerMaxLifetime = getEnvDuration(prefix+"PEER_MAX_LIFETIME", config.Server.PeerMaxLifetime)
+	config.Server.ForwardTTL = getEnvInt(prefix+"FORWARD_TTL", config.Server.ForwardTTL)
+	config.Server.LearnFromTransport = getEnvBool(prefix+"LEARN_FROM_TRANSPORT", config.Server.LearnFromTransport)
+	config.Server.StatsInterval = getEnvDuration(prefix+"STATS_INTERVAL", config.Server.StatsInterval)
+	config.Server.ProxyProtocol = getEnvBool(prefix+"PROXY_PROTOCOL", config.Server.ProxyProtocol)
+	config.Server.StrictKeys = getEnvBool(prefix+"STRICT_KEYS", config.Server.StrictKeys)
+	config.Server.PassUnknown = getEnvBool(prefix+"PASS_UNKNOWN", config.Server.PassUnknown)
+	config.Server.ShutdownDrain = getEnvDuration(prefix+"SHUTDOWN_DRAIN", config.Server.ShutdownDrain)
+	config.Server.HealthListen = getEnvString(prefix+"HEALTH_LISTEN", config.Server.HealthListen)
+	config.Server.HealthMinPeers = getEnvInt(prefix+"HEALTH_MIN_PEERS", config.Server.HealthMinPeers)
+	config.Server.HealthMinPeersGrace = getEnvDuration(prefix+"HEALTH_MIN_PEERS_GRACE", config.Server.HealthMinPeersGrace)
+	config.Server.HealthMaxDropRate = getEnvFloat(prefix+"HEALTH_MAX_DROP_RATE", config.Server.HealthMaxDropRate)
+	config.Server.HealthDropWindow = getEnvDuration(prefix+"HEALTH_DROP_WINDOW", config.Server.HealthDropWindow)
+	config.Server.PendingTimeout = getEnvDuration(prefix+"PENDING_TIMEOUT", config.Server.PendingTimeout)
+	config.Server.PendingMaxPackets = getEnvInt(prefix+"PENDING_MAX_PACKETS", config.Server.PendingMaxPackets)
+	config.Server.TapFile = getEnvString(prefix+"TAP_FILE", config.Server.TapFile)
+	config.Server.TapAddress = getEnvString(prefix+"TAP_ADDRESS", config.Server.TapAddress)
+	config.Server.TapSample = getEnvInt(prefix+"TAP_SAMPLE", config.Server.TapSample)
+	config.Server.SenderIDCollision = getEnvString(prefix+"SENDER_ID_COLLISION", config.Server.SenderIDCollision)
+	config.Server.StrictReserved = getEnvBool(prefix+"STRICT_RESERVED", config.Server.StrictReserved)
+	config.Server.UnverifiedPolicy = getEnvString(prefix+"UNVERIFIED_POLICY", config.Server.UnverifiedPolicy)
+	config.Server.CookieReply = getEnvBool(prefix+"COOKIE_REPLY", config.Server.CookieReply)
+	config.Server.CookieReplyThreshold = getEnvInt(prefix+"COOKIE_REPLY_THRESHOLD", config.Server.CookieReplyThreshold)
+	config.Server.CleanupJitter = getEnvFloat(prefix+"CLEANUP_JITTER", config.Server.CleanupJitter)
+	config.Server.CleanupGrace = getEnvDuration(prefix+"CLEANUP_GRACE", config.Server.CleanupGrace)
+	config.Server.ReceiveOnly = getEnvBool(prefix+"RECEIVE_ONLY", config.Server.ReceiveOnly)
+	config.Server.ForwardingEnabled = getEnvBool(prefix+"FORWARDING_ENABLED", config.Server.ForwardingEnabled)
+	config.Server.AdminSocket = getEnvString(prefix+"ADMIN_SOCKET", config.Server.AdminSocket)
+	config.Server.PeerStoreShards = getEnvInt(prefix+"PEER_STORE_SHARDS", config.Server.PeerStoreShards)
+	config.Server.ForwardRateLimit = getEnvFloat(prefix+"FORWARD_RATE_LIMIT", config.Server.ForwardRateLimit)
+	config.Server.ForwardRateBurst = getEnvInt(prefix+"FORWARD_RATE_BURST", config.Server.ForwardRateBurst)
+	config.Server.FanoutGap = getEnvDuration(prefix+"FANOUT_GAP", config.Server.FanoutGap)
+	config.Server.GlobalRateLimit = getEnvFloat(prefix+"GLOBAL_RATE_LIMIT", config.Server.GlobalRateLimit)
+	config.Server.GlobalRateBurst = getEnvInt(prefix+"GLOBAL_RATE_BURST", config.Server.GlobalRateBurst)
+	config.Server.BreakerFailures = getEnvInt(prefix+"BREAKER_FAILURES", config.Server.BreakerFailures)
+	config.Server.BreakerCooldown = getEnvDuration(prefix+"BREAKER_COOLDOWN", config.Server.BreakerCooldown)
+	config.Server.MemoryLimitMB = getEnvInt(prefix+"MEMORY_LIMIT_MB", config.Server.MemoryLimitMB)
+	config.Server.MemoryCheckInterval = getEnvDuration(prefix+"MEMORY_CHECK_INTERVAL", config.Server.MemoryCheckInterval)
+	config.Server.UpstreamForwarding = getEnvBool(prefix+"UPSTREAM_FORWARDING", config.Server.UpstreamForwarding)
+	config.Server.Upstreams = getEnvStrings(prefix+"UPSTREAMS", config.Server.Upstreams)
+	config.Server.AllowCIDRs = getEnvStrings(prefix+"ALLOW_CIDRS", config.Server.AllowCIDRs)
+	config.Server.DenyCIDRs = getEnvStrings(prefix+"DENY_CIDRS", config.Server.DenyCIDRs)
+	config.Server.MaxTrackedSources = getEnvInt(prefix+"MAX_TRACKED_SOURCES", config.Server.MaxTrackedSources)
+	config.Server.LoopDetectionWindow = getEnvDuration(prefix+"LOOP_DETECTION_WINDOW", config.Server.LoopDetectionWindow)
+	config.Server.TracingEndpoint = getEnvString(prefix+"TRACING_ENDPOINT", config.Server.TracingEndpoint)
+	config.Server.TracingServiceName = getEnvString(prefix+"TRACING_SERVICE_NAME", config.Server.TracingServiceName)
+	config.Server.StateFile = getEnvString(prefix+"STATE_FILE", config.Server.StateFile)
+
+	config.BufferPool.PoolSize = getEnvInt(prefix+"POOL_SIZE", config.BufferPool.PoolSize)
+	config.BufferPool.BufferSize = getEnvInt(prefix+"BUFFER_SIZE", config.BufferPool.BufferSize)
+	config.BufferPool.Prefill = getEnvBool(prefix+"BUFFER_PREFILL", config.BufferPool.Prefill)
+
+	config.WorkerPool.MaxWorkers = getEnvInt(prefix+"MAX_WORKERS", config.WorkerPool.MaxWorkers)
+	config.WorkerPool.HandlerTimeout = getEnvDuration(prefix+"HANDLER_TIMEOUT", config.WorkerPool.HandlerTimeout)
+	config.WorkerPool.ErrorLogInterval = getEnvDuration(prefix+"ERROR_LOG_INTERVAL", config.WorkerPool.ErrorLogInterval)
+	config.WorkerPool.SlowThreshold = getEnvDuration(prefix+"SLOW_THRESHOLD", config.WorkerPool.SlowThreshold)
+	config.WorkerPool.QueueFullThreshold = getEnvFloat(prefix+"QUEUE_FULL_THRESHOLD", config.WorkerPool.QueueFullThreshold)
+	config.WorkerPool.QueueFullWindow = getEnvDuration(prefix+"QUEUE_FULL_WINDOW", config.WorkerPool.QueueFullWindow)
+	config.WorkerPool.Affinity = getEnvString(prefix+"WORKER_AFFINITY", config.WorkerPool.Affinity)
+
+	config.Metrics.Prometheus = getEnvBool(prefix+"METRICS_PROMETHEUS", config.Metrics.Prometheus)
+	config.Metrics.StatsDAddress = getEnvString(prefix+"METRICS_STATSD_ADDRESS", config.Metrics.StatsDAddress)
+	config.Metrics.StatsDPrefix = getEnvString(prefix+"METRICS_STATSD_PREFIX", config.Metrics.StatsDPrefix)
+	config.Metrics.Interval = getEnvDuration(prefix+"METRICS_INTERVAL", config.Metrics.Interval)
+
+	config.Protocol.MAC1Label = getEnvString(prefix+"MAC1_LABEL", config.Protocol.MAC1Label)
+	config.Protocol.TypeInitiation = getEnvInt(prefix+"TYPE_INITIATION", config.Protocol.TypeInitiation)
+	config.Protocol.TypeResponse = getEnvInt(prefix+"TYPE_RESPONSE", config.Protocol.TypeResponse)
+	config.Protocol.TypeCookieReply = getEnvInt(prefix+"TYPE_COOKIE_REPLY", config.Protocol.TypeCookieReply)
+	config.Protocol.TypeTransport = getEnvInt(prefix+"TYPE_TRANSPORT", config.Protocol.TypeTransport)
+
+	if val := os.Getenv(prefix + "KEY_PAIRS"); val != "" {
 		pairs := strings.Split(val, ",")
-		for _, pair := range pairs {
-			keyParts := strings.Split(strings.TrimSpace(pair), ":")
-			if len(keyParts) == 2 {
-				config.KeyPairs = append(config.KeyPairs, KeyPairConfig{
-					Key1: strings.TrimSpace(keyParts[0]),
-					Key2: strings.TrimSpace(keyParts[1]),
-				})
+		for i, pair := range pairs {
+			if strings.TrimSpace(pair) == "" {
+				continue
 			}
+			keyPair, err := parseEnvKeyPair(pair)
+			if err != nil {
+				config.Warnings = append(config.Warnings, fmt.Sprintf("%sKEY_PAIRS entry %d skipped: %v", prefix, i, err))
+				continue
+			}
+			config.KeyPairs = append(config.KeyPairs, keyPair)
+		}
+	}
+}
+
+// parseEnvKeyPair parses one KEY_PAIRS entry: "key1:key2", "name|key1:key2"
+// or "name|key1:key2|expiration". The name may be empty, as in
+// "|key1:key2|5m".
+func parseEnvKeyPair(entry string) (KeyPairConfig, error) {
+	fields := strings.Split(strings.TrimSpace(entry), "|")
+	if len(fields) > 3 {
+		return KeyPairConfig{}, fmt.Errorf("expected name|key1:key2|expiration, got %d fields", len(fields))
+	}
+
+	var keyPair KeyPairConfig
+	keys := fields[0]
+	if len(fields) > 1 {
+		keyPair.Name = strings.TrimSpace(fields[0])
+		keys = fields[1]
+	}
+	if len(fields) == 3 {
+		expiration, err := time.ParseDuration(strings.TrimSpace(fields[2]))
+		if err != nil {
+			return KeyPairConfig{}, fmt.Errorf("invalid expiration: %v", err)
 		}
+		if expiration <= 0 {
+			return KeyPairConfig{}, fmt.Errorf("expiration must be positive, got %v", expiration)
+		}
+		keyPair.Expiration = expiration
 	}
+
+	keyParts := strings.Split(keys, ":")
+	if len(keyParts) != 2 {
+		return KeyPairConfig{}, fmt.Errorf("expected key1:key2")
+	}
+	keyPair.Key1 = strings.TrimSpace(keyParts[0])
+	keyPair.Key2 = strings.TrimSpace(keyParts[1])
+	if keyPair.Key1 == "" || keyPair.Key2 == "" {
+		return KeyPairConfig{}, fmt.Errorf("expected key1:key2")
+	}
+	return keyPair, nil
 }
 
 func GetLogLevel(level string) int {
@@ -210,47 +742,91 @@ func GetLogLevel(level string) int {
 	}
 }
 
+// GetLogLevelName returns the configuration name of level.
+func GetLogLevelName(level int) string {
+	switch level {
+	case LogLevelDebug:
+		return "debug"
+	case LogLevelWarning:
+		return "warning"
+	case LogLevelError:
+		return "error"
+	default:
+		return "info"
+	}
+}
+
+// publicKeyEncodings are tried in order when decoding a base64 public key.
+var publicKeyEncodings = []*base64.Encoding{
+	base64.StdEncoding,
+	base64.RawStdEncoding,
+	base64.URLEncoding,
+	base64.RawURLEncoding,
+}
+
+// DecodePublicKeyWithError decodes a base64 public key in standard or URL-safe
+// encoding, with or without padding.
 func DecodePublicKeyWithError(publicKeyBase64 string) (PublicKey, error) {
 	var publicKey PublicKey
-	decoded, err := base64.StdEncoding.DecodeString(publicKeyBase64)
-	if err != nil {
-		return publicKey, NewInvalidPublicKeyError("invalid base64 encoding")
-	}
+	decodeErr := NewInvalidPublicKeyError("invalid base64 encoding")
+
+	for _, encoding := range publicKeyEncodings {
+		decoded, err := encoding.DecodeString(publicKeyBase64)
+		if err != nil {
+			continue
+		}
+
+		if len(decoded) != blake2s.Size {
+			decodeErr = NewInvalidPublicKeyError("incorrect key size")
+			continue
+		}
 
-	if len(decoded) != blake2s.Size {
-		return publicKey, NewInvalidPublicKeyError("incorrect key size")
+		copy(publicKey[:], decoded)
+		return publicKey, nil
 	}
 
-	copy(publicKey[:], decoded)
-	return publicKey, nil
+	return publicKey, decodeErr
 }
 
+// LoadPublicKeyPairsFromConfig decodes the configured key pairs, skipping invalid ones.
+// When any key is invalid the returned error is a KeyPairErrors listing each of them.
 func LoadPublicKeyPairsFromConfig(keyPairs []KeyPairConfig) ([]PublicKeyPair, error) {
 	var publicKeyPairList []PublicKeyPair
-	var invalidKeys []string
+	var keyPairErrors KeyPairErrors
 
-	for _, kp := range keyPairs {
+	for i, kp := range keyPairs {
 		publicKey1, err1 := DecodePublicKeyWithError(kp.Key1)
 		publicKey2, err2 := DecodePublicKeyWithError(kp.Key2)
 
 		if err1 != nil {
-			invalidKeys = append(invalidKeys, kp.Key1)
-			continue
+			keyPairErrors = append(keyPairErrors, &KeyPairError{Index: i, Key: kp.Key1, Err: err1})
 		}
 
 		if err2 != nil {
-			invalidKeys = append(invalidKeys, kp.Key2)
+			keyPairErrors = append(keyPairErrors, &KeyPairError{Index: i, Key: kp.Key2, Err: err2})
+		}
+
+		senderIDs, err := ParseSenderIDSet(kp.SenderIDs)
+		if err != nil {
+			keyPairErrors = append(keyPairErrors, &KeyPairError{Index: i, Key: strings.Join(kp.SenderIDs, ","), Err: err})
+		}
+
+		if err1 != nil || err2 != nil || err != nil {
 			continue
 		}
 
 		publicKeyPairList = append(publicKeyPairList, PublicKeyPair{
+			Name:       kp.Name,
 			PublicKey1: publicKey1,
 			PublicKey2: publicKey2,
+			Expiration: kp.Expiration,
+			SenderIDs:  senderIDs,
+			Persistent: kp.Persistent,
 		})
 	}
 
-	if len(invalidKeys) > 0 {
-		return publicKeyPairList, NewInvalidPublicKeyError(fmt.Sprintf("invalid keys: %v", invalidKeys))
+	if len(keyPairErrors) > 0 {
+		return publicKeyPairList, keyPairErrors
 	}
 
 	return publicKeyPairList, nil
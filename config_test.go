@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// minimalConfig is a configuration file with one key pair.
+const minimalConfig = `
+[[keypairs]]
+key1 = "` + testPublicKeyA + `"
+key2 = "` + testPublicKeyB + `"
+`
+
+// loadTestConfig writes content to a configuration file and loads it with args.
+func loadTestConfig(t *testing.T, content string, args ...string) (*Config, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "setting.conf")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return LoadConfigFromArgs(append([]string{"-configfile", path}, args...))
+}
+
+func TestEnvPrefix(t *testing.T) {
+	tests := []struct {
+		name     string
+		variable string
+		args     []string
+		wantPort int
+	}{
+		{"default", "", nil, 1001},
+		{"variable", "RELAY_", nil, 1002},
+		{"flag", "", []string{"-envprefix", "OTHER_"}, 1003},
+		{"flag overrides variable", "RELAY_", []string{"-envprefix", "OTHER_"}, 1003},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(EnvPrefixVariable, tt.variable)
+			t.Setenv("WG_KNOT_PORT", "1001")
+			t.Setenv("RELAY_PORT", "1002")
+			t.Setenv("OTHER_PORT", "1003")
+
+			config, err := loadTestConfig(t, minimalConfig, tt.args...)
+			if err != nil {
+				t.Fatalf("LoadConfigFromArgs: %v", err)
+			}
+			if config.Server.Port != tt.wantPort {
+				t.Errorf("port = %d, want %d", config.Server.Port, tt.wantPort)
+			}
+		})
+	}
+}
+
+func TestEnvPrefixConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "custom.conf")
+	if err := os.WriteFile(path, []byte(minimalConfig+"[server]\nport = 2000\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(EnvPrefixVariable, "RELAY_")
+	t.Setenv("RELAY_CONFIG_FILE", path)
+
+	config, err := LoadConfigFromArgs(nil)
+	if err != nil {
+		t.Fatalf("LoadConfigFromArgs: %v", err)
+	}
+	if config.Server.Port != 2000 {
+		t.Errorf("port = %d, want 2000 from RELAY_CONFIG_FILE", config.Server.Port)
+	}
+}
+
+func TestDecodePublicKeyEncodings(t *testing.T) {
+	want := PublicKey{0xfb, 0xff, 0xbf}
+	for i := 3; i < len(want); i++ {
+		want[i] = byte(i)
+	}
+
+	tests := []struct {
+		name     string
+		encoding *base64.Encoding
+	}{
+		{"standard padded", base64.StdEncoding},
+		{"standard unpadded", base64.RawStdEncoding},
+		{"url-safe padded", base64.URLEncoding},
+		{"url-safe unpadded", base64.RawURLEncoding},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded := tt.encoding.EncodeToString(want[:])
+			got, err := DecodePublicKeyWithError(encoded)
+			if err != nil {
+				t.Fatalf("DecodePublicKeyWithError(%q): %v", encoded, err)
+			}
+			if got != want {
+				t.Errorf("DecodePublicKeyWithError(%q) = %x, want %x", encoded, got, want)
+			}
+		})
+	}
+}
+
+func TestDecodePublicKeyErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"empty", ""},
+		{"not base64", "not a key!"},
+		{"short", base64.StdEncoding.EncodeToString(make([]byte, 31))},
+		{"long", base64.StdEncoding.EncodeToString(make([]byte, 33))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DecodePublicKeyWithError(tt.input); !errors.Is(err, ErrInvalidPublicKey) {
+				t.Errorf("DecodePublicKeyWithError(%q) = %v, want ErrInvalidPublicKey", tt.input, err)
+			}
+		})
+	}
+}
+
+func TestApplyDerivedDefaults(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxWorkers  int
+		poolSize    int
+		numCPU      int
+		wantWorkers int
+		wantPool    int
+		wantDerived int
+	}{
+		{"derived from 4 CPUs", 0, 0, 4, 4 * DefaultWorkersPerCPU, 4 * DefaultBuffersPerCPU, 2},
+		{"derived from 64 CPUs", 0, 0, 64, 64 * DefaultWorkersPerCPU, 64 * DefaultBuffersPerCPU, 2},
+		{"CPU count below 1", 0, 0, 0, DefaultWorkersPerCPU, DefaultBuffersPerCPU, 2},
+		{"explicit values win", 7, 9, 64, 7, 9, 0},
+		{"only workers explicit", 7, 0, 2, 7, 2 * DefaultBuffersPerCPU, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{}
+			config.WorkerPool.MaxWorkers = tt.maxWorkers
+			config.BufferPool.PoolSize = tt.poolSize
+
+			applyDerivedDefaults(config, tt.numCPU)
+
+			if config.WorkerPool.MaxWorkers != tt.wantWorkers || config.BufferPool.PoolSize != tt.wantPool {
+				t.Errorf("max_workers=%d pool_size=%d, want %d and %d", config.WorkerPool.MaxWorkers, config.BufferPool.PoolSize, tt.wantWorkers, tt.wantPool)
+			}
+			if len(config.Derived) != tt.wantDerived {
+				t.Errorf("Derived = %q, want %d entries", config.Derived, tt.wantDerived)
+			}
+		})
+	}
+}
+
+func TestLoadConfigMaxPacketsAndRunFor(t *testing.T) {
+	config, err := loadTestConfig(t, minimalConfig, "-maxpackets", "1000", "-runfor", "30s")
+	if err != nil {
+		t.Fatalf("LoadConfigFromArgs: %v", err)
+	}
+	if config.MaxPackets != 1000 || config.RunFor != 30*time.Second {
+		t.Errorf("MaxPackets=%d RunFor=%v, want 1000 and 30s", config.MaxPackets, config.RunFor)
+	}
+
+	config, err = loadTestConfig(t, minimalConfig)
+	if err != nil {
+		t.Fatalf("LoadConfigFromArgs: %v", err)
+	}
+	if config.MaxPackets != 0 || config.RunFor != 0 {
+		t.Errorf("defaults MaxPackets=%d RunFor=%v, want both disabled", config.MaxPackets, config.RunFor)
+	}
+}
+
+func TestLoadConfigEmptyFile(t *testing.T) {
+	for _, content := range []string{"", "\n\n", "# truncated\n"} {
+		_, err := loadTestConfig(t, content)
+		if err == nil || !strings.Contains(err.Error(), "is empty") {
+			t.Errorf("content %q: err = %v, want an empty file error", content, err)
+		}
+	}
+
+	// Key pairs from the environment make an empty file usable.
+	t.Setenv("WG_KNOT_KEY_PAIRS", testPublicKeyA+":"+testPublicKeyB)
+	config, err := loadTestConfig(t, "")
+	if err != nil {
+		t.Fatalf("empty file with key pairs from the environment: %v", err)
+	}
+	if len(config.KeyPairs) != 1 {
+		t.Errorf("got %d key pairs, want 1 from the environment", len(config.KeyPairs))
+	}
+}
+
+func TestLoadConfigMissingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing.conf")
+	_, err := LoadConfigFromArgs([]string{"-configfile", path})
+	if err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("err = %v, want a file not found error", err)
+	}
+	if err != nil && strings.Contains(err.Error(), "is empty") {
+		t.Error("a missing file is reported as empty")
+	}
+}
+
+func TestLoadConfigFromArgsFlagOverrides(t *testing.T) {
+	content := minimalConfig + `
+[server]
+port = 1000
+log_level = "info"
+peer_expiration = "1m"
+
+[worker_pool]
+max_workers = 10
+`
+	t.Setenv("WG_KNOT_PORT", "2000")
+
+	config, err := loadTestConfig(t, content,
+		"-port", "3000",
+		"-loglevel", "debug",
+		"-peerexpiration", "5m",
+		"-maxworkers", "20",
+		"-buffersize", "2048",
+		"-proxyprotocol",
+	)
+	if err != nil {
+		t.Fatalf("LoadConfigFromArgs: %v", err)
+	}
+	if config.Server.Port != 3000 {
+		t.Errorf("port = %d, want the flag's 3000 over the environment and file", config.Server.Port)
+	}
+	if config.Server.LogLevel != "debug" || config.Server.PeerExpiration != 5*time.Minute {
+		t.Errorf("log_level=%q peer_expiration=%v, want debug and 5m", config.Server.LogLevel, config.Server.PeerExpiration)
+	}
+	if config.WorkerPool.MaxWorkers != 20 || config.BufferPool.BufferSize != 2048 || !config.Server.ProxyProtocol {
+		t.Errorf("max_workers=%d buffer_size=%d proxy_protocol=%v, want 20, 2048 and true",
+			config.WorkerPool.MaxWorkers, config.BufferPool.BufferSize, config.Server.ProxyProtocol)
+	}
+
+	// Loading again without flags is unaffected by the previous call.
+	config, err = loadTestConfig(t, content)
+	if err != nil {
+		t.Fatalf("LoadConfigFromArgs: %v", err)
+	}
+	if config.Server.Port != 2000 || config.Server.LogLevel != "info" || config.WorkerPool.MaxWorkers != 10 {
+		t.Errorf("port=%d log_level=%q max_workers=%d, want 2000, info and 10", config.Server.Port, config.Server.LogLevel, config.WorkerPool.MaxWorkers)
+	}
+}
+
+func TestLoadConfigFromArgsErrors(t *testing.T) {
+	if _, err := loadTestConfig(t, minimalConfig, "-nosuchflag"); err == nil {
+		t.Error("unknown flag accepted")
+	}
+	if _, err := loadTestConfig(t, minimalConfig, "-port", "many"); err == nil {
+		t.Error("invalid flag value accepted")
+	}
+
+	config, err := LoadConfigFromArgs([]string{"-genconfig", "-configfile", "/nonexistent/setting.conf"})
+	if err != nil || !config.GenConfig {
+		t.Errorf("-genconfig = %+v, %v, want GenConfig without reading the file", config, err)
+	}
+}
+
+func TestParseEnvKeyPair(t *testing.T) {
+	keys := testPublicKeyA + ":" + testPublicKeyB
+	tests := []struct {
+		entry string
+		want  KeyPairConfig
+	}{
+		{keys, KeyPairConfig{Key1: testPublicKeyA, Key2: testPublicKeyB}},
+		{" " + testPublicKeyA + " : " + testPublicKeyB + " ", KeyPairConfig{Key1: testPublicKeyA, Key2: testPublicKeyB}},
+		{"office|" + keys, KeyPairConfig{Name: "office", Key1: testPublicKeyA, Key2: testPublicKeyB}},
+		{"office|" + keys + "|5m", KeyPairConfig{Name: "office", Key1: testPublicKeyA, Key2: testPublicKeyB, Expiration: 5 * time.Minute}},
+		{"|" + keys + "|30s", KeyPairConfig{Key1: testPublicKeyA, Key2: testPublicKeyB, Expiration: 30 * time.Second}},
+	}
+
+	for _, tt := range tests {
+		got, err := parseEnvKeyPair(tt.entry)
+		if err != nil {
+			t.Errorf("parseEnvKeyPair(%q): %v", tt.entry, err)
+			continue
+		}
+		if got.Name != tt.want.Name || got.Key1 != tt.want.Key1 || got.Key2 != tt.want.Key2 || got.Expiration != tt.want.Expiration {
+			t.Errorf("parseEnvKeyPair(%q) = %+v, want %+v", tt.entry, got, tt.want)
+		}
+	}
+}
+
+func TestParseEnvKeyPairErrors(t *testing.T) {
+	keys := testPublicKeyA + ":" + testPublicKeyB
+	for _, entry := range []string{
+		testPublicKeyA,
+		testPublicKeyA + ":",
+		keys + ":" + testPublicKeyA,
+		"office|" + testPublicKeyA,
+		"office|" + keys + "|soon",
+		"office|" + keys + "|-5m",
+		"office|" + keys + "|5m|extra",
+	} {
+		if got, err := parseEnvKeyPair(entry); err == nil {
+			t.Errorf("parseEnvKeyPair(%q) = %+v, want an error", entry, got)
+		}
+	}
+}
+
+func TestLoadConfigEnvKeyPairsSkipsMalformed(t *testing.T) {
+	keys := testPublicKeyA + ":" + testPublicKeyB
+	t.Setenv("WG_KNOT_KEY_PAIRS", strings.Join([]string{
+		keys,
+		"broken",
+		"office|" + keys + "|5m",
+		"",
+		"home|" + keys + "|never",
+	}, ","))
+
+	config, err := loadTestConfig(t, "")
+	if err != nil {
+		t.Fatalf("LoadConfigFromArgs: %v", err)
+	}
+	if len(config.KeyPairs) != 2 {
+		t.Fatalf("got %d key pairs, want the 2 valid entries", len(config.KeyPairs))
+	}
+	if config.KeyPairs[1].Name != "office" || config.KeyPairs[1].Expiration != 5*time.Minute {
+		t.Errorf("second key pair = %+v, want office with 5m expiration", config.KeyPairs[1])
+	}
+	if len(config.Warnings) != 2 ||
+		!strings.Contains(config.Warnings[0], "entry 1 skipped") ||
+		!strings.Contains(config.Warnings[1], "entry 4 skipped") {
+		t.Errorf("Warnings = %q, want entries 1 and 4 skipped", config.Warnings)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const WGLabelCookie = "cookie--"
+
+const (
+	CookieReplySize = 64
+
+	// cookieSecretLifetime matches WireGuard's cookie refresh time.
+	cookieSecretLifetime = 2 * time.Minute
+)
+
+// CookieChecker issues WireGuard cookie replies when the relay is under load,
+// forcing initiators to prove they own their source address before their
+// handshakes are relayed.
+type CookieChecker struct {
+	sync.Mutex
+	secret         [blake2s.Size]byte
+	secretCreated  time.Time
+	previousSecret [blake2s.Size]byte
+	hasPrevious    bool
+
+	threshold   uint64
+	windowStart atomic.Int64
+	windowCount atomic.Uint64
+}
+
+// NewCookieChecker returns a CookieChecker that considers the relay under load
+// once more than threshold handshakes are seen within one second.
+func NewCookieChecker(threshold int) *CookieChecker {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &CookieChecker{threshold: uint64(threshold)}
+}
+
+// RecordHandshake counts a handshake message and reports whether the relay is
+// under load in the current one-second window.
+func (c *CookieChecker) RecordHandshake(now time.Time) bool {
+	second := now.Unix()
+	if start := c.windowStart.Load(); start != second {
+		if c.windowStart.CompareAndSwap(start, second) {
+			c.windowCount.Store(0)
+		}
+	}
+	return c.windowCount.Add(1) > c.threshold
+}
+
+// secrets returns the current cookie secret, rotating it when it has expired,
+// and the previous secret if cookies made with it may still be in use.
+func (c *CookieChecker) secrets(now time.Time) (current [blake2s.Size]byte, previous *[blake2s.Size]byte, err error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.secretCreated.IsZero() || now.Sub(c.secretCreated) >= cookieSecretLifetime {
+		if !c.secretCreated.IsZero() && now.Sub(c.secretCreated) < 2*cookieSecretLifetime {
+			c.previousSecret = c.secret
+			c.hasPrevious = true
+		} else {
+			c.hasPrevious = false
+		}
+
+		if _, err := rand.Read(c.secret[:]); err != nil {
+			return c.secret, nil, err
+		}
+		c.secretCreated = now
+	}
+
+	if c.hasPrevious {
+		prev := c.previousSecret
+		previous = &prev
+	}
+
+	return c.secret, previous, nil
+}
+
+// MakeCookie computes the cookie for a source address: MAC(secret, ip || port).
+func (c *CookieChecker) MakeCookie(addr *net.UDPAddr, now time.Time) ([blake2s.Size128]byte, error) {
+	secret, _, err := c.secrets(now)
+	if err != nil {
+		return [blake2s.Size128]byte{}, err
+	}
+	return makeCookie(secret, addr)
+}
+
+func makeCookie(secret [blake2s.Size]byte, addr *net.UDPAddr) ([blake2s.Size128]byte, error) {
+	var cookie [blake2s.Size128]byte
+
+	mac, err := blake2s.New128(secret[:])
+	if err != nil {
+		return cookie, err
+	}
+
+	ip := addr.IP.To4()
+	if ip == nil {
+		ip = addr.IP.To16()
+	}
+	var port [2]byte
+	binary.BigEndian.PutUint16(port[:], uint16(addr.Port))
+
+	mac.Write(ip)
+	mac.Write(port[:])
+	mac.Sum(cookie[:0])
+
+	return cookie, nil
+}
+
+// CheckMAC2 reports whether msg carries a mac2 made with the cookie issued to addr.
+// Cookies made with the previous secret are accepted until they age out.
+func (c *CookieChecker) CheckMAC2(msg []byte, addr *net.UDPAddr, now time.Time) (bool, error) {
+	if len(msg) < 2*blake2s.Size128 {
+		return false, NewInvalidPacketError("message too short for mac2")
+	}
+
+	current, previous, err := c.secrets(now)
+	if err != nil {
+		return false, err
+	}
+
+	candidates := [][blake2s.Size]byte{current}
+	if previous != nil {
+		candidates = append(candidates, *previous)
+	}
+
+	for _, secret := range candidates {
+		cookie, err := makeCookie(secret, addr)
+		if err != nil {
+			return false, err
+		}
+
+		valid, err := VerifyMAC2(msg, cookie)
+		if err != nil {
+			return false, err
+		}
+		if valid {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// VerifyMAC2 checks mac2 = MAC(cookie, msg[:len(msg)-16]) as defined by WireGuard.
+func VerifyMAC2(msg []byte, cookie [blake2s.Size128]byte) (bool, error) {
+	startMac2Pos := len(msg) - blake2s.Size128
+	if startMac2Pos < blake2s.Size128 {
+		return false, NewInvalidPacketError("message too short for mac2")
+	}
+
+	mac, err := blake2s.New128(cookie[:])
+	if err != nil {
+		return false, err
+	}
+
+	var mac2 [blake2s.Size128]byte
+	mac.Write(msg[:startMac2Pos])
+	mac.Sum(mac2[:0])
+
+	return hmac.Equal(mac2[:], msg[startMac2Pos:]), nil
+}
+
+// CreateCookieReply builds a Type3 Cookie Reply for msg received from addr.
+// publicKey is the key msg's mac1 was verified against, i.e. the responder's.
+func (c *CookieChecker) CreateCookieReply(msg []byte, addr *net.UDPAddr, publicKey PublicKey, now time.Time) ([]byte, error) {
+	size := len(msg)
+	startMac1Pos := size - 2*blake2s.Size128
+	if size < 8 || startMac1Pos < 0 {
+		return nil, NewInvalidPacketError("message too short for cookie reply")
+	}
+
+	cookie, err := c.MakeCookie(addr, now)
+	if err != nil {
+		return nil, err
+	}
+
+	var key [blake2s.Size]byte
+	hash, err := blake2s.New256(nil)
+	if err != nil {
+		return nil, err
+	}
+	hash.Write([]byte(WGLabelCookie))
+	hash.Write(publicKey[:])
+	hash.Sum(key[:0])
+
+	aead, err := chacha20poly1305.NewX(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	reply := make([]byte, 8+chacha20poly1305.NonceSizeX, CookieReplySize)
+	reply[0] = protocol.TypeByte(MessageTypeCookieReply)
+	copy(reply[4:8], msg[4:8])
+
+	nonce := reply[8 : 8+chacha20poly1305.NonceSizeX]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	mac1 := msg[startMac1Pos : startMac1Pos+blake2s.Size128]
+	reply = aead.Seal(reply, nonce, cookie[:], mac1)
+
+	return reply, nil
+}
+
+// HasMAC2 reports whether msg carries a non-zero mac2, i.e. the sender holds a cookie.
+func HasMAC2(msg []byte) bool {
+	if len(msg) < blake2s.Size128 {
+		return false
+	}
+	for _, b := range msg[len(msg)-blake2s.Size128:] {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
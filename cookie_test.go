@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// setMac2 seals msg with mac2 = MAC(cookie, msg[:len(msg)-16]), as a
+// WireGuard peer holding cookie does.
+func setMac2(t testing.TB, msg []byte, cookie [blake2s.Size128]byte) {
+	t.Helper()
+	mac, err := blake2s.New128(cookie[:])
+	if err != nil {
+		t.Fatalf("blake2s.New128: %v", err)
+	}
+	startMac2Pos := len(msg) - blake2s.Size128
+	mac.Write(msg[:startMac2Pos])
+	mac.Sum(msg[startMac2Pos:startMac2Pos])
+}
+
+// openCookieReply decrypts a cookie reply as the initiator of msg would.
+func openCookieReply(t testing.TB, reply, msg []byte, responderKey PublicKey) [blake2s.Size128]byte {
+	t.Helper()
+	hash, _ := blake2s.New256(nil)
+	hash.Write([]byte(WGLabelCookie))
+	hash.Write(responderKey[:])
+	aead, err := chacha20poly1305.NewX(hash.Sum(nil))
+	if err != nil {
+		t.Fatalf("chacha20poly1305.NewX: %v", err)
+	}
+
+	startMac1Pos := len(msg) - 2*blake2s.Size128
+	nonce := reply[8 : 8+chacha20poly1305.NonceSizeX]
+	plain, err := aead.Open(nil, nonce, reply[8+chacha20poly1305.NonceSizeX:], msg[startMac1Pos:startMac1Pos+blake2s.Size128])
+	if err != nil {
+		t.Fatalf("cookie reply does not decrypt: %v", err)
+	}
+
+	var cookie [blake2s.Size128]byte
+	copy(cookie[:], plain)
+	return cookie
+}
+
+func TestVerifyMAC2KnownCookie(t *testing.T) {
+	cookie := [blake2s.Size128]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	msg := make([]byte, InitiationPacketSize)
+	msg[0] = MessageTypeInitiation
+	setMac2(t, msg, cookie)
+
+	if valid, err := VerifyMAC2(msg, cookie); err != nil || !valid {
+		t.Errorf("VerifyMAC2 = %v, %v, want valid", valid, err)
+	}
+
+	otherCookie := cookie
+	otherCookie[0] ^= 0xff
+	if valid, _ := VerifyMAC2(msg, otherCookie); valid {
+		t.Error("mac2 verified with another cookie")
+	}
+
+	msg[4] ^= 0xff
+	if valid, _ := VerifyMAC2(msg, cookie); valid {
+		t.Error("mac2 verified after the message changed")
+	}
+
+	if _, err := VerifyMAC2(msg[:20], cookie); err == nil {
+		t.Error("VerifyMAC2 accepted a message too short for mac2")
+	}
+}
+
+func TestCookieCheckerCheckMAC2(t *testing.T) {
+	checker := NewCookieChecker(1)
+	addr := testAddr(t, "192.0.2.1:51820")
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	cookie, err := checker.MakeCookie(addr, now)
+	if err != nil {
+		t.Fatalf("MakeCookie: %v", err)
+	}
+	msg := make([]byte, InitiationPacketSize)
+	setMac2(t, msg, cookie)
+
+	// The cases run in order: the checker rotates its secret as time advances.
+	tests := []struct {
+		name string
+		addr *net.UDPAddr
+		now  time.Time
+		want bool
+	}{
+		{"same source", addr, now, true},
+		{"other port", testAddr(t, "192.0.2.1:51821"), now, false},
+		{"previous secret", addr, now.Add(cookieSecretLifetime), true},
+		{"aged out", addr, now.Add(3 * cookieSecretLifetime), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			valid, err := checker.CheckMAC2(msg, tt.addr, tt.now)
+			if err != nil || valid != tt.want {
+				t.Errorf("CheckMAC2 = %v, %v, want %v", valid, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCookieReplyUnderLoad(t *testing.T) {
+	publicKeyA, publicKeyB := testKeys(t)
+	sender := &captureSender{}
+	pm, _ := newTestPeerManager(t, sender)
+	pm.SetCookieChecker(NewCookieChecker(1))
+	ctx := context.Background()
+	addrA := testAddr(t, "192.0.2.1:51820")
+	addrB := testAddr(t, "192.0.2.2:51820")
+
+	// B's initiation is the one handshake allowed before the relay is under load.
+	if err := pm.HandlePacket(ctx, addrB, mustBuildInitiation(t, publicKeyA, SenderID{2, 2, 2, 2})); err != nil {
+		t.Fatalf("initiation from B: %v", err)
+	}
+
+	initiation := mustBuildInitiation(t, publicKeyB, SenderID{1, 1, 1, 1})
+	if err := pm.HandlePacket(ctx, addrA, initiation); err != nil {
+		t.Fatalf("initiation from A: %v", err)
+	}
+	sent := sender.Sent()
+	if len(sent) != 1 || !UDPAddrEqual(sent[0].to, addrA) || len(sent[0].payload) != CookieReplySize || sent[0].payload[0] != MessageTypeCookieReply {
+		t.Fatalf("sent %v, want one cookie reply to A", sent)
+	}
+
+	cookie := openCookieReply(t, sent[0].payload, initiation, publicKeyB)
+	setMac2(t, initiation, cookie)
+	if err := pm.HandlePacket(ctx, addrA, initiation); err != nil {
+		t.Fatalf("initiation with mac2: %v", err)
+	}
+
+	sent = sender.Sent()
+	if len(sent) != 2 || !UDPAddrEqual(sent[1].to, addrB) {
+		t.Fatalf("initiation with a valid mac2 was not relayed to B: %v", sent)
+	}
+	if got := pm.Stats().Snapshot().CookieReplies; got != 1 {
+		t.Errorf("cookie replies = %d, want 1", got)
+	}
+}
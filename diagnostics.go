@@ -0,0 +1,56 @@
+package main
+
+import (
+	"runtime"
+)
+
+// QueueDepth returns the number of packets waiting for a worker.
+func (wp *WorkerPool) QueueDepth() int {
+	depth := len(wp.jobQueue)
+	for _, queue := range wp.queues {
+		depth += len(queue)
+	}
+	return depth
+}
+
+// QueueCapacity returns the number of packets that can wait for a worker.
+func (wp *WorkerPool) QueueCapacity() int {
+	capacity := cap(wp.jobQueue)
+	for _, queue := range wp.queues {
+		capacity += cap(queue)
+	}
+	return capacity
+}
+
+// PeerCounts returns the number of receiver ID entries and of peers learned by public key.
+func (pm *PeerManager) PeerCounts() (receivers, publicKeyPeers int) {
+	defer pm.lockForRead()()
+
+	pm.store.RangeReceiverPeers(func(receiverID ReceiverID, peer *Peer) bool {
+		receivers++
+		return true
+	})
+	pm.store.RangePublicKeyPeers(func(publicKey PublicKey, peers []*Peer) bool {
+		publicKeyPeers += len(peers)
+		return true
+	})
+	return receivers, publicKeyPeers
+}
+
+// logRuntimeStats logs an on-demand diagnostic snapshot. It only reads state,
+// so it is safe to call at any time and repeatedly.
+func logRuntimeStats(logger LoggerInterface, pm *PeerManager, workerPool *WorkerPool, bufferPool *BufferPool) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	receivers, publicKeyPeers := pm.PeerCounts()
+
+	logger.Info("Runtime stats: goroutines=%d heap_alloc=%d heap_sys=%d sys=%d num_gc=%d",
+		runtime.NumGoroutine(), mem.HeapAlloc, mem.HeapSys, mem.Sys, mem.NumGC)
+	logger.Info("Runtime stats: worker queue depth=%d of %d, workers=%d latency=[%s]",
+		workerPool.QueueDepth(), workerPool.QueueCapacity(), workerPool.maxWorkers, workerPool.Latency())
+	logger.Info("Runtime stats: receivers=%d public_key_peers=%d last_cleanup=[%s]",
+		receivers, publicKeyPeers, pm.LastCleanup())
+	logger.Info("Runtime stats: packets=[%s]", pm.Stats().Snapshot())
+	logger.Info("Runtime stats: buffer pool=[%s]", bufferPool.Stats())
+}
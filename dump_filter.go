@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// DumpFilterAll is the debug_dump_filter value that dumps every packet.
+const DumpFilterAll = "all"
+
+// DumpFilter selects the packets whose hex dump is logged at debug level.
+// A nil DumpFilter matches nothing.
+type DumpFilter struct {
+	all bool
+	ips []net.IP
+	ids map[[4]byte]bool
+}
+
+// ParseDumpFilter parses a comma-separated list of source IP addresses and
+// sender IDs (8 hex digits), or "all". An empty filter returns nil.
+func ParseDumpFilter(filter string) (*DumpFilter, error) {
+	filter = strings.TrimSpace(filter)
+	if filter == "" {
+		return nil, nil
+	}
+
+	f := &DumpFilter{ids: make(map[[4]byte]bool)}
+	for _, entry := range strings.Split(filter, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if entry == DumpFilterAll {
+			f.all = true
+			continue
+		}
+
+		if ip := net.ParseIP(entry); ip != nil {
+			f.ips = append(f.ips, ip)
+			continue
+		}
+
+		decoded, err := hex.DecodeString(entry)
+		if err != nil || len(decoded) != 4 {
+			return nil, fmt.Errorf("invalid debug dump filter entry %q: expected an IP address or an 8 hex digit sender ID", entry)
+		}
+		f.ids[[4]byte(decoded)] = true
+	}
+
+	return f, nil
+}
+
+// Match reports whether the packet exchanged with addr should be dumped.
+// IDs are compared with bytes 4-8 of the payload: the sender ID of handshake
+// messages and the receiver ID of cookie replies and transport data.
+func (f *DumpFilter) Match(addr *net.UDPAddr, payload []byte) bool {
+	if f == nil {
+		return false
+	}
+	if f.all {
+		return true
+	}
+
+	if addr != nil {
+		for _, ip := range f.ips {
+			if ip.Equal(addr.IP) {
+				return true
+			}
+		}
+	}
+
+	if len(payload) >= 8 && len(f.ids) > 0 {
+		return f.ids[[4]byte(payload[4:8])]
+	}
+
+	return false
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultErrorLogInterval is how often suppressed worker errors are summarized.
+const DefaultErrorLogInterval = 10 * time.Second
+
+type errorCategory struct {
+	name       string
+	sentinel   error
+	suppressed atomic.Uint64
+	logged     atomic.Bool
+}
+
+// ErrorLogAggregator collapses floods of expected packet errors into periodic
+// counts. The first error of each category in an interval is logged in full;
+// the rest are only counted. Errors outside the known categories are never
+// suppressed.
+type ErrorLogAggregator struct {
+	interval   time.Duration
+	categories []*errorCategory
+}
+
+func NewErrorLogAggregator(interval time.Duration) *ErrorLogAggregator {
+	return &ErrorLogAggregator{
+		interval: interval,
+		categories: []*errorCategory{
+			{name: "invalid-packet", sentinel: ErrInvalidPacket},
+			{name: "authentication-failed", sentinel: ErrAuthenticationFailed},
+			{name: "peer-not-found", sentinel: ErrPeerNotFound},
+			{name: "send-failed", sentinel: ErrPacketSendFailed},
+			{name: "timeout", sentinel: context.DeadlineExceeded},
+		},
+	}
+}
+
+// Allow reports whether err should be logged now, counting it otherwise.
+func (a *ErrorLogAggregator) Allow(err error) bool {
+	for _, category := range a.categories {
+		if !errors.Is(err, category.sentinel) {
+			continue
+		}
+		if category.logged.CompareAndSwap(false, true) {
+			return true
+		}
+		category.suppressed.Add(1)
+		return false
+	}
+	return true
+}
+
+// Run logs the suppressed error counts every interval until ctx is cancelled.
+func (a *ErrorLogAggregator) Run(ctx context.Context, logger LoggerInterface) {
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			a.flush(logger)
+			return
+		case <-ticker.C:
+			a.flush(logger)
+		}
+	}
+}
+
+func (a *ErrorLogAggregator) flush(logger LoggerInterface) {
+	for _, category := range a.categories {
+		if suppressed := category.suppressed.Swap(0); suppressed > 0 {
+			LogAtLevel(logger, LogLevelForError(category.sentinel), "%d more %s errors in last %v", suppressed, category.name, a.interval)
+		}
+		category.logged.Store(false)
+	}
+}
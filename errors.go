@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"net"
+	"strings"
 )
 
 var (
@@ -13,6 +16,22 @@ var (
 	ErrPacketSendFailed     = errors.New("failed to send packet")
 )
 
+// LogLevelForError returns the level a packet handling error is logged at.
+// Malformed, unauthenticated and unroutable packets are routine on a public
+// relay, while failing to send is a problem with the relay itself.
+func LogLevelForError(err error) int {
+	switch {
+	case errors.Is(err, ErrInvalidPacket),
+		errors.Is(err, ErrAuthenticationFailed),
+		errors.Is(err, ErrPeerNotFound):
+		return LogLevelDebug
+	case errors.Is(err, context.DeadlineExceeded):
+		return LogLevelWarning
+	default:
+		return LogLevelError
+	}
+}
+
 func NewInvalidPacketError(details string) error {
 	return fmt.Errorf("%w: %s", ErrInvalidPacket, details)
 }
@@ -32,3 +51,71 @@ func NewInvalidPublicKeyError(details string) error {
 func NewPacketSendFailedError(err error) error {
 	return fmt.Errorf("%w: %v", ErrPacketSendFailed, err)
 }
+
+// PacketError attributes a packet handling error to the packet it occurred
+// for. errors.Is matches the wrapped error, e.g. ErrInvalidPacket.
+type PacketError struct {
+	Source *net.UDPAddr
+	// MessageType is the canonical message type, 0 when not recognised.
+	MessageType byte
+	Err         error
+}
+
+// NewPacketError wraps err, returning nil when err is nil.
+func NewPacketError(source *net.UDPAddr, messageType byte, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PacketError{Source: source, MessageType: messageType, Err: err}
+}
+
+func (e *PacketError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PacketError) Unwrap() error {
+	return e.Err
+}
+
+// LogFields returns the packet's source and message type as log fields.
+func (e *PacketError) LogFields() map[string]any {
+	fields := map[string]any{"msg_type": e.MessageType}
+	if e.Source != nil {
+		fields["src"] = e.Source
+	}
+	return fields
+}
+
+// KeyPairError describes an invalid key in a configured key pair.
+type KeyPairError struct {
+	Index int
+	Key   string
+	Err   error
+}
+
+func (e *KeyPairError) Error() string {
+	return fmt.Sprintf("keypair %d: %v: %s", e.Index, e.Err, e.Key)
+}
+
+func (e *KeyPairError) Unwrap() error {
+	return e.Err
+}
+
+// KeyPairErrors aggregates the KeyPairError values found while loading key pairs.
+type KeyPairErrors []*KeyPairError
+
+func (e KeyPairErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (e KeyPairErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, err := range e {
+		errs[i] = err
+	}
+	return errs
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestLogLevelForError(t *testing.T) {
+	source := testAddr(t, "192.0.2.1:51820")
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"invalid packet", NewInvalidPacketError("too short"), LogLevelDebug},
+		{"authentication failed", NewAuthenticationFailedError("mac1 verification failed"), LogLevelDebug},
+		{"peer not found", NewPeerNotFoundError("no peer"), LogLevelDebug},
+		{"send failed", NewPacketSendFailedError(errors.New("network is unreachable")), LogLevelError},
+		{"handler timeout", context.DeadlineExceeded, LogLevelWarning},
+		{"unclassified", errors.New("something else"), LogLevelError},
+		{"wrapped in PacketError", NewPacketError(source, MessageTypeInitiation, NewAuthenticationFailedError("mac1")), LogLevelDebug},
+		{"wrapped with %w", fmt.Errorf("handle: %w", NewPacketSendFailedError(errors.New("EPERM"))), LogLevelError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := LogLevelForError(tt.err); got != tt.want {
+				t.Errorf("LogLevelForError(%v) = %d, want %d", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPacketError(t *testing.T) {
+	source := testAddr(t, "192.0.2.1:51820")
+	err := fmt.Errorf("worker: %w", NewPacketError(source, MessageTypeResponse, NewPeerNotFoundError("no peer")))
+
+	if !errors.Is(err, ErrPeerNotFound) {
+		t.Errorf("errors.Is(%v, ErrPeerNotFound) = false", err)
+	}
+	var packetErr *PacketError
+	if !errors.As(err, &packetErr) {
+		t.Fatalf("errors.As(%v, *PacketError) = false", err)
+	}
+	if packetErr.Source != source || packetErr.MessageType != MessageTypeResponse {
+		t.Errorf("PacketError source=%v type=%d, want %v and %d", packetErr.Source, packetErr.MessageType, source, MessageTypeResponse)
+	}
+	if fields := packetErr.LogFields(); fields["src"] != source || fields["msg_type"] != byte(MessageTypeResponse) {
+		t.Errorf("LogFields = %v", fields)
+	}
+	if NewPacketError(source, MessageTypeResponse, nil) != nil {
+		t.Error("NewPacketError wrapped a nil error")
+	}
+}
+
+func TestHandlePacketErrorCarriesSource(t *testing.T) {
+	publicKeyA, _ := testKeys(t)
+	pm, _ := newTestPeerManager(t, &captureSender{})
+	source := testAddr(t, "192.0.2.1:51820")
+
+	tests := []struct {
+		name     string
+		payload  []byte
+		sentinel error
+		wantType byte
+	}{
+		{"bad mac1", mustBuildInitiation(t, PublicKey{0xff}, SenderID{1}), ErrAuthenticationFailed, MessageTypeInitiation},
+		{"unknown receiver", mustBuildResponse(t, publicKeyA, SenderID{2}, ReceiverID{9}), ErrPeerNotFound, MessageTypeResponse},
+		{"truncated", []byte{MessageTypeTransport, 0, 0, 0}, ErrInvalidPacket, MessageTypeTransport},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := pm.HandlePacket(context.Background(), source, tt.payload)
+			if !errors.Is(err, tt.sentinel) {
+				t.Errorf("err = %v, want %v", err, tt.sentinel)
+			}
+			var packetErr *PacketError
+			if !errors.As(err, &packetErr) {
+				t.Fatalf("err %v is not a *PacketError", err)
+			}
+			if !UDPAddrEqual(packetErr.Source, source) || packetErr.MessageType != tt.wantType {
+				t.Errorf("PacketError source=%v type=%d, want %v and %d", packetErr.Source, packetErr.MessageType, source, tt.wantType)
+			}
+		})
+	}
+}
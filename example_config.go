@@ -0,0 +1,18 @@
+package main
+
+import (
+	_ "embed"
+	"io"
+)
+
+// exampleConfig is the commented example configuration printed by -genconfig.
+// It is embedded from setting.conf.example so the two cannot drift apart.
+//
+//go:embed setting.conf.example
+var exampleConfig string
+
+// WriteExampleConfig writes the commented example configuration to w.
+func WriteExampleConfig(w io.Writer) error {
+	_, err := io.WriteString(w, exampleConfig)
+	return err
+}
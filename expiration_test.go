@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// learnInitiator has peer A at addr send an initiation to B, so that the
+// relay learns A by public key and by senderID.
+func learnInitiator(t *testing.T, pm *PeerManager, addr string, senderID SenderID) {
+	t.Helper()
+	_, publicKeyB := testKeys(t)
+	if err := pm.HandlePacket(context.Background(), testAddr(t, addr), mustBuildInitiation(t, publicKeyB, senderID)); err != nil {
+		t.Fatalf("initiation from %s: %v", addr, err)
+	}
+}
+
+// peerCounts returns the number of peers learned by A's public key and whether
+// the receiver entry for senderID exists.
+func peerCounts(t *testing.T, pm *PeerManager, senderID SenderID) (int, bool) {
+	t.Helper()
+	publicKeyA, _ := testKeys(t)
+	peers, _, err := pm.GetPublicKeyToPeers(context.Background(), publicKeyA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, exists, err := pm.GetPeerByReceiverID(context.Background(), ReceiverID(senderID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(peers), exists
+}
+
+func TestCleanupPeersExpirationBoundary(t *testing.T) {
+	tests := []struct {
+		name    string
+		elapsed time.Duration
+		kept    bool
+	}{
+		{"just under", time.Minute - time.Nanosecond, true},
+		{"exactly", time.Minute, false},
+		{"just over", time.Minute + time.Nanosecond, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pm, clock := newTestPeerManager(t, &captureSender{})
+			learnInitiator(t, pm, "192.0.2.1:51820", SenderID{1})
+
+			clock.Advance(tt.elapsed)
+			if err := pm.CleanupPeers(); err != nil {
+				t.Fatalf("CleanupPeers: %v", err)
+			}
+
+			peers, receiverExists := peerCounts(t, pm, SenderID{1})
+			if (peers == 1) != tt.kept || receiverExists != tt.kept {
+				t.Errorf("after %v: %d public key peers, receiver entry %v, want kept=%v", tt.elapsed, peers, receiverExists, tt.kept)
+			}
+			if stats := pm.LastCleanup(); !stats.At.Equal(clock.Now()) {
+				t.Errorf("cleanup ran at %v, want the test clock's %v", stats.At, clock.Now())
+			}
+		})
+	}
+}
+
+func TestCleanupPeersPerKeyPairExpiration(t *testing.T) {
+	mobile := PublicKeyPair{Name: "mobile", PublicKey1: PublicKey{1}, PublicKey2: PublicKey{2}, Expiration: 10 * time.Minute}
+	server := PublicKeyPair{Name: "server", PublicKey1: PublicKey{3}, PublicKey2: PublicKey{4}}
+	pm := NewPeerManager(&captureSender{}, []PublicKeyPair{mobile, server}, NewLogger(LogLevelError), time.Minute)
+	clock := newTestClock()
+	pm.SetClock(clock)
+	ctx := context.Background()
+
+	// Initiations to each pair's second key teach the relay its first key's peer.
+	for i, pair := range []PublicKeyPair{mobile, server} {
+		senderID := SenderID{byte(i + 1)}
+		if err := pm.HandlePacket(ctx, testAddr(t, "192.0.2.1:51820"), mustBuildInitiation(t, pair.PublicKey2, senderID)); err != nil {
+			t.Fatalf("initiation for %s: %v", pair.Name, err)
+		}
+	}
+
+	tests := []struct {
+		elapsed      time.Duration
+		mobileExists bool
+		serverExists bool
+	}{
+		{30 * time.Second, true, true},
+		{time.Minute, true, false},
+		{10 * time.Minute, false, false},
+	}
+
+	start := clock.Now()
+	for _, tt := range tests {
+		clock.Advance(start.Add(tt.elapsed).Sub(clock.Now()))
+		if err := pm.CleanupPeers(); err != nil {
+			t.Fatalf("CleanupPeers: %v", err)
+		}
+
+		_, mobileExists, _ := pm.GetPublicKeyToPeers(ctx, mobile.PublicKey1)
+		_, mobileReceiverExists, _ := pm.GetPeerByReceiverID(ctx, ReceiverID{1})
+		_, serverExists, _ := pm.GetPublicKeyToPeers(ctx, server.PublicKey1)
+		_, serverReceiverExists, _ := pm.GetPeerByReceiverID(ctx, ReceiverID{2})
+		if mobileExists != tt.mobileExists || mobileReceiverExists != tt.mobileExists {
+			t.Errorf("after %v: mobile peer %v, receiver %v, want %v", tt.elapsed, mobileExists, mobileReceiverExists, tt.mobileExists)
+		}
+		if serverExists != tt.serverExists || serverReceiverExists != tt.serverExists {
+			t.Errorf("after %v: server peer %v, receiver %v, want %v", tt.elapsed, serverExists, serverReceiverExists, tt.serverExists)
+		}
+	}
+}
+
+func TestCleanupPeersKeepsPersistentKeyPeers(t *testing.T) {
+	publicKeyA, publicKeyB := testKeys(t)
+	publicKeyC, publicKeyD := PublicKey{0xc}, PublicKey{0xd}
+	pm := NewPeerManager(&captureSender{}, []PublicKeyPair{
+		{Name: "server", PublicKey1: publicKeyA, PublicKey2: publicKeyB, Persistent: true},
+		{Name: "mobile", PublicKey1: publicKeyC, PublicKey2: publicKeyD},
+	}, NewLogger(LogLevelError), time.Minute)
+	clock := newTestClock()
+	pm.SetClock(clock)
+	ctx := context.Background()
+
+	learnInitiator(t, pm, "192.0.2.1:51820", SenderID{1})
+	if err := pm.HandlePacket(ctx, testAddr(t, "192.0.2.2:51820"), mustBuildInitiation(t, publicKeyD, SenderID{2})); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(24 * time.Hour)
+	if err := pm.CleanupPeers(); err != nil {
+		t.Fatalf("CleanupPeers: %v", err)
+	}
+
+	if peers, _, _ := pm.GetPublicKeyToPeers(ctx, publicKeyA); len(peers) != 1 {
+		t.Errorf("persistent key has %d peers a day later, want 1", len(peers))
+	}
+	if _, exists, _ := pm.GetPublicKeyToPeers(ctx, publicKeyC); exists {
+		t.Error("peer of a normal key survived past peer_expiration")
+	}
+	// Receiver IDs belong to sessions, which end whatever the key.
+	if _, exists, _ := pm.GetPeerByReceiverID(ctx, ReceiverID{1}); exists {
+		t.Error("receiver entry of a persistent key's peer survived past peer_expiration")
+	}
+}
+
+func TestCleanupPeersMaxLifetime(t *testing.T) {
+	publicKeyA, publicKeyB := testKeys(t)
+	pm := NewPeerManager(&captureSender{}, []PublicKeyPair{{Name: "test", PublicKey1: publicKeyA, PublicKey2: publicKeyB}}, NewLogger(LogLevelError), 24*time.Hour)
+	clock := newTestClock()
+	pm.SetClock(clock)
+	pm.SetPeerMaxLifetime(5 * time.Minute)
+
+	// The peer handshakes every 30 seconds, far within peer_expiration, so
+	// only the max lifetime can remove what it was first learned as.
+	learnInitiator(t, pm, "192.0.2.1:51820", SenderID{1})
+	for i := 2; i <= 10; i++ {
+		clock.Advance(30 * time.Second)
+		learnInitiator(t, pm, "192.0.2.1:51820", SenderID{byte(i)})
+		if err := pm.CleanupPeers(); err != nil {
+			t.Fatalf("CleanupPeers: %v", err)
+		}
+		if peers, receiverExists := peerCounts(t, pm, SenderID{1}); peers != 1 || !receiverExists {
+			t.Fatalf("handshake %d: %d peers, first receiver %v, want the active peer kept", i, peers, receiverExists)
+		}
+	}
+
+	clock.Advance(30 * time.Second)
+	if err := pm.CleanupPeers(); err != nil {
+		t.Fatalf("CleanupPeers: %v", err)
+	}
+	if peers, receiverExists := peerCounts(t, pm, SenderID{1}); peers != 0 || receiverExists {
+		t.Fatalf("at the max lifetime: %d peers, first receiver %v, want both removed", peers, receiverExists)
+	}
+	// Receiver entries learned later have their own lifetime.
+	if _, receiverExists := peerCounts(t, pm, SenderID{10}); !receiverExists {
+		t.Error("receiver entry learned 30 seconds ago was removed")
+	}
+
+	// The next handshake learns the peer afresh, with a new lifetime.
+	learnInitiator(t, pm, "192.0.2.1:51820", SenderID{11})
+	clock.Advance(4 * time.Minute)
+	if err := pm.CleanupPeers(); err != nil {
+		t.Fatalf("CleanupPeers: %v", err)
+	}
+	if peers, receiverExists := peerCounts(t, pm, SenderID{11}); peers != 1 || !receiverExists {
+		t.Errorf("re-learned peer: %d peers, receiver %v, want it kept", peers, receiverExists)
+	}
+}
+
+func TestCleanupPeersMaxLifetimeAppliesToPersistentKeys(t *testing.T) {
+	publicKeyA, publicKeyB := testKeys(t)
+	pm := NewPeerManager(&captureSender{}, []PublicKeyPair{
+		{Name: "server", PublicKey1: publicKeyA, PublicKey2: publicKeyB, Persistent: true},
+	}, NewLogger(LogLevelError), time.Minute)
+	clock := newTestClock()
+	pm.SetClock(clock)
+	pm.SetPeerMaxLifetime(time.Hour)
+
+	learnInitiator(t, pm, "192.0.2.1:51820", SenderID{1})
+	clock.Advance(time.Hour - time.Second)
+	if err := pm.CleanupPeers(); err != nil {
+		t.Fatalf("CleanupPeers: %v", err)
+	}
+	if peers, _ := peerCounts(t, pm, SenderID{1}); peers != 1 {
+		t.Fatalf("persistent key has %d peers before the max lifetime, want 1", peers)
+	}
+
+	clock.Advance(time.Second)
+	if err := pm.CleanupPeers(); err != nil {
+		t.Fatalf("CleanupPeers: %v", err)
+	}
+	if peers, _ := peerCounts(t, pm, SenderID{1}); peers != 0 {
+		t.Errorf("persistent key has %d peers at the max lifetime, want 0", peers)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+)
+
+// ForwardOverrides maps peers to static addresses that replace their learned
+// address when forwarding. A sender ID override takes precedence over a public
+// key override, and both take precedence over the learned address.
+type ForwardOverrides struct {
+	byReceiverID map[ReceiverID]*net.UDPAddr
+	byPublicKey  map[PublicKey]*net.UDPAddr
+}
+
+// LoadForwardOverridesFromConfig validates and decodes the configured overrides.
+// It returns nil when none are configured.
+func LoadForwardOverridesFromConfig(configs []ForwardOverrideConfig) (*ForwardOverrides, error) {
+	if len(configs) == 0 {
+		return nil, nil
+	}
+
+	overrides := &ForwardOverrides{
+		byReceiverID: make(map[ReceiverID]*net.UDPAddr),
+		byPublicKey:  make(map[PublicKey]*net.UDPAddr),
+	}
+
+	for i, c := range configs {
+		if (c.SenderID == "") == (c.PublicKey == "") {
+			return nil, fmt.Errorf("forward override %d: exactly one of sender_id and public_key must be set", i)
+		}
+
+		addr, err := net.ResolveUDPAddr("udp", c.Address)
+		if err != nil {
+			return nil, fmt.Errorf("forward override %d: invalid address %q: %v", i, c.Address, err)
+		}
+		if addr.IP == nil || addr.Port == 0 {
+			return nil, fmt.Errorf("forward override %d: address %q must include an IP and a port", i, c.Address)
+		}
+		addr = NormalizeUDPAddr(addr)
+
+		if c.SenderID != "" {
+			decoded, err := hex.DecodeString(c.SenderID)
+			if err != nil || len(decoded) != len(ReceiverID{}) {
+				return nil, fmt.Errorf("forward override %d: sender_id must be 8 hex digits: %q", i, c.SenderID)
+			}
+			overrides.byReceiverID[ReceiverID(decoded)] = addr
+			continue
+		}
+
+		publicKey, err := DecodePublicKeyWithError(c.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("forward override %d: %v: %s", i, err, c.PublicKey)
+		}
+		overrides.byPublicKey[publicKey] = addr
+	}
+
+	return overrides, nil
+}
+
+// Len returns the number of configured overrides.
+func (o *ForwardOverrides) Len() int {
+	return len(o.byReceiverID) + len(o.byPublicKey)
+}
+
+// Lookup returns the override for a peer reached through receiverID (nil when
+// the peer was found by public key) whose static key is publicKey.
+func (o *ForwardOverrides) Lookup(receiverID *ReceiverID, publicKey PublicKey) (*net.UDPAddr, bool) {
+	if receiverID != nil {
+		if addr, exists := o.byReceiverID[*receiverID]; exists {
+			return addr, true
+		}
+	}
+
+	if publicKey != (PublicKey{}) {
+		if addr, exists := o.byPublicKey[publicKey]; exists {
+			return addr, true
+		}
+	}
+
+	return nil, false
+}
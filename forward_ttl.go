@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+)
+
+// ValidateForwardTTL checks a forward_ttl setting; 0 keeps the system default.
+func ValidateForwardTTL(ttl int) error {
+	if ttl < 0 || ttl > 255 {
+		return fmt.Errorf("forward_ttl must be between 1 and 255, or 0 for the system default, got %d", ttl)
+	}
+	return nil
+}
+
+// forwardTTLError combines the results of setting the IPv4 and IPv6 options.
+// A socket only accepts the option of its own address family, except that
+// IPv6 sockets on some platforms also take the IPv4 one for mapped
+// addresses, so one success is enough.
+func forwardTTLError(v4Err, v6Err error) error {
+	if v4Err != nil && v6Err != nil {
+		return fmt.Errorf("failed to set TTL: %v (IPv6 hop limit: %v)", v4Err, v6Err)
+	}
+	return nil
+}
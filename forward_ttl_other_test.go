@@ -0,0 +1,61 @@
+//go:build !windows
+
+package main
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+// socketOption reads an integer socket option of conn.
+func socketOption(t *testing.T, conn *net.UDPConn, level, option int) int {
+	t.Helper()
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value int
+	var optErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		value, optErr = syscall.GetsockoptInt(int(fd), level, option)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if optErr != nil {
+		t.Fatalf("getsockopt: %v", optErr)
+	}
+	return value
+}
+
+func TestSetForwardTTL(t *testing.T) {
+	t.Run("IPv4", func(t *testing.T) {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatalf("ListenUDP: %v", err)
+		}
+		defer conn.Close()
+
+		if err := SetForwardTTL(conn, 7); err != nil {
+			t.Fatalf("SetForwardTTL: %v", err)
+		}
+		if got := socketOption(t, conn, syscall.IPPROTO_IP, syscall.IP_TTL); got != 7 {
+			t.Errorf("IP_TTL = %d, want 7", got)
+		}
+	})
+
+	t.Run("IPv6", func(t *testing.T) {
+		conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+		if err != nil {
+			t.Skipf("no IPv6 loopback: %v", err)
+		}
+		defer conn.Close()
+
+		if err := SetForwardTTL(conn, 9); err != nil {
+			t.Fatalf("SetForwardTTL: %v", err)
+		}
+		if got := socketOption(t, conn, syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS); got != 9 {
+			t.Errorf("IPV6_UNICAST_HOPS = %d, want 9", got)
+		}
+	})
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateForwardTTL(t *testing.T) {
+	for _, ttl := range []int{0, 1, 64, 255} {
+		if err := ValidateForwardTTL(ttl); err != nil {
+			t.Errorf("ValidateForwardTTL(%d) = %v, want nil", ttl, err)
+		}
+	}
+	for _, ttl := range []int{-1, 256, 1000} {
+		if err := ValidateForwardTTL(ttl); err == nil {
+			t.Errorf("ValidateForwardTTL(%d) = nil, want an error", ttl)
+		}
+	}
+}
+
+func TestForwardTTLError(t *testing.T) {
+	failed := errors.New("protocol not available")
+	if err := forwardTTLError(nil, failed); err != nil {
+		t.Errorf("IPv4 set, IPv6 failed: %v, want nil", err)
+	}
+	if err := forwardTTLError(failed, nil); err != nil {
+		t.Errorf("IPv6 set, IPv4 failed: %v, want nil", err)
+	}
+	if err := forwardTTLError(failed, failed); err == nil {
+		t.Error("both failed: nil, want an error")
+	}
+}
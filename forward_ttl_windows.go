@@ -0,0 +1,27 @@
+//go:build windows
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// SetForwardTTL sets the IPv4 TTL and IPv6 hop limit of packets sent from conn.
+func SetForwardTTL(conn *net.UDPConn, ttl int) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var v4Err, v6Err error
+	err = rawConn.Control(func(fd uintptr) {
+		v4Err = syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IP, syscall.IP_TTL, ttl)
+		v6Err = syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, ttl)
+	})
+	if err != nil {
+		return err
+	}
+
+	return forwardTTLError(v4Err, v6Err)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func FuzzHandlePacket(f *testing.F) {
+	publicKeyA, publicKeyB := testKeys(f)
+	initiation := mustBuildInitiation(f, publicKeyB, SenderID{0x11, 0x12, 0x13, 0x14})
+	response := mustBuildResponse(f, publicKeyA, SenderID{0x21, 0x22, 0x23, 0x24}, ReceiverID{0x11, 0x12, 0x13, 0x14})
+	cookieReply := make([]byte, CookieReplySize)
+	cookieReply[0] = MessageTypeCookieReply
+	copy(cookieReply[4:8], []byte{0x11, 0x12, 0x13, 0x14})
+	transport := make([]byte, 32)
+	transport[0] = MessageTypeTransport
+	copy(transport[4:8], []byte{0x21, 0x22, 0x23, 0x24})
+
+	f.Add(initiation)
+	f.Add(response)
+	f.Add(cookieReply)
+	f.Add(transport)
+	f.Add(initiation[:InitiationPacketSize-1])
+	f.Add(response[:60])
+	f.Add(transport[:16])
+	for size := 0; size <= 4; size++ {
+		f.Add(make([]byte, size))
+	}
+	f.Add([]byte{MessageTypeInitiation})
+	f.Add([]byte{MessageTypeTransport, 0, 0, 0})
+	f.Add([]byte{5, 0, 0, 0, 1, 2, 3, 4})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0xff})
+
+	addr := testAddr(f, "192.0.2.1:51820")
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		pm, _ := newTestPeerManager(t, &captureSender{})
+		pm.SetPassUnknown(true)
+
+		_ = pm.HandlePacket(context.Background(), addr, payload)
+	})
+}
@@ -2,9 +2,9 @@ module github.com/0141KoppePan/wg-knot
 
 go 1.24
 
-require golang.org/x/crypto v0.38.0
-
 require (
-	github.com/BurntSushi/toml v1.5.0 // indirect
-	golang.org/x/sys v0.33.0 // indirect
+	github.com/BurntSushi/toml v1.5.0
+	golang.org/x/crypto v0.38.0
 )
+
+require golang.org/x/sys v0.33.0 // indirect
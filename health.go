@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HealthState is the lifecycle state reported by the health endpoints.
+type HealthState int32
+
+const (
+	HealthStarting HealthState = iota
+	HealthReady
+	HealthDraining
+)
+
+func (s HealthState) String() string {
+	switch s {
+	case HealthStarting:
+		return "starting"
+	case HealthReady:
+		return "ready"
+	case HealthDraining:
+		return "draining"
+	default:
+		return "unknown"
+	}
+}
+
+// HealthCheck reports the status of one component. A non-nil error makes
+// /readyz fail; the status is shown either way.
+type HealthCheck func() (string, error)
+
+type namedHealthCheck struct {
+	name  string
+	check HealthCheck
+}
+
+// Health tracks the relay's lifecycle for liveness and readiness checks.
+type Health struct {
+	state  atomic.Int32
+	mu     sync.Mutex
+	checks []namedHealthCheck
+}
+
+func NewHealth() *Health {
+	return &Health{}
+}
+
+func (h *Health) SetState(state HealthState) {
+	h.state.Store(int32(state))
+}
+
+func (h *Health) State() HealthState {
+	return HealthState(h.state.Load())
+}
+
+// AddCheck adds a check that is run, and shown, on every health request.
+func (h *Health) AddCheck(name string, check HealthCheck) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks = append(h.checks, namedHealthCheck{name: name, check: check})
+}
+
+// ServeHTTP answers /healthz while the process runs and /readyz only while
+// the relay accepts new tunnels.
+func (h *Health) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	state := h.State()
+	ready := state == HealthReady
+	var body strings.Builder
+	body.WriteString(state.String() + "\n")
+
+	h.mu.Lock()
+	checks := h.checks
+	h.mu.Unlock()
+	for _, c := range checks {
+		status, err := c.check()
+		if err != nil {
+			ready = false
+			status = fmt.Sprintf("%s (unhealthy: %v)", status, err)
+		}
+		fmt.Fprintf(&body, "%s: %s\n", c.name, status)
+	}
+
+	code := http.StatusOK
+	if r.URL.Path == "/readyz" && !ready {
+		code = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write([]byte(body.String()))
+}
+
+// StartHealthServer serves health on address until the returned server is
+// closed, and metrics on /metrics unless it is nil.
+func StartHealthServer(address string, health *Health, metrics http.Handler, logger LoggerInterface) (*http.Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", health)
+	mux.Handle("/readyz", health)
+	if metrics != nil {
+		mux.Handle("/metrics", metrics)
+	}
+
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Health server stopped: %v", err)
+		}
+	}()
+
+	return server, nil
+}
+
+// AddHealthRoute serves handler at pattern on a server started by
+// StartHealthServer, for endpoints whose data exists only after it started.
+func AddHealthRoute(server *http.Server, pattern string, handler http.Handler) {
+	server.Handler.(*http.ServeMux).Handle(pattern, handler)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// healthMinDropSample is the fewest packets a drop rate window must hold to be
+// judged, so that a handful of junk packets cannot fail readiness.
+const healthMinDropSample = 100
+
+// DefaultHealthDropWindow is the window the drop rate is measured over.
+const DefaultHealthDropWindow = time.Minute
+
+// HealthThresholds mark a running relay unhealthy. Zero values disable a check.
+type HealthThresholds struct {
+	// MinPeers is the fewest receiver entries expected once the relay has had
+	// that many; staying below it for longer than MinPeersGrace is unhealthy.
+	MinPeers      int
+	MinPeersGrace time.Duration
+	// MaxDropRate is the highest fraction of received packets that may be
+	// dropped over each DropWindow.
+	MaxDropRate float64
+	DropWindow  time.Duration
+}
+
+// HealthMonitor samples the PeerManager and provides health checks for the
+// thresholds.
+type HealthMonitor struct {
+	pm         *PeerManager
+	thresholds HealthThresholds
+
+	mu         sync.Mutex
+	peers      int
+	hadPeers   bool
+	belowSince time.Time
+	prev       PacketStatsSnapshot
+	received   uint64
+	dropped    uint64
+}
+
+func NewHealthMonitor(pm *PeerManager, thresholds HealthThresholds) *HealthMonitor {
+	if thresholds.DropWindow <= 0 {
+		thresholds.DropWindow = DefaultHealthDropWindow
+	}
+	return &HealthMonitor{pm: pm, thresholds: thresholds, prev: pm.Stats().Snapshot()}
+}
+
+// AddChecks registers the checks of the configured thresholds with health.
+func (m *HealthMonitor) AddChecks(health *Health) {
+	if m.thresholds.MinPeers > 0 {
+		health.AddCheck("peers", m.checkPeers)
+	}
+	if m.thresholds.MaxDropRate > 0 {
+		health.AddCheck("drops", m.checkDrops)
+	}
+}
+
+// Run samples the peer count every second and the drop rate every DropWindow
+// until ctx is cancelled.
+func (m *HealthMonitor) Run(ctx context.Context) {
+	peerTicker := time.NewTicker(time.Second)
+	defer peerTicker.Stop()
+	dropTicker := time.NewTicker(m.thresholds.DropWindow)
+	defer dropTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-peerTicker.C:
+			m.samplePeers(now)
+		case <-dropTicker.C:
+			m.sampleDrops()
+		}
+	}
+}
+
+func (m *HealthMonitor) samplePeers(now time.Time) {
+	receivers, _ := m.pm.PeerCounts()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.peers = receivers
+	switch {
+	case receivers >= m.thresholds.MinPeers:
+		m.hadPeers = true
+		m.belowSince = time.Time{}
+	case m.hadPeers && m.belowSince.IsZero():
+		m.belowSince = now
+	}
+}
+
+func (m *HealthMonitor) sampleDrops() {
+	current := m.pm.Stats().Snapshot()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	diff := current.Sub(m.prev)
+	m.prev = current
+	m.received, m.dropped = 0, 0
+	for i := range diff.Received {
+		m.received += diff.Received[i]
+		m.dropped += diff.Dropped[i]
+	}
+}
+
+func (m *HealthMonitor) checkPeers() (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status := fmt.Sprintf("%d receivers", m.peers)
+	if !m.belowSince.IsZero() {
+		if below := time.Since(m.belowSince); below > m.thresholds.MinPeersGrace {
+			return status, fmt.Errorf("below %d for %v", m.thresholds.MinPeers, below.Round(time.Second))
+		}
+	}
+	return status, nil
+}
+
+func (m *HealthMonitor) checkDrops() (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status := fmt.Sprintf("%d of %d packets dropped in the last %v", m.dropped, m.received, m.thresholds.DropWindow)
+	if m.received >= healthMinDropSample {
+		if rate := float64(m.dropped) / float64(m.received); rate > m.thresholds.MaxDropRate {
+			return status, fmt.Errorf("drop rate %.2f above %.2f", rate, m.thresholds.MaxDropRate)
+		}
+	}
+	return status, nil
+}
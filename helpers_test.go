@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Public keys of the key pair configured by newTestPeerManager. They are the
+// keys of peer A (initiator) and peer B (responder).
+const (
+	testPublicKeyA = "0nL3Fpz84OwqGYh1+PwxmTqxqRY6fI8DzbpPpU2Z39g="
+	testPublicKeyB = "u1RWcs3gPLiF04aD/L0wXdT7bniiCvOpV2KeSUjndso="
+)
+
+// testClock is a Clock that only moves when told to.
+type testClock struct {
+	sync.Mutex
+	now time.Time
+}
+
+func newTestClock() *testClock {
+	return &testClock{now: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *testClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// sentPacket is a packet recorded by captureSender.
+type sentPacket struct {
+	to      *net.UDPAddr
+	payload []byte
+}
+
+// captureSender is a PacketSender that records every packet instead of sending it.
+type captureSender struct {
+	sync.Mutex
+	sent []sentPacket
+	err  error
+}
+
+func (s *captureSender) SendPacket(to *net.UDPAddr, payload []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.sent = append(s.sent, sentPacket{to: to, payload: append([]byte(nil), payload...)})
+	return nil
+}
+
+// Sent returns the packets recorded so far.
+func (s *captureSender) Sent() []sentPacket {
+	s.Lock()
+	defer s.Unlock()
+	return append([]sentPacket(nil), s.sent...)
+}
+
+func mustDecodePublicKey(t testing.TB, publicKeyBase64 string) PublicKey {
+	t.Helper()
+	publicKey, err := DecodePublicKeyWithError(publicKeyBase64)
+	if err != nil {
+		t.Fatalf("DecodePublicKeyWithError(%q): %v", publicKeyBase64, err)
+	}
+	return publicKey
+}
+
+// testKeys returns the public keys of peers A and B.
+func testKeys(t testing.TB) (PublicKey, PublicKey) {
+	t.Helper()
+	return mustDecodePublicKey(t, testPublicKeyA), mustDecodePublicKey(t, testPublicKeyB)
+}
+
+// newTestPeerManager returns a PeerManager with the test key pair, sending
+// through sender and driven by a test clock.
+func newTestPeerManager(t testing.TB, sender PacketSender) (*PeerManager, *testClock) {
+	t.Helper()
+	publicKeyA, publicKeyB := testKeys(t)
+	pm := NewPeerManager(sender, []PublicKeyPair{{Name: "test", PublicKey1: publicKeyA, PublicKey2: publicKeyB}}, NewLogger(LogLevelError), time.Minute)
+	clock := newTestClock()
+	pm.SetClock(clock)
+	return pm, clock
+}
+
+func testAddr(t testing.TB, addr string) *net.UDPAddr {
+	t.Helper()
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatalf("ResolveUDPAddr(%q): %v", addr, err)
+	}
+	return udpAddr
+}
+
+func mustBuildInitiation(t testing.TB, publicKey PublicKey, senderID SenderID) []byte {
+	t.Helper()
+	packet, err := BuildInitiationPacket(publicKey, senderID)
+	if err != nil {
+		t.Fatalf("BuildInitiationPacket: %v", err)
+	}
+	return packet
+}
+
+func mustBuildResponse(t testing.TB, publicKey PublicKey, senderID SenderID, receiverID ReceiverID) []byte {
+	t.Helper()
+	packet, err := BuildResponsePacket(publicKey, senderID, receiverID)
+	if err != nil {
+		t.Fatalf("BuildResponsePacket: %v", err)
+	}
+	return packet
+}
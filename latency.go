@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the LatencyHistogram buckets. Slower
+// observations fall into a final overflow bucket.
+var latencyBuckets = [...]time.Duration{
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	1 * time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	1 * time.Second,
+}
+
+// LatencyHistogram counts durations in fixed buckets. It is safe for
+// concurrent use and cumulative until Reset.
+type LatencyHistogram struct {
+	buckets [len(latencyBuckets) + 1]atomic.Uint64
+	count   atomic.Uint64
+	sum     atomic.Int64 // nanoseconds
+}
+
+func (h *LatencyHistogram) Observe(d time.Duration) {
+	i := 0
+	for i < len(latencyBuckets) && d > latencyBuckets[i] {
+		i++
+	}
+	h.buckets[i].Add(1)
+	h.count.Add(1)
+	h.sum.Add(int64(d))
+}
+
+// Reset zeroes the histogram. Observations made concurrently may be lost.
+func (h *LatencyHistogram) Reset() {
+	for i := range h.buckets {
+		h.buckets[i].Store(0)
+	}
+	h.count.Store(0)
+	h.sum.Store(0)
+}
+
+type LatencySnapshot struct {
+	// Buckets holds the count per bucket, not cumulative; the last entry
+	// counts observations above the largest bound.
+	Buckets []uint64
+	Bounds  []time.Duration
+	Count   uint64
+	Sum     time.Duration
+}
+
+func (h *LatencyHistogram) Snapshot() LatencySnapshot {
+	s := LatencySnapshot{
+		Buckets: make([]uint64, len(h.buckets)),
+		Bounds:  latencyBuckets[:],
+		Count:   h.count.Load(),
+		Sum:     time.Duration(h.sum.Load()),
+	}
+	for i := range h.buckets {
+		s.Buckets[i] = h.buckets[i].Load()
+	}
+	return s
+}
+
+// Quantile returns the upper bound of the bucket holding quantile q, or -1 if
+// it lies in the overflow bucket.
+func (s LatencySnapshot) Quantile(q float64) time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	rank := uint64(q * float64(s.Count))
+	var seen uint64
+	for i, n := range s.Buckets {
+		seen += n
+		if seen > rank {
+			if i < len(s.Bounds) {
+				return s.Bounds[i]
+			}
+			return -1
+		}
+	}
+	return -1
+}
+
+func (s LatencySnapshot) String() string {
+	if s.Count == 0 {
+		return "count=0"
+	}
+	quantile := func(q float64) string {
+		if d := s.Quantile(q); d >= 0 {
+			return "<=" + d.String()
+		}
+		return ">" + s.Bounds[len(s.Bounds)-1].String()
+	}
+	return fmt.Sprintf("count=%d avg=%v p50%s p99%s", s.Count, s.Sum/time.Duration(s.Count), quantile(0.5), quantile(0.99))
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// Listener is a socket the relay receives packets on, with its own settings.
+type Listener struct {
+	Addr          *net.UDPAddr
+	ProxyProtocol bool
+	// SourceFilter applies to this listener only, on top of the server wide
+	// allow_cidrs and deny_cidrs; nil accepts every source.
+	SourceFilter *SourceFilter
+}
+
+// LoadListenersFromConfig resolves the configured listeners. Without any, the
+// relay has a single listener on server.listen_address and server.port.
+func LoadListenersFromConfig(server ServerConfig, configs []ListenerConfig) ([]Listener, error) {
+	if len(configs) == 0 {
+		configs = []ListenerConfig{{
+			Address:       server.ListenAddress,
+			Port:          server.Port,
+			ProxyProtocol: server.ProxyProtocol,
+		}}
+	}
+
+	listeners := make([]Listener, 0, len(configs))
+	seen := make(map[string]int)
+	for i, c := range configs {
+		address := c.Address
+		if address == "" {
+			address = server.ListenAddress
+		}
+		if c.Port < 1 || c.Port > 65535 {
+			return nil, fmt.Errorf("listener %d: invalid port %d", i, c.Port)
+		}
+
+		addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(address, strconv.Itoa(c.Port)))
+		if err != nil {
+			return nil, fmt.Errorf("listener %d: %v", i, err)
+		}
+		addr = NormalizeUDPAddr(addr)
+		if previous, exists := seen[addr.String()]; exists {
+			return nil, fmt.Errorf("listener %d: %s is already used by listener %d", i, addr, previous)
+		}
+		seen[addr.String()] = i
+
+		listener := Listener{Addr: addr, ProxyProtocol: c.ProxyProtocol}
+		if len(c.AllowCIDRs) > 0 || len(c.DenyCIDRs) > 0 {
+			listener.SourceFilter, err = ParseSourceFilter(c.AllowCIDRs, c.DenyCIDRs)
+			if err != nil {
+				return nil, fmt.Errorf("listener %d: %v", i, err)
+			}
+		}
+		listeners = append(listeners, listener)
+	}
+
+	return listeners, nil
+}
+
+func (l Listener) String() string {
+	s := l.Addr.String()
+	if l.ProxyProtocol {
+		s += " proxy_protocol"
+	}
+	if l.SourceFilter != nil {
+		s += " " + l.SourceFilter.String()
+	}
+	return s
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestLoadListenersMixedConfig(t *testing.T) {
+	config, err := loadTestConfig(t, minimalConfig+`
+[[listeners]]
+port = 51820
+proxy_protocol = true
+allow_cidrs = ["192.0.2.0/24"]
+
+[[listeners]]
+address = "127.0.0.1"
+port = 51821
+`)
+	if err != nil {
+		t.Fatalf("LoadConfigFromArgs: %v", err)
+	}
+
+	listeners, err := LoadListenersFromConfig(config.Server, config.Listeners)
+	if err != nil {
+		t.Fatalf("LoadListenersFromConfig: %v", err)
+	}
+	if len(listeners) != 2 {
+		t.Fatalf("got %d listeners, want 2", len(listeners))
+	}
+
+	public, internal := listeners[0], listeners[1]
+	if public.Addr.String() != "0.0.0.0:51820" || !public.ProxyProtocol || public.SourceFilter == nil {
+		t.Errorf("public listener = %s, want 0.0.0.0:51820 with proxy_protocol and a source filter", public)
+	}
+	if !public.SourceFilter.Allowed(testAddr(t, "192.0.2.1:51820")) || public.SourceFilter.Allowed(testAddr(t, "198.51.100.1:51820")) {
+		t.Errorf("public listener filter %s does not apply allow_cidrs", public.SourceFilter)
+	}
+	if internal.Addr.String() != "127.0.0.1:51821" || internal.ProxyProtocol || internal.SourceFilter != nil {
+		t.Errorf("internal listener = %s, want 127.0.0.1:51821 without proxy_protocol or filter", internal)
+	}
+}
+
+func TestLoadListenersDefault(t *testing.T) {
+	server := ServerConfig{ListenAddress: "127.0.0.1", Port: 51820, ProxyProtocol: true}
+	listeners, err := LoadListenersFromConfig(server, nil)
+	if err != nil {
+		t.Fatalf("LoadListenersFromConfig: %v", err)
+	}
+	if len(listeners) != 1 || listeners[0].Addr.String() != "127.0.0.1:51820" || !listeners[0].ProxyProtocol {
+		t.Errorf("listeners = %v, want the server address with proxy_protocol", listeners)
+	}
+}
+
+func TestLoadListenersErrors(t *testing.T) {
+	server := ServerConfig{ListenAddress: "0.0.0.0", Port: 51820}
+	tests := []struct {
+		name    string
+		configs []ListenerConfig
+		want    string
+	}{
+		{"same address twice", []ListenerConfig{{Port: 51820}, {Address: "0.0.0.0", Port: 51820}}, "already used by listener 0"},
+		{"invalid port", []ListenerConfig{{Port: 0}}, "invalid port"},
+		{"invalid CIDR", []ListenerConfig{{Port: 51820, DenyCIDRs: []string{"192.0.2.0/33"}}}, "listener 0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadListenersFromConfig(server, tt.configs)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReceiverAppliesListenerFilter(t *testing.T) {
+	filter, err := ParseSourceFilter(nil, []string{"198.51.100.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &fakeConn{reads: []fakeRead{
+		{data: []byte{MessageTypeTransport}, addr: testAddr(t, "198.51.100.1:51820")},
+		{data: []byte{MessageTypeTransport, 1}, addr: testAddr(t, "192.0.2.1:51820")},
+	}}
+	handled := &handledPackets{}
+	workerPool := NewWorkerPool(WorkerPoolConfig{MaxWorkers: 1}, handled.handle, NewLogger(LogLevelError))
+	workerPool.Start(context.Background())
+	receiver := NewReceiver(conn, NewBufferPool(4, 1500), workerPool, &PacketStats{}, NewLogger(LogLevelError), false)
+	receiver.SetSourceFilter(filter)
+
+	receiver.receive()
+	receiver.receive()
+	workerPool.Shutdown()
+
+	if len(handled.payloads) != 1 || len(handled.payloads[0]) != 2 {
+		t.Errorf("handled %v, want only the packet from outside the denied range", handled.payloads)
+	}
+}
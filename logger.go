@@ -1,8 +1,16 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"log"
+	"net"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -12,12 +20,42 @@ const (
 	LogLevelError
 )
 
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+const (
+	LogTimeFormatRFC3339 = "rfc3339"
+	LogTimeFormatUnix    = "unix"
+)
+
 type Logger struct {
 	debugLogger   *log.Logger
 	infoLogger    *log.Logger
 	warningLogger *log.Logger
 	errorLogger   *log.Logger
-	minLevel      int
+	minLevel      *atomic.Int32 // shared with child loggers so SetLevel applies to all
+	format        string
+	timeFormat    string
+	utc           bool
+	splitAddrs    bool
+	fields        map[string]any
+	fieldPrefix   string
+}
+
+// LoggerOptions controls how log lines are rendered.
+type LoggerOptions struct {
+	// Format is LogFormatText (default) or LogFormatJSON.
+	Format string
+	// TimeFormat is LogTimeFormatRFC3339, LogTimeFormatUnix or a Go time layout.
+	// Empty keeps the standard "2006/01/02 15:04:05" timestamp.
+	TimeFormat string
+	// UTC renders timestamps in UTC instead of local time.
+	UTC bool
+	// SplitAddrs renders *net.UDPAddr fields such as src as separate
+	// src_ip and src_port fields instead of one "ip:port" field.
+	SplitAddrs bool
 }
 
 type LoggerInterface interface {
@@ -25,39 +63,190 @@ type LoggerInterface interface {
 	Info(format string, v ...interface{})
 	Warning(format string, v ...interface{})
 	Error(format string, v ...interface{})
+	WithFields(fields map[string]any) LoggerInterface
+}
+
+// quietDebugLogger drops Debug messages, e.g. for packets that are not
+// sampled for debug logging, and passes everything else on.
+type quietDebugLogger struct {
+	LoggerInterface
+}
+
+func (quietDebugLogger) Debug(format string, v ...interface{}) {}
+
+func (l quietDebugLogger) WithFields(fields map[string]any) LoggerInterface {
+	return quietDebugLogger{l.LoggerInterface.WithFields(fields)}
 }
 
 func NewLogger(minLevel int) *Logger {
+	return NewLoggerWithOptions(minLevel, LoggerOptions{})
+}
+
+func NewLoggerWithOptions(level int, options LoggerOptions) *Logger {
+	minLevel := new(atomic.Int32)
+	minLevel.Store(int32(level))
+
+	if options.Format == LogFormatJSON {
+		return &Logger{
+			debugLogger:   log.New(os.Stdout, "", 0),
+			infoLogger:    log.New(os.Stdout, "", 0),
+			warningLogger: log.New(os.Stdout, "", 0),
+			errorLogger:   log.New(os.Stderr, "", 0),
+			minLevel:      minLevel,
+			format:        LogFormatJSON,
+			timeFormat:    options.TimeFormat,
+			utc:           options.UTC,
+			splitAddrs:    options.SplitAddrs,
+		}
+	}
+
+	// The standard timestamp is rendered by the log package; custom formats by output.
+	flags := 0
+	if options.TimeFormat == "" {
+		flags = log.Ldate | log.Ltime
+		if options.UTC {
+			flags |= log.LUTC
+		}
+	}
+
 	return &Logger{
-		debugLogger:   log.New(os.Stdout, "[DEBUG] ", log.Ldate|log.Ltime),
-		infoLogger:    log.New(os.Stdout, "[INFO] ", log.Ldate|log.Ltime),
-		warningLogger: log.New(os.Stdout, "[WARN] ", log.Ldate|log.Ltime),
-		errorLogger:   log.New(os.Stderr, "[ERROR] ", log.Ldate|log.Ltime),
+		debugLogger:   log.New(os.Stdout, "[DEBUG] ", flags),
+		infoLogger:    log.New(os.Stdout, "[INFO] ", flags),
+		warningLogger: log.New(os.Stdout, "[WARN] ", flags),
+		errorLogger:   log.New(os.Stderr, "[ERROR] ", flags),
 		minLevel:      minLevel,
+		format:        LogFormatText,
+		timeFormat:    options.TimeFormat,
+		utc:           options.UTC,
+		splitAddrs:    options.SplitAddrs,
 	}
 }
 
+// SetLevel changes the minimum level logged by l and every logger derived from it.
+// It is safe to call while other goroutines are logging.
+func (l *Logger) SetLevel(level int) {
+	l.minLevel.Store(int32(level))
+}
+
+// Level returns the current minimum level.
+func (l *Logger) Level() int {
+	return int(l.minLevel.Load())
+}
+
+// timestamp formats now according to the configured time format.
+func (l *Logger) timestamp(now time.Time) string {
+	if l.utc {
+		now = now.UTC()
+	}
+
+	switch l.timeFormat {
+	case "", LogTimeFormatRFC3339:
+		return now.Format(time.RFC3339)
+	case LogTimeFormatUnix:
+		return strconv.FormatInt(now.Unix(), 10)
+	default:
+		return now.Format(l.timeFormat)
+	}
+}
+
+// WithFields returns a child logger that attaches fields to every message.
+// Fields are rendered as key=value pairs in text mode and as JSON members in JSON mode.
+func (l *Logger) WithFields(fields map[string]any) LoggerInterface {
+	child := *l
+	child.fields = make(map[string]any, len(l.fields)+len(fields)+1)
+	for k, v := range l.fields {
+		child.fields[k] = v
+	}
+	for k, v := range fields {
+		if addr, ok := v.(*net.UDPAddr); ok {
+			if l.splitAddrs {
+				child.fields[k+"_ip"] = addr.IP.String()
+				child.fields[k+"_port"] = addr.Port
+				continue
+			}
+			v = addr.String()
+		}
+		child.fields[k] = v
+	}
+
+	keys := make([]string, 0, len(child.fields))
+	for k := range child.fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s=%v ", k, child.fields[k])
+	}
+	child.fieldPrefix = b.String()
+
+	return &child
+}
+
 func (l *Logger) Debug(format string, v ...interface{}) {
-	if l.minLevel <= LogLevelDebug {
-		l.debugLogger.Printf(format, v...)
+	if l.Level() <= LogLevelDebug {
+		l.output(l.debugLogger, "debug", format, v...)
 	}
 }
 
 func (l *Logger) Info(format string, v ...interface{}) {
-	if l.minLevel <= LogLevelInfo {
-		l.infoLogger.Printf(format, v...)
+	if l.Level() <= LogLevelInfo {
+		l.output(l.infoLogger, "info", format, v...)
 	}
 }
 
 func (l *Logger) Warning(format string, v ...interface{}) {
-	if l.minLevel <= LogLevelWarning {
-		l.warningLogger.Printf(format, v...)
+	if l.Level() <= LogLevelWarning {
+		l.output(l.warningLogger, "warning", format, v...)
 	}
 }
 
 func (l *Logger) Error(format string, v ...interface{}) {
-	if l.minLevel <= LogLevelError {
-		l.errorLogger.Printf(format, v...)
+	if l.Level() <= LogLevelError {
+		l.output(l.errorLogger, "error", format, v...)
+	}
+}
+
+func (l *Logger) output(logger *log.Logger, level string, format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+
+	if l.format != LogFormatJSON {
+		if l.timeFormat != "" {
+			logger.Print(l.timestamp(time.Now()) + " " + l.fieldPrefix + msg)
+			return
+		}
+		logger.Print(l.fieldPrefix + msg)
+		return
+	}
+
+	entry := make(map[string]any, len(l.fields)+3)
+	for k, v := range l.fields {
+		entry[k] = v
+	}
+	entry["time"] = l.timestamp(time.Now())
+	entry["level"] = level
+	entry["msg"] = msg
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		logger.Printf(`{"level":%q,"msg":%q}`, level, msg)
+		return
+	}
+	logger.Print(string(data))
+}
+
+// LogAtLevel logs through the method of logger matching level.
+func LogAtLevel(logger LoggerInterface, level int, format string, v ...interface{}) {
+	switch level {
+	case LogLevelDebug:
+		logger.Debug(format, v...)
+	case LogLevelInfo:
+		logger.Info(format, v...)
+	case LogLevelWarning:
+		logger.Warning(format, v...)
+	default:
+		logger.Error(format, v...)
 	}
 }
 
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureOutput redirects every level of l to the returned buffer.
+func captureOutput(l *Logger) *bytes.Buffer {
+	var buf bytes.Buffer
+	l.debugLogger.SetOutput(&buf)
+	l.infoLogger.SetOutput(&buf)
+	l.warningLogger.SetOutput(&buf)
+	l.errorLogger.SetOutput(&buf)
+	return &buf
+}
+
+func TestLoggerTimestamp(t *testing.T) {
+	now := time.Date(2025, 3, 4, 5, 6, 7, 0, time.FixedZone("JST", 9*60*60))
+	tests := []struct {
+		name       string
+		timeFormat string
+		utc        bool
+		want       string
+	}{
+		{"default", "", false, "2025-03-04T05:06:07+09:00"},
+		{"rfc3339", LogTimeFormatRFC3339, false, "2025-03-04T05:06:07+09:00"},
+		{"rfc3339 utc", LogTimeFormatRFC3339, true, "2025-03-03T20:06:07Z"},
+		{"unix", LogTimeFormatUnix, false, "1741032367"},
+		{"layout", "2006-01-02 15:04:05.000", true, "2025-03-03 20:06:07.000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewLoggerWithOptions(LogLevelInfo, LoggerOptions{TimeFormat: tt.timeFormat, UTC: tt.utc})
+			if got := l.timestamp(now); got != tt.want {
+				t.Errorf("timestamp = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoggerEmittedTimestamp(t *testing.T) {
+	tests := []struct {
+		name    string
+		options LoggerOptions
+		pattern string
+	}{
+		{"standard", LoggerOptions{}, `^\[INFO\] \d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2} hello\n$`},
+		{"rfc3339 utc", LoggerOptions{TimeFormat: LogTimeFormatRFC3339, UTC: true}, `^\[INFO\] \d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}Z hello\n$`},
+		{"unix", LoggerOptions{TimeFormat: LogTimeFormatUnix}, `^\[INFO\] \d{10} hello\n$`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewLoggerWithOptions(LogLevelInfo, tt.options)
+			buf := captureOutput(l)
+			l.Info("hello")
+			if !regexp.MustCompile(tt.pattern).MatchString(buf.String()) {
+				t.Errorf("emitted %q, want a match for %s", buf.String(), tt.pattern)
+			}
+		})
+	}
+}
+
+func TestLoggerJSONTimestamp(t *testing.T) {
+	l := NewLoggerWithOptions(LogLevelInfo, LoggerOptions{Format: LogFormatJSON, TimeFormat: LogTimeFormatRFC3339, UTC: true})
+	buf := captureOutput(l)
+	l.Info("hello")
+
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("invalid JSON %q: %v", buf.String(), err)
+	}
+	timestamp, _ := entry["time"].(string)
+	if _, err := time.Parse(time.RFC3339, timestamp); err != nil || !strings.HasSuffix(timestamp, "Z") {
+		t.Errorf("time = %q, want an RFC 3339 UTC timestamp", timestamp)
+	}
+}
+
+func TestLoggerSplitAddrs(t *testing.T) {
+	src := &net.UDPAddr{IP: net.ParseIP("198.51.100.7"), Port: 40123}
+
+	l := NewLoggerWithOptions(LogLevelInfo, LoggerOptions{Format: LogFormatJSON, SplitAddrs: true})
+	buf := captureOutput(l)
+	l.WithFields(map[string]any{"src": src}).Info("hello")
+
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("invalid JSON %q: %v", buf.String(), err)
+	}
+	if entry["src_ip"] != "198.51.100.7" || entry["src_port"] != float64(40123) {
+		t.Errorf("src_ip=%v src_port=%v, want 198.51.100.7 and 40123", entry["src_ip"], entry["src_port"])
+	}
+	if _, exists := entry["src"]; exists {
+		t.Errorf("src = %v, want it replaced by src_ip and src_port", entry["src"])
+	}
+
+	// Without the option the address stays one field.
+	l = NewLoggerWithOptions(LogLevelInfo, LoggerOptions{Format: LogFormatJSON})
+	buf = captureOutput(l)
+	l.WithFields(map[string]any{"src": src}).Info("hello")
+	entry = nil
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("invalid JSON %q: %v", buf.String(), err)
+	}
+	if entry["src"] != "198.51.100.7:40123" || entry["src_ip"] != nil {
+		t.Errorf("entry = %v, want a single src field", entry)
+	}
+}
+
+func TestPacketLogSplitsSource(t *testing.T) {
+	l := NewLoggerWithOptions(LogLevelDebug, LoggerOptions{Format: LogFormatJSON, SplitAddrs: true})
+	buf := captureOutput(l)
+	publicKeyA, publicKeyB := testKeys(t)
+	pm := NewPeerManager(&captureSender{}, []PublicKeyPair{{PublicKey1: publicKeyA, PublicKey2: publicKeyB}}, l, time.Minute)
+
+	src := testAddr(t, "[2001:db8::7]:40123")
+	if err := pm.HandlePacket(context.Background(), src, mustBuildInitiation(t, publicKeyB, SenderID{1})); err != nil {
+		t.Fatalf("HandlePacket: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	found := 0
+	for _, line := range lines {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("invalid JSON %q: %v", line, err)
+		}
+		if _, exists := entry["src_ip"]; !exists {
+			continue
+		}
+		found++
+		if entry["src_ip"] != "2001:db8::7" || entry["src_port"] != float64(40123) {
+			t.Errorf("src_ip=%v src_port=%v in %q, want 2001:db8::7 and 40123", entry["src_ip"], entry["src_port"], line)
+		}
+	}
+	if found == 0 {
+		t.Errorf("no packet log line has src_ip and src_port: %q", lines)
+	}
+}
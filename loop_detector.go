@@ -0,0 +1,81 @@
+package main
+
+import (
+	"hash/maphash"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type loopKey struct {
+	destination string
+	hash        uint64
+}
+
+// LoopDetector remembers recently forwarded payloads per destination so that a
+// packet bouncing between misconfigured key pairs (A→B→A) is dropped instead
+// of being amplified.
+type LoopDetector struct {
+	sync.Mutex
+	window    time.Duration
+	seed      maphash.Seed
+	seen      map[loopKey]time.Time
+	lastSweep time.Time
+	sources   *SourceTracker
+}
+
+// sourceKindLoop is the SourceTracker kind of loop detector entries.
+const sourceKindLoop = "loop"
+
+// SetSourceTracker keeps the remembered payloads in a shared, bounded
+// SourceTracker, which evicts the oldest entries when full, instead of a
+// private map that is only swept of expired entries.
+func (d *LoopDetector) SetSourceTracker(sources *SourceTracker) {
+	d.sources = sources
+}
+
+func NewLoopDetector(window time.Duration) *LoopDetector {
+	return &LoopDetector{
+		window: window,
+		seed:   maphash.MakeSeed(),
+		seen:   make(map[loopKey]time.Time),
+	}
+}
+
+// Seen records payload as forwarded to destination and reports whether the same
+// payload was already forwarded there within the window.
+func (d *LoopDetector) Seen(destination *net.UDPAddr, payload []byte, now time.Time) bool {
+	key := loopKey{
+		destination: destination.String(),
+		hash:        maphash.Bytes(d.seed, payload),
+	}
+
+	if d.sources != nil {
+		sourceKey := key.destination + "|" + strconv.FormatUint(key.hash, 16)
+		if value, exists := d.sources.Get(sourceKindLoop, sourceKey); exists && now.Sub(value.(time.Time)) < d.window {
+			return true
+		}
+		d.sources.Put(sourceKindLoop, sourceKey, now)
+		return false
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	if now.Sub(d.lastSweep) >= d.window {
+		for k, seenAt := range d.seen {
+			if now.Sub(seenAt) >= d.window {
+				delete(d.seen, k)
+			}
+		}
+		d.lastSweep = now
+	}
+
+	if seenAt, exists := d.seen[key]; exists && now.Sub(seenAt) < d.window {
+		return true
+	}
+
+	d.seen[key] = now
+	return false
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// loopbackSender delivers every sent packet to another relay as if it arrived
+// from addr, wiring two relays into each other. It gives up after maxHops so a
+// missed loop fails the test instead of recursing forever.
+type loopbackSender struct {
+	relay   *PeerManager
+	addr    *net.UDPAddr
+	hops    *int
+	maxHops int
+}
+
+func (s loopbackSender) SendPacket(to *net.UDPAddr, payload []byte) error {
+	*s.hops++
+	if *s.hops > s.maxHops {
+		return nil
+	}
+	return s.relay.HandlePacket(context.Background(), s.addr, payload)
+}
+
+func TestLoopDetectorBreaksLoopBetweenRelays(t *testing.T) {
+	publicKeyA, publicKeyB := testKeys(t)
+	addr1 := testAddr(t, "192.0.2.1:51820")
+	addr2 := testAddr(t, "192.0.2.2:51820")
+	pairs := []PublicKeyPair{{PublicKey1: publicKeyA, PublicKey2: publicKeyB}}
+
+	// Each relay believes the receiver lives behind the other relay.
+	hops := 0
+	sender1 := &loopbackSender{addr: addr1, hops: &hops, maxHops: 20}
+	sender2 := &loopbackSender{addr: addr2, hops: &hops, maxHops: 20}
+	relay1 := NewPeerManager(sender1, pairs, NewLogger(LogLevelError), time.Minute)
+	relay2 := NewPeerManager(sender2, pairs, NewLogger(LogLevelError), time.Minute)
+	sender1.relay, sender2.relay = relay2, relay1
+	relay1.SetLoopDetector(NewLoopDetector(time.Second))
+	relay2.SetLoopDetector(NewLoopDetector(time.Second))
+
+	receiverID := ReceiverID{1, 2, 3, 4}
+	ctx := context.Background()
+	if err := relay1.AddPeer(ctx, receiverID, addr2, publicKeyA); err != nil {
+		t.Fatalf("AddPeer: %v", err)
+	}
+	if err := relay2.AddPeer(ctx, receiverID, addr1, publicKeyA); err != nil {
+		t.Fatalf("AddPeer: %v", err)
+	}
+
+	packet := make([]byte, 32)
+	packet[0] = MessageTypeTransport
+	copy(packet[4:8], receiverID[:])
+	if err := relay1.HandlePacket(ctx, testAddr(t, "198.51.100.1:51820"), packet); err != nil {
+		t.Fatalf("HandlePacket: %v", err)
+	}
+
+	// relay1 → relay2 → relay1, where relay1 drops the repeat.
+	if hops != 2 {
+		t.Errorf("packet crossed %d hops, want 2", hops)
+	}
+	loops := relay1.Stats().Snapshot().LoopsDetected + relay2.Stats().Snapshot().LoopsDetected
+	if loops != 1 {
+		t.Errorf("LoopsDetected = %d, want 1", loops)
+	}
+}
+
+func TestLoopDetectorWindow(t *testing.T) {
+	detector := NewLoopDetector(time.Second)
+	addr := testAddr(t, "192.0.2.1:51820")
+	now := time.Now()
+
+	if detector.Seen(addr, []byte("payload"), now) {
+		t.Fatal("first packet reported as a loop")
+	}
+	if !detector.Seen(addr, []byte("payload"), now.Add(500*time.Millisecond)) {
+		t.Error("repeat within the window not reported as a loop")
+	}
+	if detector.Seen(testAddr(t, "192.0.2.2:51820"), []byte("payload"), now) {
+		t.Error("same payload to another destination reported as a loop")
+	}
+	if detector.Seen(addr, []byte("payload"), now.Add(2*time.Second)) {
+		t.Error("repeat after the window reported as a loop")
+	}
+}
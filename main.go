@@ -2,15 +2,31 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
-	"strconv"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
+// Process exit codes.
+const (
+	ExitOK           = 0
+	ExitFailure      = 1
+	ExitConfigError  = 2
+	ExitNoUsableKeys = 3
+)
+
+// workerShutdownTimeout bounds how long shutdown waits for the worker pool to
+// handle the jobs still queued.
+const workerShutdownTimeout = 5 * time.Second
+
 func setupSignalHandler(ctx context.Context, cancel context.CancelFunc, logger LoggerInterface) {
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
@@ -27,111 +43,527 @@ func setupSignalHandler(ctx context.Context, cancel context.CancelFunc, logger L
 }
 
 func main() {
-	fmt.Printf("WG Knot v%s\n", Version)
-
+	startedAt := time.Now()
 	config, err := LoadConfig()
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(ExitOK)
+	}
 	if err != nil {
+		fmt.Printf("WG Knot v%s\n", Version)
 		fmt.Printf("Failed to load configuration: %v\n", err)
-		os.Exit(1)
+		os.Exit(ExitConfigError)
+	}
+
+	// The example configuration goes to stdout alone so it can be redirected to a file.
+	if config.GenConfig {
+		if err := WriteExampleConfig(os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write example configuration: %v\n", err)
+			os.Exit(ExitFailure)
+		}
+		os.Exit(ExitOK)
+	}
+
+	fmt.Printf("WG Knot v%s\n", Version)
+
+	if config.CheckOnly {
+		os.Exit(RunConfigCheck(config))
 	}
 
-	logger := NewLogger(GetLogLevel(config.Server.LogLevel))
+	logger := NewLoggerWithOptions(GetLogLevel(config.Server.LogLevel), LoggerOptions{
+		Format:     config.Server.LogFormat,
+		TimeFormat: config.Server.LogTimeFormat,
+		UTC:        config.Server.LogUTC,
+		SplitAddrs: config.Server.LogSplitSource,
+	})
+
+	for _, derived := range config.Derived {
+		logger.Info("Derived default: %s", derived)
+	}
+	for _, warning := range config.Warnings {
+		logger.Warning("%s", warning)
+	}
+
+	// The active protocol is read without locking, so it is set before
+	// anything that handles packets or starts a goroutine.
+	wireProtocol, err := LoadProtocolFromConfig(config.Protocol)
+	if err != nil {
+		logger.Error("Invalid protocol configuration: %v", err)
+		os.Exit(ExitConfigError)
+	}
+	if err := SetProtocol(wireProtocol); err != nil {
+		logger.Error("Failed to set protocol: %v", err)
+		os.Exit(ExitConfigError)
+	}
+	if !wireProtocol.IsDefault() {
+		logger.Warning("Using a WireGuard protocol variant: mac1 label %q, type bytes %d/%d/%d/%d",
+			wireProtocol.LabelMAC1, wireProtocol.TypeInitiation, wireProtocol.TypeResponse, wireProtocol.TypeCookieReply, wireProtocol.TypeTransport)
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	if config.Metrics.Prometheus && config.Server.HealthListen == "" {
+		logger.Error("metrics.prometheus needs server.health_listen to serve /metrics")
+		os.Exit(ExitConfigError)
+	}
+
+	var metricsSinks MultiMetricsSink
+	var prometheusSink *PrometheusSink
+	if config.Metrics.Prometheus {
+		prometheusSink = NewPrometheusSink()
+		metricsSinks = append(metricsSinks, prometheusSink)
+	}
+	if config.Metrics.StatsDAddress != "" {
+		statsdSink, err := NewStatsDSink(config.Metrics.StatsDAddress, config.Metrics.StatsDPrefix)
+		if err != nil {
+			logger.Error("Failed to set up StatsD: %v", err)
+			os.Exit(ExitConfigError)
+		}
+		defer statsdSink.Close()
+		metricsSinks = append(metricsSinks, statsdSink)
+		logger.Info("Pushing metrics to StatsD at %s every %v", config.Metrics.StatsDAddress, config.Metrics.Interval)
+	}
+
+	health := NewHealth()
+	var healthServer *http.Server
+	if config.Server.HealthListen != "" {
+		var metricsHandler http.Handler
+		if prometheusSink != nil {
+			metricsHandler = prometheusSink
+		}
+		healthServer, err = StartHealthServer(config.Server.HealthListen, health, metricsHandler, logger)
+		if err != nil {
+			logger.Error("Failed to start health server: %v", err)
+			os.Exit(ExitFailure)
+		}
+		defer healthServer.Close()
+		logger.Info("Health endpoints listening on %s", config.Server.HealthListen)
+	}
+
 	publicKeyPairList, err := LoadPublicKeyPairsFromConfig(config.KeyPairs)
 	if err != nil {
+		if config.Server.StrictKeys {
+			logger.Error("Invalid public keys with strict_keys enabled: %v", err)
+			os.Exit(ExitConfigError)
+		}
 		logger.Warning("Some public keys are invalid: %v", err)
 	}
 
 	if len(publicKeyPairList) == 0 {
 		logger.Error("No valid public key pairs configured")
-		os.Exit(1)
+		os.Exit(ExitNoUsableKeys)
 	}
 
-	addr, err := net.ResolveUDPAddr("udp",
-		net.JoinHostPort(config.Server.ListenAddress,
-			strconv.Itoa(config.Server.Port)))
+	upstreams, err := LoadUpstreamsFromConfig(config.Server.Upstreams)
 	if err != nil {
-		logger.Error("Failed to resolve address: %v", err)
-		os.Exit(1)
+		logger.Error("Invalid upstreams: %v", err)
+		os.Exit(ExitConfigError)
 	}
 
-	conn, err := net.ListenUDP("udp", addr)
+	dumpFilter, err := ParseDumpFilter(config.Server.DebugDumpFilter)
 	if err != nil {
-		logger.Error("Failed to start UDP listener: %v", err)
-		os.Exit(1)
+		logger.Error("Invalid debug_dump_filter: %v", err)
+		os.Exit(ExitConfigError)
 	}
-	defer conn.Close()
 
-	err = conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+	sourceFilter, err := ParseSourceFilter(config.Server.AllowCIDRs, config.Server.DenyCIDRs)
 	if err != nil {
-		logger.Error("Failed to set read deadline: %v", err)
-		os.Exit(1)
+		logger.Error("Invalid CIDR list: %v", err)
+		os.Exit(ExitConfigError)
 	}
 
-	packetSender := NewUDPPacketSender(conn, logger)
-	pm := NewPeerManager(packetSender, publicKeyPairList, logger, config.Server.PeerExpiration)
+	forwardOverrides, err := LoadForwardOverridesFromConfig(config.ForwardOverrides)
+	if err != nil {
+		logger.Error("Invalid forward override: %v", err)
+		os.Exit(ExitConfigError)
+	}
 
-	go func() {
-		ticker := time.NewTicker(10 * time.Second)
-		defer ticker.Stop()
-		for range ticker.C {
-			if err := pm.CleanupPeers(); err != nil {
-				logger.Error("Failed to cleanup peers: %v", err)
+	listeners, err := LoadListenersFromConfig(config.Server, config.Listeners)
+	if err != nil {
+		logger.Error("Invalid listeners: %v", err)
+		os.Exit(ExitConfigError)
+	}
+
+	if err := ValidateTransport(config.Server.Transport); err != nil {
+		logger.Error("Invalid transport: %v", err)
+		os.Exit(ExitConfigError)
+	}
+
+	// A socket passed by systemd replaces the first listener's.
+	systemdConn, activated, err := SystemdListenUDPConn()
+	if err != nil {
+		logger.Error("Failed to use systemd socket: %v", err)
+		os.Exit(ExitFailure)
+	}
+
+	conns := make([]Transport, len(listeners))
+	for i, listener := range listeners {
+		var conn Transport
+		if i == 0 && activated {
+			conn = systemdConn
+			logger.Info("Using socket passed by systemd: %s", conn.LocalAddr())
+		} else {
+			conn, err = ListenTransport(config.Server.Transport, listener.Addr)
+			if err != nil {
+				logger.Error("Failed to start %s listener on %s: %v", config.Server.Transport, listener.Addr, err)
+				os.Exit(ExitFailure)
 			}
 		}
-	}()
+		defer conn.Close()
+		conns[i] = conn
 
-	bufferPool := NewBufferPool(config.BufferPool.PoolSize, config.BufferPool.BufferSize)
-	logger.Info("Buffer pool created: size=%d, buffer size=%d bytes",
-		config.BufferPool.PoolSize, config.BufferPool.BufferSize)
+		if config.Server.BindDevice != "" {
+			udpConn, ok := conn.(*net.UDPConn)
+			if !ok {
+				logger.Error("bind_device is only supported with the udp transport")
+				os.Exit(ExitConfigError)
+			}
+			if err := BindToDevice(udpConn, config.Server.BindDevice); err != nil {
+				logger.Error("Failed to bind to device: %v", err)
+				os.Exit(ExitFailure)
+			}
+			logger.Info("Socket %s bound to device %s", listener.Addr, config.Server.BindDevice)
+		}
 
-	workerPool := NewWorkerPool(config.WorkerPool.MaxWorkers, pm.HandlePacket, logger)
-	workerPool.Start(ctx)
-	logger.Info("Worker pool created: max workers=%d", config.WorkerPool.MaxWorkers)
+		err = conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+		if err != nil {
+			logger.Error("Failed to set read deadline: %v", err)
+			os.Exit(ExitFailure)
+		}
+	}
 
-	setupSignalHandler(ctx, cancel, logger)
+	if config.Server.ForwardTTL != 0 {
+		if err := ValidateForwardTTL(config.Server.ForwardTTL); err != nil {
+			logger.Error("Invalid forward_ttl: %v", err)
+			os.Exit(ExitConfigError)
+		}
+		udpConn, ok := conns[0].(*net.UDPConn)
+		if !ok {
+			logger.Error("forward_ttl is only supported with the udp transport")
+			os.Exit(ExitConfigError)
+		}
+		if err := SetForwardTTL(udpConn, config.Server.ForwardTTL); err != nil {
+			logger.Error("Failed to set forward_ttl: %v", err)
+			os.Exit(ExitFailure)
+		}
+		logger.Info("Forwarded packets leave with TTL %d", config.Server.ForwardTTL)
+	}
+
+	// Replies leave from the first listener, whichever listener the packet
+	// they answer arrived on.
+	udpPacketSender := NewUDPPacketSender(conns[0], logger)
+	udpPacketSender.SetDumpFilter(dumpFilter)
+	var packetSender PacketSender = udpPacketSender
+	if config.Server.ReceiveOnly {
+		packetSender = NullPacketSender{}
+	}
+	var store PeerStore = NewMemoryStore()
+	if config.Server.PeerStoreShards > 0 {
+		store = NewShardedStore(config.Server.PeerStoreShards)
+		logger.Info("Using sharded peer store: shards=%d", config.Server.PeerStoreShards)
+	}
+	pm := NewPeerManagerWithStore(store, packetSender, publicKeyPairList, logger, config.Server.PeerExpiration)
+	pm.SetPassUnknown(config.Server.PassUnknown)
+	pm.SetReceiverExpiration(config.Server.ReceiverExpiration)
+	pm.SetPeerMaxLifetime(config.Server.PeerMaxLifetime)
+	pm.SetForwardingEnabled(config.Server.ForwardingEnabled)
+	if !config.Server.ForwardingEnabled {
+		logger.Warning("Starting in standby: peers are learned but no packets are forwarded")
+	}
+	health.AddCheck("forwarding", func() (string, error) {
+		if pm.ForwardingEnabled() {
+			return "enabled", nil
+		}
+		return "standby", nil
+	})
+	if config.Server.HealthMinPeers > 0 || config.Server.HealthMaxDropRate > 0 {
+		monitor := NewHealthMonitor(pm, HealthThresholds{
+			MinPeers:      config.Server.HealthMinPeers,
+			MinPeersGrace: config.Server.HealthMinPeersGrace,
+			MaxDropRate:   config.Server.HealthMaxDropRate,
+			DropWindow:    config.Server.HealthDropWindow,
+		})
+		monitor.AddChecks(health)
+		go monitor.Run(ctx)
+	}
+	pm.SetStrictReserved(config.Server.StrictReserved)
+	if err := pm.SetSenderIDCollisionPolicy(config.Server.SenderIDCollision); err != nil {
+		logger.Error("Invalid sender_id_collision: %v", err)
+		os.Exit(ExitConfigError)
+	}
+	if err := pm.SetUnverifiedPolicy(config.Server.UnverifiedPolicy); err != nil {
+		logger.Error("Invalid unverified_policy: %v", err)
+		os.Exit(ExitConfigError)
+	}
+	if config.Server.UnverifiedPolicy == UnverifiedPolicyForwardByReceiver {
+		logger.Warning("Forwarding handshake responses that fail mac1 verification by their receiver ID")
+	}
+	pm.SetLearnFromTransport(config.Server.LearnFromTransport)
+	if config.Server.LearnFromTransport {
+		logger.Warning("Learning peer addresses from unauthenticated transport packets")
+	}
+	pm.SetDumpFilter(dumpFilter)
+	pm.SetDebugSampleRate(config.Server.DebugSampleRate)
+	pm.SetFanoutGap(config.Server.FanoutGap)
+	pm.SetSourceFilter(sourceFilter)
+	if config.Server.PendingTimeout > 0 {
+		pm.SetPendingBuffer(NewPendingBuffer(config.Server.PendingTimeout, config.Server.PendingMaxPackets))
+		logger.Info("Holding packets for unknown receivers up to %v", config.Server.PendingTimeout)
+	}
+	if config.Server.UpstreamForwarding && len(upstreams) > 0 {
+		pm.SetUpstreams(upstreams)
+		logger.Warning("Upstream forwarding enabled: packets for unknown receivers are copied to %d relays", len(upstreams))
+	}
+	if forwardOverrides != nil {
+		pm.SetForwardOverrides(forwardOverrides)
+		logger.Info("Forward overrides configured: %d", forwardOverrides.Len())
+	}
+	var sources *SourceTracker
+	if config.Server.MaxTrackedSources > 0 {
+		sources = NewSourceTracker(config.Server.MaxTrackedSources)
+	}
+	if config.Server.ForwardRateLimit > 0 {
+		rateLimiter := NewRateLimiter(config.Server.ForwardRateLimit, config.Server.ForwardRateBurst)
+		if sources != nil {
+			rateLimiter.SetSourceTracker(sources)
+		}
+		pm.SetForwardRateLimiter(rateLimiter)
+		logger.Info("Forward rate limit enabled: %.0f packets/s per destination", config.Server.ForwardRateLimit)
+	}
+	if config.Server.BreakerFailures > 0 {
+		pm.SetCircuitBreaker(NewCircuitBreaker(config.Server.BreakerFailures, config.Server.BreakerCooldown))
+		logger.Info("Circuit breaker enabled: pause a destination for %v after %d send failures", config.Server.BreakerCooldown, config.Server.BreakerFailures)
+	}
+	if config.Server.LoopDetectionWindow > 0 {
+		loopDetector := NewLoopDetector(config.Server.LoopDetectionWindow)
+		if sources != nil {
+			loopDetector.SetSourceTracker(sources)
+		}
+		pm.SetLoopDetector(loopDetector)
+	}
+	if config.Server.MemoryLimitMB > 0 {
+		memoryGuard := NewMemoryGuard(uint64(config.Server.MemoryLimitMB)<<20, logger)
+		pm.SetMemoryGuard(memoryGuard)
+		go memoryGuard.Run(ctx, config.Server.MemoryCheckInterval)
+		logger.Info("Memory guard enabled: shedding load above %d MiB", config.Server.MemoryLimitMB)
+	}
+	if config.Server.TracingEndpoint != "" {
+		tracer := NewOTLPTracer(config.Server.TracingEndpoint, config.Server.TracingServiceName, logger)
+		pm.SetTracer(tracer)
+		go tracer.Run(ctx)
+		logger.Info("Tracing enabled: exporting spans to %s", config.Server.TracingEndpoint)
+	}
+	if config.Server.TapFile != "" || config.Server.TapAddress != "" {
+		local, _ := conns[0].LocalAddr().(*net.UDPAddr)
+		if local == nil {
+			local = listeners[0].Addr
+		}
+		tap, err := NewPacketTap(config.Server.TapFile, config.Server.TapAddress, config.Server.TapSample, local, logger)
+		if err != nil {
+			logger.Error("Failed to start packet tap: %v", err)
+			os.Exit(ExitFailure)
+		}
+		pm.SetPacketTap(tap)
+		go tap.Run(ctx)
+		logger.Info("Packet tap enabled: file=%q collector=%q sampling 1 in %d", config.Server.TapFile, config.Server.TapAddress, max(config.Server.TapSample, 1))
+	}
+	if config.Server.CookieReply {
+		pm.SetCookieChecker(NewCookieChecker(config.Server.CookieReplyThreshold))
+		logger.Info("Cookie replies enabled above %d handshakes/s", config.Server.CookieReplyThreshold)
+	}
 
-	logger.Info("Started listening for UDP packets: %s:%d", config.Server.ListenAddress, config.Server.Port)
+	if config.Server.StateFile != "" {
+		restored, err := pm.LoadPeers(config.Server.StateFile)
+		if err != nil {
+			logger.Warning("Failed to restore peers: %v", err)
+		} else {
+			logger.Info("Restored %d peers from %s", restored, config.Server.StateFile)
+		}
+	}
 
-	for {
-		select {
-		case <-ctx.Done():
-			logger.Info("Shutting down, waiting for worker pool to complete...")
-			workerPool.Shutdown()
-			logger.Info("Shutdown complete")
-			return
-		default:
-			buffer := bufferPool.Get()
+	go runCleanupLoop(ctx, pm, DefaultCleanupInterval, config.Server.CleanupGrace, config.Server.CleanupJitter, logger)
 
-			err = conn.SetReadDeadline(time.Now().Add(1 * time.Second))
-			if err != nil {
-				logger.Error("Failed to set read deadline: %v", err)
-				bufferPool.Put(buffer)
-				continue
-			}
+	unroutableInterval := config.WorkerPool.ErrorLogInterval
+	if unroutableInterval <= 0 {
+		unroutableInterval = DefaultErrorLogInterval
+	}
+	go runUnroutableLog(ctx, pm, unroutableInterval, logger)
 
-			n, remoteAddr, err := conn.ReadFromUDP(buffer)
-			if err != nil {
-				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-					bufferPool.Put(buffer)
-					continue
+	bufferPool := NewBufferPoolWithClasses(config.BufferPool.PoolSize, config.BufferPool.BufferSize, config.BufferPool.SizeClasses)
+	logger.Info("Buffer pool created: size=%d, buffer size=%d bytes, classes=%v",
+		config.BufferPool.PoolSize, config.BufferPool.BufferSize, bufferPool.ClassSizes())
+	if config.BufferPool.Prefill {
+		logger.Info("Buffer pool prefilled with %d buffers", bufferPool.Prefill())
+	}
+	go bufferPool.MonitorMissRate(ctx, 10*time.Second, logger)
+
+	if config.Server.StatsInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(config.Server.StatsInterval)
+			defer ticker.Stop()
+			// Counters are not reset here so that exported metrics keep growing.
+			last := pm.Stats().Snapshot()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					current := pm.Stats().Snapshot()
+					logger.Info("Packet summary (last %v): %s", config.Server.StatsInterval, current.Sub(last))
+					last = current
+					logger.Info("Buffer pool: %s", bufferPool.Stats())
+					logger.Info("Last peer cleanup: %s", pm.LastCleanup())
+					if sources != nil {
+						logger.Info("Tracked sources: %s", sources)
+					}
 				}
-				logger.Error("Packet reading error: %v", err)
-				bufferPool.Put(buffer)
-				continue
 			}
+		}()
+	}
+
+	// Workers outlive ctx so that packets relayed during the shutdown drain
+	// are still handled. At shutdown the pool first works through its queues
+	// and only stops handlers still running after workerShutdownTimeout.
+	if _, err := ParseWorkerAffinity(config.WorkerPool.Affinity); err != nil {
+		logger.Error("Invalid worker_pool.affinity: %v", err)
+		os.Exit(ExitConfigError)
+	}
+	workerPool := NewWorkerPool(config.WorkerPool, pm.HandlePacket, logger)
+	workerPool.SetBufferPool(bufferPool)
+	if config.WorkerPool.QueueFullThreshold > 0 {
+		workerPool.SetOnQueueFull(config.WorkerPool.QueueFullThreshold, config.WorkerPool.QueueFullWindow, func(stats QueueDropStats) {
+			logger.Error("Worker queue dropping packets above %.3f: %s", config.WorkerPool.QueueFullThreshold, stats)
+		})
+	}
+	workerPool.Start(context.WithoutCancel(ctx))
+	logger.Info("Worker pool created: max workers=%d, affinity=%s", config.WorkerPool.MaxWorkers, config.WorkerPool.Affinity)
+
+	state := NewStateReporter(pm, workerPool, bufferPool, config, listeners, startedAt)
+	if healthServer != nil {
+		AddHealthRoute(healthServer, "/state", state)
+	}
+
+	if config.Server.AdminSocket != "" {
+		admin, err := NewAdminServer(config.Server.AdminSocket, logger)
+		if err != nil {
+			logger.Error("Failed to open admin socket: %v", err)
+			os.Exit(ExitFailure)
+		}
+		registerAdminCommands(admin, pm, workerPool, bufferPool, state, logger)
+		go admin.Run(ctx)
+		logger.Info("Admin socket listening on %s", config.Server.AdminSocket)
+	}
+
+	if len(metricsSinks) > 0 {
+		reporter := NewMetricsReporter(metricsSinks)
+		reporter.AddSource(pm.ReportMetrics)
+		reporter.AddSource(workerPool.ReportMetrics)
+		reporter.AddSource(bufferPool.ReportMetrics)
+		reporter.Report()
+		go reporter.Run(ctx, config.Metrics.Interval, logger)
+	}
+
+	setupSignalHandler(ctx, cancel, logger)
+	setupLogLevelSignal(ctx, logger)
+	setupStatsSignal(ctx, func() {
+		logRuntimeStats(logger, pm, workerPool, bufferPool)
+	})
+
+	for _, listener := range listeners {
+		logger.Info("Started listening for UDP packets: %s", listener)
+	}
 
-			packetData := make([]byte, n)
-			copy(packetData, buffer[:n])
+	if _, err := SdNotify("READY=1"); err != nil {
+		logger.Warning("Failed to notify systemd readiness: %v", err)
+	}
+	health.SetState(HealthReady)
+	context.AfterFunc(ctx, func() { health.SetState(HealthDraining) })
 
-			bufferPool.Put(buffer)
+	watchdogInterval, err := SdWatchdogInterval()
+	if err != nil {
+		logger.Warning("Failed to read systemd watchdog settings: %v", err)
+	}
 
-			if !workerPool.Submit(remoteAddr, packetData) {
-				logger.Warning("Worker pool queue is full, packet dropped")
+	if watchdogInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(watchdogInterval / 2)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					if _, err := SdNotify("WATCHDOG=1"); err != nil {
+						logger.Warning("Failed to send systemd watchdog ping: %v", err)
+					}
+				}
 			}
+		}()
+	}
+
+	var globalRateLimiter *RateLimiter
+	if config.Server.GlobalRateLimit > 0 {
+		globalRateLimiter = NewRateLimiter(config.Server.GlobalRateLimit, config.Server.GlobalRateBurst)
+		logger.Info("Global rate limit enabled: %.0f packets/s", config.Server.GlobalRateLimit)
+	}
+	var received atomic.Uint64
+	if config.MaxPackets > 0 {
+		logger.Info("Shutting down after %d packets", config.MaxPackets)
+	}
+	receivers := make([]*Receiver, len(listeners))
+	for i, listener := range listeners {
+		receiver := NewReceiver(conns[i], bufferPool, workerPool, pm.Stats(), logger, listener.ProxyProtocol)
+		receiver.SetSourceFilter(listener.SourceFilter)
+		receiver.SetRateLimiter(globalRateLimiter)
+		receiver.SetMaxPackets(config.MaxPackets, &received)
+		receivers[i] = receiver
+	}
+	if config.RunFor > 0 {
+		time.AfterFunc(config.RunFor, func() {
+			logger.Info("Run time of %v reached", config.RunFor)
+			cancel()
+		})
+	}
+
+	// runReceivers runs fn on every receiver and waits for all of them.
+	runReceivers := func(fn func(receiver *Receiver)) {
+		var wg sync.WaitGroup
+		for _, receiver := range receivers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				fn(receiver)
+			}()
+		}
+		wg.Wait()
+	}
+	runReceivers(func(receiver *Receiver) {
+		receiver.Run(ctx)
+		// Run also returns when the packet limit is reached: stop everything else too.
+		cancel()
+	})
+
+	SdNotify("STOPPING=1")
+	if config.Server.ShutdownDrain > 0 {
+		logger.Info("Draining for %v: relaying existing tunnels, dropping new handshakes", config.Server.ShutdownDrain)
+		runReceivers(func(receiver *Receiver) {
+			receiver.Drain(config.Server.ShutdownDrain)
+		})
+		logger.Info("Drain complete: %d handshake initiations dropped", pm.Stats().Snapshot().DrainRejected)
+	}
+
+	logger.Info("Shutting down, waiting for worker pool to complete...")
+	workerPool.ShutdownTimeout(workerShutdownTimeout)
+	if config.MaxPackets > 0 || config.RunFor > 0 {
+		logRuntimeStats(logger, pm, workerPool, bufferPool)
+	}
+	if config.Server.StateFile != "" {
+		saved, err := pm.SavePeers(config.Server.StateFile)
+		if err != nil {
+			logger.Error("Failed to save peers: %v", err)
+		} else {
+			logger.Info("Saved %d peers to %s", saved, config.Server.StateFile)
 		}
 	}
+	logger.Info("Shutdown complete")
 }
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultMemoryCheckInterval is how often the MemoryGuard reads memory usage.
+const DefaultMemoryCheckInterval = time.Second
+
+// MemoryGuard sheds load while the process uses more memory than a limit, so
+// that a flood slows the relay down instead of getting it OOM-killed. It
+// recovers once usage is back below 90% of the limit.
+type MemoryGuard struct {
+	limit    uint64
+	shedding atomic.Bool
+	logger   LoggerInterface
+}
+
+// NewMemoryGuard sheds load above limit bytes.
+func NewMemoryGuard(limit uint64, logger LoggerInterface) *MemoryGuard {
+	return &MemoryGuard{limit: limit, logger: logger}
+}
+
+// Shedding reports whether load is being shed. A nil guard never sheds.
+func (g *MemoryGuard) Shedding() bool {
+	return g != nil && g.shedding.Load()
+}
+
+// Check compares the memory obtained from the OS and not yet returned to it
+// with the limit.
+func (g *MemoryGuard) Check() {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	used := m.Sys - m.HeapReleased
+
+	switch {
+	case used > g.limit && !g.shedding.Load():
+		g.shedding.Store(true)
+		g.logger.Warning("Memory usage %d MiB is above the limit of %d MiB, dropping handshake initiations and new peers", used>>20, g.limit>>20)
+	case used < g.limit/10*9 && g.shedding.Load():
+		g.shedding.Store(false)
+		g.logger.Info("Memory usage %d MiB is back below the limit of %d MiB, no longer shedding load", used>>20, g.limit>>20)
+	}
+}
+
+// Run checks memory usage every interval until ctx is cancelled.
+func (g *MemoryGuard) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			g.Check()
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMetricsInterval is how often metrics are collected and pushed.
+const DefaultMetricsInterval = 10 * time.Second
+
+// metricsNamespace prefixes every metric name.
+const metricsNamespace = "wg_knot_"
+
+// Labels qualify a metric, e.g. {"type": "initiation"}.
+type Labels map[string]string
+
+// MetricsSink receives the relay's metrics. Components report their current
+// values to it once per collection round, after which Flush is called.
+type MetricsSink interface {
+	// Counter reports the current value of a count that only grows, except
+	// when the relay's statistics are reset.
+	Counter(name string, labels Labels, value uint64)
+	Gauge(name string, labels Labels, value float64)
+	Flush() error
+}
+
+type noopMetricsSink struct{}
+
+func (noopMetricsSink) Counter(name string, labels Labels, value uint64) {}
+func (noopMetricsSink) Gauge(name string, labels Labels, value float64)  {}
+func (noopMetricsSink) Flush() error                                     { return nil }
+
+// MultiMetricsSink reports to every sink it holds.
+type MultiMetricsSink []MetricsSink
+
+func (m MultiMetricsSink) Counter(name string, labels Labels, value uint64) {
+	for _, sink := range m {
+		sink.Counter(name, labels, value)
+	}
+}
+
+func (m MultiMetricsSink) Gauge(name string, labels Labels, value float64) {
+	for _, sink := range m {
+		sink.Gauge(name, labels, value)
+	}
+}
+
+func (m MultiMetricsSink) Flush() error {
+	var errs []error
+	for _, sink := range m {
+		if err := sink.Flush(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// MetricsSource reports a component's metrics to sink.
+type MetricsSource func(sink MetricsSink)
+
+// MetricsReporter collects metrics from its sources into a sink periodically.
+type MetricsReporter struct {
+	sink    MetricsSink
+	sources []MetricsSource
+}
+
+// NewMetricsReporter reports to sink, or nowhere when sink is nil.
+func NewMetricsReporter(sink MetricsSink) *MetricsReporter {
+	if sink == nil {
+		sink = noopMetricsSink{}
+	}
+	return &MetricsReporter{sink: sink}
+}
+
+// AddSource must be called before Run.
+func (r *MetricsReporter) AddSource(source MetricsSource) {
+	r.sources = append(r.sources, source)
+}
+
+// Report runs one collection round.
+func (r *MetricsReporter) Report() error {
+	for _, source := range r.sources {
+		source(r.sink)
+	}
+	return r.sink.Flush()
+}
+
+// Run reports every interval until ctx is cancelled.
+func (r *MetricsReporter) Run(ctx context.Context, interval time.Duration, logger LoggerInterface) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.Report(); err != nil {
+				logger.Warning("Failed to export metrics: %v", err)
+			}
+		}
+	}
+}
+
+// metricKey renders name and labels in Prometheus notation, with labels sorted.
+func metricKey(name string, labels Labels) string {
+	if len(labels) == 0 {
+		return name
+	}
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = fmt.Sprintf("%s=%q", key, labels[key])
+	}
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+type promSample struct {
+	key   string
+	value string
+}
+
+// PrometheusSink serves the most recent collection round in the Prometheus
+// text format. Register it as an http.Handler, e.g. on /metrics.
+type PrometheusSink struct {
+	mu        sync.Mutex
+	pending   map[string][]promSample // metric name -> samples
+	types     map[string]string
+	published []byte
+}
+
+func NewPrometheusSink() *PrometheusSink {
+	return &PrometheusSink{
+		pending: make(map[string][]promSample),
+		types:   make(map[string]string),
+	}
+}
+
+func (p *PrometheusSink) Counter(name string, labels Labels, value uint64) {
+	p.add(metricsNamespace+name, "counter", labels, fmt.Sprint(value))
+}
+
+func (p *PrometheusSink) Gauge(name string, labels Labels, value float64) {
+	p.add(metricsNamespace+name, "gauge", labels, fmt.Sprint(value))
+}
+
+func (p *PrometheusSink) add(name, metricType string, labels Labels, value string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.types[name] = metricType
+	p.pending[name] = append(p.pending[name], promSample{key: metricKey(name, labels), value: value})
+}
+
+func (p *PrometheusSink) Flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	names := make([]string, 0, len(p.pending))
+	for name := range p.pending {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var out strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&out, "# TYPE %s %s\n", name, p.types[name])
+		for _, sample := range p.pending[name] {
+			fmt.Fprintf(&out, "%s %s\n", sample.key, sample.value)
+		}
+	}
+
+	p.published = []byte(out.String())
+	p.pending = make(map[string][]promSample)
+	return nil
+}
+
+func (p *PrometheusSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	published := p.published
+	p.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(published)
+}
+
+// statsdMaxPacket keeps StatsD datagrams below a typical path MTU.
+const statsdMaxPacket = 1432
+
+// StatsDSink pushes metrics to a StatsD server over UDP, with labels as
+// DogStatsD tags. Counters are sent as the increase since the previous round.
+type StatsDSink struct {
+	mu     sync.Mutex
+	conn   net.Conn
+	prefix string
+	last   map[string]uint64
+	lines  []string
+}
+
+// NewStatsDSink sends to address, prepending prefix (e.g. "wg_knot.") to every name.
+func NewStatsDSink(address, prefix string) (*StatsDSink, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return &StatsDSink{conn: conn, prefix: prefix, last: make(map[string]uint64)}, nil
+}
+
+func (s *StatsDSink) Counter(name string, labels Labels, value uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := metricKey(name, labels)
+	delta := since(value, s.last[key])
+	s.last[key] = value
+	if delta > 0 {
+		s.lines = append(s.lines, s.line(name, labels, fmt.Sprint(delta), "c"))
+	}
+}
+
+func (s *StatsDSink) Gauge(name string, labels Labels, value float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lines = append(s.lines, s.line(name, labels, fmt.Sprint(value), "g"))
+}
+
+func (s *StatsDSink) line(name string, labels Labels, value, metricType string) string {
+	line := s.prefix + name + ":" + value + "|" + metricType
+	if len(labels) == 0 {
+		return line
+	}
+	tags := make([]string, 0, len(labels))
+	for key, value := range labels {
+		tags = append(tags, key+":"+value)
+	}
+	sort.Strings(tags)
+	return line + "|#" + strings.Join(tags, ",")
+}
+
+// Flush sends the lines of this round, packed into as few datagrams as fit.
+func (s *StatsDSink) Flush() error {
+	s.mu.Lock()
+	lines := s.lines
+	s.lines = nil
+	s.mu.Unlock()
+
+	var packet []byte
+	var errs []error
+	send := func() {
+		if len(packet) == 0 {
+			return
+		}
+		if _, err := s.conn.Write(packet); err != nil {
+			errs = append(errs, err)
+		}
+		packet = packet[:0]
+	}
+	for _, line := range lines {
+		if len(packet) > 0 && len(packet)+1+len(line) > statsdMaxPacket {
+			send()
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	send()
+
+	return errors.Join(errs...)
+}
+
+func (s *StatsDSink) Close() error {
+	return s.conn.Close()
+}
+
+// messageTypeNames label per type metrics, indexed by message type - 1.
+var messageTypeNames = [MessageTypeTransport]string{"initiation", "response", "cookie_reply", "transport"}
+
+// ReportMetrics reports the packet counters, key pair counters and peer counts.
+func (pm *PeerManager) ReportMetrics(sink MetricsSink) {
+	snapshot := pm.stats.Snapshot()
+	for i, name := range messageTypeNames {
+		labels := Labels{"type": name}
+		sink.Counter("packets_received_total", labels, snapshot.Received[i])
+		sink.Counter("packets_forwarded_total", labels, snapshot.Forwarded[i])
+		sink.Counter("packets_dropped_total", labels, snapshot.Dropped[i])
+	}
+	for _, counter := range snapshot.Counters() {
+		sink.Counter(counter.Name+"_total", nil, counter.Value)
+	}
+	for name, count := range snapshot.KeyPairs {
+		sink.Counter("keypair_forwarded_total", Labels{"keypair": name}, count)
+	}
+
+	receivers, publicKeyPeers := pm.PeerCounts()
+	sink.Gauge("receivers", nil, float64(receivers))
+	sink.Gauge("public_key_peers", nil, float64(publicKeyPeers))
+
+	forwarding := 0.0
+	if pm.ForwardingEnabled() {
+		forwarding = 1
+	}
+	sink.Gauge("forwarding_enabled", nil, forwarding)
+}
+
+// ReportMetrics reports the queue depth and packet handling latency.
+func (wp *WorkerPool) ReportMetrics(sink MetricsSink) {
+	sink.Gauge("worker_queue_depth", nil, float64(wp.QueueDepth()))
+	sink.Gauge("worker_queue_capacity", nil, float64(wp.QueueCapacity()))
+	sink.Gauge("workers", nil, float64(wp.maxWorkers))
+
+	latency := wp.Latency()
+	sink.Counter("packet_latency_count", nil, latency.Count)
+	sink.Gauge("packet_latency_sum_seconds", nil, latency.Sum.Seconds())
+	for _, q := range []float64{0.5, 0.99} {
+		value := latency.Quantile(q)
+		if value < 0 {
+			// Beyond the largest bucket: report that bound as a lower limit.
+			value = latency.Bounds[len(latency.Bounds)-1]
+		}
+		sink.Gauge("packet_latency_seconds", Labels{"quantile": fmt.Sprint(q)}, value.Seconds())
+	}
+}
+
+// ReportMetrics reports the buffer pool counters.
+func (bp *BufferPool) ReportMetrics(sink MetricsSink) {
+	stats := bp.Stats()
+	sink.Counter("buffer_pool_hits_total", nil, stats.Hits)
+	sink.Counter("buffer_pool_misses_total", nil, stats.Misses)
+	sink.Counter("buffer_pool_returned_total", nil, stats.Returned)
+	sink.Counter("buffer_pool_dropped_total", nil, stats.Dropped)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSink records the values of the last collection round by metric key.
+type fakeSink struct {
+	counters map[string]uint64
+	gauges   map[string]float64
+	flushes  int
+}
+
+func newFakeSink() *fakeSink {
+	return &fakeSink{counters: make(map[string]uint64), gauges: make(map[string]float64)}
+}
+
+func (s *fakeSink) Counter(name string, labels Labels, value uint64) {
+	s.counters[metricKey(name, labels)] = value
+}
+
+func (s *fakeSink) Gauge(name string, labels Labels, value float64) {
+	s.gauges[metricKey(name, labels)] = value
+}
+
+func (s *fakeSink) Flush() error {
+	s.flushes++
+	return nil
+}
+
+func TestMetricsReporterFakeSink(t *testing.T) {
+	_, publicKeyB := testKeys(t)
+	pm, _ := newTestPeerManager(t, &captureSender{})
+	bufferPool := NewBufferPool(4, 1500)
+	sink := newFakeSink()
+	reporter := NewMetricsReporter(sink)
+	reporter.AddSource(pm.ReportMetrics)
+	reporter.AddSource(bufferPool.ReportMetrics)
+
+	learnInitiator(t, pm, "192.0.2.1:51820", SenderID{1})
+	pm.HandlePacket(context.Background(), testAddr(t, "192.0.2.2:51820"), mustBuildInitiation(t, publicKeyB, SenderID{2}))
+	bufferPool.Put(bufferPool.Get())
+
+	if err := reporter.Report(); err != nil {
+		t.Fatalf("Report: %v", err)
+	}
+
+	counters := map[string]uint64{
+		`packets_received_total{type="initiation"}`: 2,
+		`packets_received_total{type="transport"}`:  0,
+		"buffer_pool_misses_total":                  1,
+		"buffer_pool_returned_total":                1,
+	}
+	for key, want := range counters {
+		if got, exists := sink.counters[key]; !exists || got != want {
+			t.Errorf("counter %s = %d (reported %v), want %d", key, got, exists, want)
+		}
+	}
+	gauges := map[string]float64{
+		"receivers":          2,
+		"public_key_peers":   2,
+		"forwarding_enabled": 1,
+	}
+	for key, want := range gauges {
+		if got, exists := sink.gauges[key]; !exists || got != want {
+			t.Errorf("gauge %s = %v (reported %v), want %v", key, got, exists, want)
+		}
+	}
+	if sink.flushes != 1 {
+		t.Errorf("sink flushed %d times, want 1", sink.flushes)
+	}
+}
+
+func TestStatsDSinkSendsCounterDeltas(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	sink, err := NewStatsDSink(server.LocalAddr().String(), "wg_knot.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	receive := func() string {
+		t.Helper()
+		buf := make([]byte, statsdMaxPacket)
+		server.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := server.Read(buf)
+		if err != nil {
+			t.Fatalf("no StatsD datagram received: %v", err)
+		}
+		return string(buf[:n])
+	}
+
+	sink.Counter("packets_received_total", Labels{"type": "initiation"}, 5)
+	sink.Gauge("receivers", nil, 3)
+	if err := sink.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := receive(), "wg_knot.packets_received_total:5|c|#type:initiation\nwg_knot.receivers:3|g"; got != want {
+		t.Errorf("first round = %q, want %q", got, want)
+	}
+
+	// Counters are sent as the increase since the last round, and not at all
+	// when unchanged.
+	sink.Counter("packets_received_total", Labels{"type": "initiation"}, 7)
+	sink.Counter("packets_received_total", Labels{"type": "response"}, 0)
+	sink.Flush()
+	if got, want := receive(), "wg_knot.packets_received_total:2|c|#type:initiation"; got != want {
+		t.Errorf("second round = %q, want %q", got, want)
+	}
+}
+
+func TestPrometheusSinkServesLastRound(t *testing.T) {
+	sink := NewPrometheusSink()
+	sink.Counter("packets_received_total", Labels{"type": "initiation"}, 5)
+	sink.Gauge("receivers", nil, 3)
+	sink.Flush()
+
+	recorder := httptest.NewRecorder()
+	sink.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+	for _, want := range []string{
+		"# TYPE wg_knot_packets_received_total counter\n",
+		`wg_knot_packets_received_total{type="initiation"} 5`,
+		"# TYPE wg_knot_receivers gauge\nwg_knot_receivers 3\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics output %q does not contain %q", body, want)
+		}
+	}
+}
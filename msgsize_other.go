@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isMessageTooLong reports whether a send failed because the datagram exceeds
+// the MTU of the outgoing path (EMSGSIZE).
+func isMessageTooLong(err error) bool {
+	return errors.Is(err, syscall.EMSGSIZE)
+}
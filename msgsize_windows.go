@@ -0,0 +1,17 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// wsaEMSGSIZE is the Winsock error for a datagram larger than the path MTU.
+const wsaEMSGSIZE = syscall.Errno(10040)
+
+// isMessageTooLong reports whether a send failed because the datagram exceeds
+// the MTU of the outgoing path (WSAEMSGSIZE).
+func isMessageTooLong(err error) bool {
+	return errors.Is(err, wsaEMSGSIZE)
+}
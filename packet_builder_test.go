@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/blake2s"
+)
+
+// Handshake message sizes on the wire.
+const (
+	InitiationPacketSize = 148
+	ResponsePacketSize   = 92
+)
+
+// BuildInitiationPacket returns a handshake initiation from senderID to the
+// owner of publicKey, with a valid mac1 for publicKey and a zero mac2. The
+// encrypted fields are zero: the packet satisfies the relay, not WireGuard.
+func BuildInitiationPacket(publicKey PublicKey, senderID SenderID) ([]byte, error) {
+	packet := make([]byte, InitiationPacketSize)
+	packet[0] = protocol.TypeByte(MessageTypeInitiation)
+	copy(packet[4:8], senderID[:])
+	if err := setMac1(packet, publicKey); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+// BuildResponsePacket returns a handshake response from senderID answering
+// receiverID, shaped like BuildInitiationPacket's packets.
+func BuildResponsePacket(publicKey PublicKey, senderID SenderID, receiverID ReceiverID) ([]byte, error) {
+	packet := make([]byte, ResponsePacketSize)
+	packet[0] = protocol.TypeByte(MessageTypeResponse)
+	copy(packet[4:8], senderID[:])
+	copy(packet[8:12], receiverID[:])
+	if err := setMac1(packet, publicKey); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+// setMac1 computes the mac1 field of a handshake packet for publicKey.
+func setMac1(packet []byte, publicKey PublicKey) error {
+	mac1Key, err := CalculateMac1Key(publicKey)
+	if err != nil {
+		return err
+	}
+	mac, err := blake2s.New128(mac1Key[:])
+	if err != nil {
+		return err
+	}
+
+	startMac1Pos := len(packet) - 2*blake2s.Size128
+	mac.Write(packet[:startMac1Pos])
+	copy(packet[startMac1Pos:], mac.Sum(nil))
+	return nil
+}
+
+func TestBuildInitiationPacketRoundTrip(t *testing.T) {
+	pm, _ := newTestPeerManager(t, nil)
+	_, publicKeyB := testKeys(t)
+
+	packet := mustBuildInitiation(t, publicKeyB, SenderID{1, 2, 3, 4})
+	if len(packet) != InitiationPacketSize {
+		t.Fatalf("len = %d, want %d", len(packet), InitiationPacketSize)
+	}
+
+	publicKey, err := pm.CheckMAC1AndGetPublicKey(context.Background(), packet)
+	if err != nil {
+		t.Fatalf("CheckMAC1AndGetPublicKey: %v", err)
+	}
+	if *publicKey != publicKeyB {
+		t.Errorf("verified key = %x, want %x", *publicKey, publicKeyB)
+	}
+}
+
+func TestBuildResponsePacketRoundTrip(t *testing.T) {
+	pm, _ := newTestPeerManager(t, nil)
+	publicKeyA, _ := testKeys(t)
+
+	packet := mustBuildResponse(t, publicKeyA, SenderID{5, 6, 7, 8}, ReceiverID{1, 2, 3, 4})
+	if len(packet) != ResponsePacketSize {
+		t.Fatalf("len = %d, want %d", len(packet), ResponsePacketSize)
+	}
+	if !bytes.Equal(packet[8:12], []byte{1, 2, 3, 4}) {
+		t.Errorf("receiver ID = %x, want 01020304", packet[8:12])
+	}
+
+	publicKey, err := pm.CheckMAC1AndGetPublicKey(context.Background(), packet)
+	if err != nil {
+		t.Fatalf("CheckMAC1AndGetPublicKey: %v", err)
+	}
+	if *publicKey != publicKeyA {
+		t.Errorf("verified key = %x, want %x", *publicKey, publicKeyA)
+	}
+}
+
+func TestCheckMAC1RejectsBuiltPacket(t *testing.T) {
+	pm, _ := newTestPeerManager(t, nil)
+	_, publicKeyB := testKeys(t)
+
+	tests := []struct {
+		name   string
+		packet func() []byte
+	}{
+		{"unconfigured key", func() []byte {
+			return mustBuildInitiation(t, PublicKey{1}, SenderID{1, 2, 3, 4})
+		}},
+		{"tampered sender ID", func() []byte {
+			packet := mustBuildInitiation(t, publicKeyB, SenderID{1, 2, 3, 4})
+			packet[4] ^= 0xff
+			return packet
+		}},
+		{"tampered mac1", func() []byte {
+			packet := mustBuildInitiation(t, publicKeyB, SenderID{1, 2, 3, 4})
+			packet[InitiationPacketSize-2*blake2s.Size128] ^= 0xff
+			return packet
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := pm.CheckMAC1AndGetPublicKey(context.Background(), tt.packet())
+			if !errors.Is(err, ErrAuthenticationFailed) {
+				t.Errorf("err = %v, want ErrAuthenticationFailed", err)
+			}
+		})
+	}
+}
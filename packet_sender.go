@@ -2,6 +2,8 @@ package main
 
 import (
 	"encoding/hex"
+	"fmt"
+	"io"
 	"net"
 )
 
@@ -9,20 +11,41 @@ type PacketSender interface {
 	SendPacket(to *net.UDPAddr, payload []byte) error
 }
 
+// NullPacketSender discards every packet. PeerManager uses it when no sender
+// is configured, which turns the relay into a receive-only diagnostic tool.
+type NullPacketSender struct{}
+
+func (NullPacketSender) SendPacket(to *net.UDPAddr, payload []byte) error {
+	return nil
+}
+
 type UDPPacketSender struct {
-	conn   *net.UDPConn
-	logger LoggerInterface
+	conn       UDPConn
+	logger     LoggerInterface
+	dumpFilter *DumpFilter
 }
 
-func NewUDPPacketSender(conn *net.UDPConn, logger LoggerInterface) *UDPPacketSender {
+func NewUDPPacketSender(conn UDPConn, logger LoggerInterface) *UDPPacketSender {
 	return &UDPPacketSender{conn: conn, logger: logger}
 }
 
+// SetDumpFilter selects the sent packets that are hex dumped at debug level.
+func (s *UDPPacketSender) SetDumpFilter(dumpFilter *DumpFilter) {
+	s.dumpFilter = dumpFilter
+}
+
 func (s *UDPPacketSender) SendPacket(to *net.UDPAddr, payload []byte) error {
-	_, err := s.conn.WriteToUDP(payload, to)
+	n, err := s.conn.WriteToUDP(payload, to)
+	// A truncated WireGuard message is useless to the receiver, so a short
+	// write is a failure even though the datagram went out.
+	if err == nil && n != len(payload) {
+		err = fmt.Errorf("%w: wrote %d of %d bytes", io.ErrShortWrite, n, len(payload))
+	}
 	if err == nil {
 		s.logger.Debug("Packet sent to %s", to.String())
-		s.logger.Debug("Packet: %d byte\n%s", len(payload), hex.Dump(payload))
+		if s.dumpFilter.Match(to, payload) {
+			s.logger.Debug("Packet: %d byte\n%s", len(payload), hex.Dump(payload))
+		}
 	}
 	return err
 }
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestUDPPacketSenderShortWrite(t *testing.T) {
+	conn := &fakeConn{writeN: func(n int) int { return n - 1 }}
+	sender := NewUDPPacketSender(conn, NewLogger(LogLevelError))
+
+	err := sender.SendPacket(testAddr(t, "192.0.2.1:51820"), make([]byte, 148))
+	if !errors.Is(err, io.ErrShortWrite) {
+		t.Fatalf("err = %v, want io.ErrShortWrite", err)
+	}
+	if !strings.Contains(err.Error(), "wrote 147 of 148 bytes") {
+		t.Errorf("error %q does not report the byte counts", err)
+	}
+}
+
+func TestForwardPacketShortWrite(t *testing.T) {
+	conn := &fakeConn{writeN: func(n int) int { return n / 2 }}
+	pm, _ := newTestPeerManager(t, NewUDPPacketSender(conn, NewLogger(LogLevelError)))
+
+	err := pm.ForwardPacket(context.Background(), testAddr(t, "192.0.2.1:51820"), transportPacket(ReceiverID{1}))
+	if !errors.Is(err, ErrPacketSendFailed) {
+		t.Errorf("err = %v, want ErrPacketSendFailed", err)
+	}
+	snapshot := pm.Stats().Snapshot()
+	if snapshot.ShortWrites != 1 {
+		t.Errorf("ShortWrites = %d, want 1", snapshot.ShortWrites)
+	}
+	if forwarded := snapshot.Forwarded[MessageTypeTransport-1]; forwarded != 0 {
+		t.Errorf("short write counted as %d forwarded packets", forwarded)
+	}
+}
@@ -1,13 +1,20 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/hmac"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"maps"
 	"net"
+	"net/netip"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/blake2s"
@@ -15,6 +22,9 @@ import (
 
 const WGLabelMAC1 = "mac1----"
 
+// mac1ScanCheckInterval is how many keys are tried between context checks in the mac1 scan.
+const mac1ScanCheckInterval = 64
+
 const (
 	MessageTypeInitiation  = 1
 	MessageTypeResponse    = 2
@@ -27,41 +37,157 @@ type Mac1Key [32]byte
 type SenderID [4]byte
 type ReceiverID [4]byte
 
+// Peer is a learned peer endpoint. Peers held by a PeerManager are guarded by
+// its lock; code running outside the lock must only work on a Clone.
 type Peer struct {
 	Addr      *net.UDPAddr
 	Timestamp time.Time
+	// FirstSeen is when the relay learned the peer; unlike Timestamp it is
+	// never refreshed, so it bounds the entry's total lifetime.
+	FirstSeen time.Time
+	KeyPair   string
+	// Expiration overrides the PeerManager's peer expiration when non-zero.
+	Expiration time.Duration
+	// PublicKey is the peer's own static public key, zero when unknown.
+	PublicKey PublicKey
+	// Unverified marks receiver entries learned from responses that failed
+	// mac1 verification. They are never persisted.
+	Unverified bool
+}
+
+// Clone returns a deep copy of the peer, including its address.
+func (p *Peer) Clone() *Peer {
+	clone := *p
+	if p.Addr != nil {
+		addr := *p.Addr
+		addr.IP = append(net.IP(nil), p.Addr.IP...)
+		clone.Addr = &addr
+	}
+	return &clone
 }
 
 type PublicKeyPair struct {
+	Name       string
 	PublicKey1 PublicKey
 	PublicKey2 PublicKey
+	// Expiration overrides the server peer expiration for peers of this pair when non-zero.
+	Expiration time.Duration
+	// SenderIDs limits the sender IDs of initiations for this pair; nil allows all.
+	SenderIDs *SenderIDSet
+	// Persistent exempts the pair's peers learned by public key from expiration.
+	Persistent bool
 }
 
 type PeerManager struct {
-	sync.Mutex
-	packetSender                 PacketSender
-	ReceiverToPeerMap            map[ReceiverID]*Peer
-	PublicKeyToPeersMap          map[PublicKey][]*Peer
-	PublicKeyToMac1KeyMap        map[PublicKey]Mac1Key
-	PublicKeyToPairPublicKeysMap map[PublicKey][]PublicKey
-	logger                       LoggerInterface
-	peerExpiration               time.Duration
+	sync.RWMutex
+	packetSender       PacketSender
+	receiveOnly        bool
+	store              PeerStore
+	logger             LoggerInterface
+	peerExpiration     time.Duration
+	receiverExpiration time.Duration
+	peerMaxLifetime    time.Duration
+	stats              PacketStats
+	passUnknown        bool
+	keyPairNames       map[PublicKey]string
+	keyPairExpirations map[PublicKey]time.Duration
+	keyPairSenderIDs   map[PublicKey]*SenderIDSet
+	persistentKeys     map[PublicKey]bool
+	cookieChecker      *CookieChecker
+	clock              Clock
+
+	forwardRateLimiter *RateLimiter
+	rateLimitLog       *LogThrottle
+	loopDetector       *LoopDetector
+	loopLog            *LogThrottle
+	mtuLog             *LogThrottle
+	multiPairLog       *LogThrottle
+
+	peerLearned      PeerLearnedFunc
+	tracer           Tracer
+	forwardOverrides *ForwardOverrides
+	dumpFilter       *DumpFilter
+	strictReserved   bool
+	lastCleanup      CleanupStats
+	upstreams        []*net.UDPAddr
+	upstreamSeen     *LoopDetector
+
+	replaceCollidingSenders bool
+	pending                 *PendingBuffer
+	unroutable              unroutableCounter
+	tap                     *PacketTap
+	standby                 atomic.Bool
+	sourceFilter            atomic.Pointer[SourceFilter]
+	debugSampleRate         uint64
+	debugSampleSeen         atomic.Uint64
+	memoryGuard             *MemoryGuard
+	fanoutGap               time.Duration
+	breaker                 *CircuitBreaker
+	forwardUnverified       bool
+	sessions                *sessionLinks
 }
 
+// PeerLearnedFunc is called when a packet teaches the relay a new peer.
+// publicKey is the key the packet's mac1 was verified against.
+type PeerLearnedFunc func(publicKey PublicKey, senderID SenderID, addr *net.UDPAddr)
+
 func NewPeerManager(packetSender PacketSender, publicKeyPairList []PublicKeyPair, logger LoggerInterface, peerExpiration time.Duration) *PeerManager {
+	return NewPeerManagerWithStore(NewMemoryStore(), packetSender, publicKeyPairList, logger, peerExpiration)
+}
+
+func NewPeerManagerWithStore(store PeerStore, packetSender PacketSender, publicKeyPairList []PublicKeyPair, logger LoggerInterface, peerExpiration time.Duration) *PeerManager {
+	receiveOnly := false
+	if packetSender == nil {
+		packetSender = NullPacketSender{}
+	}
+	if _, ok := packetSender.(NullPacketSender); ok {
+		logger.Warning("No packet sender configured, forwarding is disabled")
+		receiveOnly = true
+	}
+
 	pm := &PeerManager{
-		packetSender:                 packetSender,
-		PublicKeyToPairPublicKeysMap: make(map[PublicKey][]PublicKey),
-		PublicKeyToMac1KeyMap:        make(map[PublicKey]Mac1Key),
-		PublicKeyToPeersMap:          make(map[PublicKey][]*Peer),
-		ReceiverToPeerMap:            make(map[ReceiverID]*Peer),
-		logger:                       logger,
-		peerExpiration:               peerExpiration,
+		packetSender:       packetSender,
+		receiveOnly:        receiveOnly,
+		store:              store,
+		logger:             logger,
+		peerExpiration:     peerExpiration,
+		keyPairNames:       make(map[PublicKey]string),
+		keyPairExpirations: make(map[PublicKey]time.Duration),
+		keyPairSenderIDs:   make(map[PublicKey]*SenderIDSet),
+		persistentKeys:     make(map[PublicKey]bool),
+		clock:              realClock{},
+		rateLimitLog:       NewLogThrottle(10 * time.Second),
+		loopLog:            NewLogThrottle(10 * time.Second),
+		mtuLog:             NewLogThrottle(10 * time.Second),
+		multiPairLog:       NewLogThrottle(10 * time.Second),
+		debugSampleRate:    1,
+		tracer:             noopTracer{},
 	}
 
 	for _, publicKeyPair := range publicKeyPairList {
 		if _, err := pm.AddPublicKeyPair(context.Background(), publicKeyPair.PublicKey1, publicKeyPair.PublicKey2); err != nil {
 			pm.logger.Error("Failed to add public key pair: %v", err)
+			continue
+		}
+
+		if publicKeyPair.Name != "" {
+			pm.keyPairNames[publicKeyPair.PublicKey1] = publicKeyPair.Name
+			pm.keyPairNames[publicKeyPair.PublicKey2] = publicKeyPair.Name
+		}
+
+		if publicKeyPair.Expiration > 0 {
+			pm.keyPairExpirations[publicKeyPair.PublicKey1] = publicKeyPair.Expiration
+			pm.keyPairExpirations[publicKeyPair.PublicKey2] = publicKeyPair.Expiration
+		}
+
+		if publicKeyPair.Persistent {
+			pm.persistentKeys[publicKeyPair.PublicKey1] = true
+			pm.persistentKeys[publicKeyPair.PublicKey2] = true
+		}
+
+		if publicKeyPair.SenderIDs != nil {
+			pm.keyPairSenderIDs[publicKeyPair.PublicKey1] = publicKeyPair.SenderIDs
+			pm.keyPairSenderIDs[publicKeyPair.PublicKey2] = publicKeyPair.SenderIDs
 		}
 	}
 
@@ -86,20 +212,298 @@ func (pm *PeerManager) AddPublicKeyPair(ctx context.Context, publicKey1, publicK
 		return false, err
 	}
 
-	pm.PublicKeyToMac1KeyMap[publicKey1] = mac1Key1
-	pm.PublicKeyToMac1KeyMap[publicKey2] = mac1Key2
+	pm.store.SetMac1Key(publicKey1, mac1Key1)
+	pm.store.SetMac1Key(publicKey2, mac1Key2)
+
+	pm.store.AddPairPublicKey(publicKey1, publicKey2)
+	pm.store.AddPairPublicKey(publicKey2, publicKey1)
+
+	return true, nil
+}
+
+// ListKeyPairs returns a snapshot of the configured key pairs. Each pair is
+// reported once with its lower key first, and pairs are sorted by key.
+func (pm *PeerManager) ListKeyPairs() [][2]PublicKey {
+	pm.RLock()
+	defer pm.RUnlock()
+
+	seen := make(map[[2]PublicKey]bool)
+	var keyPairs [][2]PublicKey
+	pm.store.RangePairPublicKeys(func(publicKey PublicKey, pairPublicKeys []PublicKey) bool {
+		for _, pairPublicKey := range pairPublicKeys {
+			keyPair := [2]PublicKey{publicKey, pairPublicKey}
+			if bytes.Compare(publicKey[:], pairPublicKey[:]) > 0 {
+				keyPair = [2]PublicKey{pairPublicKey, publicKey}
+			}
+			if !seen[keyPair] {
+				seen[keyPair] = true
+				keyPairs = append(keyPairs, keyPair)
+			}
+		}
+		return true
+	})
+
+	sort.Slice(keyPairs, func(i, j int) bool {
+		if c := bytes.Compare(keyPairs[i][0][:], keyPairs[j][0][:]); c != 0 {
+			return c < 0
+		}
+		return bytes.Compare(keyPairs[i][1][:], keyPairs[j][1][:]) < 0
+	})
+
+	return keyPairs
+}
+
+// SetPassUnknown controls whether packets with a type byte outside 1-4 are
+// forwarded by the receiver ID in bytes 4-8 instead of being dropped.
+func (pm *PeerManager) SetPassUnknown(passUnknown bool) {
+	pm.passUnknown = passUnknown
+}
 
-	isEqual := func(a, b PublicKey) bool {
-		return a == b
+// SetClock replaces the clock used for peer timestamps and expiration.
+func (pm *PeerManager) SetClock(clock Clock) {
+	pm.clock = clock
+}
+
+// SetCircuitBreaker pauses forwarding to destinations that keep failing.
+// A nil breaker always sends.
+func (pm *PeerManager) SetCircuitBreaker(breaker *CircuitBreaker) {
+	pm.breaker = breaker
+}
+
+// SetForwardRateLimiter limits how fast packets are sent to each destination.
+// A nil limiter disables the limit.
+func (pm *PeerManager) SetForwardRateLimiter(rateLimiter *RateLimiter) {
+	pm.forwardRateLimiter = rateLimiter
+}
+
+// SetPeerLearnedHook registers fn to be called, outside the PeerManager lock,
+// whenever a new sender ID is learned. Refreshes of known peers do not call it.
+func (pm *PeerManager) SetPeerLearnedHook(fn PeerLearnedFunc) {
+	pm.peerLearned = fn
+}
+
+// notifyPeerLearned calls the peer learned hook, if any. It must not be called
+// with the PeerManager lock held.
+func (pm *PeerManager) notifyPeerLearned(publicKey PublicKey, senderID SenderID, addr *net.UDPAddr) {
+	if pm.peerLearned != nil {
+		pm.peerLearned(publicKey, senderID, addr)
 	}
+}
 
-	AppendUniqueValue(pm.PublicKeyToPairPublicKeysMap, publicKey1, publicKey2, isEqual)
-	AppendUniqueValue(pm.PublicKeyToPairPublicKeysMap, publicKey2, publicKey1, isEqual)
+// SetForwardOverrides sets static addresses used instead of learned ones when
+// forwarding to specific peers. A nil value disables overrides.
+func (pm *PeerManager) SetForwardOverrides(overrides *ForwardOverrides) {
+	pm.forwardOverrides = overrides
+}
 
-	return true, nil
+// forwardAddress returns the address to forward to for peer, applying any
+// configured override. receiverID is nil when peer was found by public key.
+func (pm *PeerManager) forwardAddress(peer *Peer, receiverID *ReceiverID) *net.UDPAddr {
+	if pm.forwardOverrides != nil {
+		if addr, exists := pm.forwardOverrides.Lookup(receiverID, peer.PublicKey); exists {
+			return addr
+		}
+	}
+	return peer.Addr
+}
+
+// SetStrictReserved controls whether handshake and cookie messages with
+// non-zero reserved header bytes are dropped. They are counted either way.
+func (pm *PeerManager) SetStrictReserved(strictReserved bool) {
+	pm.strictReserved = strictReserved
+}
+
+// SetPendingBuffer makes Type3/4 packets for receiver IDs that are not known
+// yet wait in pending until a handshake teaches the relay their receiver,
+// instead of failing with ErrPeerNotFound. A nil buffer disables this.
+func (pm *PeerManager) SetPendingBuffer(pending *PendingBuffer) {
+	pm.pending = pending
+}
+
+// deliverPending forwards the packets held for receiverID once it is learned.
+func (pm *PeerManager) deliverPending(ctx context.Context, receiverID ReceiverID) {
+	if pm.pending == nil {
+		return
+	}
+	for _, payload := range pm.pending.Take(receiverID, pm.clock.Now()) {
+		if err := pm.ForwardPacketToReceiver(ctx, receiverID, payload); err != nil {
+			pm.loggerFrom(ctx).Debug("Failed to deliver pending packet for receiver %x: %v", receiverID, err)
+			continue
+		}
+		pm.stats.IncPendingDelivered()
+	}
+}
+
+// SetReceiverExpiration sets how long receiver ID entries, which route
+// handshake responses, cookie replies and transport data back, are kept
+// without a new handshake. It overrides the peer and key pair expirations for
+// those entries; 0 applies the same expiration as to other peers.
+func (pm *PeerManager) SetReceiverExpiration(expiration time.Duration) {
+	pm.receiverExpiration = expiration
+}
+
+// SetPeerMaxLifetime removes every peer and receiver ID entry this long after
+// it was first learned, however active it is and even for persistent key
+// pairs, so that mappings are re-learned periodically. 0 disables the limit.
+func (pm *PeerManager) SetPeerMaxLifetime(lifetime time.Duration) {
+	pm.peerMaxLifetime = lifetime
+}
+
+// SetForwardingEnabled switches between forwarding and warm standby. In
+// standby packets are still handled and peers learned, but nothing is sent,
+// so that promoting a standby relay does not require new handshakes.
+// It is safe to call while packets are handled.
+func (pm *PeerManager) SetForwardingEnabled(enabled bool) {
+	pm.standby.Store(!enabled)
+}
+
+func (pm *PeerManager) ForwardingEnabled() bool {
+	return !pm.standby.Load()
+}
+
+// SetSourceFilter replaces the filter deciding which sources packets are
+// accepted from. A nil filter accepts every source. It is safe to call while
+// packets are handled.
+func (pm *PeerManager) SetSourceFilter(filter *SourceFilter) {
+	pm.sourceFilter.Store(filter)
+}
+
+func (pm *PeerManager) SourceFilter() *SourceFilter {
+	return pm.sourceFilter.Load()
+}
+
+// SetDebugSampleRate limits the per-packet debug logs to one in every rate
+// packets; 1 logs every packet and 0 none. Other levels are not sampled.
+func (pm *PeerManager) SetDebugSampleRate(rate int) {
+	pm.debugSampleRate = uint64(max(rate, 0))
+}
+
+func (pm *PeerManager) debugSampled() bool {
+	switch pm.debugSampleRate {
+	case 0:
+		return false
+	case 1:
+		return true
+	default:
+		return pm.debugSampleSeen.Add(1)%pm.debugSampleRate == 0
+	}
+}
+
+// SetFanoutGap spaces the copies of a handshake initiation sent to several
+// peers of a key at least gap apart, so large fan-outs do not burst on egress.
+// The worker handling the initiation waits in between; 0 sends them at once.
+func (pm *PeerManager) SetFanoutGap(gap time.Duration) {
+	pm.fanoutGap = gap
+}
+
+// waitFanoutGap waits the fan-out gap before sending the next copy.
+func (pm *PeerManager) waitFanoutGap(ctx context.Context) error {
+	if pm.fanoutGap <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(pm.fanoutGap)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// SetMemoryGuard drops handshake initiations and stops learning new peers
+// while guard is shedding load. Known peers are still relayed.
+func (pm *PeerManager) SetMemoryGuard(guard *MemoryGuard) {
+	pm.memoryGuard = guard
+}
+
+// SetPacketTap mirrors received packets to tap before they are handled.
+func (pm *PeerManager) SetPacketTap(tap *PacketTap) {
+	pm.tap = tap
+}
+
+// SetDumpFilter selects the received packets that are hex dumped at debug level.
+// A nil filter disables dumps.
+func (pm *PeerManager) SetDumpFilter(dumpFilter *DumpFilter) {
+	pm.dumpFilter = dumpFilter
+}
+
+// SetTracer enables tracing spans around packet handling. A nil tracer disables tracing.
+func (pm *PeerManager) SetTracer(tracer Tracer) {
+	if tracer == nil {
+		tracer = noopTracer{}
+	}
+	pm.tracer = tracer
+}
+
+// SetLoopDetector enables dropping payloads re-forwarded to the same destination.
+// A nil detector disables loop detection.
+func (pm *PeerManager) SetLoopDetector(loopDetector *LoopDetector) {
+	pm.loopDetector = loopDetector
+}
+
+// SetCookieChecker enables cookie replies to handshakes received while under load.
+// A nil checker disables them.
+func (pm *PeerManager) SetCookieChecker(cookieChecker *CookieChecker) {
+	pm.cookieChecker = cookieChecker
+}
+
+// KeyPairName returns the configured name of the key pair containing publicKey,
+// or a truncated base64 form of the key when the pair has no name.
+func (pm *PeerManager) KeyPairName(publicKey PublicKey) string {
+	if name, exists := pm.keyPairNames[publicKey]; exists {
+		return name
+	}
+	return base64.StdEncoding.EncodeToString(publicKey[:])[:8]
+}
+
+// Stats returns the packet counters updated by HandlePacket.
+func (pm *PeerManager) Stats() *PacketStats {
+	return &pm.stats
 }
 
 func (pm *PeerManager) HandlePacket(ctx context.Context, addr *net.UDPAddr, payload []byte) error {
+	ctx, span := pm.tracer.Start(ctx, "HandlePacket")
+	defer span.End()
+
+	if pm.tap != nil {
+		pm.tap.Mirror(addr, payload)
+	}
+
+	dropped := new(bool)
+	ctx = context.WithValue(ctx, droppedContextKey{}, dropped)
+	err := pm.handlePacket(ctx, addr, payload)
+
+	if span.IsRecording() {
+		span.SetAttribute("net.peer.addr", addr.String())
+		if len(payload) > 0 {
+			span.SetAttribute("wg.message_type", payload[0])
+		}
+		if err != nil {
+			span.SetAttribute("wg.outcome", "dropped")
+			span.SetError(err)
+		} else {
+			span.SetAttribute("wg.outcome", "handled")
+		}
+	}
+
+	var messageType byte
+	if len(payload) > 0 {
+		messageType = protocol.MessageType(payload[0])
+		pm.stats.IncReceived(messageType)
+		if err != nil || *dropped {
+			pm.stats.IncDropped(messageType)
+		}
+	}
+
+	if errors.Is(err, ErrAuthenticationFailed) {
+		pm.stats.IncAuthFailures()
+	}
+
+	return NewPacketError(addr, messageType, err)
+}
+
+func (pm *PeerManager) handlePacket(ctx context.Context, addr *net.UDPAddr, payload []byte) error {
 	if ctx.Err() != nil {
 		return ctx.Err()
 	}
@@ -108,10 +512,37 @@ func (pm *PeerManager) HandlePacket(ctx context.Context, addr *net.UDPAddr, payl
 		return NewInvalidPacketError("insufficient length")
 	}
 
-	typeByte := payload[0]
+	if !pm.sourceFilter.Load().Allowed(addr) {
+		pm.stats.IncSourceDenied()
+		markDropped(ctx)
+		return nil
+	}
+
+	var logger LoggerInterface = &packetLogger{parent: pm.logger, addr: addr, payload: payload}
+	if !pm.debugSampled() {
+		logger = quietDebugLogger{logger}
+	}
+	ctx = context.WithValue(ctx, loggerContextKey{}, logger)
+	ctx = context.WithValue(ctx, sourceAddrContextKey{}, addr)
+
+	typeByte := protocol.MessageType(payload[0])
+	if typeByte >= MessageTypeInitiation && typeByte <= MessageTypeCookieReply && !reservedBytesZero(payload) {
+		pm.stats.IncReservedNonZero()
+		if pm.strictReserved {
+			return NewInvalidPacketError("non-zero reserved bytes")
+		}
+		pm.loggerFrom(ctx).Debug("Reserved header bytes are not zero: %x", payload[1:4])
+	}
+
 	switch typeByte {
 	case MessageTypeInitiation:
-		pm.logger.Debug("Received Type1 packet: size=%d bytes", len(payload))
+		pm.loggerFrom(ctx).Debug("Received Type1 packet: size=%d bytes", len(payload))
+
+		if pm.memoryGuard.Shedding() {
+			pm.stats.IncMemoryShed()
+			markDropped(ctx)
+			return nil
+		}
 
 		if len(payload) != 148 {
 			return NewInvalidPacketError("invalid Type1 packet length")
@@ -122,10 +553,21 @@ func (pm *PeerManager) HandlePacket(ctx context.Context, addr *net.UDPAddr, payl
 			return err
 		}
 
+		ctx = context.WithValue(ctx, loggerContextKey{}, pm.loggerFrom(ctx).WithFields(map[string]any{"keypair": pm.KeyPairName(*publicKey)}))
+
+		if !pm.keyPairSenderIDs[*publicKey].Contains(SenderID(payload[4:8])) {
+			pm.stats.IncSenderIDRejected()
+			return NewInvalidPacketError("sender ID not allowed for key pair")
+		}
+
+		if pm.needsCookie(ctx, addr, payload) {
+			return pm.SendCookieReply(ctx, addr, *publicKey, payload)
+		}
+
 		return pm.HandleType1Packet(ctx, addr, SenderID(payload[4:8]), *publicKey, payload)
 
 	case MessageTypeResponse:
-		pm.logger.Debug("Received Type2 packet: size=%d bytes", len(payload))
+		pm.loggerFrom(ctx).Debug("Received Type2 packet: size=%d bytes", len(payload))
 
 		if len(payload) != 92 {
 			return NewInvalidPacketError("invalid Type2 packet length")
@@ -133,13 +575,25 @@ func (pm *PeerManager) HandlePacket(ctx context.Context, addr *net.UDPAddr, payl
 
 		publicKey, err := pm.CheckMAC1AndGetPublicKey(ctx, payload)
 		if err != nil {
+			if pm.forwardUnverified && errors.Is(err, ErrAuthenticationFailed) {
+				pm.stats.IncUnverifiedForwarded()
+				pm.loggerFrom(ctx).Debug("mac1 not verified, forwarding by receiver ID")
+				pm.learnUnverifiedSender(ctx, addr, SenderID(payload[4:8]))
+				return pm.ForwardPacketToReceiver(ctx, ReceiverID(payload[8:12]), payload)
+			}
 			return err
 		}
 
+		ctx = context.WithValue(ctx, loggerContextKey{}, pm.loggerFrom(ctx).WithFields(map[string]any{"keypair": pm.KeyPairName(*publicKey)}))
+
+		if pm.needsCookie(ctx, addr, payload) {
+			return pm.SendCookieReply(ctx, addr, *publicKey, payload)
+		}
+
 		return pm.HandleType2Packet(ctx, addr, SenderID(payload[4:8]), ReceiverID(payload[8:12]), *publicKey, payload)
 
 	case MessageTypeCookieReply:
-		pm.logger.Debug("Received Type3 packet: size=%d bytes", len(payload))
+		pm.loggerFrom(ctx).Debug("Received Type3 packet: size=%d bytes", len(payload))
 
 		if len(payload) != 64 {
 			return NewInvalidPacketError("invalid Type3 packet length")
@@ -148,17 +602,96 @@ func (pm *PeerManager) HandlePacket(ctx context.Context, addr *net.UDPAddr, payl
 		return pm.HandleType3And4Packet(ctx, ReceiverID(payload[4:8]), payload)
 
 	case MessageTypeTransport:
-		pm.logger.Debug("Received Type4 packet: size=%d bytes", len(payload))
+		pm.loggerFrom(ctx).Debug("Received Type4 packet: size=%d bytes", len(payload))
 
 		if len(payload) < 32 {
 			return NewInvalidPacketError("invalid Type4 packet length")
 		}
+		pm.learnFromTransport(ctx, addr, ReceiverID(payload[4:8]))
 
 		return pm.HandleType3And4Packet(ctx, ReceiverID(payload[4:8]), payload)
 
 	default:
-		return NewInvalidPacketError("unknown packet type")
+		return pm.HandleUnknownPacket(ctx, payload)
+	}
+}
+
+// reservedBytesZero reports whether the three reserved bytes following the
+// message type are zero, as WireGuard requires. Packets too short to carry
+// them are left to the per-type length checks.
+func reservedBytesZero(payload []byte) bool {
+	return len(payload) < 4 || payload[1] == 0 && payload[2] == 0 && payload[3] == 0
+}
+
+// needsCookie reports whether a handshake must be answered with a cookie reply
+// instead of being relayed: the relay is under load and the sender has not
+// proven possession of a valid cookie through mac2.
+func (pm *PeerManager) needsCookie(ctx context.Context, addr *net.UDPAddr, payload []byte) bool {
+	if pm.cookieChecker == nil {
+		return false
+	}
+
+	now := pm.clock.Now()
+	if !pm.cookieChecker.RecordHandshake(now) {
+		return false
 	}
+
+	valid, err := pm.cookieChecker.CheckMAC2(payload, addr, now)
+	if err != nil {
+		pm.loggerFrom(ctx).Debug("mac2 check failed: %v", err)
+		return true
+	}
+
+	if !valid && HasMAC2(payload) {
+		pm.stats.IncMAC2Failures()
+	}
+
+	return !valid
+}
+
+// SendCookieReply answers a handshake with a Cookie Reply on behalf of the
+// responder identified by publicKey. The handshake itself is not relayed.
+func (pm *PeerManager) SendCookieReply(ctx context.Context, addr *net.UDPAddr, publicKey PublicKey, payload []byte) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if pm.standby.Load() {
+		pm.stats.IncForwardingHeld()
+		markDropped(ctx)
+		return nil
+	}
+
+	reply, err := pm.cookieChecker.CreateCookieReply(payload, addr, publicKey, pm.clock.Now())
+	if err != nil {
+		return err
+	}
+
+	if err := pm.packetSender.SendPacket(addr, reply); err != nil {
+		return pm.sendFailed(addr, reply, err)
+	}
+
+	pm.stats.IncCookieReplies()
+	pm.loggerFrom(ctx).Debug("Under load, sent cookie reply to %s", addr.String())
+	return nil
+}
+
+// HandleUnknownPacket handle a packet with an unknown message type.
+// Such packets are dropped quietly unless pass-unknown mode is enabled.
+func (pm *PeerManager) HandleUnknownPacket(ctx context.Context, payload []byte) error {
+	pm.stats.IncUnknownTypes()
+	pm.loggerFrom(ctx).Debug("Received unknown packet type %d: size=%d bytes", payload[0], len(payload))
+
+	if !pm.passUnknown {
+		markDropped(ctx)
+		return nil
+	}
+
+	if len(payload) < 8 {
+		return NewInvalidPacketError("unknown packet type too short to route")
+	}
+
+	return pm.ForwardPacketToReceiver(ctx, ReceiverID(payload[4:8]), payload)
 }
 
 // HandleType1Packet handle a Handshake Initiation packet
@@ -177,10 +710,16 @@ func (pm *PeerManager) HandleType1Packet(ctx context.Context, addr *net.UDPAddr,
 	}
 
 	if exists {
-		for _, peer := range peers {
-			if err := pm.ForwardPacket(ctx, peer.Addr, payload); err != nil {
+		for i, peer := range peers {
+			if i > 0 {
+				if err := pm.waitFanoutGap(ctx); err != nil {
+					return err
+				}
+			}
+			if err := pm.ForwardPacket(ctx, pm.forwardAddress(peer, nil), payload); err != nil {
 				return err
 			}
+			pm.stats.IncKeyPairForwarded(peer.KeyPair)
 		}
 	}
 
@@ -193,11 +732,14 @@ func (pm *PeerManager) HandleType2Packet(ctx context.Context, addr *net.UDPAddr,
 		return ctx.Err()
 	}
 
-	pm.logger.Debug("Packet\n%s\n", hex.Dump(payload))
+	if pm.dumpFilter.Match(addr, payload) {
+		pm.loggerFrom(ctx).Debug("Packet\n%s\n", hex.Dump(payload))
+	}
 
 	if err := pm.AddPeerBySenderID(ctx, addr, senderID, publicKey); err != nil {
 		return err
 	}
+	pm.linkSession(senderID, receiverID)
 
 	return pm.ForwardPacketToReceiver(ctx, receiverID, payload)
 }
@@ -216,25 +758,52 @@ func (pm *PeerManager) CheckMAC1AndGetPublicKey(ctx context.Context, payload []b
 		return nil, ctx.Err()
 	}
 
-	pm.Lock()
-	defer pm.Unlock()
+	_, span := pm.tracer.Start(ctx, "mac1_scan")
+	defer span.End()
+
+	defer pm.lockForRead()()
 
+	// Checked here as well as by the callers so the slicing below can never go out of range.
 	size := len(payload)
+	if size < 2*blake2s.Size128 {
+		return nil, NewInvalidPacketError("message too short for mac1 and mac2")
+	}
+
 	startMac2Pos := size - blake2s.Size128
 	startMac1Pos := startMac2Pos - blake2s.Size128
 	var mac1 [blake2s.Size128]byte
+	var found *PublicKey
+	var macErr error
+	scanned := 0
+
+	pm.store.RangeMac1Keys(func(publicKey PublicKey, mac1Key Mac1Key) bool {
+		scanned++
+		if scanned%mac1ScanCheckInterval == 0 && ctx.Err() != nil {
+			macErr = ctx.Err()
+			return false
+		}
 
-	for publicKey, mac1Key := range pm.PublicKeyToMac1KeyMap {
 		mac, err := blake2s.New128(mac1Key[:])
 		if err != nil {
-			return nil, err
+			macErr = err
+			return false
 		}
 
 		mac.Write(payload[:startMac1Pos])
 		mac.Sum(mac1[:0])
 		if hmac.Equal(mac1[:], payload[startMac1Pos:startMac2Pos]) {
-			return &publicKey, nil
+			found = &publicKey
+			return false
 		}
+		return true
+	})
+
+	if macErr != nil {
+		return nil, macErr
+	}
+
+	if found != nil {
+		return found, nil
 	}
 
 	return nil, NewAuthenticationFailedError("mac1 verification failed")
@@ -245,34 +814,56 @@ func (pm *PeerManager) AddPeerByPublicKey(ctx context.Context, addr *net.UDPAddr
 		return ctx.Err()
 	}
 
+	learned := false
+	// Registered before the unlock so the hook runs after the lock is released.
+	defer func() {
+		if learned {
+			pm.notifyPeerLearned(receiverPublicKey, senderID, addr)
+			pm.deliverPending(ctx, ReceiverID(senderID))
+		}
+	}()
+
 	pm.Lock()
 	defer pm.Unlock()
 
-	peer, exists := pm.ReceiverToPeerMap[ReceiverID(senderID)]
+	peer, exists := pm.store.GetReceiverPeer(ReceiverID(senderID))
+	if exists {
+		if pairs, ok := pm.store.GetPairPublicKeys(receiverPublicKey); ok && len(pairs) == 1 {
+			exists = !pm.replaceOnCollision(ctx, peer, senderID, pairs[0])
+		}
+	}
 	if !exists {
-		publicKey, exists := pm.PublicKeyToPairPublicKeysMap[receiverPublicKey]
+		publicKey, exists := pm.store.GetPairPublicKeys(receiverPublicKey)
 		if !exists {
 			return NewPeerNotFoundError("paired public key not found")
 		}
-
-		peer = &Peer{Addr: addr, Timestamp: time.Now()}
-		isEqual := func(a, b *Peer) bool {
-			if a == nil || b == nil {
-				return false
-			}
-			return a.Addr.String() == b.Addr.String()
+		if pm.memoryGuard.Shedding() {
+			pm.stats.IncMemoryShed()
+			pm.loggerFrom(ctx).Debug("SenderID: %x, not learned while shedding load", senderID)
+			return nil
 		}
+		learned = true
+
+		now := pm.clock.Now()
+		peer = &Peer{Addr: addr, Timestamp: now, FirstSeen: now, KeyPair: pm.KeyPairName(receiverPublicKey), Expiration: pm.keyPairExpirations[receiverPublicKey]}
 
 		if len(publicKey) == 1 {
-			AppendUniqueValue(pm.PublicKeyToPeersMap, publicKey[0], peer, isEqual)
-			pm.logger.Debug("SenderID: %x, Add peer: %s, PublicKey: %s", senderID, peer.Addr.String(), base64.StdEncoding.EncodeToString(publicKey[0][:]))
+			peer.PublicKey = publicKey[0]
+			pm.store.AddPublicKeyPeer(publicKey[0], peer)
+			pm.loggerFrom(ctx).Debug("SenderID: %x, Add peer: %s, PublicKey: %s", senderID, peer.Addr.String(), base64.StdEncoding.EncodeToString(publicKey[0][:]))
 		} else {
-			pm.logger.Debug(fmt.Sprintf("multiple paired public keys found: %s", base64.StdEncoding.EncodeToString(receiverPublicKey[:])))
+			// The sender could own any of the paired keys, so it is not
+			// learned by public key and initiations addressed to it are not relayed.
+			pm.stats.IncMultiplePairedKeys()
+			if pm.multiPairLog.Allow(pm.clock.Now()) {
+				pm.loggerFrom(ctx).Warning("Public key %s is paired with %d keys, peers sending to it are not learned by public key",
+					base64.StdEncoding.EncodeToString(receiverPublicKey[:]), len(publicKey))
+			}
 		}
 	}
 
-	pm.logger.Debug("SenderID: %x, Update peer: %s", senderID, peer.Addr.String())
-	pm.ReceiverToPeerMap[ReceiverID(senderID)] = peer
+	pm.loggerFrom(ctx).Debug("SenderID: %x, Update peer: %s", senderID, peer.Addr.String())
+	pm.store.SetReceiverPeer(ReceiverID(senderID), peer)
 
 	return nil
 }
@@ -282,29 +873,245 @@ func (pm *PeerManager) AddPeerBySenderID(ctx context.Context, addr *net.UDPAddr,
 		return ctx.Err()
 	}
 
+	learned := false
+	// Registered before the unlock so the hook runs after the lock is released.
+	defer func() {
+		if learned {
+			pm.notifyPeerLearned(publicKey, senderID, addr)
+			pm.deliverPending(ctx, ReceiverID(senderID))
+		}
+	}()
+
 	pm.Lock()
 	defer pm.Unlock()
 
-	peer, exists := pm.ReceiverToPeerMap[ReceiverID(senderID)]
+	// publicKey is the initiator's key the response was sealed for; the
+	// responder owns its pair partner, which is unknown when there are several.
+	var senderPublicKey PublicKey
+	if pairs, ok := pm.store.GetPairPublicKeys(publicKey); ok && len(pairs) == 1 {
+		senderPublicKey = pairs[0]
+	}
+
+	existing, exists := pm.store.GetReceiverPeer(ReceiverID(senderID))
+	if exists {
+		exists = !pm.replaceOnCollision(ctx, existing, senderID, senderPublicKey)
+	}
 	if !exists {
-		peer = &Peer{Addr: addr, Timestamp: time.Now()}
-		pm.logger.Debug("SenderID: %x, Add peer: %s, PublicKey: %s", senderID, peer.Addr.String(), base64.StdEncoding.EncodeToString(publicKey[:]))
-		pm.ReceiverToPeerMap[ReceiverID(senderID)] = peer
+		if pm.memoryGuard.Shedding() {
+			pm.stats.IncMemoryShed()
+			pm.loggerFrom(ctx).Debug("SenderID: %x, not learned while shedding load", senderID)
+			return nil
+		}
+		learned = true
+		now := pm.clock.Now()
+		peer := &Peer{Addr: addr, Timestamp: now, FirstSeen: now, KeyPair: pm.KeyPairName(publicKey), Expiration: pm.keyPairExpirations[publicKey], PublicKey: senderPublicKey}
+		pm.loggerFrom(ctx).Debug("SenderID: %x, Add peer: %s, PublicKey: %s", senderID, peer.Addr.String(), base64.StdEncoding.EncodeToString(senderPublicKey[:]))
+		pm.store.SetReceiverPeer(ReceiverID(senderID), peer)
 	}
 
 	return nil
 }
 
-func (pm *PeerManager) GetPublicKeyToPeers(ctx context.Context, publicKey PublicKey) ([]*Peer, bool, error) {
+// learnUnverifiedSender records addr for the sender of a response that failed
+// mac1 verification, so transport packets addressed to it can be routed. It
+// never replaces an existing entry, and unlike AddPeerBySenderID it does not
+// call the learned hook or release pending packets.
+func (pm *PeerManager) learnUnverifiedSender(ctx context.Context, addr *net.UDPAddr, senderID SenderID) {
+	pm.Lock()
+	defer pm.Unlock()
+
+	if _, exists := pm.store.GetReceiverPeer(ReceiverID(senderID)); exists {
+		return
+	}
+	if pm.memoryGuard.Shedding() {
+		pm.stats.IncMemoryShed()
+		return
+	}
+
+	now := pm.clock.Now()
+	pm.store.SetReceiverPeer(ReceiverID(senderID), &Peer{Addr: addr, Timestamp: now, FirstSeen: now, Unverified: true})
+	pm.stats.IncUnverifiedLearned()
+	pm.loggerFrom(ctx).Debug("SenderID: %x, Add unverified peer: %s", senderID, addr.String())
+}
+
+// AddPeer registers a peer with its own public key publicKey, reachable at
+// addr and addressed by receiverID, as if it had sent a handshake initiation.
+// It is meant for pre-seeding peers; publicKey must belong to a configured key pair.
+func (pm *PeerManager) AddPeer(ctx context.Context, receiverID ReceiverID, addr *net.UDPAddr, publicKey PublicKey) error {
 	if ctx.Err() != nil {
-		return nil, false, ctx.Err()
+		return ctx.Err()
 	}
+	if addr == nil {
+		return fmt.Errorf("peer address is required")
+	}
+
+	added := false
+	defer func() {
+		if added {
+			pm.deliverPending(ctx, receiverID)
+		}
+	}()
 
 	pm.Lock()
 	defer pm.Unlock()
 
-	peers, exists := pm.PublicKeyToPeersMap[publicKey]
-	return peers, exists, nil
+	if _, exists := pm.store.GetPairPublicKeys(publicKey); !exists {
+		return NewInvalidPublicKeyError(fmt.Sprintf("public key is not configured: %s", base64.StdEncoding.EncodeToString(publicKey[:])))
+	}
+
+	now := pm.clock.Now()
+	peer := &Peer{Addr: addr, Timestamp: now, FirstSeen: now, KeyPair: pm.KeyPairName(publicKey), Expiration: pm.keyPairExpirations[publicKey], PublicKey: publicKey}
+	pm.store.SetReceiverPeer(receiverID, peer)
+	pm.store.AddPublicKeyPeer(publicKey, peer)
+	added = true
+	pm.loggerFrom(ctx).Debug("ReceiverID: %x, Add peer: %s, PublicKey: %s", receiverID, addr.String(), base64.StdEncoding.EncodeToString(publicKey[:]))
+
+	return nil
+}
+
+// Policies for handshake responses failing mac1 verification: drop them, or
+// route them by their receiver ID like transport packets.
+const (
+	UnverifiedPolicyDrop              = "drop"
+	UnverifiedPolicyForwardByReceiver = "forward-by-receiver"
+)
+
+// SetUnverifiedPolicy sets how handshake responses whose mac1 matches no
+// configured key are handled. Initiations carry no receiver ID and are always
+// dropped.
+func (pm *PeerManager) SetUnverifiedPolicy(policy string) error {
+	forward, err := ParseUnverifiedPolicy(policy)
+	if err != nil {
+		return err
+	}
+	pm.forwardUnverified = forward
+	return nil
+}
+
+// ParseUnverifiedPolicy reports whether policy forwards unverified responses.
+// An empty policy is UnverifiedPolicyDrop.
+func ParseUnverifiedPolicy(policy string) (bool, error) {
+	switch policy {
+	case UnverifiedPolicyDrop, "":
+		return false, nil
+	case UnverifiedPolicyForwardByReceiver:
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown unverified policy: %s", policy)
+	}
+}
+
+// Sender ID collision policies: keep the peer that registered the ID first, or
+// replace it with the newest sender.
+const (
+	SenderIDCollisionKeep    = "keep"
+	SenderIDCollisionReplace = "replace"
+)
+
+// SetSenderIDCollisionPolicy sets how a sender ID already used by a peer with
+// a different public key is handled. Collisions are logged and counted either way.
+func (pm *PeerManager) SetSenderIDCollisionPolicy(policy string) error {
+	replace, err := ParseSenderIDCollisionPolicy(policy)
+	if err != nil {
+		return err
+	}
+	pm.replaceCollidingSenders = replace
+	return nil
+}
+
+// ParseSenderIDCollisionPolicy reports whether policy replaces colliding peers.
+// An empty policy is SenderIDCollisionKeep.
+func ParseSenderIDCollisionPolicy(policy string) (bool, error) {
+	switch policy {
+	case SenderIDCollisionKeep, "":
+		return false, nil
+	case SenderIDCollisionReplace:
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown sender ID collision policy: %s", policy)
+	}
+}
+
+// replaceOnCollision reports whether existing, registered for senderID, must
+// be replaced by a new sender with publicKey. Receiver IDs are only 4 bytes
+// chosen by the peers, and cookie replies and transport data carry nothing
+// else to route by, so two tunnels picking the same ID cannot both be served.
+func (pm *PeerManager) replaceOnCollision(ctx context.Context, existing *Peer, senderID SenderID, publicKey PublicKey) bool {
+	if existing.PublicKey == (PublicKey{}) || publicKey == (PublicKey{}) || existing.PublicKey == publicKey {
+		return false
+	}
+
+	kept := "existing"
+	if pm.replaceCollidingSenders {
+		kept = "new"
+	}
+	pm.stats.IncSenderIDCollisions()
+	pm.loggerFrom(ctx).Warning("SenderID collision: %x is used by %s (key pair %s) and by a sender of key pair %s, keeping the %s peer",
+		senderID, existing.Addr.String(), existing.KeyPair, pm.KeyPairName(publicKey), kept)
+
+	if pm.replaceCollidingSenders {
+		pm.removePublicKeyPeer(existing.PublicKey, existing)
+	}
+	return pm.replaceCollidingSenders
+}
+
+// removePublicKeyPeer removes peer from the peers learned for publicKey.
+// The caller must hold the lock.
+func (pm *PeerManager) removePublicKeyPeer(publicKey PublicKey, peer *Peer) {
+	peers, exists := pm.store.GetPublicKeyPeers(publicKey)
+	if !exists {
+		return
+	}
+
+	remaining := make([]*Peer, 0, len(peers))
+	for _, p := range peers {
+		if p != peer {
+			remaining = append(remaining, p)
+		}
+	}
+	if len(remaining) == 0 {
+		pm.store.DeletePublicKeyPeers(publicKey)
+	} else if len(remaining) < len(peers) {
+		pm.store.SetPublicKeyPeers(publicKey, remaining)
+	}
+}
+
+// GetPublicKeyToPeers returns copies of the peers learned for publicKey.
+func (pm *PeerManager) GetPublicKeyToPeers(ctx context.Context, publicKey PublicKey) ([]*Peer, bool, error) {
+	if ctx.Err() != nil {
+		return nil, false, ctx.Err()
+	}
+
+	defer pm.lockForRead()()
+
+	peers, exists := pm.store.GetPublicKeyPeers(publicKey)
+	if !exists {
+		return nil, false, nil
+	}
+
+	// Return copies so callers never share peers with CleanupPeers or other handlers.
+	snapshot := make([]*Peer, len(peers))
+	for i, peer := range peers {
+		snapshot[i] = peer.Clone()
+	}
+
+	return snapshot, true, nil
+}
+
+// GetPeerByReceiverID returns a copy of the peer registered for receiverID.
+func (pm *PeerManager) GetPeerByReceiverID(ctx context.Context, receiverID ReceiverID) (*Peer, bool, error) {
+	if ctx.Err() != nil {
+		return nil, false, ctx.Err()
+	}
+
+	defer pm.lockForRead()()
+
+	peer, exists := pm.store.GetReceiverPeer(receiverID)
+	if !exists {
+		return nil, false, nil
+	}
+
+	return peer.Clone(), true, nil
 }
 
 func (pm *PeerManager) ForwardPacketToReceiver(ctx context.Context, receiverID ReceiverID, payload []byte) error {
@@ -312,68 +1119,331 @@ func (pm *PeerManager) ForwardPacketToReceiver(ctx context.Context, receiverID R
 		return ctx.Err()
 	}
 
-	pm.Lock()
-	defer pm.Unlock()
+	// Only the lookup happens under the lock; the send does not block other handlers.
+	peer, exists, err := pm.GetPeerByReceiverID(ctx, receiverID)
+	if err != nil {
+		return err
+	}
 
-	peer, exists := pm.ReceiverToPeerMap[receiverID]
 	if !exists {
+		queued := pm.pending != nil && pm.pending.Add(receiverID, payload, pm.clock.Now())
+		if queued {
+			pm.stats.IncPendingQueued()
+			pm.loggerFrom(ctx).Debug("Receiver %x not known yet, packet held as pending", receiverID)
+		}
+		if forwarded, err := pm.forwardToUpstreams(ctx, payload); forwarded || queued || err != nil {
+			return err
+		}
+		pm.stats.IncPeerNotFound()
+		pm.unroutable.record(receiverID)
 		return NewPeerNotFoundError(fmt.Sprintf("no peer found for receiver ID: %x", receiverID))
 	}
 
-	return pm.ForwardPacket(ctx, peer.Addr, payload)
+	if err := pm.ForwardPacket(ctx, pm.forwardAddress(peer, &receiverID), payload); err != nil {
+		return err
+	}
+
+	pm.stats.IncKeyPairForwarded(peer.KeyPair)
+	return nil
 }
 
+// ForwardPacket sends payload to the given address. to must not be the Addr of a
+// stored peer unless the caller holds the lock; pass a Clone's Addr instead.
 func (pm *PeerManager) ForwardPacket(ctx context.Context, to *net.UDPAddr, payload []byte) error {
 	if ctx.Err() != nil {
 		return ctx.Err()
 	}
 
+	_, span := pm.tracer.Start(ctx, "forward")
+	defer span.End()
+	if span.IsRecording() {
+		span.SetAttribute("net.peer.destination", to.String())
+		span.SetAttribute("wg.size", len(payload))
+	}
+
+	if pm.loopDetector != nil {
+		now := pm.clock.Now()
+		if pm.loopDetector.Seen(to, payload, now) {
+			pm.stats.IncLoopsDetected()
+			markDropped(ctx)
+			if pm.loopLog.Allow(now) {
+				pm.logger.Error("Forwarding loop detected: identical packet sent to %s again, check for key pairs relaying to each other", to.String())
+			}
+			return nil
+		}
+	}
+
+	if pm.forwardRateLimiter != nil {
+		now := pm.clock.Now()
+		if !pm.forwardRateLimiter.Allow(to.String(), now) {
+			pm.stats.IncRateLimited()
+			markDropped(ctx)
+			if pm.rateLimitLog.Allow(now) {
+				pm.logger.Warning("Forward rate limit exceeded for %s, dropping packets", to.String())
+			}
+			return nil
+		}
+	}
+
+	if pm.receiveOnly {
+		pm.loggerFrom(ctx).Debug("Forwarding disabled, not sending packet: destination=%s, size=%d bytes", to.String(), len(payload))
+		return nil
+	}
+
+	if pm.standby.Load() {
+		pm.stats.IncForwardingHeld()
+		markDropped(ctx)
+		pm.loggerFrom(ctx).Debug("Standby, not sending packet: destination=%s, size=%d bytes", to.String(), len(payload))
+		return nil
+	}
+
+	var breakerKey netip.AddrPort
+	if pm.breaker != nil {
+		breakerKey = to.AddrPort()
+		if !pm.breaker.Allow(breakerKey, pm.clock.Now()) {
+			pm.stats.IncBreakerOpen()
+			markDropped(ctx)
+			pm.loggerFrom(ctx).Debug("Circuit breaker open, not sending packet: destination=%s, size=%d bytes", to.String(), len(payload))
+			return nil
+		}
+	}
+
 	if err := pm.packetSender.SendPacket(to, payload); err != nil {
-		return NewPacketSendFailedError(err)
+		// An oversized packet says nothing about whether the destination is reachable.
+		if pm.breaker != nil && !isMessageTooLong(err) && pm.breaker.Failure(breakerKey, pm.clock.Now()) {
+			pm.logger.Warning("Sending to %s failed %d times in a row, pausing it for %v: %v", to.String(), pm.breaker.threshold, pm.breaker.cooldown, err)
+		}
+		return pm.sendFailed(to, payload, err)
+	}
+	if pm.breaker != nil && pm.breaker.Success(breakerKey) {
+		pm.logger.Info("Sending to %s recovered, circuit breaker closed", to.String())
 	}
 
-	pm.logger.Debug("packet forwarded: destination=%s, size=%d bytes", to.String(), len(payload))
+	pm.stats.IncForwarded(protocol.MessageType(payload[0]))
+
+	pm.loggerFrom(ctx).Debug("packet forwarded: destination=%s, size=%d bytes", to.String(), len(payload))
 	return nil
 }
 
+// sendFailed counts short writes and oversized packets, and wraps err as a
+// PacketSendFailed error.
+func (pm *PeerManager) sendFailed(to *net.UDPAddr, payload []byte, err error) error {
+	switch {
+	case errors.Is(err, io.ErrShortWrite):
+		pm.stats.IncShortWrites()
+	case isMessageTooLong(err):
+		pm.stats.IncMessageTooLong()
+		if pm.mtuLog.Allow(pm.clock.Now()) {
+			pm.logger.Warning("Packet of %d bytes to %s exceeds the path MTU and was dropped, check the MTU of the relay's egress path", len(payload), to.String())
+		}
+	}
+	return NewPacketSendFailedError(err)
+}
+
+// CleanupStats summarizes one CleanupPeers run.
+type CleanupStats struct {
+	At                 time.Time
+	Elapsed            time.Duration
+	PeersRemoved       int
+	PeersRemaining     int
+	ReceiversRemoved   int
+	ReceiversRemaining int
+}
+
+func (s CleanupStats) String() string {
+	return fmt.Sprintf("at=%s elapsed=%v peers_removed=%d peers_remaining=%d receivers_removed=%d receivers_remaining=%d",
+		s.At.Format(time.RFC3339), s.Elapsed, s.PeersRemoved, s.PeersRemaining, s.ReceiversRemoved, s.ReceiversRemaining)
+}
+
+// LastCleanup returns the summary of the most recent CleanupPeers run.
+// At is zero when no cleanup has run yet.
+func (pm *PeerManager) LastCleanup() CleanupStats {
+	pm.RLock()
+	defer pm.RUnlock()
+
+	return pm.lastCleanup
+}
+
 func (pm *PeerManager) CleanupPeers() error {
 	pm.Lock()
 	defer pm.Unlock()
 
-	now := time.Now()
-	expire := pm.peerExpiration
+	now := pm.clock.Now()
+	started := time.Now()
 
-	if expire <= 0 {
-		return fmt.Errorf("invalid peer expiration duration: %v", expire)
+	if pm.peerExpiration <= 0 {
+		return fmt.Errorf("invalid peer expiration duration: %v", pm.peerExpiration)
 	}
 
-	for publicKey, peers := range pm.PublicKeyToPeersMap {
+	stats := CleanupStats{At: now}
+
+	pm.store.RangePublicKeyPeers(func(publicKey PublicKey, peers []*Peer) bool {
 		remaining := make([]*Peer, 0, len(peers))
 		for _, peer := range peers {
-			if now.Sub(peer.Timestamp) < expire {
+			if !pm.isPublicKeyPeerExpired(publicKey, peer, now) {
 				remaining = append(remaining, peer)
 			} else {
 				pm.logger.Debug("Remove peer from PublicKeyToPeersMap: %s", peer.Addr.String())
 			}
 		}
+		stats.PeersRemoved += len(peers) - len(remaining)
+		stats.PeersRemaining += len(remaining)
 		if len(remaining) == 0 {
 			pm.logger.Debug("Remove key from PublicKeyToPeersMap: %s", base64.StdEncoding.EncodeToString(publicKey[:]))
-			delete(pm.PublicKeyToPeersMap, publicKey)
+			pm.store.DeletePublicKeyPeers(publicKey)
 		} else {
-			pm.PublicKeyToPeersMap[publicKey] = remaining
+			pm.store.SetPublicKeyPeers(publicKey, remaining)
 		}
-	}
+		return true
+	})
 
-	for receiverID, peer := range pm.ReceiverToPeerMap {
-		if now.Sub(peer.Timestamp) >= expire {
+	pm.store.RangeReceiverPeers(func(receiverID ReceiverID, peer *Peer) bool {
+		if pm.isReceiverExpired(peer, now) {
 			pm.logger.Debug("Remove key from ReceiverToPeerMap: %x", receiverID)
-			delete(pm.ReceiverToPeerMap, receiverID)
+			pm.store.DeleteReceiverPeer(receiverID)
+			stats.ReceiversRemoved++
+		} else {
+			stats.ReceiversRemaining++
 		}
+		return true
+	})
+
+	pm.pruneSessions()
+
+	if pm.pending != nil {
+		pm.pending.Expire(now)
+	}
+
+	stats.Elapsed = time.Since(started)
+	pm.lastCleanup = stats
+
+	summary := pm.logger.WithFields(map[string]any{
+		"peers_removed":       stats.PeersRemoved,
+		"peers_remaining":     stats.PeersRemaining,
+		"receivers_removed":   stats.ReceiversRemoved,
+		"receivers_remaining": stats.ReceiversRemaining,
+		"elapsed":             stats.Elapsed,
+	})
+	if stats.PeersRemoved > 0 || stats.ReceiversRemoved > 0 {
+		summary.Info("Peer cleanup completed")
+	} else {
+		summary.Debug("Peer cleanup completed")
 	}
 
 	return nil
 }
 
+// lockForRead acquires what a pure lookup needs and returns the release function.
+// Lookups share a read lock; stores that are safe for concurrent use need none.
+// Nothing on the forward path refreshes peer timestamps, so Type3/Type4
+// forwarding only ever takes the read lock.
+func (pm *PeerManager) lockForRead() func() {
+	if _, ok := pm.store.(ConcurrentPeerStore); ok {
+		return func() {}
+	}
+
+	pm.RLock()
+	return pm.RUnlock
+}
+
+type loggerContextKey struct{}
+
+type droppedContextKey struct{}
+
+// markDropped records that HandlePacket's packet was dropped without an error,
+// so that it is still counted as dropped.
+func markDropped(ctx context.Context) {
+	if dropped, ok := ctx.Value(droppedContextKey{}).(*bool); ok {
+		*dropped = true
+	}
+}
+
+// loggerFrom returns the per-packet logger attached by HandlePacket, or the manager's logger.
+func (pm *PeerManager) loggerFrom(ctx context.Context) LoggerInterface {
+	if logger, ok := ctx.Value(loggerContextKey{}).(LoggerInterface); ok {
+		return logger
+	}
+	return pm.logger
+}
+
+// packetLogger is the per-packet logger attached by HandlePacket. The child
+// logger carrying the packet's fields is only built once a message passes the
+// level check, so packets that log nothing do not pay for it.
+type packetLogger struct {
+	parent  LoggerInterface
+	addr    *net.UDPAddr
+	payload []byte
+	fields  map[string]any
+	child   LoggerInterface
+}
+
+func (l *packetLogger) logger() LoggerInterface {
+	if l.child == nil {
+		fields := packetLogFields(l.addr, l.payload)
+		maps.Copy(fields, l.fields)
+		l.child = l.parent.WithFields(fields)
+	}
+	return l.child
+}
+
+// enabled reports whether the parent logger writes messages of level.
+func (l *packetLogger) enabled(level int) bool {
+	if leveled, ok := l.parent.(interface{ Level() int }); ok {
+		return leveled.Level() <= level
+	}
+	return true
+}
+
+func (l *packetLogger) Debug(format string, v ...interface{}) {
+	if l.enabled(LogLevelDebug) {
+		l.logger().Debug(format, v...)
+	}
+}
+
+func (l *packetLogger) Info(format string, v ...interface{}) {
+	if l.enabled(LogLevelInfo) {
+		l.logger().Info(format, v...)
+	}
+}
+
+func (l *packetLogger) Warning(format string, v ...interface{}) {
+	if l.enabled(LogLevelWarning) {
+		l.logger().Warning(format, v...)
+	}
+}
+
+func (l *packetLogger) Error(format string, v ...interface{}) {
+	if l.enabled(LogLevelError) {
+		l.logger().Error(format, v...)
+	}
+}
+
+// WithFields returns a packet logger that adds fields, still built lazily.
+func (l *packetLogger) WithFields(fields map[string]any) LoggerInterface {
+	merged := make(map[string]any, len(l.fields)+len(fields))
+	maps.Copy(merged, l.fields)
+	maps.Copy(merged, fields)
+	return &packetLogger{parent: l.parent, addr: l.addr, payload: l.payload, fields: merged}
+}
+
+func packetLogFields(addr *net.UDPAddr, payload []byte) map[string]any {
+	fields := make(map[string]any, 2)
+	if addr != nil {
+		fields["src"] = addr
+	}
+
+	if len(payload) >= 8 {
+		switch protocol.MessageType(payload[0]) {
+		case MessageTypeInitiation, MessageTypeResponse:
+			fields["sender_id"] = hex.EncodeToString(payload[4:8])
+		case MessageTypeCookieReply, MessageTypeTransport:
+			fields["receiver_id"] = hex.EncodeToString(payload[4:8])
+		}
+	}
+
+	return fields
+}
+
 func CalculateMac1Key(publicKey PublicKey) (Mac1Key, error) {
 	var mac1Key Mac1Key
 	hash, err := blake2s.New256(nil)
@@ -381,7 +1451,7 @@ func CalculateMac1Key(publicKey PublicKey) (Mac1Key, error) {
 		return mac1Key, err
 	}
 
-	hash.Write([]byte(WGLabelMAC1))
+	hash.Write([]byte(protocol.LabelMAC1))
 	hash.Write(publicKey[:])
 	hash.Sum(mac1Key[:0])
 
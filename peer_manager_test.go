@@ -0,0 +1,629 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countingStore counts the mac1 keys scanned and runs onScan after each one.
+type countingStore struct {
+	*MemoryStore
+	scanned int
+	onScan  func(scanned int)
+}
+
+func (s *countingStore) RangeMac1Keys(fn func(publicKey PublicKey, mac1Key Mac1Key) bool) {
+	s.MemoryStore.RangeMac1Keys(func(publicKey PublicKey, mac1Key Mac1Key) bool {
+		s.scanned++
+		if s.onScan != nil {
+			s.onScan(s.scanned)
+		}
+		return fn(publicKey, mac1Key)
+	})
+}
+
+// newManyKeysPeerManager returns a PeerManager with pairs unrelated key pairs.
+func newManyKeysPeerManager(t testing.TB, store PeerStore, pairs int) *PeerManager {
+	t.Helper()
+	keyPairs := make([]PublicKeyPair, pairs)
+	for i := range keyPairs {
+		keyPairs[i] = PublicKeyPair{
+			PublicKey1: PublicKey{0, byte(i), byte(i >> 8), byte(i >> 16)},
+			PublicKey2: PublicKey{1, byte(i), byte(i >> 8), byte(i >> 16)},
+		}
+	}
+	return NewPeerManagerWithStore(store, &captureSender{}, keyPairs, NewLogger(LogLevelError), time.Minute)
+}
+
+func TestCheckMAC1PreCancelledContext(t *testing.T) {
+	store := &countingStore{MemoryStore: NewMemoryStore()}
+	pm := newManyKeysPeerManager(t, store, 5000)
+	packet := mustBuildInitiation(t, PublicKey{0xff}, SenderID{1, 2, 3, 4})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := pm.CheckMAC1AndGetPublicKey(ctx, packet)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+	if store.scanned != 0 {
+		t.Errorf("scanned %d keys with a cancelled context, want 0", store.scanned)
+	}
+}
+
+func TestCheckMAC1CancelledDuringScan(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := &countingStore{MemoryStore: NewMemoryStore()}
+	pm := newManyKeysPeerManager(t, store, 5000)
+	store.onScan = func(scanned int) {
+		if scanned == 10 {
+			cancel()
+		}
+	}
+	packet := mustBuildInitiation(t, PublicKey{0xff}, SenderID{1, 2, 3, 4})
+
+	_, err := pm.CheckMAC1AndGetPublicKey(ctx, packet)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+	if store.scanned > mac1ScanCheckInterval {
+		t.Errorf("scanned %d of 10000 keys after cancellation, want at most %d", store.scanned, mac1ScanCheckInterval)
+	}
+}
+
+func TestGetPeerByReceiverID(t *testing.T) {
+	pm, _ := newTestPeerManager(t, &captureSender{})
+	learnInitiator(t, pm, "192.0.2.1:51820", SenderID{1, 2, 3, 4})
+	ctx := context.Background()
+
+	peer, exists, err := pm.GetPeerByReceiverID(ctx, ReceiverID{1, 2, 3, 4})
+	if err != nil || !exists {
+		t.Fatalf("GetPeerByReceiverID = %v, %v, want the learned peer", exists, err)
+	}
+	if peer.Addr.String() != "192.0.2.1:51820" || peer.KeyPair != "test" {
+		t.Errorf("peer = %s %q, want 192.0.2.1:51820 \"test\"", peer.Addr, peer.KeyPair)
+	}
+
+	// The result is a copy: changing it must not change the relay's peer.
+	peer.Addr.IP[0] = 10
+	peer.Addr.Port = 1
+	again, _, _ := pm.GetPeerByReceiverID(ctx, ReceiverID{1, 2, 3, 4})
+	if again.Addr.String() != "192.0.2.1:51820" {
+		t.Errorf("stored peer changed to %s through the returned copy", again.Addr)
+	}
+
+	if _, exists, err := pm.GetPeerByReceiverID(ctx, ReceiverID{9, 9, 9, 9}); exists || err != nil {
+		t.Errorf("unknown receiver ID: exists=%v err=%v, want false and nil", exists, err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, _, err := pm.GetPeerByReceiverID(cancelled, ReceiverID{1, 2, 3, 4}); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled context: err = %v, want context.Canceled", err)
+	}
+}
+
+func TestListKeyPairs(t *testing.T) {
+	pm := NewPeerManager(&captureSender{}, []PublicKeyPair{
+		{PublicKey1: PublicKey{3}, PublicKey2: PublicKey{1}},
+		{PublicKey1: PublicKey{1}, PublicKey2: PublicKey{2}},
+	}, NewLogger(LogLevelError), time.Minute)
+
+	// Adding a known pair in reverse order must not duplicate it.
+	if _, err := pm.AddPublicKeyPair(context.Background(), PublicKey{2}, PublicKey{1}); err != nil {
+		t.Fatalf("AddPublicKeyPair: %v", err)
+	}
+
+	want := [][2]PublicKey{
+		{PublicKey{1}, PublicKey{2}},
+		{PublicKey{1}, PublicKey{3}},
+	}
+	for i := 0; i < 3; i++ {
+		if got := pm.ListKeyPairs(); !reflect.DeepEqual(got, want) {
+			t.Fatalf("ListKeyPairs = %x, want %x", got, want)
+		}
+	}
+}
+
+func TestPeerLearnedHookFiresOncePerNewPeer(t *testing.T) {
+	publicKeyA, publicKeyB := testKeys(t)
+	pm, _ := newTestPeerManager(t, &captureSender{})
+	addrA := testAddr(t, "192.0.2.1:51820")
+	addrB := testAddr(t, "192.0.2.2:51820")
+
+	type learned struct {
+		publicKey PublicKey
+		senderID  SenderID
+		addr      string
+	}
+	var got []learned
+	pm.SetPeerLearnedHook(func(publicKey PublicKey, senderID SenderID, addr *net.UDPAddr) {
+		got = append(got, learned{publicKey, senderID, addr.String()})
+	})
+
+	ctx := context.Background()
+	packets := []struct {
+		addr    *net.UDPAddr
+		payload []byte
+	}{
+		{addrA, mustBuildInitiation(t, publicKeyB, SenderID{1})},
+		{addrA, mustBuildInitiation(t, publicKeyB, SenderID{1})}, // retransmission
+		{addrB, mustBuildResponse(t, publicKeyA, SenderID{2}, ReceiverID{1})},
+		{addrB, mustBuildResponse(t, publicKeyA, SenderID{2}, ReceiverID{1})}, // retransmission
+		{addrA, mustBuildInitiation(t, publicKeyB, SenderID{3})},              // rekey
+	}
+	for _, packet := range packets {
+		if err := pm.HandlePacket(ctx, packet.addr, packet.payload); err != nil {
+			t.Fatalf("HandlePacket: %v", err)
+		}
+	}
+
+	// The hook reports the key each packet's mac1 was verified against.
+	want := []learned{
+		{publicKeyB, SenderID{1}, addrA.String()},
+		{publicKeyA, SenderID{2}, addrB.String()},
+		{publicKeyB, SenderID{3}, addrA.String()},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("hook calls = %v, want %v", got, want)
+	}
+}
+
+func TestNilPacketSenderDisablesForwarding(t *testing.T) {
+	publicKeyA, publicKeyB := testKeys(t)
+	logger := NewLogger(LogLevelWarning)
+	output := captureOutput(logger)
+	pm := NewPeerManager(nil, []PublicKeyPair{{PublicKey1: publicKeyA, PublicKey2: publicKeyB}}, logger, time.Minute)
+
+	if !strings.Contains(output.String(), "forwarding is disabled") {
+		t.Errorf("log = %q, want a forwarding disabled warning", output.String())
+	}
+
+	ctx := context.Background()
+	learnInitiator(t, pm, "192.0.2.1:51820", SenderID{1})
+	if err := pm.HandlePacket(ctx, testAddr(t, "192.0.2.2:51820"), mustBuildResponse(t, publicKeyA, SenderID{2}, ReceiverID{1})); err != nil {
+		t.Errorf("response: %v", err)
+	}
+	if err := pm.ForwardPacketToReceiver(ctx, ReceiverID{2}, []byte{MessageTypeTransport}); err != nil {
+		t.Errorf("ForwardPacketToReceiver: %v", err)
+	}
+}
+
+func TestCheckMAC1ShortPayload(t *testing.T) {
+	pm, _ := newTestPeerManager(t, &captureSender{})
+	for _, size := range []int{0, 1, 31} {
+		_, err := pm.CheckMAC1AndGetPublicKey(context.Background(), make([]byte, size))
+		if !errors.Is(err, ErrInvalidPacket) {
+			t.Errorf("%d byte payload: err = %v, want ErrInvalidPacket", size, err)
+		}
+	}
+}
+
+func TestSenderIDCollision(t *testing.T) {
+	publicKeyA, publicKeyB := testKeys(t)
+	publicKeyC, publicKeyD := PublicKey{0xc}, PublicKey{0xd}
+	addr1 := testAddr(t, "192.0.2.1:51820")
+	addr2 := testAddr(t, "192.0.2.2:51820")
+
+	tests := []struct {
+		policy   string
+		wantAddr *net.UDPAddr
+		// wantPeersA is the number of peers still learned by A's public key.
+		wantPeersA int
+	}{
+		{SenderIDCollisionKeep, addr1, 1},
+		{SenderIDCollisionReplace, addr2, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			pm := NewPeerManager(&captureSender{}, []PublicKeyPair{
+				{Name: "tunnel1", PublicKey1: publicKeyA, PublicKey2: publicKeyB},
+				{Name: "tunnel2", PublicKey1: publicKeyC, PublicKey2: publicKeyD},
+			}, NewLogger(LogLevelError), time.Minute)
+			if err := pm.SetSenderIDCollisionPolicy(tt.policy); err != nil {
+				t.Fatal(err)
+			}
+			ctx := context.Background()
+			senderID := SenderID{1, 2, 3, 4}
+
+			// A retransmission from the same tunnel is not a collision.
+			for range 2 {
+				if err := pm.HandlePacket(ctx, addr1, mustBuildInitiation(t, publicKeyB, senderID)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := pm.Stats().Snapshot().SenderIDCollisions; got != 0 {
+				t.Fatalf("SenderIDCollisions after a retransmission = %d, want 0", got)
+			}
+
+			// Another tunnel picks the same sender ID.
+			if err := pm.HandlePacket(ctx, addr2, mustBuildInitiation(t, publicKeyD, senderID)); err != nil {
+				t.Fatal(err)
+			}
+			if got := pm.Stats().Snapshot().SenderIDCollisions; got != 1 {
+				t.Errorf("SenderIDCollisions = %d, want 1", got)
+			}
+			peer, exists, _ := pm.GetPeerByReceiverID(ctx, ReceiverID(senderID))
+			if !exists || !UDPAddrEqual(peer.Addr, tt.wantAddr) {
+				t.Errorf("receiver entry = %v, want %s", peer, tt.wantAddr)
+			}
+			peersA, _, _ := pm.GetPublicKeyToPeers(ctx, publicKeyA)
+			if len(peersA) != tt.wantPeersA {
+				t.Errorf("peers learned by A's public key = %d, want %d", len(peersA), tt.wantPeersA)
+			}
+		})
+	}
+}
+
+func TestSenderIDCollisionOnResponse(t *testing.T) {
+	publicKeyA, publicKeyB := testKeys(t)
+	publicKeyC, publicKeyD := PublicKey{0xc}, PublicKey{0xd}
+	pm := NewPeerManager(&captureSender{}, []PublicKeyPair{
+		{Name: "tunnel1", PublicKey1: publicKeyA, PublicKey2: publicKeyB},
+		{Name: "tunnel2", PublicKey1: publicKeyC, PublicKey2: publicKeyD},
+	}, NewLogger(LogLevelError), time.Minute)
+	ctx := context.Background()
+	addr1 := testAddr(t, "192.0.2.1:51820")
+	senderID := SenderID{1, 2, 3, 4}
+
+	if err := pm.HandlePacket(ctx, addr1, mustBuildInitiation(t, publicKeyB, senderID)); err != nil {
+		t.Fatal(err)
+	}
+	if err := pm.HandlePacket(ctx, testAddr(t, "198.51.100.1:51820"), mustBuildInitiation(t, publicKeyD, SenderID{9})); err != nil {
+		t.Fatal(err)
+	}
+	// D answers C's initiation with the sender ID tunnel1's A already uses.
+	if err := pm.HandlePacket(ctx, testAddr(t, "192.0.2.2:51820"), mustBuildResponse(t, publicKeyC, senderID, ReceiverID{9})); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := pm.Stats().Snapshot().SenderIDCollisions; got != 1 {
+		t.Errorf("SenderIDCollisions = %d, want 1", got)
+	}
+	if peer, _, _ := pm.GetPeerByReceiverID(ctx, ReceiverID(senderID)); !UDPAddrEqual(peer.Addr, addr1) || peer.PublicKey != publicKeyA {
+		t.Errorf("receiver entry = %s with key %x, want A's entry kept", peer.Addr, peer.PublicKey)
+	}
+}
+
+func TestAddPeer(t *testing.T) {
+	publicKeyA, _ := testKeys(t)
+	sender := &captureSender{}
+	pm, _ := newTestPeerManager(t, sender)
+	ctx := context.Background()
+	addr := testAddr(t, "192.0.2.1:51820")
+
+	if err := pm.AddPeer(ctx, ReceiverID{1}, addr, publicKeyA); err != nil {
+		t.Fatalf("AddPeer: %v", err)
+	}
+
+	peer, exists, _ := pm.GetPeerByReceiverID(ctx, ReceiverID{1})
+	if !exists || !UDPAddrEqual(peer.Addr, addr) || peer.PublicKey != publicKeyA || peer.KeyPair != "test" {
+		t.Errorf("receiver entry = %+v, want A at %s in key pair test", peer, addr)
+	}
+	if peers, _, _ := pm.GetPublicKeyToPeers(ctx, publicKeyA); len(peers) != 1 || !UDPAddrEqual(peers[0].Addr, addr) {
+		t.Errorf("peers of A = %v, want the added peer", peers)
+	}
+
+	// The seeded peer receives initiations addressed to A without ever having sent one.
+	initiation := mustBuildInitiation(t, publicKeyA, SenderID{2})
+	if err := pm.HandlePacket(ctx, testAddr(t, "198.51.100.1:51820"), initiation); err != nil {
+		t.Fatal(err)
+	}
+	if sent := sender.Sent(); len(sent) != 1 || !UDPAddrEqual(sent[0].to, addr) {
+		t.Errorf("initiation sent to %v, want the added peer", sent)
+	}
+}
+
+func TestAddPeerErrors(t *testing.T) {
+	publicKeyA, _ := testKeys(t)
+	pm, _ := newTestPeerManager(t, &captureSender{})
+	addr := testAddr(t, "192.0.2.1:51820")
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := pm.AddPeer(context.Background(), ReceiverID{1}, addr, PublicKey{0xff}); !errors.Is(err, ErrInvalidPublicKey) {
+		t.Errorf("unconfigured key: err = %v, want ErrInvalidPublicKey", err)
+	}
+	if err := pm.AddPeer(context.Background(), ReceiverID{1}, nil, publicKeyA); err == nil {
+		t.Error("nil address accepted")
+	}
+	if err := pm.AddPeer(cancelled, ReceiverID{1}, addr, publicKeyA); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled context: err = %v, want context.Canceled", err)
+	}
+	if receivers, _ := pm.PeerCounts(); receivers != 0 {
+		t.Errorf("failed AddPeer calls stored %d receivers, want 0", receivers)
+	}
+}
+
+func TestAddPeerByPublicKey(t *testing.T) {
+	publicKeyA, publicKeyB := testKeys(t)
+	ctx := context.Background()
+	addr := testAddr(t, "192.0.2.1:51820")
+
+	t.Run("unknown public key", func(t *testing.T) {
+		pm, _ := newTestPeerManager(t, &captureSender{})
+		if err := pm.AddPeerByPublicKey(ctx, addr, SenderID{1}, PublicKey{0xff}); !errors.Is(err, ErrPeerNotFound) {
+			t.Errorf("err = %v, want ErrPeerNotFound", err)
+		}
+		if receivers, publicKeyPeers := pm.PeerCounts(); receivers != 0 || publicKeyPeers != 0 {
+			t.Errorf("stored %d receivers and %d public key peers, want none", receivers, publicKeyPeers)
+		}
+	})
+
+	t.Run("single paired key", func(t *testing.T) {
+		pm, clock := newTestPeerManager(t, &captureSender{})
+		if err := pm.AddPeerByPublicKey(ctx, addr, SenderID{1}, publicKeyB); err != nil {
+			t.Fatalf("AddPeerByPublicKey: %v", err)
+		}
+
+		// The sender addressed B, so it is learned as B's partner A.
+		peers, exists, _ := pm.GetPublicKeyToPeers(ctx, publicKeyA)
+		if !exists || len(peers) != 1 || !UDPAddrEqual(peers[0].Addr, addr) || peers[0].PublicKey != publicKeyA {
+			t.Fatalf("peers of A = %v, want the sender", peers)
+		}
+		if !peers[0].Timestamp.Equal(clock.Now()) {
+			t.Errorf("Timestamp = %v, want the test clock's %v", peers[0].Timestamp, clock.Now())
+		}
+		if _, exists, _ := pm.GetPeerByReceiverID(ctx, ReceiverID{1}); !exists {
+			t.Error("receiver entry not added")
+		}
+	})
+
+	t.Run("existing receiver entry", func(t *testing.T) {
+		pm, clock := newTestPeerManager(t, &captureSender{})
+		if err := pm.AddPeerByPublicKey(ctx, addr, SenderID{1}, publicKeyB); err != nil {
+			t.Fatal(err)
+		}
+		learned := 0
+		pm.SetPeerLearnedHook(func(PublicKey, SenderID, *net.UDPAddr) { learned++ })
+
+		first := clock.Now()
+		clock.Advance(time.Second)
+		if err := pm.AddPeerByPublicKey(ctx, testAddr(t, "192.0.2.2:51820"), SenderID{1}, publicKeyB); err != nil {
+			t.Fatalf("AddPeerByPublicKey: %v", err)
+		}
+
+		// The known entry is kept as it was; it is not a new peer.
+		peer, _, _ := pm.GetPeerByReceiverID(ctx, ReceiverID{1})
+		if !UDPAddrEqual(peer.Addr, addr) || !peer.Timestamp.Equal(first) {
+			t.Errorf("receiver entry = %s at %v, want %s at %v", peer.Addr, peer.Timestamp, addr, first)
+		}
+		if peers, _, _ := pm.GetPublicKeyToPeers(ctx, publicKeyA); len(peers) != 1 {
+			t.Errorf("A has %d peers, want 1", len(peers))
+		}
+		if learned != 0 {
+			t.Errorf("peer learned hook fired %d times for a known sender", learned)
+		}
+	})
+}
+
+func TestUnverifiedPolicy(t *testing.T) {
+	publicKeyA, publicKeyB := testKeys(t)
+	ctx := context.Background()
+	addrA := testAddr(t, "192.0.2.1:51820")
+	addrB := testAddr(t, "198.51.100.1:51820")
+	// Signed for a key the relay is not configured with.
+	response := mustBuildResponse(t, PublicKey{0xee}, SenderID{0xb1}, ReceiverID{0xa1})
+
+	t.Run("drop", func(t *testing.T) {
+		sender := &captureSender{}
+		pm, _ := newTestPeerManager(t, sender)
+		learnInitiator(t, pm, addrA.String(), SenderID{0xa1})
+
+		if err := pm.HandlePacket(ctx, addrB, response); !errors.Is(err, ErrAuthenticationFailed) {
+			t.Errorf("err = %v, want ErrAuthenticationFailed", err)
+		}
+		if sent := sender.Sent(); len(sent) != 0 {
+			t.Errorf("relay sent %d packets, want 0", len(sent))
+		}
+		if _, exists, _ := pm.GetPeerByReceiverID(ctx, ReceiverID{0xb1}); exists {
+			t.Error("unverified sender learned under the drop policy")
+		}
+	})
+
+	t.Run("forward-by-receiver", func(t *testing.T) {
+		sender := &captureSender{}
+		pm, _ := newTestPeerManager(t, sender)
+		if err := pm.SetUnverifiedPolicy(UnverifiedPolicyForwardByReceiver); err != nil {
+			t.Fatal(err)
+		}
+		learned := 0
+		pm.SetPeerLearnedHook(func(PublicKey, SenderID, *net.UDPAddr) { learned++ })
+		learnInitiator(t, pm, addrA.String(), SenderID{0xa1})
+		learned = 0
+
+		if err := pm.HandlePacket(ctx, addrB, response); err != nil {
+			t.Fatalf("HandlePacket: %v", err)
+		}
+		if sent := sender.Sent(); len(sent) != 1 || !UDPAddrEqual(sent[0].to, addrA) {
+			t.Fatalf("response sent as %v, want to A", sent)
+		}
+
+		// The sender gets a return path for transport data, marked unverified.
+		peer, exists, _ := pm.GetPeerByReceiverID(ctx, ReceiverID{0xb1})
+		if !exists || !peer.Unverified || !UDPAddrEqual(peer.Addr, addrB) {
+			t.Fatalf("receiver entry = %+v, %v, want an unverified entry for B", peer, exists)
+		}
+		if err := pm.HandlePacket(ctx, addrA, transportPacket(ReceiverID{0xb1})); err != nil {
+			t.Errorf("transport to the unverified sender: %v", err)
+		}
+		if sent := sender.Sent(); len(sent) != 2 || !UDPAddrEqual(sent[1].to, addrB) {
+			t.Errorf("transport sent as %v, want to B", sent[1:])
+		}
+
+		snapshot := pm.Stats().Snapshot()
+		if snapshot.UnverifiedForwarded != 1 || snapshot.UnverifiedLearned != 1 {
+			t.Errorf("UnverifiedForwarded=%d UnverifiedLearned=%d, want 1 and 1", snapshot.UnverifiedForwarded, snapshot.UnverifiedLearned)
+		}
+		if learned != 0 {
+			t.Errorf("peer learned hook fired %d times for an unverified sender", learned)
+		}
+
+		// Initiations carry no receiver ID and are still dropped.
+		if err := pm.HandlePacket(ctx, addrB, mustBuildInitiation(t, PublicKey{0xee}, SenderID{0xb2})); !errors.Is(err, ErrAuthenticationFailed) {
+			t.Errorf("unverified initiation: err = %v, want ErrAuthenticationFailed", err)
+		}
+	})
+
+	t.Run("does not replace a verified entry", func(t *testing.T) {
+		pm, _ := newTestPeerManager(t, &captureSender{})
+		pm.SetUnverifiedPolicy(UnverifiedPolicyForwardByReceiver)
+		learnInitiator(t, pm, addrA.String(), SenderID{0xa1})
+		if err := pm.HandlePacket(ctx, addrB, mustBuildResponse(t, publicKeyA, SenderID{0xb1}, ReceiverID{0xa1})); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := pm.HandlePacket(ctx, testAddr(t, "203.0.113.1:51820"), response); err != nil {
+			t.Fatal(err)
+		}
+		peer, _, _ := pm.GetPeerByReceiverID(ctx, ReceiverID{0xb1})
+		if peer.Unverified || !UDPAddrEqual(peer.Addr, addrB) || peer.PublicKey != publicKeyB {
+			t.Errorf("receiver entry = %+v, want B's verified entry", peer)
+		}
+	})
+
+	t.Run("not persisted", func(t *testing.T) {
+		pm, _ := newTestPeerManager(t, &captureSender{})
+		pm.SetUnverifiedPolicy(UnverifiedPolicyForwardByReceiver)
+		learnInitiator(t, pm, addrA.String(), SenderID{0xa1})
+		pm.HandlePacket(ctx, addrB, response)
+
+		saved, err := pm.SavePeers(filepath.Join(t.TempDir(), "peers.json"))
+		if err != nil {
+			t.Fatalf("SavePeers: %v", err)
+		}
+		if receivers, _ := pm.PeerCounts(); receivers != 2 || saved != 1 {
+			t.Errorf("saved %d of %d receivers, want only the verified one", saved, receivers)
+		}
+	})
+
+	if err := (&PeerManager{}).SetUnverifiedPolicy("forward-all"); err == nil {
+		t.Error("unknown policy accepted")
+	}
+}
+
+func TestHandlePacketCountsQuietDrops(t *testing.T) {
+	_, publicKeyB := testKeys(t)
+	addrA := "192.0.2.1:51820"
+	addrB := testAddr(t, "198.51.100.1:51820")
+	toA := transportPacket(ReceiverID{0xa1})
+
+	tests := []struct {
+		name    string
+		sender  *captureSender
+		setup   func(t *testing.T, pm *PeerManager)
+		from    *net.UDPAddr
+		packets [][]byte
+		// messageType and dropped are the per-type drop count expected.
+		messageType byte
+		dropped     uint64
+	}{
+		{
+			name: "memory shed",
+			setup: func(t *testing.T, pm *PeerManager) {
+				guard := NewMemoryGuard(1, NewLogger(LogLevelError))
+				guard.Check()
+				pm.SetMemoryGuard(guard)
+			},
+			from:        addrB,
+			packets:     [][]byte{mustBuildInitiation(t, publicKeyB, SenderID{0xb1})},
+			messageType: MessageTypeInitiation,
+			dropped:     1,
+		},
+		{
+			name: "source denied",
+			setup: func(t *testing.T, pm *PeerManager) {
+				filter, err := ParseSourceFilter(nil, []string{"198.51.100.0/24"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				pm.SetSourceFilter(filter)
+			},
+			from:        addrB,
+			packets:     [][]byte{toA},
+			messageType: MessageTypeTransport,
+			dropped:     1,
+		},
+		{
+			name: "rate limited",
+			setup: func(t *testing.T, pm *PeerManager) {
+				pm.SetForwardRateLimiter(NewRateLimiter(1, 1))
+			},
+			from:        addrB,
+			packets:     [][]byte{transportPacket(ReceiverID{0xa1}), append(transportPacket(ReceiverID{0xa1}), 1)},
+			messageType: MessageTypeTransport,
+			dropped:     1,
+		},
+		{
+			name: "loop detected",
+			setup: func(t *testing.T, pm *PeerManager) {
+				pm.SetLoopDetector(NewLoopDetector(time.Second))
+			},
+			from:        addrB,
+			packets:     [][]byte{toA, toA},
+			messageType: MessageTypeTransport,
+			dropped:     1,
+		},
+		{
+			// The first send fails with an error, the second finds the breaker open.
+			name:   "breaker open",
+			sender: &captureSender{err: errors.New("host unreachable")},
+			setup: func(t *testing.T, pm *PeerManager) {
+				pm.SetCircuitBreaker(NewCircuitBreaker(1, time.Minute))
+			},
+			from:        addrB,
+			packets:     [][]byte{transportPacket(ReceiverID{0xa1}), append(transportPacket(ReceiverID{0xa1}), 1)},
+			messageType: MessageTypeTransport,
+			dropped:     2,
+		},
+		{
+			name: "standby",
+			setup: func(t *testing.T, pm *PeerManager) {
+				pm.SetForwardingEnabled(false)
+			},
+			from:        addrB,
+			packets:     [][]byte{toA},
+			messageType: MessageTypeTransport,
+			dropped:     1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender := tt.sender
+			if sender == nil {
+				sender = &captureSender{}
+			}
+			pm, _ := newTestPeerManager(t, sender)
+			learnInitiator(t, pm, addrA, SenderID{0xa1})
+			tt.setup(t, pm)
+
+			for _, packet := range tt.packets {
+				pm.HandlePacket(context.Background(), tt.from, packet)
+			}
+
+			if got := pm.Stats().Snapshot().Dropped[tt.messageType-1]; got != tt.dropped {
+				t.Errorf("Dropped[type %d] = %d, want %d", tt.messageType, got, tt.dropped)
+			}
+		})
+	}
+
+	// Unknown types have no per-type counters; UnknownTypes counts their drops.
+	t.Run("unknown type", func(t *testing.T) {
+		pm, _ := newTestPeerManager(t, &captureSender{})
+		pm.HandlePacket(context.Background(), addrB, []byte{0x7f, 0, 0, 0, 1, 2, 3, 4})
+		if got := pm.Stats().Snapshot().UnknownTypes; got != 1 {
+			t.Errorf("UnknownTypes = %d, want 1", got)
+		}
+	})
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// PeerStateVersion is the current version of the peer state file format.
+// Version 2 added the key pair name and the receiver entries' public keys;
+// version 1 files are still loaded, without them.
+const PeerStateVersion = 2
+
+type peerState struct {
+	Version        int                   `json:"version"`
+	SavedAt        time.Time             `json:"saved_at"`
+	Receivers      []receiverStateEntry  `json:"receivers"`
+	PublicKeyPeers []publicKeyStateEntry `json:"public_key_peers"`
+}
+
+type receiverStateEntry struct {
+	ReceiverID string        `json:"receiver_id"`
+	Addr       string        `json:"addr"`
+	Timestamp  time.Time     `json:"timestamp"`
+	FirstSeen  time.Time     `json:"first_seen,omitzero"`
+	Expiration time.Duration `json:"expiration,omitempty"`
+	KeyPair    string        `json:"key_pair,omitempty"`
+	PublicKey  string        `json:"public_key,omitempty"`
+}
+
+type publicKeyStateEntry struct {
+	PublicKey  string        `json:"public_key"`
+	Addr       string        `json:"addr"`
+	Timestamp  time.Time     `json:"timestamp"`
+	FirstSeen  time.Time     `json:"first_seen,omitzero"`
+	Expiration time.Duration `json:"expiration,omitempty"`
+	KeyPair    string        `json:"key_pair,omitempty"`
+}
+
+// SavePeers writes the non-expired peers to path.
+// The file is replaced atomically so a crash never leaves a partial state behind.
+func (pm *PeerManager) SavePeers(path string) (int, error) {
+	pm.RLock()
+	now := pm.clock.Now()
+	state := peerState{Version: PeerStateVersion, SavedAt: now}
+
+	pm.store.RangeReceiverPeers(func(receiverID ReceiverID, peer *Peer) bool {
+		if !peer.Unverified && !pm.isReceiverExpired(peer, now) {
+			entry := receiverStateEntry{
+				ReceiverID: hex.EncodeToString(receiverID[:]),
+				Addr:       peer.Addr.String(),
+				Timestamp:  peer.Timestamp,
+				FirstSeen:  peer.FirstSeen,
+				Expiration: peer.Expiration,
+				KeyPair:    peer.KeyPair,
+			}
+			if peer.PublicKey != (PublicKey{}) {
+				entry.PublicKey = base64.StdEncoding.EncodeToString(peer.PublicKey[:])
+			}
+			state.Receivers = append(state.Receivers, entry)
+		}
+		return true
+	})
+
+	pm.store.RangePublicKeyPeers(func(publicKey PublicKey, peers []*Peer) bool {
+		for _, peer := range peers {
+			if !pm.isPublicKeyPeerExpired(publicKey, peer, now) {
+				state.PublicKeyPeers = append(state.PublicKeyPeers, publicKeyStateEntry{
+					PublicKey:  base64.StdEncoding.EncodeToString(publicKey[:]),
+					Addr:       peer.Addr.String(),
+					Timestamp:  peer.Timestamp,
+					FirstSeen:  peer.FirstSeen,
+					Expiration: peer.Expiration,
+					KeyPair:    peer.KeyPair,
+				})
+			}
+		}
+		return true
+	})
+	pm.RUnlock()
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode peer state: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create peer state file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return 0, fmt.Errorf("failed to write peer state file: %v", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return 0, fmt.Errorf("failed to write peer state file: %v", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return 0, fmt.Errorf("failed to replace peer state file: %v", err)
+	}
+
+	return len(state.Receivers), nil
+}
+
+// LoadPeers restores peers saved by SavePeers, discarding expired entries and
+// public keys that are no longer configured. A missing file is not an error.
+func (pm *PeerManager) LoadPeers(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read peer state file: %v", err)
+	}
+
+	var state peerState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return 0, fmt.Errorf("failed to decode peer state file: %v", err)
+	}
+
+	if state.Version != 1 && state.Version != PeerStateVersion {
+		return 0, fmt.Errorf("unsupported peer state version: %d", state.Version)
+	}
+
+	pm.Lock()
+	defer pm.Unlock()
+
+	now := pm.clock.Now()
+	// Expirations follow the current configuration; the saved one is only
+	// kept for peers of key pairs that are no longer configured.
+	expirations := make(map[string]time.Duration)
+	pm.store.RangePairPublicKeys(func(publicKey PublicKey, _ []PublicKey) bool {
+		expirations[pm.KeyPairName(publicKey)] = pm.keyPairExpirations[publicKey]
+		return true
+	})
+
+	// Entries sharing an address and timestamp were the same *Peer before saving.
+	peers := make(map[string]*Peer)
+	getPeer := func(addrString string, timestamp, firstSeen time.Time, expiration time.Duration, keyPair string) (*Peer, error) {
+		key := addrString + "|" + timestamp.String()
+		if peer, exists := peers[key]; exists {
+			return peer, nil
+		}
+
+		addr, err := net.ResolveUDPAddr("udp", addrString)
+		if err != nil {
+			return nil, err
+		}
+
+		if current, exists := expirations[keyPair]; exists {
+			expiration = current
+		}
+		peer := &Peer{Addr: addr, Timestamp: timestamp, FirstSeen: firstSeen, Expiration: expiration, KeyPair: keyPair}
+		peers[key] = peer
+		return peer, nil
+	}
+
+	restored := 0
+	for _, entry := range state.Receivers {
+		decoded, err := hex.DecodeString(entry.ReceiverID)
+		if err != nil || len(decoded) != len(ReceiverID{}) {
+			pm.logger.Warning("Skipping invalid receiver ID in peer state: %s", entry.ReceiverID)
+			continue
+		}
+
+		peer, err := getPeer(entry.Addr, entry.Timestamp, entry.FirstSeen, entry.Expiration, entry.KeyPair)
+		if err != nil {
+			pm.logger.Warning("Skipping invalid address in peer state: %s", entry.Addr)
+			continue
+		}
+
+		if pm.isReceiverExpired(peer, now) {
+			continue
+		}
+
+		// Keys that are no longer configured are dropped, leaving the peer
+		// reachable by its receiver ID only.
+		if entry.PublicKey != "" {
+			publicKey, err := DecodePublicKeyWithError(entry.PublicKey)
+			if err != nil {
+				pm.logger.Warning("Skipping invalid public key in peer state: %s", entry.PublicKey)
+			} else if _, exists := pm.store.GetPairPublicKeys(publicKey); exists {
+				peer.PublicKey = publicKey
+			}
+		}
+
+		pm.store.SetReceiverPeer(ReceiverID(decoded), peer)
+		restored++
+	}
+
+	for _, entry := range state.PublicKeyPeers {
+		publicKey, err := DecodePublicKeyWithError(entry.PublicKey)
+		if err != nil {
+			pm.logger.Warning("Skipping invalid public key in peer state: %s", entry.PublicKey)
+			continue
+		}
+
+		if _, exists := pm.store.GetPairPublicKeys(publicKey); !exists {
+			continue
+		}
+
+		keyPair := entry.KeyPair
+		if keyPair == "" {
+			// Version 1 files carry no key pair name.
+			keyPair = pm.KeyPairName(publicKey)
+		}
+		peer, err := getPeer(entry.Addr, entry.Timestamp, entry.FirstSeen, entry.Expiration, keyPair)
+		if err != nil {
+			pm.logger.Warning("Skipping invalid address in peer state: %s", entry.Addr)
+			continue
+		}
+		if peer.KeyPair == "" {
+			// Shared with a version 1 receiver entry.
+			peer.KeyPair = keyPair
+			peer.Expiration = pm.keyPairExpirations[publicKey]
+		}
+
+		if pm.isPublicKeyPeerExpired(publicKey, peer, now) {
+			continue
+		}
+
+		peer.PublicKey = publicKey
+		pm.store.AddPublicKeyPeer(publicKey, peer)
+	}
+
+	return restored, nil
+}
+
+// isExpired reports whether peer has been idle longer than its key pair's
+// expiration, or the server peer expiration when the pair has none.
+func (pm *PeerManager) isExpired(peer *Peer, now time.Time) bool {
+	expiration := pm.peerExpiration
+	if peer.Expiration > 0 {
+		expiration = peer.Expiration
+	}
+	return expiration > 0 && now.Sub(peer.Timestamp) >= expiration
+}
+
+// isPastMaxLifetime reports whether peer was first learned longer than the
+// peer max lifetime ago. Peers without FirstSeen count from Timestamp.
+func (pm *PeerManager) isPastMaxLifetime(peer *Peer, now time.Time) bool {
+	if pm.peerMaxLifetime <= 0 {
+		return false
+	}
+	firstSeen := peer.FirstSeen
+	if firstSeen.IsZero() {
+		firstSeen = peer.Timestamp
+	}
+	return now.Sub(firstSeen) >= pm.peerMaxLifetime
+}
+
+// isPublicKeyPeerExpired is isExpired for peers learned by publicKey, which
+// never expire when their key pair is persistent, except at the max lifetime.
+func (pm *PeerManager) isPublicKeyPeerExpired(publicKey PublicKey, peer *Peer, now time.Time) bool {
+	if pm.isPastMaxLifetime(peer, now) {
+		return true
+	}
+	return !pm.persistentKeys[publicKey] && pm.isExpired(peer, now)
+}
+
+// isReceiverExpired is isExpired for receiver ID entries, which use the
+// receiver expiration instead when one is set.
+func (pm *PeerManager) isReceiverExpired(peer *Peer, now time.Time) bool {
+	if pm.isPastMaxLifetime(peer, now) {
+		return true
+	}
+	if pm.receiverExpiration > 0 {
+		return now.Sub(peer.Timestamp) >= pm.receiverExpiration
+	}
+	return pm.isExpired(peer, now)
+}
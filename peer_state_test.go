@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSaveAndLoadPeersRoundTrip(t *testing.T) {
+	publicKeyA, publicKeyB := testKeys(t)
+	pm, clock := newTestPeerManager(t, &captureSender{})
+	addrA := testAddr(t, "192.0.2.1:51820")
+	addrB := testAddr(t, "[2001:db8::2]:51820")
+	ctx := context.Background()
+
+	if err := pm.HandlePacket(ctx, addrA, mustBuildInitiation(t, publicKeyB, SenderID{1, 1, 1, 1})); err != nil {
+		t.Fatalf("initiation: %v", err)
+	}
+	if err := pm.HandlePacket(ctx, addrB, mustBuildResponse(t, publicKeyA, SenderID{2, 2, 2, 2}, ReceiverID{1, 1, 1, 1})); err != nil {
+		t.Fatalf("response: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "peers.json")
+	saved, err := pm.SavePeers(path)
+	if err != nil || saved != 2 {
+		t.Fatalf("SavePeers = %d, %v, want 2 receivers", saved, err)
+	}
+
+	restored, _ := newTestPeerManager(t, &captureSender{})
+	restored.SetClock(clock)
+	loaded, err := restored.LoadPeers(path)
+	if err != nil || loaded != 2 {
+		t.Fatalf("LoadPeers = %d, %v, want 2 receivers", loaded, err)
+	}
+
+	tests := []struct {
+		receiverID ReceiverID
+		addr       string
+		publicKey  PublicKey
+	}{
+		{ReceiverID{1, 1, 1, 1}, "192.0.2.1:51820", publicKeyA},
+		{ReceiverID{2, 2, 2, 2}, "[2001:db8::2]:51820", publicKeyB},
+	}
+	for _, tt := range tests {
+		peer, exists, err := restored.GetPeerByReceiverID(ctx, tt.receiverID)
+		if err != nil || !exists {
+			t.Fatalf("receiver %x not restored: %v", tt.receiverID, err)
+		}
+		if peer.Addr.String() != tt.addr || peer.KeyPair != "test" || peer.PublicKey != tt.publicKey {
+			t.Errorf("receiver %x = %s %q %x, want %s \"test\" %x", tt.receiverID, peer.Addr, peer.KeyPair, peer.PublicKey, tt.addr, tt.publicKey)
+		}
+	}
+
+	peers, exists, err := restored.GetPublicKeyToPeers(ctx, publicKeyA)
+	if err != nil || !exists || len(peers) != 1 || peers[0].Addr.String() != "192.0.2.1:51820" {
+		t.Errorf("public key peers of A = %v, want peer A", peers)
+	}
+}
+
+func TestLoadPeersDropsExpiredEntries(t *testing.T) {
+	publicKeyA, publicKeyB := testKeys(t)
+	pm, clock := newTestPeerManager(t, &captureSender{})
+	if err := pm.HandlePacket(context.Background(), testAddr(t, "192.0.2.1:51820"), mustBuildInitiation(t, publicKeyB, SenderID{1, 1, 1, 1})); err != nil {
+		t.Fatalf("initiation: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "peers.json")
+	if _, err := pm.SavePeers(path); err != nil {
+		t.Fatalf("SavePeers: %v", err)
+	}
+
+	clock.Advance(2 * time.Minute)
+	restored, _ := newTestPeerManager(t, &captureSender{})
+	restored.SetClock(clock)
+	loaded, err := restored.LoadPeers(path)
+	if err != nil || loaded != 0 {
+		t.Errorf("LoadPeers = %d, %v, want 0 after expiration", loaded, err)
+	}
+	if _, exists, _ := restored.GetPublicKeyToPeers(context.Background(), publicKeyA); exists {
+		t.Error("expired public key peer was restored")
+	}
+}
+
+func TestLoadPeersVersion1(t *testing.T) {
+	publicKeyA, _ := testKeys(t)
+	pm, clock := newTestPeerManager(t, &captureSender{})
+	now := clock.Now().Format(time.RFC3339Nano)
+	state := `{
+  "version": 1,
+  "receivers": [{"receiver_id": "01010101", "addr": "192.0.2.1:51820", "timestamp": "` + now + `"}],
+  "public_key_peers": [{"public_key": "` + testPublicKeyA + `", "addr": "192.0.2.1:51820", "timestamp": "` + now + `"}]
+}`
+	path := filepath.Join(t.TempDir(), "peers.json")
+	if err := os.WriteFile(path, []byte(state), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := pm.LoadPeers(path)
+	if err != nil || loaded != 1 {
+		t.Fatalf("LoadPeers = %d, %v, want 1", loaded, err)
+	}
+
+	peer, exists, _ := pm.GetPeerByReceiverID(context.Background(), ReceiverID{1, 1, 1, 1})
+	if !exists {
+		t.Fatal("receiver entry not restored")
+	}
+	// Both entries were the same peer, so the public key peer fills in the key pair.
+	if peer.PublicKey != publicKeyA || peer.KeyPair != "test" {
+		t.Errorf("restored peer has key %x and key pair %q, want A and \"test\"", peer.PublicKey, peer.KeyPair)
+	}
+}
+
+func TestLoadPeers(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{"unsupported version", `{"version": 99}`, true},
+		{"malformed", `{`, true},
+		{"invalid entries skipped", `{"version": 2, "receivers": [{"receiver_id": "zz", "addr": "192.0.2.1:1"}, {"receiver_id": "01010101", "addr": "bad"}]}`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pm, _ := newTestPeerManager(t, &captureSender{})
+			path := filepath.Join(t.TempDir(), "peers.json")
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			loaded, err := pm.LoadPeers(path)
+			if (err != nil) != tt.wantErr || loaded != 0 {
+				t.Errorf("LoadPeers = %d, %v, want 0 and error %v", loaded, err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		pm, _ := newTestPeerManager(t, &captureSender{})
+		if loaded, err := pm.LoadPeers(filepath.Join(t.TempDir(), "missing.json")); err != nil || loaded != 0 {
+			t.Errorf("LoadPeers = %d, %v, want 0 and no error", loaded, err)
+		}
+	})
+}
+
+func TestLoadPeersUsesConfiguredExpiration(t *testing.T) {
+	mobile := PublicKeyPair{Name: "mobile", PublicKey1: PublicKey{1}, PublicKey2: PublicKey{2}, Expiration: time.Hour}
+	plain := PublicKeyPair{Name: "plain", PublicKey1: PublicKey{3}, PublicKey2: PublicKey{4}}
+	pm := NewPeerManager(&captureSender{}, []PublicKeyPair{mobile, plain}, NewLogger(LogLevelError), time.Minute)
+	clock := newTestClock()
+	pm.SetClock(clock)
+
+	// Every entry was saved with a 10 minute expiration.
+	now := clock.Now().Format(time.RFC3339Nano)
+	entry := func(receiverID, keyPair string) string {
+		return `{"receiver_id": "` + receiverID + `", "addr": "192.0.2.` + receiverID[7:] + `:51820", "timestamp": "` + now + `", "expiration": 600000000000, "key_pair": "` + keyPair + `"}`
+	}
+	mobileKey := base64.StdEncoding.EncodeToString(mobile.PublicKey1[:])
+	state := `{
+  "version": 2,
+  "receivers": [` + entry("00000001", "mobile") + `, ` + entry("00000002", "plain") + `, ` + entry("00000003", "removed") + `],
+  "public_key_peers": [{"public_key": "` + mobileKey + `", "addr": "192.0.2.1:51820", "timestamp": "` + now + `", "expiration": 600000000000, "key_pair": "mobile"}]
+}`
+	path := filepath.Join(t.TempDir(), "peers.json")
+	if err := os.WriteFile(path, []byte(state), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err := pm.LoadPeers(path); err != nil || loaded != 3 {
+		t.Fatalf("LoadPeers = %d, %v, want 3", loaded, err)
+	}
+
+	ctx := context.Background()
+	tests := []struct {
+		receiverID ReceiverID
+		expiration time.Duration
+	}{
+		{ReceiverID{0, 0, 0, 1}, time.Hour},
+		{ReceiverID{0, 0, 0, 2}, 0},
+		{ReceiverID{0, 0, 0, 3}, 10 * time.Minute},
+	}
+	for _, tt := range tests {
+		peer, exists, _ := pm.GetPeerByReceiverID(ctx, tt.receiverID)
+		if !exists {
+			t.Fatalf("receiver %x not restored", tt.receiverID)
+		}
+		if peer.Expiration != tt.expiration {
+			t.Errorf("receiver %x (%s) expiration = %v, want %v", tt.receiverID, peer.KeyPair, peer.Expiration, tt.expiration)
+		}
+	}
+
+	peers, _, _ := pm.GetPublicKeyToPeers(ctx, mobile.PublicKey1)
+	if len(peers) != 1 || peers[0].Expiration != time.Hour {
+		t.Errorf("public key peers of mobile = %v, want one with a 1h expiration", peers)
+	}
+}
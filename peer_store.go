@@ -0,0 +1,138 @@
+package main
+
+// PeerStore holds the relay state used by PeerManager.
+// Implementations are not required to be safe for concurrent use;
+// PeerManager serializes all access with its own lock.
+type PeerStore interface {
+	GetReceiverPeer(receiverID ReceiverID) (*Peer, bool)
+	SetReceiverPeer(receiverID ReceiverID, peer *Peer)
+	DeleteReceiverPeer(receiverID ReceiverID)
+	RangeReceiverPeers(fn func(receiverID ReceiverID, peer *Peer) bool)
+
+	GetPublicKeyPeers(publicKey PublicKey) ([]*Peer, bool)
+	AddPublicKeyPeer(publicKey PublicKey, peer *Peer)
+	SetPublicKeyPeers(publicKey PublicKey, peers []*Peer)
+	DeletePublicKeyPeers(publicKey PublicKey)
+	RangePublicKeyPeers(fn func(publicKey PublicKey, peers []*Peer) bool)
+
+	SetMac1Key(publicKey PublicKey, mac1Key Mac1Key)
+	RangeMac1Keys(fn func(publicKey PublicKey, mac1Key Mac1Key) bool)
+
+	AddPairPublicKey(publicKey, pairPublicKey PublicKey)
+	GetPairPublicKeys(publicKey PublicKey) ([]PublicKey, bool)
+	RangePairPublicKeys(fn func(publicKey PublicKey, pairPublicKeys []PublicKey) bool)
+}
+
+// ConcurrentPeerStore is implemented by stores that are safe for concurrent use.
+// PeerManager serves pure lookups from such stores without taking its lock;
+// stored peers must then be treated as immutable and replaced, not modified.
+type ConcurrentPeerStore interface {
+	PeerStore
+	concurrentSafe()
+}
+
+// MemoryStore is the default map-based PeerStore.
+type MemoryStore struct {
+	ReceiverToPeerMap            map[ReceiverID]*Peer
+	PublicKeyToPeersMap          map[PublicKey][]*Peer
+	PublicKeyToMac1KeyMap        map[PublicKey]Mac1Key
+	PublicKeyToPairPublicKeysMap map[PublicKey][]PublicKey
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		ReceiverToPeerMap:            make(map[ReceiverID]*Peer),
+		PublicKeyToPeersMap:          make(map[PublicKey][]*Peer),
+		PublicKeyToMac1KeyMap:        make(map[PublicKey]Mac1Key),
+		PublicKeyToPairPublicKeysMap: make(map[PublicKey][]PublicKey),
+	}
+}
+
+func (s *MemoryStore) GetReceiverPeer(receiverID ReceiverID) (*Peer, bool) {
+	peer, exists := s.ReceiverToPeerMap[receiverID]
+	return peer, exists
+}
+
+func (s *MemoryStore) SetReceiverPeer(receiverID ReceiverID, peer *Peer) {
+	s.ReceiverToPeerMap[receiverID] = peer
+}
+
+func (s *MemoryStore) DeleteReceiverPeer(receiverID ReceiverID) {
+	delete(s.ReceiverToPeerMap, receiverID)
+}
+
+func (s *MemoryStore) RangeReceiverPeers(fn func(receiverID ReceiverID, peer *Peer) bool) {
+	for receiverID, peer := range s.ReceiverToPeerMap {
+		if !fn(receiverID, peer) {
+			return
+		}
+	}
+}
+
+func (s *MemoryStore) GetPublicKeyPeers(publicKey PublicKey) ([]*Peer, bool) {
+	peers, exists := s.PublicKeyToPeersMap[publicKey]
+	return peers, exists
+}
+
+// AddPublicKeyPeer appends peer unless a peer with the same address is already present.
+func (s *MemoryStore) AddPublicKeyPeer(publicKey PublicKey, peer *Peer) {
+	isEqual := func(a, b *Peer) bool {
+		if a == nil || b == nil {
+			return false
+		}
+		return UDPAddrEqual(a.Addr, b.Addr)
+	}
+
+	AppendUniqueValue(s.PublicKeyToPeersMap, publicKey, peer, isEqual)
+}
+
+func (s *MemoryStore) SetPublicKeyPeers(publicKey PublicKey, peers []*Peer) {
+	s.PublicKeyToPeersMap[publicKey] = peers
+}
+
+func (s *MemoryStore) DeletePublicKeyPeers(publicKey PublicKey) {
+	delete(s.PublicKeyToPeersMap, publicKey)
+}
+
+func (s *MemoryStore) RangePublicKeyPeers(fn func(publicKey PublicKey, peers []*Peer) bool) {
+	for publicKey, peers := range s.PublicKeyToPeersMap {
+		if !fn(publicKey, peers) {
+			return
+		}
+	}
+}
+
+func (s *MemoryStore) SetMac1Key(publicKey PublicKey, mac1Key Mac1Key) {
+	s.PublicKeyToMac1KeyMap[publicKey] = mac1Key
+}
+
+func (s *MemoryStore) RangeMac1Keys(fn func(publicKey PublicKey, mac1Key Mac1Key) bool) {
+	for publicKey, mac1Key := range s.PublicKeyToMac1KeyMap {
+		if !fn(publicKey, mac1Key) {
+			return
+		}
+	}
+}
+
+func (s *MemoryStore) AddPairPublicKey(publicKey, pairPublicKey PublicKey) {
+	isEqual := func(a, b PublicKey) bool {
+		return a == b
+	}
+
+	AppendUniqueValue(s.PublicKeyToPairPublicKeysMap, publicKey, pairPublicKey, isEqual)
+}
+
+func (s *MemoryStore) GetPairPublicKeys(publicKey PublicKey) ([]PublicKey, bool) {
+	publicKeys, exists := s.PublicKeyToPairPublicKeysMap[publicKey]
+	return publicKeys, exists
+}
+
+func (s *MemoryStore) RangePairPublicKeys(fn func(publicKey PublicKey, pairPublicKeys []PublicKey) bool) {
+	for publicKey, pairPublicKeys := range s.PublicKeyToPairPublicKeysMap {
+		if !fn(publicKey, pairPublicKeys) {
+			return
+		}
+	}
+}
+
+var _ PeerStore = (*MemoryStore)(nil)
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+// ShardedStore is a PeerStore that spreads receiver and public key entries
+// over independently locked shards. Unlike MemoryStore it is safe for
+// concurrent use, so PeerManager can serve lookups without its own lock and
+// handlers touching different peers do not contend.
+type ShardedStore struct {
+	receiverShards  []receiverShard
+	publicKeyShards []publicKeyShard
+
+	keysMu sync.RWMutex
+	keys   *MemoryStore // mac1 keys and key pairs, written only at configuration time
+}
+
+type receiverShard struct {
+	sync.RWMutex
+	peers map[ReceiverID]*Peer
+}
+
+type publicKeyShard struct {
+	sync.RWMutex
+	peers map[PublicKey][]*Peer
+}
+
+func NewShardedStore(shardCount int) *ShardedStore {
+	if shardCount < 1 {
+		shardCount = 1
+	}
+
+	s := &ShardedStore{
+		receiverShards:  make([]receiverShard, shardCount),
+		publicKeyShards: make([]publicKeyShard, shardCount),
+		keys:            NewMemoryStore(),
+	}
+
+	for i := range s.receiverShards {
+		s.receiverShards[i].peers = make(map[ReceiverID]*Peer)
+		s.publicKeyShards[i].peers = make(map[PublicKey][]*Peer)
+	}
+
+	return s
+}
+
+func (s *ShardedStore) concurrentSafe() {}
+
+func (s *ShardedStore) receiverShard(receiverID ReceiverID) *receiverShard {
+	return &s.receiverShards[binary.LittleEndian.Uint32(receiverID[:])%uint32(len(s.receiverShards))]
+}
+
+func (s *ShardedStore) publicKeyShard(publicKey PublicKey) *publicKeyShard {
+	return &s.publicKeyShards[binary.LittleEndian.Uint32(publicKey[:4])%uint32(len(s.publicKeyShards))]
+}
+
+func (s *ShardedStore) GetReceiverPeer(receiverID ReceiverID) (*Peer, bool) {
+	shard := s.receiverShard(receiverID)
+	shard.RLock()
+	defer shard.RUnlock()
+
+	peer, exists := shard.peers[receiverID]
+	return peer, exists
+}
+
+func (s *ShardedStore) SetReceiverPeer(receiverID ReceiverID, peer *Peer) {
+	shard := s.receiverShard(receiverID)
+	shard.Lock()
+	defer shard.Unlock()
+
+	shard.peers[receiverID] = peer
+}
+
+func (s *ShardedStore) DeleteReceiverPeer(receiverID ReceiverID) {
+	shard := s.receiverShard(receiverID)
+	shard.Lock()
+	defer shard.Unlock()
+
+	delete(shard.peers, receiverID)
+}
+
+// RangeReceiverPeers iterates over a per-shard snapshot, so fn may modify the store.
+func (s *ShardedStore) RangeReceiverPeers(fn func(receiverID ReceiverID, peer *Peer) bool) {
+	for i := range s.receiverShards {
+		shard := &s.receiverShards[i]
+
+		shard.RLock()
+		snapshot := make(map[ReceiverID]*Peer, len(shard.peers))
+		for receiverID, peer := range shard.peers {
+			snapshot[receiverID] = peer
+		}
+		shard.RUnlock()
+
+		for receiverID, peer := range snapshot {
+			if !fn(receiverID, peer) {
+				return
+			}
+		}
+	}
+}
+
+func (s *ShardedStore) GetPublicKeyPeers(publicKey PublicKey) ([]*Peer, bool) {
+	shard := s.publicKeyShard(publicKey)
+	shard.RLock()
+	defer shard.RUnlock()
+
+	peers, exists := shard.peers[publicKey]
+	return peers, exists
+}
+
+// AddPublicKeyPeer appends peer unless a peer with the same address is already present.
+func (s *ShardedStore) AddPublicKeyPeer(publicKey PublicKey, peer *Peer) {
+	shard := s.publicKeyShard(publicKey)
+	shard.Lock()
+	defer shard.Unlock()
+
+	isEqual := func(a, b *Peer) bool {
+		if a == nil || b == nil {
+			return false
+		}
+		return UDPAddrEqual(a.Addr, b.Addr)
+	}
+
+	// Copy on write so slices handed out by GetPublicKeyPeers are never modified.
+	for _, existing := range shard.peers[publicKey] {
+		if isEqual(existing, peer) {
+			return
+		}
+	}
+	peers := append([]*Peer(nil), shard.peers[publicKey]...)
+	shard.peers[publicKey] = append(peers, peer)
+}
+
+func (s *ShardedStore) SetPublicKeyPeers(publicKey PublicKey, peers []*Peer) {
+	shard := s.publicKeyShard(publicKey)
+	shard.Lock()
+	defer shard.Unlock()
+
+	shard.peers[publicKey] = peers
+}
+
+func (s *ShardedStore) DeletePublicKeyPeers(publicKey PublicKey) {
+	shard := s.publicKeyShard(publicKey)
+	shard.Lock()
+	defer shard.Unlock()
+
+	delete(shard.peers, publicKey)
+}
+
+// RangePublicKeyPeers iterates over a per-shard snapshot, so fn may modify the store.
+func (s *ShardedStore) RangePublicKeyPeers(fn func(publicKey PublicKey, peers []*Peer) bool) {
+	for i := range s.publicKeyShards {
+		shard := &s.publicKeyShards[i]
+
+		shard.RLock()
+		snapshot := make(map[PublicKey][]*Peer, len(shard.peers))
+		for publicKey, peers := range shard.peers {
+			snapshot[publicKey] = peers
+		}
+		shard.RUnlock()
+
+		for publicKey, peers := range snapshot {
+			if !fn(publicKey, peers) {
+				return
+			}
+		}
+	}
+}
+
+func (s *ShardedStore) SetMac1Key(publicKey PublicKey, mac1Key Mac1Key) {
+	s.keysMu.Lock()
+	defer s.keysMu.Unlock()
+
+	s.keys.SetMac1Key(publicKey, mac1Key)
+}
+
+func (s *ShardedStore) RangeMac1Keys(fn func(publicKey PublicKey, mac1Key Mac1Key) bool) {
+	s.keysMu.RLock()
+	defer s.keysMu.RUnlock()
+
+	s.keys.RangeMac1Keys(fn)
+}
+
+func (s *ShardedStore) AddPairPublicKey(publicKey, pairPublicKey PublicKey) {
+	s.keysMu.Lock()
+	defer s.keysMu.Unlock()
+
+	s.keys.AddPairPublicKey(publicKey, pairPublicKey)
+}
+
+func (s *ShardedStore) GetPairPublicKeys(publicKey PublicKey) ([]PublicKey, bool) {
+	s.keysMu.RLock()
+	defer s.keysMu.RUnlock()
+
+	return s.keys.GetPairPublicKeys(publicKey)
+}
+
+func (s *ShardedStore) RangePairPublicKeys(fn func(publicKey PublicKey, pairPublicKeys []PublicKey) bool) {
+	s.keysMu.RLock()
+	defer s.keysMu.RUnlock()
+
+	s.keys.RangePairPublicKeys(fn)
+}
+
+var _ ConcurrentPeerStore = (*ShardedStore)(nil)
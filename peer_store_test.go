@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func peerStores() map[string]func() PeerStore {
+	return map[string]func() PeerStore{
+		"memory":  func() PeerStore { return NewMemoryStore() },
+		"sharded": func() PeerStore { return NewShardedStore(4) },
+	}
+}
+
+func TestPeerStoreReceiverPeers(t *testing.T) {
+	for name, newStore := range peerStores() {
+		t.Run(name, func(t *testing.T) {
+			store := newStore()
+			peer := &Peer{Addr: testAddr(t, "192.0.2.1:51820")}
+
+			if _, exists := store.GetReceiverPeer(ReceiverID{1}); exists {
+				t.Fatal("empty store returned a receiver peer")
+			}
+
+			store.SetReceiverPeer(ReceiverID{1}, peer)
+			got, exists := store.GetReceiverPeer(ReceiverID{1})
+			if !exists || got != peer {
+				t.Fatalf("GetReceiverPeer = %v, %v, want the stored peer", got, exists)
+			}
+
+			count := 0
+			store.RangeReceiverPeers(func(receiverID ReceiverID, peer *Peer) bool {
+				count++
+				return true
+			})
+			if count != 1 {
+				t.Errorf("RangeReceiverPeers visited %d entries, want 1", count)
+			}
+
+			store.DeleteReceiverPeer(ReceiverID{1})
+			if _, exists := store.GetReceiverPeer(ReceiverID{1}); exists {
+				t.Error("receiver peer still present after DeleteReceiverPeer")
+			}
+		})
+	}
+}
+
+func TestPeerStorePublicKeyPeersAreUniqueByAddr(t *testing.T) {
+	for name, newStore := range peerStores() {
+		t.Run(name, func(t *testing.T) {
+			store := newStore()
+			publicKey := PublicKey{1}
+
+			store.AddPublicKeyPeer(publicKey, &Peer{Addr: testAddr(t, "192.0.2.1:51820")})
+			store.AddPublicKeyPeer(publicKey, &Peer{Addr: testAddr(t, "192.0.2.1:51820")})
+			store.AddPublicKeyPeer(publicKey, &Peer{Addr: testAddr(t, "192.0.2.2:51820")})
+
+			peers, exists := store.GetPublicKeyPeers(publicKey)
+			if !exists || len(peers) != 2 {
+				t.Fatalf("GetPublicKeyPeers returned %d peers, want 2", len(peers))
+			}
+
+			store.SetPublicKeyPeers(publicKey, peers[:1])
+			if peers, _ := store.GetPublicKeyPeers(publicKey); len(peers) != 1 {
+				t.Errorf("after SetPublicKeyPeers got %d peers, want 1", len(peers))
+			}
+
+			store.DeletePublicKeyPeers(publicKey)
+			if _, exists := store.GetPublicKeyPeers(publicKey); exists {
+				t.Error("public key peers still present after DeletePublicKeyPeers")
+			}
+		})
+	}
+}
+
+func TestPeerStoreKeyPairs(t *testing.T) {
+	for name, newStore := range peerStores() {
+		t.Run(name, func(t *testing.T) {
+			store := newStore()
+
+			store.AddPairPublicKey(PublicKey{1}, PublicKey{2})
+			store.AddPairPublicKey(PublicKey{1}, PublicKey{2})
+			store.AddPairPublicKey(PublicKey{1}, PublicKey{3})
+			pairs, exists := store.GetPairPublicKeys(PublicKey{1})
+			if !exists || len(pairs) != 2 || pairs[0] != (PublicKey{2}) || pairs[1] != (PublicKey{3}) {
+				t.Errorf("GetPairPublicKeys = %v, %v, want [2 3] in insertion order", pairs, exists)
+			}
+
+			store.SetMac1Key(PublicKey{1}, Mac1Key{9})
+			var mac1Keys []Mac1Key
+			store.RangeMac1Keys(func(publicKey PublicKey, mac1Key Mac1Key) bool {
+				mac1Keys = append(mac1Keys, mac1Key)
+				return true
+			})
+			if len(mac1Keys) != 1 || mac1Keys[0] != (Mac1Key{9}) {
+				t.Errorf("RangeMac1Keys = %v, want [9]", mac1Keys)
+			}
+		})
+	}
+}
+
+// TestMemoryStoreMatchesPeerManagerMaps checks that a handshake initiation is
+// recorded in the same maps the PeerManager used before stores existed.
+func TestMemoryStoreMatchesPeerManagerMaps(t *testing.T) {
+	publicKeyA, publicKeyB := testKeys(t)
+	store := NewMemoryStore()
+	pm := NewPeerManagerWithStore(store, &captureSender{}, []PublicKeyPair{{PublicKey1: publicKeyA, PublicKey2: publicKeyB}}, NewLogger(LogLevelError), 0)
+	addrA := testAddr(t, "192.0.2.1:51820")
+
+	if err := pm.HandlePacket(context.Background(), addrA, mustBuildInitiation(t, publicKeyB, SenderID{1, 2, 3, 4})); err != nil {
+		t.Fatalf("HandlePacket: %v", err)
+	}
+
+	if len(store.PublicKeyToMac1KeyMap) != 2 || len(store.PublicKeyToPairPublicKeysMap) != 2 {
+		t.Errorf("key maps have %d mac1 keys and %d pairs, want 2 and 2", len(store.PublicKeyToMac1KeyMap), len(store.PublicKeyToPairPublicKeysMap))
+	}
+
+	peer, exists := store.ReceiverToPeerMap[ReceiverID{1, 2, 3, 4}]
+	if !exists || !UDPAddrEqual(peer.Addr, addrA) {
+		t.Fatalf("ReceiverToPeerMap entry = %v, %v, want peer A", peer, exists)
+	}
+
+	peers := store.PublicKeyToPeersMap[publicKeyA]
+	if len(peers) != 1 || peers[0] != peer {
+		t.Errorf("PublicKeyToPeersMap[A] = %v, want the receiver entry's peer", peers)
+	}
+}
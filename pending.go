@@ -0,0 +1,109 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultPendingMaxPackets bounds the packets held by a PendingBuffer.
+const DefaultPendingMaxPackets = 1024
+
+// pendingPerReceiver bounds the packets held for a single receiver ID.
+const pendingPerReceiver = 16
+
+type pendingPacket struct {
+	data  []byte
+	added time.Time
+}
+
+// PendingBuffer briefly holds Type3/4 packets whose receiver ID is not known
+// yet, so that a transport packet overtaking the handshake response that
+// teaches the relay its receiver is delivered instead of dropped. Held packets
+// are copies, as handlers must not retain the payload they are given.
+type PendingBuffer struct {
+	mu         sync.Mutex
+	timeout    time.Duration
+	maxPackets int
+	total      int
+	packets    map[ReceiverID][]pendingPacket
+}
+
+func NewPendingBuffer(timeout time.Duration, maxPackets int) *PendingBuffer {
+	if maxPackets <= 0 {
+		maxPackets = DefaultPendingMaxPackets
+	}
+	return &PendingBuffer{
+		timeout:    timeout,
+		maxPackets: maxPackets,
+		packets:    make(map[ReceiverID][]pendingPacket),
+	}
+}
+
+// Add holds a copy of payload for receiverID. It reports false when the
+// buffer or the receiver's share of it is full.
+func (b *PendingBuffer) Add(receiverID ReceiverID, payload []byte, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.total >= b.maxPackets {
+		b.expire(now)
+	}
+	if b.total >= b.maxPackets || len(b.packets[receiverID]) >= pendingPerReceiver {
+		return false
+	}
+
+	data := make([]byte, len(payload))
+	copy(data, payload)
+	b.packets[receiverID] = append(b.packets[receiverID], pendingPacket{data: data, added: now})
+	b.total++
+	return true
+}
+
+// Take removes and returns the packets held for receiverID that have not expired.
+func (b *PendingBuffer) Take(receiverID ReceiverID, now time.Time) [][]byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	packets, exists := b.packets[receiverID]
+	if !exists {
+		return nil
+	}
+	delete(b.packets, receiverID)
+	b.total -= len(packets)
+
+	var result [][]byte
+	for _, packet := range packets {
+		if now.Sub(packet.added) <= b.timeout {
+			result = append(result, packet.data)
+		}
+	}
+	return result
+}
+
+// Expire drops packets held for longer than the timeout and returns how many.
+func (b *PendingBuffer) Expire(now time.Time) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.expire(now)
+}
+
+func (b *PendingBuffer) expire(now time.Time) int {
+	expired := 0
+	for receiverID, packets := range b.packets {
+		kept := packets[:0]
+		for _, packet := range packets {
+			if now.Sub(packet.added) <= b.timeout {
+				kept = append(kept, packet)
+			}
+		}
+		expired += len(packets) - len(kept)
+		if len(kept) == 0 {
+			delete(b.packets, receiverID)
+		} else {
+			b.packets[receiverID] = kept
+		}
+	}
+	b.total -= expired
+	return expired
+}
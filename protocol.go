@@ -0,0 +1,122 @@
+package main
+
+import "fmt"
+
+// maxMAC1LabelLength bounds a custom mac1 label; WireGuard's is 8 bytes.
+const maxMAC1LabelLength = 64
+
+// Protocol holds the wire constants that identify WireGuard messages, so that
+// modified WireGuard variants using other values can be relayed. The relay
+// works with MessageTypeInitiation to MessageTypeTransport internally and maps
+// type bytes on the wire through the active Protocol.
+type Protocol struct {
+	LabelMAC1       string
+	TypeInitiation  byte
+	TypeResponse    byte
+	TypeCookieReply byte
+	TypeTransport   byte
+}
+
+// DefaultProtocol is standard WireGuard.
+var DefaultProtocol = Protocol{
+	LabelMAC1:       WGLabelMAC1,
+	TypeInitiation:  MessageTypeInitiation,
+	TypeResponse:    MessageTypeResponse,
+	TypeCookieReply: MessageTypeCookieReply,
+	TypeTransport:   MessageTypeTransport,
+}
+
+// protocol is the active Protocol. It is only changed by SetProtocol at
+// startup, before any PeerManager computes mac1 keys.
+var protocol = DefaultProtocol
+
+// SetProtocol validates p and makes it the active Protocol. protocol is read
+// without synchronization, so SetProtocol must be called before any goroutine
+// that handles packets is started. An invalid p leaves the active Protocol
+// unchanged.
+func SetProtocol(p Protocol) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	protocol = p
+	return nil
+}
+
+func (p Protocol) Validate() error {
+	if len(p.LabelMAC1) == 0 || len(p.LabelMAC1) > maxMAC1LabelLength {
+		return fmt.Errorf("mac1 label must be 1 to %d bytes, got %d", maxMAC1LabelLength, len(p.LabelMAC1))
+	}
+
+	types := p.typeBytes()
+	for i := range types {
+		if types[i] == 0 {
+			return fmt.Errorf("message type %d must not be 0", i+1)
+		}
+		for j := i + 1; j < len(types); j++ {
+			if types[i] == types[j] {
+				return fmt.Errorf("message types %d and %d both use type byte %d", i+1, j+1, types[i])
+			}
+		}
+	}
+	return nil
+}
+
+func (p Protocol) typeBytes() [MessageTypeTransport]byte {
+	return [MessageTypeTransport]byte{p.TypeInitiation, p.TypeResponse, p.TypeCookieReply, p.TypeTransport}
+}
+
+// MessageType maps a type byte on the wire to MessageTypeInitiation to
+// MessageTypeTransport, or returns 0 for an unknown type.
+func (p Protocol) MessageType(typeByte byte) byte {
+	for i, b := range p.typeBytes() {
+		if b == typeByte {
+			return byte(i + 1)
+		}
+	}
+	return 0
+}
+
+// TypeByte returns the type byte sent on the wire for messageType.
+func (p Protocol) TypeByte(messageType byte) byte {
+	types := p.typeBytes()
+	if messageType < MessageTypeInitiation || messageType > MessageTypeTransport {
+		return messageType
+	}
+	return types[messageType-1]
+}
+
+// IsDefault reports whether p is standard WireGuard.
+func (p Protocol) IsDefault() bool {
+	return p == DefaultProtocol
+}
+
+// LoadProtocolFromConfig returns the Protocol described by config, with unset
+// values taken from DefaultProtocol.
+func LoadProtocolFromConfig(config ProtocolConfig) (Protocol, error) {
+	p := DefaultProtocol
+	if config.MAC1Label != "" {
+		p.LabelMAC1 = config.MAC1Label
+	}
+
+	overrides := []struct {
+		value int
+		field *byte
+		name  string
+	}{
+		{config.TypeInitiation, &p.TypeInitiation, "type_initiation"},
+		{config.TypeResponse, &p.TypeResponse, "type_response"},
+		{config.TypeCookieReply, &p.TypeCookieReply, "type_cookie_reply"},
+		{config.TypeTransport, &p.TypeTransport, "type_transport"},
+	}
+	for _, override := range overrides {
+		if override.value == 0 {
+			continue
+		}
+		if override.value < 1 || override.value > 255 {
+			return p, fmt.Errorf("%s must be between 1 and 255, got %d", override.name, override.value)
+		}
+		*override.field = byte(override.value)
+	}
+
+	return p, p.Validate()
+}
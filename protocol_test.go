@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// useProtocol makes p the active Protocol for the rest of the test.
+func useProtocol(t *testing.T, p Protocol) {
+	t.Helper()
+	if err := SetProtocol(p); err != nil {
+		t.Fatalf("SetProtocol: %v", err)
+	}
+	t.Cleanup(func() { protocol = DefaultProtocol })
+}
+
+func TestCustomMAC1Label(t *testing.T) {
+	publicKeyA, publicKeyB := testKeys(t)
+	standard := mustBuildInitiation(t, publicKeyB, SenderID{1})
+
+	variant := DefaultProtocol
+	variant.LabelMAC1 = "mac1-variant----"
+	useProtocol(t, variant)
+
+	pm, _ := newTestPeerManager(t, &captureSender{})
+	ctx := context.Background()
+
+	publicKey, err := pm.CheckMAC1AndGetPublicKey(ctx, mustBuildInitiation(t, publicKeyB, SenderID{2}))
+	if err != nil || *publicKey != publicKeyB {
+		t.Errorf("packet with the custom label: %v, %v, want B's key", publicKey, err)
+	}
+	if _, err := pm.CheckMAC1AndGetPublicKey(ctx, standard); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Errorf("packet with the standard label: err = %v, want ErrAuthenticationFailed", err)
+	}
+
+	// The whole handshake works with the variant's keys.
+	learnInitiator(t, pm, "192.0.2.1:51820", SenderID{3})
+	if err := pm.HandlePacket(ctx, testAddr(t, "192.0.2.2:51820"), mustBuildResponse(t, publicKeyA, SenderID{4}, ReceiverID{3})); err != nil {
+		t.Errorf("response with the custom label: %v", err)
+	}
+}
+
+func TestCustomMessageTypes(t *testing.T) {
+	publicKeyA, publicKeyB := testKeys(t)
+	variant := Protocol{LabelMAC1: WGLabelMAC1, TypeInitiation: 0x11, TypeResponse: 0x12, TypeCookieReply: 0x13, TypeTransport: 0x14}
+	useProtocol(t, variant)
+
+	sender := &captureSender{}
+	pm, _ := newTestPeerManager(t, sender)
+	ctx := context.Background()
+
+	initiation := mustBuildInitiation(t, publicKeyB, SenderID{1})
+	if initiation[0] != 0x11 {
+		t.Fatalf("initiation type byte = %#x, want 0x11", initiation[0])
+	}
+	if err := pm.HandlePacket(ctx, testAddr(t, "192.0.2.1:51820"), initiation); err != nil {
+		t.Fatalf("initiation: %v", err)
+	}
+	if err := pm.HandlePacket(ctx, testAddr(t, "192.0.2.2:51820"), mustBuildResponse(t, publicKeyA, SenderID{2}, ReceiverID{1})); err != nil {
+		t.Fatalf("response: %v", err)
+	}
+	if sent := sender.Sent(); len(sent) != 1 || sent[0].payload[0] != 0x12 {
+		t.Errorf("relay sent %d packets, want the response with its type byte unchanged", len(sent))
+	}
+}
+
+func TestLoadProtocolFromConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  ProtocolConfig
+		wantErr bool
+	}{
+		{"defaults", ProtocolConfig{}, false},
+		{"custom label", ProtocolConfig{MAC1Label: "variant-mac1"}, false},
+		{"label too long", ProtocolConfig{MAC1Label: string(make([]byte, maxMAC1LabelLength+1))}, true},
+		{"custom types", ProtocolConfig{TypeInitiation: 11, TypeResponse: 12, TypeCookieReply: 13, TypeTransport: 14}, false},
+		{"duplicate types", ProtocolConfig{TypeInitiation: 2}, true},
+		{"type out of range", ProtocolConfig{TypeTransport: 256}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := LoadProtocolFromConfig(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadProtocolFromConfig: err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.config == (ProtocolConfig{}) && !p.IsDefault() {
+				t.Errorf("empty config gave %+v, want DefaultProtocol", p)
+			}
+		})
+	}
+}
+
+func TestSetProtocolRejectsInvalid(t *testing.T) {
+	variant := Protocol{LabelMAC1: WGLabelMAC1, TypeInitiation: 0x11, TypeResponse: 0x12, TypeCookieReply: 0x13, TypeTransport: 0x14}
+	useProtocol(t, variant)
+
+	invalid := variant
+	invalid.TypeTransport = invalid.TypeInitiation
+	if err := SetProtocol(invalid); err == nil {
+		t.Fatal("SetProtocol accepted duplicate type bytes")
+	}
+	if protocol != variant {
+		t.Errorf("active protocol = %+v after a rejected SetProtocol, want %+v", protocol, variant)
+	}
+}
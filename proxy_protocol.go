@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+)
+
+var proxyProtocolV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+const (
+	proxyProtocolV2HeaderLen = 16
+
+	proxyProtocolV2CmdLocal = 0x0
+	proxyProtocolV2CmdProxy = 0x1
+
+	proxyProtocolV2FamilyInet  = 0x1
+	proxyProtocolV2FamilyInet6 = 0x2
+
+	proxyProtocolV2AddrLenInet  = 12
+	proxyProtocolV2AddrLenInet6 = 36
+)
+
+// ParseProxyProtocolV2 strips a PROXY protocol v2 header from data.
+// It returns the source address conveyed by the header, or from when the
+// header carries a LOCAL command, together with the remaining payload.
+func ParseProxyProtocolV2(from *net.UDPAddr, data []byte) (*net.UDPAddr, []byte, error) {
+	if len(data) < proxyProtocolV2HeaderLen {
+		return nil, nil, NewInvalidPacketError("PROXY v2 header too short")
+	}
+
+	if !bytes.Equal(data[:len(proxyProtocolV2Signature)], proxyProtocolV2Signature) {
+		return nil, nil, NewInvalidPacketError("missing PROXY v2 signature")
+	}
+
+	versionCommand := data[12]
+	if versionCommand>>4 != 0x2 {
+		return nil, nil, NewInvalidPacketError("unsupported PROXY protocol version")
+	}
+
+	addrLen := int(binary.BigEndian.Uint16(data[14:16]))
+	end := proxyProtocolV2HeaderLen + addrLen
+	if len(data) < end {
+		return nil, nil, NewInvalidPacketError("truncated PROXY v2 header")
+	}
+
+	addrData := data[proxyProtocolV2HeaderLen:end]
+	payload := data[end:]
+
+	switch versionCommand & 0x0F {
+	case proxyProtocolV2CmdLocal:
+		return from, payload, nil
+	case proxyProtocolV2CmdProxy:
+	default:
+		return nil, nil, NewInvalidPacketError("unsupported PROXY v2 command")
+	}
+
+	switch data[13] >> 4 {
+	case proxyProtocolV2FamilyInet:
+		if addrLen < proxyProtocolV2AddrLenInet {
+			return nil, nil, NewInvalidPacketError("invalid PROXY v2 IPv4 address block")
+		}
+		ip := make(net.IP, net.IPv4len)
+		copy(ip, addrData[0:4])
+		port := binary.BigEndian.Uint16(addrData[8:10])
+		return &net.UDPAddr{IP: ip, Port: int(port)}, payload, nil
+
+	case proxyProtocolV2FamilyInet6:
+		if addrLen < proxyProtocolV2AddrLenInet6 {
+			return nil, nil, NewInvalidPacketError("invalid PROXY v2 IPv6 address block")
+		}
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, addrData[0:16])
+		port := binary.BigEndian.Uint16(addrData[32:34])
+		return NormalizeUDPAddr(&net.UDPAddr{IP: ip, Port: int(port)}), payload, nil
+
+	default:
+		return nil, nil, NewInvalidPacketError("unsupported PROXY v2 address family")
+	}
+}
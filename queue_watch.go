@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// DefaultQueueFullWindow is the window the queue drop rate is measured over.
+const DefaultQueueFullWindow = 10 * time.Second
+
+// QueueDropStats summarizes the packets Submit accepted and refused over one window.
+type QueueDropStats struct {
+	Window        time.Duration
+	Submitted     uint64
+	Dropped       uint64
+	DropRate      float64
+	QueueDepth    int
+	QueueCapacity int
+}
+
+func (s QueueDropStats) String() string {
+	return fmt.Sprintf("window=%v submitted=%d dropped=%d drop_rate=%.3f queue_depth=%d of %d",
+		s.Window, s.Submitted, s.Dropped, s.DropRate, s.QueueDepth, s.QueueCapacity)
+}
+
+// SetOnQueueFull calls fn, at most once per window, when more than threshold
+// of the packets submitted during that window were dropped because the queue
+// was full. fn runs on its own goroutine and should not block for long. Call
+// it before Start; a nil fn disables the hook.
+func (wp *WorkerPool) SetOnQueueFull(threshold float64, window time.Duration, fn func(QueueDropStats)) {
+	if window <= 0 {
+		window = DefaultQueueFullWindow
+	}
+	wp.queueFullThreshold = threshold
+	wp.queueFullWindow = window
+	wp.onQueueFull = fn
+}
+
+// watchQueue evaluates the drop rate every window until ctx is cancelled.
+func (wp *WorkerPool) watchQueue(ctx context.Context) {
+	ticker := time.NewTicker(wp.queueFullWindow)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if stats, full := wp.queueDropWindow(); full {
+				wp.onQueueFull(stats)
+			}
+		}
+	}
+}
+
+// queueDropWindow returns the drop stats since the previous call and whether
+// they exceed the threshold.
+func (wp *WorkerPool) queueDropWindow() (QueueDropStats, bool) {
+	stats := QueueDropStats{
+		Window:        wp.queueFullWindow,
+		Submitted:     wp.submitted.Swap(0),
+		Dropped:       wp.queueDropped.Swap(0),
+		QueueDepth:    wp.QueueDepth(),
+		QueueCapacity: wp.QueueCapacity(),
+	}
+	if stats.Dropped == 0 {
+		return stats, false
+	}
+	stats.DropRate = float64(stats.Dropped) / float64(stats.Submitted)
+	return stats, stats.DropRate > wp.queueFullThreshold
+}
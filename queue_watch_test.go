@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestQueueDropWindow(t *testing.T) {
+	handler := func(ctx context.Context, addr *net.UDPAddr, payload []byte) error { return nil }
+	wp := NewWorkerPool(WorkerPoolConfig{MaxWorkers: 1}, handler, NewLogger(LogLevelError))
+	wp.SetOnQueueFull(0.5, time.Second, func(QueueDropStats) {})
+	addr := testAddr(t, "192.0.2.1:51820")
+
+	// Not started, so the queue of 2 fills and the third packet is dropped.
+	for range 3 {
+		wp.Submit(addr, []byte{MessageTypeTransport})
+	}
+	stats, full := wp.queueDropWindow()
+	if full || stats.Submitted != 3 || stats.Dropped != 1 {
+		t.Errorf("one of three dropped: %s, full=%v, want below the threshold", stats, full)
+	}
+	if stats.QueueDepth != 2 || stats.QueueCapacity != 2 {
+		t.Errorf("queue depth %d of %d, want 2 of 2", stats.QueueDepth, stats.QueueCapacity)
+	}
+
+	for range 3 {
+		wp.Submit(addr, []byte{MessageTypeTransport})
+	}
+	if stats, full := wp.queueDropWindow(); !full || stats.DropRate != 1 {
+		t.Errorf("every packet dropped: %s, full=%v, want above the threshold", stats, full)
+	}
+
+	// Each window starts from zero.
+	if stats, full := wp.queueDropWindow(); full || stats.Submitted != 0 || stats.Dropped != 0 {
+		t.Errorf("idle window: %s, full=%v, want nothing counted", stats, full)
+	}
+}
+
+func TestOnQueueFullFiresWhenSaturated(t *testing.T) {
+	release := make(chan struct{})
+	blocked := func(ctx context.Context, addr *net.UDPAddr, payload []byte) error {
+		<-release
+		return nil
+	}
+	wp := NewWorkerPool(WorkerPoolConfig{MaxWorkers: 1}, blocked, NewLogger(LogLevelError))
+	fired := make(chan QueueDropStats, 10)
+	wp.SetOnQueueFull(0.5, 20*time.Millisecond, func(stats QueueDropStats) {
+		fired <- stats
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wp.Start(ctx)
+	defer func() {
+		close(release)
+		cancel()
+		wp.Shutdown()
+	}()
+
+	// The only worker is stuck, so at most three packets get in: one being
+	// handled and two queued.
+	addr := testAddr(t, "192.0.2.1:51820")
+	for range 100 {
+		wp.Submit(addr, []byte{MessageTypeTransport})
+	}
+
+	select {
+	case stats := <-fired:
+		// A window may end midway through the burst, so only the rate is exact.
+		if stats.Submitted == 0 || stats.Submitted > 100 || stats.DropRate <= 0.5 {
+			t.Errorf("hook got %s, want most of up to 100 packets dropped", stats)
+		}
+		if stats.Window != 20*time.Millisecond || stats.QueueCapacity != 2 {
+			t.Errorf("hook got window %v and capacity %d, want 20ms and 2", stats.Window, stats.QueueCapacity)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("queue full hook did not fire")
+	}
+
+	// Once the burst's windows have passed, the hook stays quiet.
+	time.Sleep(50 * time.Millisecond)
+	for len(fired) > 0 {
+		<-fired
+	}
+	select {
+	case stats := <-fired:
+		t.Errorf("hook fired again without new drops: %s", stats)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestOnQueueFullDisabledByDefault(t *testing.T) {
+	handler := func(ctx context.Context, addr *net.UDPAddr, payload []byte) error { return nil }
+	wp := NewWorkerPool(WorkerPoolConfig{MaxWorkers: 1}, handler, NewLogger(LogLevelError))
+	if wp.onQueueFull != nil {
+		t.Error("a new worker pool has a queue full hook")
+	}
+}
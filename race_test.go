@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// runConcurrently runs each fn in its own goroutine, iterations times, and
+// waits for all of them. Run with -race to detect unsynchronized access.
+func runConcurrently(iterations int, fns ...func(i int)) {
+	var wg sync.WaitGroup
+	for _, fn := range fns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range iterations {
+				fn(i)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestConcurrentForwardCleanupAndPeerReads(t *testing.T) {
+	publicKeyA, publicKeyB := testKeys(t)
+	pm, clock := newTestPeerManager(t, &captureSender{})
+	ctx := context.Background()
+	learnInitiator(t, pm, "192.0.2.1:51820", SenderID{1})
+
+	runConcurrently(200,
+		func(i int) {
+			addr := testAddr(t, fmt.Sprintf("192.0.2.%d:51820", i%50+1))
+			pm.HandlePacket(ctx, addr, mustBuildInitiation(t, publicKeyB, SenderID{byte(i)}))
+		},
+		func(i int) {
+			addr := testAddr(t, fmt.Sprintf("198.51.100.%d:51820", i%50+1))
+			pm.HandlePacket(ctx, addr, mustBuildInitiation(t, publicKeyA, SenderID{byte(i), 1}))
+		},
+		func(i int) {
+			clock.Advance(time.Second)
+			pm.CleanupPeers()
+		},
+		func(i int) {
+			peers, _, _ := pm.GetPublicKeyToPeers(ctx, publicKeyA)
+			for _, peer := range peers {
+				_ = peer.Addr.String()
+				peer.Addr.Port++
+				peer.Timestamp = time.Time{}
+			}
+		},
+		func(i int) {
+			if peer, exists, _ := pm.GetPeerByReceiverID(ctx, ReceiverID{byte(i)}); exists {
+				peer.Addr.IP[0]++
+			}
+		},
+	)
+}
+
+func TestConcurrentRoamingAndForwarding(t *testing.T) {
+	publicKeyA, _ := testKeys(t)
+	pm, _ := newTestPeerManager(t, &captureSender{})
+	pm.SetLearnFromTransport(true)
+	ctx := context.Background()
+
+	learnInitiator(t, pm, "192.0.2.1:51820", SenderID{1, 1, 1, 1})
+	if err := pm.HandlePacket(ctx, testAddr(t, "192.0.2.2:51820"), mustBuildResponse(t, publicKeyA, SenderID{2, 2, 2, 2}, ReceiverID{1, 1, 1, 1})); err != nil {
+		t.Fatalf("response: %v", err)
+	}
+
+	transport := func(receiverID ReceiverID) []byte {
+		packet := make([]byte, 32)
+		packet[0] = MessageTypeTransport
+		copy(packet[4:8], receiverID[:])
+		return packet
+	}
+
+	runConcurrently(200,
+		func(i int) {
+			// A roams between addresses while sending to B.
+			addr := testAddr(t, fmt.Sprintf("203.0.113.%d:51820", i%10+1))
+			pm.HandlePacket(ctx, addr, transport(ReceiverID{2, 2, 2, 2}))
+		},
+		func(i int) {
+			pm.HandlePacket(ctx, testAddr(t, "192.0.2.2:51820"), transport(ReceiverID{1, 1, 1, 1}))
+		},
+		func(i int) {
+			if peer, exists, _ := pm.GetPeerByReceiverID(ctx, ReceiverID{1, 1, 1, 1}); exists {
+				_ = peer.Addr.String()
+			}
+		},
+		func(i int) {
+			pm.CleanupPeers()
+		},
+	)
+
+	if got := pm.Stats().Snapshot().TransportRoamed; got == 0 {
+		t.Error("no transport packet moved A's receiver entry")
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rateLimiterIdleTimeout is how long an unused bucket is kept before it is swept.
+const rateLimiterIdleTimeout = time.Minute
+
+type tokenBucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// RateLimiter is a set of token buckets keyed by an arbitrary string, such as
+// a destination address.
+type RateLimiter struct {
+	sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	sources   *SourceTracker
+}
+
+// sourceKindRateLimit is the SourceTracker kind of rate limiter buckets.
+const sourceKindRateLimit = "rate_limit"
+
+// SetSourceTracker keeps the buckets in a shared, bounded SourceTracker
+// instead of a private map that is only swept of idle entries.
+func (rl *RateLimiter) SetSourceTracker(sources *SourceTracker) {
+	rl.sources = sources
+}
+
+// bucket returns the bucket for key, creating a full one when there is none.
+func (rl *RateLimiter) bucket(key string, now time.Time) *tokenBucket {
+	if rl.sources != nil {
+		if value, exists := rl.sources.Get(sourceKindRateLimit, key); exists {
+			return value.(*tokenBucket)
+		}
+		bucket := &tokenBucket{tokens: rl.burst, lastSeen: now}
+		rl.sources.Put(sourceKindRateLimit, key, bucket)
+		return bucket
+	}
+
+	if now.Sub(rl.lastSweep) >= rateLimiterIdleTimeout {
+		for k, bucket := range rl.buckets {
+			if now.Sub(bucket.lastSeen) >= rateLimiterIdleTimeout {
+				delete(rl.buckets, k)
+			}
+		}
+		rl.lastSweep = now
+	}
+
+	bucket, exists := rl.buckets[key]
+	if !exists {
+		bucket = &tokenBucket{tokens: rl.burst, lastSeen: now}
+		rl.buckets[key] = bucket
+	}
+	return bucket
+}
+
+// NewRateLimiter allows rate events per second per key with bursts of up to burst.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = int(rate)
+	}
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &RateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Allow consumes a token for key and reports whether one was available.
+func (rl *RateLimiter) Allow(key string, now time.Time) bool {
+	rl.Lock()
+	defer rl.Unlock()
+
+	bucket := rl.bucket(key, now)
+	bucket.tokens += now.Sub(bucket.lastSeen).Seconds() * rl.rate
+	if bucket.tokens > rl.burst {
+		bucket.tokens = rl.burst
+	}
+	bucket.lastSeen = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+
+	bucket.tokens--
+	return true
+}
+
+// LogThrottle lets a repeated log message through at most once per interval.
+type LogThrottle struct {
+	interval time.Duration
+	last     atomic.Int64
+}
+
+func NewLogThrottle(interval time.Duration) *LogThrottle {
+	return &LogThrottle{interval: interval}
+}
+
+// Allow reports whether the message may be logged now.
+func (t *LogThrottle) Allow(now time.Time) bool {
+	last := t.last.Load()
+	if last != 0 && now.UnixNano()-last < int64(t.interval) {
+		return false
+	}
+	return t.last.CompareAndSwap(last, now.UnixNano())
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// UDPConn is the subset of *net.UDPConn used by the relay.
+type UDPConn interface {
+	ReadFromUDP(b []byte) (int, *net.UDPAddr, error)
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+	SetReadDeadline(t time.Time) error
+	Close() error
+}
+
+var _ UDPConn = (*net.UDPConn)(nil)
+
+// receiveReadTimeout bounds each read so the loop notices context cancellation.
+const receiveReadTimeout = 1 * time.Second
+
+// Receiver reads datagrams from a UDPConn and submits them to a WorkerPool.
+type Receiver struct {
+	conn          UDPConn
+	bufferPool    *BufferPool
+	workerPool    *WorkerPool
+	stats         *PacketStats
+	logger        LoggerInterface
+	proxyProtocol bool
+	draining      bool
+	rateLimiter   *RateLimiter
+	rateLimitLog  *LogThrottle
+	sourceFilter  *SourceFilter
+	maxPackets    uint64
+	received      *atomic.Uint64
+}
+
+func NewReceiver(conn UDPConn, bufferPool *BufferPool, workerPool *WorkerPool, stats *PacketStats, logger LoggerInterface, proxyProtocol bool) *Receiver {
+	return &Receiver{
+		conn:          conn,
+		bufferPool:    bufferPool,
+		workerPool:    workerPool,
+		stats:         stats,
+		logger:        logger,
+		proxyProtocol: proxyProtocol,
+		rateLimitLog:  NewLogThrottle(10 * time.Second),
+		received:      new(atomic.Uint64),
+	}
+}
+
+// SetSourceFilter drops packets from sources filter does not allow, before
+// they reach the worker pool.
+func (r *Receiver) SetSourceFilter(filter *SourceFilter) {
+	r.sourceFilter = filter
+}
+
+// SetRateLimiter caps the datagrams the relay processes as a whole; packets
+// beyond the limit are dropped right after they are read.
+func (r *Receiver) SetRateLimiter(rateLimiter *RateLimiter) {
+	r.rateLimiter = rateLimiter
+}
+
+// SetMaxPackets makes Run return once n datagrams have been read; 0 means no
+// limit. Receivers sharing the received counter stop at n datagrams in total.
+func (r *Receiver) SetMaxPackets(n uint64, received *atomic.Uint64) {
+	r.maxPackets = n
+	r.received = received
+}
+
+// Run reads packets until ctx is cancelled or the SetMaxPackets limit is reached.
+func (r *Receiver) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+			r.receive()
+			if r.maxPackets > 0 && r.received.Load() >= r.maxPackets {
+				return
+			}
+		}
+	}
+}
+
+// Drain keeps receiving for timeout after Run returns so that handshakes and
+// transport data of existing tunnels are still relayed during a restart, while
+// new handshake initiations are dropped.
+func (r *Receiver) Drain(timeout time.Duration) {
+	r.draining = true
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		r.receive()
+	}
+}
+
+// receive reads and dispatches a single datagram.
+func (r *Receiver) receive() {
+	buffer := r.bufferPool.Get()
+	defer r.bufferPool.Put(buffer)
+
+	readDeadline := time.Now().Add(receiveReadTimeout)
+	if r.draining {
+		readDeadline = time.Now().Add(100 * time.Millisecond)
+	}
+	if err := r.conn.SetReadDeadline(readDeadline); err != nil {
+		r.logger.Error("Failed to set read deadline: %v", err)
+		return
+	}
+
+	n, remoteAddr, err := r.conn.ReadFromUDP(buffer)
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return
+		}
+		r.logger.Error("Packet reading error: %v", err)
+		return
+	}
+	r.received.Add(1)
+
+	// A datagram that fills the whole buffer may have been truncated by the read.
+	if n == len(buffer) {
+		r.stats.IncTruncated()
+		r.logger.Warning("Dropping possibly truncated packet from %s: size=%d bytes fills buffer_size", remoteAddr, n)
+		return
+	}
+
+	if r.rateLimiter != nil {
+		now := time.Now()
+		if !r.rateLimiter.Allow("", now) {
+			r.stats.IncGlobalRateLimited()
+			if r.rateLimitLog.Allow(now) {
+				r.logger.Warning("Global rate limit exceeded, dropping packets")
+			}
+			return
+		}
+	}
+
+	remoteAddr = NormalizeUDPAddr(remoteAddr)
+
+	payload := buffer[:n]
+	if r.proxyProtocol {
+		// Strip the header before copying so that the pooled copy keeps the
+		// capacity Put matches size classes by.
+		remoteAddr, payload, err = ParseProxyProtocolV2(remoteAddr, payload)
+		if err != nil {
+			r.stats.IncProxyInvalid()
+			r.logger.Debug("Dropping packet with invalid PROXY header: %v", err)
+			return
+		}
+	}
+
+	packetData := r.bufferPool.GetSize(len(payload))
+	copy(packetData, payload)
+
+	if !r.sourceFilter.Allowed(remoteAddr) {
+		r.bufferPool.Put(packetData)
+		r.stats.IncSourceDenied()
+		return
+	}
+
+	if r.draining && len(packetData) > 0 && protocol.MessageType(packetData[0]) == MessageTypeInitiation {
+		r.bufferPool.Put(packetData)
+		r.stats.IncDrainRejected()
+		r.logger.Debug("Draining, dropped handshake initiation from %s", remoteAddr)
+		return
+	}
+
+	// On success the worker returns packetData to the pool once it is handled.
+	if !r.workerPool.Submit(remoteAddr, packetData) {
+		r.bufferPool.Put(packetData)
+		r.logger.Warning("Worker pool queue is full, packet dropped")
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeRead is one scripted result of fakeConn.ReadFromUDP.
+type fakeRead struct {
+	data []byte
+	addr *net.UDPAddr
+	err  error
+}
+
+// fakeConn is a UDPConn whose reads follow a script. Once the script is
+// exhausted every read times out. Writes are recorded; writeN, when set,
+// returns the byte count reported for a write of n bytes.
+type fakeConn struct {
+	sync.Mutex
+	reads  []fakeRead
+	writes []sentPacket
+	writeN func(n int) int
+}
+
+func (c *fakeConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	c.Lock()
+	defer c.Unlock()
+	if len(c.reads) == 0 {
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+	read := c.reads[0]
+	c.reads = c.reads[1:]
+	if read.err != nil {
+		return 0, nil, read.err
+	}
+	return copy(b, read.data), read.addr, nil
+}
+
+func (c *fakeConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	c.Lock()
+	defer c.Unlock()
+	c.writes = append(c.writes, sentPacket{to: addr, payload: append([]byte(nil), b...)})
+	if c.writeN != nil {
+		return c.writeN(len(b)), nil
+	}
+	return len(b), nil
+}
+
+func (c *fakeConn) SetReadDeadline(t time.Time) error { return nil }
+
+func (c *fakeConn) Close() error { return nil }
+
+// handledPackets collects the payloads a WorkerPool handled.
+type handledPackets struct {
+	sync.Mutex
+	payloads [][]byte
+}
+
+func (h *handledPackets) handle(ctx context.Context, addr *net.UDPAddr, payload []byte) error {
+	h.Lock()
+	defer h.Unlock()
+	h.payloads = append(h.payloads, append([]byte(nil), payload...))
+	return nil
+}
+
+// receiveAll runs a Receiver over conn until its script is exhausted and
+// returns the payloads that reached the worker pool.
+func receiveAll(t *testing.T, conn *fakeConn, bufferSize int, stats *PacketStats) [][]byte {
+	t.Helper()
+	handled := &handledPackets{}
+	workerPool := NewWorkerPool(WorkerPoolConfig{MaxWorkers: 1}, handled.handle, NewLogger(LogLevelError))
+	workerPool.Start(context.Background())
+
+	receiver := NewReceiver(conn, NewBufferPool(4, bufferSize), workerPool, stats, NewLogger(LogLevelError), false)
+	for {
+		conn.Lock()
+		remaining := len(conn.reads)
+		conn.Unlock()
+		if remaining == 0 {
+			break
+		}
+		receiver.receive()
+	}
+
+	workerPool.Shutdown()
+	return handled.payloads
+}
+
+func TestReceiverDropsDatagramFillingBuffer(t *testing.T) {
+	addr := testAddr(t, "192.0.2.1:51820")
+	conn := &fakeConn{reads: []fakeRead{
+		{data: make([]byte, 64), addr: addr},
+		{data: make([]byte, 63), addr: addr},
+	}}
+	var stats PacketStats
+
+	handled := receiveAll(t, conn, 64, &stats)
+
+	if len(handled) != 1 || len(handled[0]) != 63 {
+		t.Errorf("handled %d packets, want only the 63 byte one", len(handled))
+	}
+	if got := stats.Snapshot().Truncated; got != 1 {
+		t.Errorf("truncated = %d, want 1", got)
+	}
+}
+
+func TestReceiverScriptedReads(t *testing.T) {
+	addr := testAddr(t, "192.0.2.1:51820")
+	conn := &fakeConn{reads: []fakeRead{
+		{err: os.ErrDeadlineExceeded},
+		{err: errors.New("connection refused")},
+		{data: []byte{MessageTypeTransport, 0, 0, 0, 1, 2, 3, 4}, addr: addr},
+		{err: os.ErrDeadlineExceeded},
+	}}
+	var stats PacketStats
+
+	handled := receiveAll(t, conn, 1500, &stats)
+
+	if len(handled) != 1 || handled[0][0] != MessageTypeTransport {
+		t.Errorf("handled %v, want only the transport packet", handled)
+	}
+}
+
+func TestReceiverRunStopsAtMaxPackets(t *testing.T) {
+	addr := testAddr(t, "192.0.2.1:51820")
+	conn := &fakeConn{}
+	for range 5 {
+		conn.reads = append(conn.reads, fakeRead{err: errors.New("permanent")}, fakeRead{data: []byte{MessageTypeTransport}, addr: addr})
+	}
+	handled := &handledPackets{}
+	workerPool := NewWorkerPool(WorkerPoolConfig{MaxWorkers: 4}, handled.handle, NewLogger(LogLevelError))
+	workerPool.Start(context.Background())
+
+	var received atomic.Uint64
+	receiver := NewReceiver(conn, NewBufferPool(4, 1500), workerPool, &PacketStats{}, NewLogger(LogLevelError), false)
+	receiver.SetMaxPackets(3, &received)
+
+	done := make(chan struct{})
+	go func() {
+		receiver.Run(context.Background())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run did not return after 3 packets")
+	}
+	workerPool.Shutdown()
+
+	if got := received.Load(); got != 3 {
+		t.Errorf("received = %d, want 3: errors and timeouts must not count", got)
+	}
+	if len(handled.payloads) != 3 {
+		t.Errorf("handled %d packets, want 3", len(handled.payloads))
+	}
+}
+
+func TestReceiverRunStopsOnCancel(t *testing.T) {
+	workerPool := NewWorkerPool(WorkerPoolConfig{MaxWorkers: 1}, (&handledPackets{}).handle, NewLogger(LogLevelError))
+	receiver := NewReceiver(&fakeConn{}, NewBufferPool(4, 1500), workerPool, &PacketStats{}, NewLogger(LogLevelError), false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		receiver.Run(ctx)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run did not return after cancellation")
+	}
+}
+
+func TestReceiversShareMaxPackets(t *testing.T) {
+	addr := testAddr(t, "192.0.2.1:51820")
+	handled := &handledPackets{}
+	workerPool := NewWorkerPool(WorkerPoolConfig{MaxWorkers: 4}, handled.handle, NewLogger(LogLevelError))
+	workerPool.Start(context.Background())
+
+	// Two listeners, each with more datagrams waiting than the total limit.
+	var received atomic.Uint64
+	receivers := make([]*Receiver, 2)
+	for i := range receivers {
+		conn := &fakeConn{}
+		for range 10 {
+			conn.reads = append(conn.reads, fakeRead{data: []byte{MessageTypeTransport}, addr: addr})
+		}
+		receivers[i] = NewReceiver(conn, NewBufferPool(4, 1500), workerPool, &PacketStats{}, NewLogger(LogLevelError), false)
+		receivers[i].SetMaxPackets(6, &received)
+	}
+
+	var wg sync.WaitGroup
+	for _, receiver := range receivers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			receiver.Run(context.Background())
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("receivers did not stop at the shared packet limit")
+	}
+	workerPool.Shutdown()
+
+	// Each receiver checks the limit after its own read, so the total can
+	// overshoot by at most one datagram per other receiver.
+	if got := received.Load(); got < 6 || got > 7 {
+		t.Errorf("received = %d, want 6 or 7 in total", got)
+	}
+}
+
+func TestReceiverProxyProtocolReturnsBuffers(t *testing.T) {
+	addr := testAddr(t, "192.0.2.1:51820")
+	payload := make([]byte, 92)
+	payload[0] = MessageTypeResponse
+	local := append(append([]byte(nil), proxyProtocolV2Signature...), 0x20, 0, 0, 0)
+	conn := &fakeConn{reads: []fakeRead{
+		{data: append(local, payload...), addr: addr},
+		{data: payload, addr: addr},
+	}}
+	var stats PacketStats
+	bufferPool := NewBufferPoolWithClasses(4, 1500, []int{92})
+	handled := &handledPackets{}
+	workerPool := NewWorkerPool(WorkerPoolConfig{MaxWorkers: 1}, handled.handle, NewLogger(LogLevelError))
+	workerPool.SetBufferPool(bufferPool)
+	workerPool.Start(context.Background())
+
+	receiver := NewReceiver(conn, bufferPool, workerPool, &stats, NewLogger(LogLevelError), true)
+	receiver.receive()
+	receiver.receive()
+	workerPool.Shutdown()
+
+	if len(handled.payloads) != 1 || len(handled.payloads[0]) != len(payload) {
+		t.Fatalf("handled %d packets, want only the payload behind the PROXY header", len(handled.payloads))
+	}
+	if got := stats.Snapshot().ProxyInvalid; got != 1 {
+		t.Errorf("ProxyInvalid = %d, want 1", got)
+	}
+	// Two receive buffers and the 92-byte copy handed to the worker.
+	if got := bufferPool.Stats().Returned; got != 3 {
+		t.Errorf("buffers returned = %d, want 3", got)
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// relayStep sends payload from addr through pm and returns what the relay sent.
+func relayStep(t *testing.T, pm *PeerManager, sender *captureSender, addr *net.UDPAddr, payload []byte) []sentPacket {
+	t.Helper()
+	before := len(sender.Sent())
+	if err := pm.HandlePacket(context.Background(), addr, payload); err != nil {
+		t.Fatalf("HandlePacket from %s: %v", addr, err)
+	}
+	return sender.Sent()[before:]
+}
+
+// assertSentTo checks that sent holds exactly payload, once to each of addrs.
+func assertSentTo(t *testing.T, sent []sentPacket, payload []byte, addrs ...*net.UDPAddr) {
+	t.Helper()
+	if len(sent) != len(addrs) {
+		t.Fatalf("relay sent %d packets, want %d", len(sent), len(addrs))
+	}
+	for i, packet := range sent {
+		if !UDPAddrEqual(packet.to, addrs[i]) {
+			t.Errorf("packet %d sent to %s, want %s", i, packet.to, addrs[i])
+		}
+		if !bytes.Equal(packet.payload, payload) {
+			t.Errorf("packet %d payload was modified", i)
+		}
+	}
+}
+
+func transportPacket(receiverID ReceiverID) []byte {
+	packet := make([]byte, 48)
+	packet[0] = MessageTypeTransport
+	copy(packet[4:8], receiverID[:])
+	return packet
+}
+
+func TestRelayHandshakeFlow(t *testing.T) {
+	publicKeyA, publicKeyB := testKeys(t)
+	sender := &captureSender{}
+	pm, _ := newTestPeerManager(t, sender)
+	addrA := testAddr(t, "192.0.2.1:51820")
+	addrB1 := testAddr(t, "198.51.100.1:51820")
+	addrB2 := testAddr(t, "198.51.100.2:51820")
+
+	// B is reachable at two addresses and announces itself with initiations
+	// that no A endpoint is known to receive yet.
+	initiationFromB1 := mustBuildInitiation(t, publicKeyA, SenderID{0xb1})
+	assertSentTo(t, relayStep(t, pm, sender, addrB1, initiationFromB1), initiationFromB1)
+	initiationFromB2 := mustBuildInitiation(t, publicKeyA, SenderID{0xb2})
+	assertSentTo(t, relayStep(t, pm, sender, addrB2, initiationFromB2), initiationFromB2)
+
+	// A's initiation is fanned out to every address known for B.
+	initiation := mustBuildInitiation(t, publicKeyB, SenderID{0xa1})
+	if len(initiation) != InitiationPacketSize {
+		t.Fatalf("initiation is %d bytes, want %d", len(initiation), InitiationPacketSize)
+	}
+	assertSentTo(t, relayStep(t, pm, sender, addrA, initiation), initiation, addrB1, addrB2)
+
+	// B1 answers; the response is routed back to A by receiver ID.
+	response := mustBuildResponse(t, publicKeyA, SenderID{0xb3}, ReceiverID{0xa1})
+	if len(response) != ResponsePacketSize {
+		t.Fatalf("response is %d bytes, want %d", len(response), ResponsePacketSize)
+	}
+	assertSentTo(t, relayStep(t, pm, sender, addrB1, response), response, addrA)
+
+	// Transport data flows both ways by receiver ID.
+	toB := transportPacket(ReceiverID{0xb3})
+	assertSentTo(t, relayStep(t, pm, sender, addrA, toB), toB, addrB1)
+	toA := transportPacket(ReceiverID{0xa1})
+	assertSentTo(t, relayStep(t, pm, sender, addrB1, toA), toA, addrA)
+}
+
+func TestRelayRejectsResponseWithBadMAC1(t *testing.T) {
+	publicKeyA, _ := testKeys(t)
+	sender := &captureSender{}
+	pm, _ := newTestPeerManager(t, sender)
+	learnInitiator(t, pm, "192.0.2.1:51820", SenderID{0xa1})
+
+	// Flip a byte inside mac1, which occupies bytes 60-76 of the response.
+	response := mustBuildResponse(t, publicKeyA, SenderID{0xb1}, ReceiverID{0xa1})
+	response[70] ^= 0xff
+	if err := pm.HandlePacket(context.Background(), testAddr(t, "198.51.100.1:51820"), response); err == nil {
+		t.Error("response with a corrupted mac1 was accepted")
+	}
+	if sent := sender.Sent(); len(sent) != 0 {
+		t.Errorf("relay sent %d packets for a corrupted response, want 0", len(sent))
+	}
+}
+
+func TestRelayTransportOvertakingResponse(t *testing.T) {
+	publicKeyA, _ := testKeys(t)
+	addrA := testAddr(t, "192.0.2.1:51820")
+	addrB := testAddr(t, "198.51.100.1:51820")
+	early := transportPacket(ReceiverID{0xb1})
+	response := mustBuildResponse(t, publicKeyA, SenderID{0xb1}, ReceiverID{0xa1})
+
+	t.Run("without pending buffer", func(t *testing.T) {
+		sender := &captureSender{}
+		pm, _ := newTestPeerManager(t, sender)
+		learnInitiator(t, pm, addrA.String(), SenderID{0xa1})
+
+		if err := pm.HandlePacket(context.Background(), addrA, early); !errors.Is(err, ErrPeerNotFound) {
+			t.Errorf("early transport: err = %v, want ErrPeerNotFound", err)
+		}
+	})
+
+	t.Run("held until the response", func(t *testing.T) {
+		sender := &captureSender{}
+		pm, _ := newTestPeerManager(t, sender)
+		pm.SetPendingBuffer(NewPendingBuffer(time.Second, 0))
+		learnInitiator(t, pm, addrA.String(), SenderID{0xa1})
+
+		assertSentTo(t, relayStep(t, pm, sender, addrA, early), early)
+		if got := pm.Stats().Snapshot().PendingQueued; got != 1 {
+			t.Errorf("PendingQueued = %d, want 1", got)
+		}
+
+		// Learning B from the response delivers the held packet, then the
+		// response itself is relayed to A.
+		sent := relayStep(t, pm, sender, addrB, response)
+		if len(sent) != 2 {
+			t.Fatalf("relay sent %d packets, want the held transport packet and the response", len(sent))
+		}
+		assertSentTo(t, sent[:1], early, addrB)
+		assertSentTo(t, sent[1:], response, addrA)
+	})
+
+	t.Run("held packet expires", func(t *testing.T) {
+		sender := &captureSender{}
+		pm, clock := newTestPeerManager(t, sender)
+		pm.SetPendingBuffer(NewPendingBuffer(time.Second, 0))
+		learnInitiator(t, pm, addrA.String(), SenderID{0xa1})
+
+		relayStep(t, pm, sender, addrA, early)
+		clock.Advance(2 * time.Second)
+		assertSentTo(t, relayStep(t, pm, sender, addrB, response), response, addrA)
+	})
+}
+
+func TestRelayStandbyLearnsWithoutSending(t *testing.T) {
+	publicKeyA, publicKeyB := testKeys(t)
+	sender := &captureSender{}
+	pm, _ := newTestPeerManager(t, sender)
+	pm.SetForwardingEnabled(false)
+	addrA := testAddr(t, "192.0.2.1:51820")
+	addrB := testAddr(t, "198.51.100.1:51820")
+
+	// B announces itself, A initiates and B answers, all while in standby.
+	relayStep(t, pm, sender, addrB, mustBuildInitiation(t, publicKeyA, SenderID{0xb1}))
+	relayStep(t, pm, sender, addrA, mustBuildInitiation(t, publicKeyB, SenderID{0xa1}))
+	relayStep(t, pm, sender, addrB, mustBuildResponse(t, publicKeyA, SenderID{0xb2}, ReceiverID{0xa1}))
+	toA := transportPacket(ReceiverID{0xa1})
+	relayStep(t, pm, sender, addrB, toA)
+
+	if sent := sender.Sent(); len(sent) != 0 {
+		t.Fatalf("standby relay sent %d packets, want 0", len(sent))
+	}
+	if got := pm.Stats().Snapshot().ForwardingHeld; got != 3 {
+		t.Errorf("ForwardingHeld = %d, want 3", got)
+	}
+	ctx := context.Background()
+	for _, receiverID := range []ReceiverID{{0xa1}, {0xb2}} {
+		if _, exists, _ := pm.GetPeerByReceiverID(ctx, receiverID); !exists {
+			t.Errorf("receiver %x not learned in standby", receiverID)
+		}
+	}
+
+	// Once promoted, the learned state routes traffic without a new handshake.
+	pm.SetForwardingEnabled(true)
+	assertSentTo(t, relayStep(t, pm, sender, addrB, toA), toA, addrA)
+	toB := transportPacket(ReceiverID{0xb2})
+	assertSentTo(t, relayStep(t, pm, sender, addrA, toB), toB, addrB)
+}
+
+// timedSender records when each packet was sent.
+type timedSender struct {
+	sync.Mutex
+	times []time.Time
+}
+
+func (s *timedSender) SendPacket(to *net.UDPAddr, payload []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	s.times = append(s.times, time.Now())
+	return nil
+}
+
+// fanOutToB has B announce itself from count addresses, then sends A's
+// initiation, which the relay fans out to all of them.
+func fanOutToB(t *testing.T, pm *PeerManager, ctx context.Context, count int) error {
+	t.Helper()
+	publicKeyA, publicKeyB := testKeys(t)
+	for i := range count {
+		addr := testAddr(t, fmt.Sprintf("198.51.100.%d:51820", i+1))
+		if err := pm.HandlePacket(context.Background(), addr, mustBuildInitiation(t, publicKeyA, SenderID{0xb0, byte(i)})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return pm.HandlePacket(ctx, testAddr(t, "192.0.2.1:51820"), mustBuildInitiation(t, publicKeyB, SenderID{0xa1}))
+}
+
+func TestRelayFanoutPacing(t *testing.T) {
+	const gap = 20 * time.Millisecond
+	sender := &timedSender{}
+	pm, _ := newTestPeerManager(t, sender)
+	pm.SetFanoutGap(gap)
+
+	if err := fanOutToB(t, pm, context.Background(), 4); err != nil {
+		t.Fatalf("initiation: %v", err)
+	}
+
+	if len(sender.times) != 4 {
+		t.Fatalf("relay sent %d copies, want 4", len(sender.times))
+	}
+	for i := 1; i < len(sender.times); i++ {
+		if spacing := sender.times[i].Sub(sender.times[i-1]); spacing < gap {
+			t.Errorf("copies %d and %d sent %v apart, want at least %v", i-1, i, spacing, gap)
+		}
+	}
+}
+
+func TestRelayFanoutPacingStopsOnCancel(t *testing.T) {
+	sender := &timedSender{}
+	pm, _ := newTestPeerManager(t, sender)
+	pm.SetFanoutGap(time.Hour)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := fanOutToB(t, pm, ctx, 3)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want context.DeadlineExceeded", err)
+	}
+	if len(sender.times) != 1 {
+		t.Errorf("relay sent %d copies before the deadline, want 1", len(sender.times))
+	}
+}
+
+func TestRelayRoamingDuringTransport(t *testing.T) {
+	publicKeyA, _ := testKeys(t)
+	addrA := testAddr(t, "192.0.2.1:51820")
+	addrARoamed := testAddr(t, "203.0.113.5:40000")
+	addrB := testAddr(t, "198.51.100.1:51820")
+	toA := transportPacket(ReceiverID{0xa1})
+	toB := transportPacket(ReceiverID{0xb1})
+
+	handshake := func(t *testing.T, learn bool) (*PeerManager, *captureSender) {
+		sender := &captureSender{}
+		pm, _ := newTestPeerManager(t, sender)
+		pm.SetLearnFromTransport(learn)
+		learnInitiator(t, pm, addrA.String(), SenderID{0xa1})
+		response := mustBuildResponse(t, publicKeyA, SenderID{0xb1}, ReceiverID{0xa1})
+		assertSentTo(t, relayStep(t, pm, sender, addrB, response), response, addrA)
+		return pm, sender
+	}
+
+	t.Run("learning enabled", func(t *testing.T) {
+		pm, sender := handshake(t, true)
+
+		// A's NAT rebinds mid-session; its next transport packet moves the return path.
+		assertSentTo(t, relayStep(t, pm, sender, addrARoamed, toB), toB, addrB)
+		assertSentTo(t, relayStep(t, pm, sender, addrB, toA), toA, addrARoamed)
+
+		// Packets from the address already learned change nothing.
+		assertSentTo(t, relayStep(t, pm, sender, addrARoamed, toB), toB, addrB)
+		if got := pm.Stats().Snapshot().TransportRoamed; got != 1 {
+			t.Errorf("TransportRoamed = %d, want 1", got)
+		}
+	})
+
+	t.Run("learning disabled", func(t *testing.T) {
+		pm, sender := handshake(t, false)
+
+		assertSentTo(t, relayStep(t, pm, sender, addrARoamed, toB), toB, addrB)
+		assertSentTo(t, relayStep(t, pm, sender, addrB, toA), toA, addrA)
+		if got := pm.Stats().Snapshot().TransportRoamed; got != 0 {
+			t.Errorf("TransportRoamed = %d, want 0", got)
+		}
+	})
+
+	t.Run("no completed handshake", func(t *testing.T) {
+		sender := &captureSender{}
+		pm, _ := newTestPeerManager(t, sender)
+		pm.SetLearnFromTransport(true)
+		learnInitiator(t, pm, addrA.String(), SenderID{0xa1})
+
+		// Without a response the relay cannot tell whose entry a packet
+		// to 0xb1 would move, so it moves none.
+		pm.HandlePacket(context.Background(), addrARoamed, toB)
+		if peer, _, _ := pm.GetPeerByReceiverID(context.Background(), ReceiverID{0xa1}); !UDPAddrEqual(peer.Addr, addrA) {
+			t.Errorf("A's entry moved to %s without a completed handshake", peer.Addr)
+		}
+	})
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// sessionLinks pairs the two receiver IDs of each handshake the relay saw
+// completed, so that a transport packet addressed to one side tells which
+// receiver ID entry its sender owns.
+type sessionLinks struct {
+	sync.Mutex
+	peers map[ReceiverID]ReceiverID
+}
+
+func newSessionLinks() *sessionLinks {
+	return &sessionLinks{peers: make(map[ReceiverID]ReceiverID)}
+}
+
+func (l *sessionLinks) link(a, b ReceiverID) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.peers[a] = b
+	l.peers[b] = a
+}
+
+// counterpart returns the receiver ID of the other side of receiverID's session.
+func (l *sessionLinks) counterpart(receiverID ReceiverID) (ReceiverID, bool) {
+	l.Lock()
+	defer l.Unlock()
+
+	other, exists := l.peers[receiverID]
+	return other, exists
+}
+
+// prune forgets the sessions whose sides both no longer have receiver entries.
+func (l *sessionLinks) prune(exists func(ReceiverID) bool) {
+	l.Lock()
+	defer l.Unlock()
+
+	for a, b := range l.peers {
+		if !exists(a) && !exists(b) {
+			delete(l.peers, a)
+		}
+	}
+}
+
+// SetLearnFromTransport makes transport packets update the address of their
+// sender's receiver ID entry, so that a peer roaming mid-session keeps
+// receiving without a new handshake. Transport packets are not authenticated,
+// so anyone who observes a receiver ID can redirect its return path.
+func (pm *PeerManager) SetLearnFromTransport(enabled bool) {
+	if enabled {
+		pm.sessions = newSessionLinks()
+	} else {
+		pm.sessions = nil
+	}
+}
+
+// linkSession records that the handshake response from senderID answered
+// receiverID.
+func (pm *PeerManager) linkSession(senderID SenderID, receiverID ReceiverID) {
+	if pm.sessions != nil {
+		pm.sessions.link(ReceiverID(senderID), receiverID)
+	}
+}
+
+// learnFromTransport moves the sender of a transport packet addressed to
+// receiverID to addr when it arrives from an address other than the one
+// learned at the handshake.
+func (pm *PeerManager) learnFromTransport(ctx context.Context, addr *net.UDPAddr, receiverID ReceiverID) {
+	if pm.sessions == nil || addr == nil {
+		return
+	}
+	senderID, exists := pm.sessions.counterpart(receiverID)
+	if !exists {
+		return
+	}
+
+	unlock := pm.lockForRead()
+	peer, exists := pm.store.GetReceiverPeer(senderID)
+	unlock()
+	if !exists || UDPAddrEqual(peer.Addr, addr) {
+		return
+	}
+
+	pm.Lock()
+	defer pm.Unlock()
+
+	// Checked again under the write lock in case a handshake replaced it.
+	current, exists := pm.store.GetReceiverPeer(senderID)
+	if !exists || current != peer {
+		return
+	}
+	roamed := peer.Clone()
+	roamed.Addr = addr
+	pm.store.SetReceiverPeer(senderID, roamed)
+
+	pm.stats.IncTransportRoamed()
+	pm.loggerFrom(ctx).Debug("ReceiverID: %x, roamed from %s to %s", senderID, peer.Addr.String(), addr.String())
+}
+
+// pruneSessions drops the session links of expired receiver entries. The
+// caller holds the PeerManager lock.
+func (pm *PeerManager) pruneSessions() {
+	if pm.sessions == nil {
+		return
+	}
+	pm.sessions.prune(func(receiverID ReceiverID) bool {
+		_, exists := pm.store.GetReceiverPeer(receiverID)
+		return exists
+	})
+}
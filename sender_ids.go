@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+type senderIDRange struct {
+	first, last uint32
+}
+
+// SenderIDSet is a set of sender IDs given as single IDs and inclusive ranges.
+// IDs are compared as big endian numbers of their 4 wire bytes.
+type SenderIDSet struct {
+	ranges []senderIDRange
+}
+
+// ParseSenderIDSet parses entries such as "0a1b2c3d" or "00000000-0000ffff".
+// It returns nil, which allows every sender ID, when there are no entries.
+func ParseSenderIDSet(entries []string) (*SenderIDSet, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	set := &SenderIDSet{}
+	for _, entry := range entries {
+		firstText, lastText, isRange := strings.Cut(strings.TrimSpace(entry), "-")
+		if !isRange {
+			lastText = firstText
+		}
+		first, err := parseSenderIDNumber(firstText)
+		if err != nil {
+			return nil, err
+		}
+		last, err := parseSenderIDNumber(lastText)
+		if err != nil {
+			return nil, err
+		}
+		if first > last {
+			return nil, fmt.Errorf("sender ID range %q ends before it starts", entry)
+		}
+		set.ranges = append(set.ranges, senderIDRange{first: first, last: last})
+	}
+	return set, nil
+}
+
+func parseSenderIDNumber(text string) (uint32, error) {
+	decoded, err := hex.DecodeString(text)
+	if err != nil || len(decoded) != len(SenderID{}) {
+		return 0, fmt.Errorf("sender ID must be 8 hex digits: %q", text)
+	}
+	return binary.BigEndian.Uint32(decoded), nil
+}
+
+// Contains reports whether senderID is in the set. A nil set contains every ID.
+func (s *SenderIDSet) Contains(senderID SenderID) bool {
+	if s == nil {
+		return true
+	}
+	id := binary.BigEndian.Uint32(senderID[:])
+	for _, r := range s.ranges {
+		if id >= r.first && id <= r.last {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseSenderIDSet(t *testing.T) {
+	set, err := ParseSenderIDSet([]string{"0a1b2c3d", "00000100-000001ff"})
+	if err != nil {
+		t.Fatalf("ParseSenderIDSet: %v", err)
+	}
+
+	tests := []struct {
+		senderID SenderID
+		want     bool
+	}{
+		{SenderID{0x0a, 0x1b, 0x2c, 0x3d}, true},
+		{SenderID{0x0a, 0x1b, 0x2c, 0x3e}, false},
+		{SenderID{0, 0, 1, 0}, true},
+		{SenderID{0, 0, 1, 0xff}, true},
+		{SenderID{0, 0, 2, 0}, false},
+		{SenderID{0, 0, 0, 0xff}, false},
+	}
+	for _, tt := range tests {
+		if got := set.Contains(tt.senderID); got != tt.want {
+			t.Errorf("Contains(%x) = %v, want %v", tt.senderID, got, tt.want)
+		}
+	}
+
+	var all *SenderIDSet
+	if !all.Contains(SenderID{1, 2, 3, 4}) {
+		t.Error("nil set rejected a sender ID")
+	}
+	if set, err := ParseSenderIDSet(nil); set != nil || err != nil {
+		t.Errorf("ParseSenderIDSet(nil) = %v, %v, want nil, nil", set, err)
+	}
+	for _, entry := range []string{"0a1b2c", "000001ff-00000100", "zzzzzzzz"} {
+		if _, err := ParseSenderIDSet([]string{entry}); err == nil {
+			t.Errorf("ParseSenderIDSet(%q) accepted an invalid entry", entry)
+		}
+	}
+}
+
+func TestKeyPairSenderIDs(t *testing.T) {
+	publicKeyA, publicKeyB := testKeys(t)
+	allowed, err := ParseSenderIDSet([]string{"01000000-01ffffff"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm := NewPeerManager(&captureSender{}, []PublicKeyPair{{PublicKey1: publicKeyA, PublicKey2: publicKeyB, SenderIDs: allowed}}, NewLogger(LogLevelError), time.Minute)
+	ctx := context.Background()
+	addr := testAddr(t, "192.0.2.1:51820")
+
+	if err := pm.HandlePacket(ctx, addr, mustBuildInitiation(t, publicKeyB, SenderID{1, 2, 3, 4})); err != nil {
+		t.Errorf("in-range sender ID: %v", err)
+	}
+	if err := pm.HandlePacket(ctx, addr, mustBuildInitiation(t, publicKeyB, SenderID{2, 0, 0, 0})); !errors.Is(err, ErrInvalidPacket) {
+		t.Errorf("out-of-range sender ID: err = %v, want ErrInvalidPacket", err)
+	}
+
+	if got := pm.Stats().Snapshot().SenderIDRejected; got != 1 {
+		t.Errorf("SenderIDRejected = %d, want 1", got)
+	}
+	if _, exists, _ := pm.GetPeerByReceiverID(ctx, ReceiverID{2, 0, 0, 0}); exists {
+		t.Error("out-of-range sender learned")
+	}
+	if _, exists, _ := pm.GetPeerByReceiverID(ctx, ReceiverID{1, 2, 3, 4}); !exists {
+		t.Error("in-range sender not learned")
+	}
+}
@@ -0,0 +1,51 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// setupLogLevelSignal cycles the log level debug → info → warning → error on
+// every SIGUSR1, so debug logging can be turned on during an incident without
+// restarting and losing the learned peers.
+func setupLogLevelSignal(ctx context.Context, logger *Logger) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGUSR1)
+
+	go func() {
+		defer signal.Stop(sigCh)
+		for {
+			select {
+			case <-sigCh:
+				level := (logger.Level() + 1) % (LogLevelError + 1)
+				logger.SetLevel(level)
+				// Logged at error level so the change is visible whatever the new level.
+				logger.Error("Received SIGUSR1, log level changed to %s", GetLogLevelName(level))
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// setupStatsSignal logs a runtime stats snapshot on every SIGUSR2.
+func setupStatsSignal(ctx context.Context, dump func()) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGUSR2)
+
+	go func() {
+		defer signal.Stop(sigCh)
+		for {
+			select {
+			case <-sigCh:
+				dump()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,11 @@
+//go:build windows
+
+package main
+
+import "context"
+
+// setupLogLevelSignal does nothing on Windows, which has no SIGUSR1.
+func setupLogLevelSignal(ctx context.Context, logger *Logger) {}
+
+// setupStatsSignal does nothing on Windows, which has no SIGUSR2.
+func setupStatsSignal(ctx context.Context, dump func()) {}
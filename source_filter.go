@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// SourceFilter decides which source addresses packets are accepted from.
+// A source matching a deny prefix is rejected; otherwise it is accepted when
+// the allow list is empty or one of its prefixes matches.
+type SourceFilter struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// ParseSourceFilter parses CIDR prefixes; single addresses are accepted as
+// /32 or /128 prefixes.
+func ParseSourceFilter(allow, deny []string) (*SourceFilter, error) {
+	allowPrefixes, err := parsePrefixes(allow)
+	if err != nil {
+		return nil, fmt.Errorf("allow: %w", err)
+	}
+	denyPrefixes, err := parsePrefixes(deny)
+	if err != nil {
+		return nil, fmt.Errorf("deny: %w", err)
+	}
+	return &SourceFilter{allow: allowPrefixes, deny: denyPrefixes}, nil
+}
+
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if !strings.Contains(value, "/") {
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// WithAllow returns a copy of f with the allow list replaced.
+func (f *SourceFilter) WithAllow(allow []netip.Prefix) *SourceFilter {
+	return &SourceFilter{allow: allow, deny: f.deny}
+}
+
+// WithDeny returns a copy of f with the deny list replaced.
+func (f *SourceFilter) WithDeny(deny []netip.Prefix) *SourceFilter {
+	return &SourceFilter{allow: f.allow, deny: deny}
+}
+
+// Allowed reports whether packets from addr are accepted. A nil filter
+// accepts every source.
+func (f *SourceFilter) Allowed(addr *net.UDPAddr) bool {
+	if f == nil || (len(f.allow) == 0 && len(f.deny) == 0) {
+		return true
+	}
+	ip, ok := netip.AddrFromSlice(addr.IP)
+	if !ok {
+		return false
+	}
+	ip = ip.Unmap()
+
+	for _, prefix := range f.deny {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, prefix := range f.allow {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *SourceFilter) String() string {
+	if f == nil {
+		return "allow=[] deny=[]"
+	}
+	return fmt.Sprintf("allow=%v deny=%v", f.allow, f.deny)
+}
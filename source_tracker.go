@@ -0,0 +1,98 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultMaxTrackedSources bounds the per-address state kept by the rate
+// limiter and loop detector together.
+const DefaultMaxTrackedSources = 100000
+
+type sourceKey struct {
+	kind string
+	key  string
+}
+
+type sourceEntry struct {
+	key   sourceKey
+	value any
+}
+
+// SourceTracker is a least recently used table shared by the features that
+// keep state per address, so that an attacker cycling spoofed addresses can
+// only push out old entries instead of growing memory without bound.
+// Each feature stores its entries under its own kind.
+//
+// Only the forward rate limiter and the loop detector use it. Learned peers
+// are not tracked here: evicting one would break a live tunnel, so the peer
+// maps are bounded by peer expiration and the memory guard instead. mac1
+// failures are only counted, not kept per address.
+type SourceTracker struct {
+	sync.Mutex
+	capacity  int
+	entries   map[sourceKey]*list.Element
+	order     *list.List // front is most recently used
+	evictions atomic.Uint64
+}
+
+func NewSourceTracker(capacity int) *SourceTracker {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &SourceTracker{
+		capacity: capacity,
+		entries:  make(map[sourceKey]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// Get returns the value stored for key and marks it as recently used.
+func (t *SourceTracker) Get(kind, key string) (any, bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	element, exists := t.entries[sourceKey{kind, key}]
+	if !exists {
+		return nil, false
+	}
+	t.order.MoveToFront(element)
+	return element.Value.(*sourceEntry).value, true
+}
+
+// Put stores value for key, evicting the least recently used entries of any
+// kind when the tracker is full.
+func (t *SourceTracker) Put(kind, key string, value any) {
+	t.Lock()
+	defer t.Unlock()
+
+	k := sourceKey{kind, key}
+	if element, exists := t.entries[k]; exists {
+		element.Value.(*sourceEntry).value = value
+		t.order.MoveToFront(element)
+		return
+	}
+
+	for len(t.entries) >= t.capacity {
+		oldest := t.order.Back()
+		delete(t.entries, oldest.Value.(*sourceEntry).key)
+		t.order.Remove(oldest)
+		t.evictions.Add(1)
+	}
+
+	t.entries[k] = t.order.PushFront(&sourceEntry{key: k, value: value})
+}
+
+// Len returns the number of tracked entries.
+func (t *SourceTracker) Len() int {
+	t.Lock()
+	defer t.Unlock()
+
+	return len(t.entries)
+}
+
+func (t *SourceTracker) String() string {
+	return fmt.Sprintf("entries=%d capacity=%d evictions=%d", t.Len(), t.capacity, t.evictions.Load())
+}
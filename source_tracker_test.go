@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSourceTrackerEvictsLeastRecentlyUsed(t *testing.T) {
+	sources := NewSourceTracker(2)
+	sources.Put("rate", "a", 1)
+	sources.Put("loop", "b", 2)
+	sources.Get("rate", "a")
+	sources.Put("rate", "c", 3)
+
+	if _, exists := sources.Get("loop", "b"); exists {
+		t.Error("least recently used entry was not evicted")
+	}
+	if value, exists := sources.Get("rate", "a"); !exists || value != 1 {
+		t.Errorf("Get(rate, a) = %v, %v, want 1, true", value, exists)
+	}
+	if _, exists := sources.Get("loop", "a"); exists {
+		t.Error("kinds share keys")
+	}
+}
+
+func TestSourceTrackerCapHoldsUnderFlood(t *testing.T) {
+	const capacity = 100
+	sources := NewSourceTracker(capacity)
+	sender := &captureSender{}
+	pm, _ := newTestPeerManager(t, sender)
+	publicKeyA, _ := testKeys(t)
+
+	rateLimiter := NewRateLimiter(1000, 10)
+	rateLimiter.SetSourceTracker(sources)
+	pm.SetForwardRateLimiter(rateLimiter)
+	loopDetector := NewLoopDetector(time.Second)
+	loopDetector.SetSourceTracker(sources)
+	pm.SetLoopDetector(loopDetector)
+
+	// Every packet goes to a destination the relay has never seen before.
+	ctx := context.Background()
+	const flood = 5000
+	for i := range flood {
+		var receiverID ReceiverID
+		binary.BigEndian.PutUint32(receiverID[:], uint32(i+1))
+		addr := testAddr(t, fmt.Sprintf("10.%d.%d.%d:51820", i>>16&0xff, i>>8&0xff, i&0xff))
+		if err := pm.AddPeer(ctx, receiverID, addr, publicKeyA); err != nil {
+			t.Fatalf("AddPeer: %v", err)
+		}
+		if err := pm.ForwardPacketToReceiver(ctx, receiverID, transportPacket(receiverID)); err != nil {
+			t.Fatalf("ForwardPacketToReceiver: %v", err)
+		}
+		if sources.Len() > capacity {
+			t.Fatalf("after %d sources the tracker holds %d entries, cap is %d", i+1, sources.Len(), capacity)
+		}
+	}
+
+	if got := len(sender.Sent()); got != flood {
+		t.Errorf("forwarded %d packets, want %d", got, flood)
+	}
+	if evictions := sources.evictions.Load(); evictions < 2*flood-capacity {
+		t.Errorf("evictions = %d, want at least %d", evictions, 2*flood-capacity)
+	}
+}
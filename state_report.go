@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// StateReport is the relay's state as one JSON document, for dashboards that
+// read JSON rather than scraping Prometheus. Keys are never included in full.
+type StateReport struct {
+	Version       string             `json:"version"`
+	StartedAt     time.Time          `json:"started_at"`
+	UptimeSeconds float64            `json:"uptime_seconds"`
+	Config        StateConfigSummary `json:"config"`
+	KeyPairs      []KeyPairState     `json:"keypairs"`
+	Peers         StatePeers         `json:"peers"`
+	Counters      map[string]uint64  `json:"counters"`
+	Packets       StatePackets       `json:"packets"`
+	Workers       StateWorkers       `json:"workers"`
+	BufferPool    StateBufferPool    `json:"buffer_pool"`
+}
+
+type StateConfigSummary struct {
+	Listeners          []string `json:"listeners"`
+	Transport          string   `json:"transport"`
+	PeerExpiration     string   `json:"peer_expiration"`
+	ReceiverExpiration string   `json:"receiver_expiration"`
+	ForwardingEnabled  bool     `json:"forwarding_enabled"`
+	ReceiveOnly        bool     `json:"receive_only"`
+	UnverifiedPolicy   string   `json:"unverified_policy"`
+	MaxWorkers         int      `json:"max_workers"`
+	WorkerAffinity     string   `json:"worker_affinity"`
+	PoolSize           int      `json:"pool_size"`
+	BufferSize         int      `json:"buffer_size"`
+}
+
+// KeyPairState counts the peers of one key pair. Keys holds the first 8
+// base64 characters of each public key.
+type KeyPairState struct {
+	Name           string    `json:"name"`
+	Keys           [2]string `json:"keys"`
+	Receivers      int       `json:"receivers"`
+	PublicKeyPeers int       `json:"public_key_peers"`
+	Persistent     bool      `json:"persistent"`
+}
+
+type StatePeers struct {
+	Receivers      int `json:"receivers"`
+	PublicKeyPeers int `json:"public_key_peers"`
+}
+
+// StatePackets holds the per message type counters, keyed by message type name.
+type StatePackets struct {
+	Received  map[string]uint64 `json:"received"`
+	Forwarded map[string]uint64 `json:"forwarded"`
+	Dropped   map[string]uint64 `json:"dropped"`
+}
+
+type StateWorkers struct {
+	Workers       int     `json:"workers"`
+	QueueDepth    int     `json:"queue_depth"`
+	QueueCapacity int     `json:"queue_capacity"`
+	Handled       uint64  `json:"handled"`
+	LatencyAvgMs  float64 `json:"latency_avg_ms"`
+	LatencyP50Ms  float64 `json:"latency_p50_ms"`
+	LatencyP99Ms  float64 `json:"latency_p99_ms"`
+}
+
+type StateBufferPool struct {
+	Hits     uint64 `json:"hits"`
+	Misses   uint64 `json:"misses"`
+	Returned uint64 `json:"returned"`
+	Dropped  uint64 `json:"dropped"`
+}
+
+// StateReporter assembles StateReports from the running relay.
+type StateReporter struct {
+	pm         *PeerManager
+	workerPool *WorkerPool
+	bufferPool *BufferPool
+	config     *Config
+	listeners  []Listener
+	startedAt  time.Time
+}
+
+func NewStateReporter(pm *PeerManager, workerPool *WorkerPool, bufferPool *BufferPool, config *Config, listeners []Listener, startedAt time.Time) *StateReporter {
+	return &StateReporter{
+		pm:         pm,
+		workerPool: workerPool,
+		bufferPool: bufferPool,
+		config:     config,
+		listeners:  listeners,
+		startedAt:  startedAt,
+	}
+}
+
+func (r *StateReporter) Report() StateReport {
+	report := StateReport{
+		Version:       Version,
+		StartedAt:     r.startedAt.UTC(),
+		UptimeSeconds: time.Since(r.startedAt).Seconds(),
+		Config:        r.configSummary(),
+		KeyPairs:      r.pm.KeyPairStates(),
+		Counters:      make(map[string]uint64),
+	}
+
+	report.Peers.Receivers, report.Peers.PublicKeyPeers = r.pm.PeerCounts()
+
+	snapshot := r.pm.Stats().Snapshot()
+	for _, counter := range snapshot.Counters() {
+		report.Counters[counter.Name] = counter.Value
+	}
+	report.Packets = StatePackets{
+		Received:  make(map[string]uint64),
+		Forwarded: make(map[string]uint64),
+		Dropped:   make(map[string]uint64),
+	}
+	for i, name := range messageTypeNames {
+		report.Packets.Received[name] = snapshot.Received[i]
+		report.Packets.Forwarded[name] = snapshot.Forwarded[i]
+		report.Packets.Dropped[name] = snapshot.Dropped[i]
+	}
+
+	latency := r.workerPool.Latency()
+	report.Workers = StateWorkers{
+		Workers:       r.workerPool.maxWorkers,
+		QueueDepth:    r.workerPool.QueueDepth(),
+		QueueCapacity: r.workerPool.QueueCapacity(),
+		Handled:       latency.Count,
+		LatencyP50Ms:  durationMilliseconds(latency.Quantile(0.5)),
+		LatencyP99Ms:  durationMilliseconds(latency.Quantile(0.99)),
+	}
+	if latency.Count > 0 {
+		report.Workers.LatencyAvgMs = durationMilliseconds(latency.Sum / time.Duration(latency.Count))
+	}
+
+	pool := r.bufferPool.Stats()
+	report.BufferPool = StateBufferPool{
+		Hits:     pool.Hits,
+		Misses:   pool.Misses,
+		Returned: pool.Returned,
+		Dropped:  pool.Dropped,
+	}
+
+	return report
+}
+
+func (r *StateReporter) configSummary() StateConfigSummary {
+	server := r.config.Server
+	summary := StateConfigSummary{
+		Listeners:          make([]string, 0, len(r.listeners)),
+		Transport:          server.Transport,
+		PeerExpiration:     server.PeerExpiration.String(),
+		ReceiverExpiration: server.ReceiverExpiration.String(),
+		ForwardingEnabled:  r.pm.ForwardingEnabled(),
+		ReceiveOnly:        server.ReceiveOnly,
+		UnverifiedPolicy:   server.UnverifiedPolicy,
+		MaxWorkers:         r.config.WorkerPool.MaxWorkers,
+		WorkerAffinity:     r.config.WorkerPool.Affinity,
+		PoolSize:           r.config.BufferPool.PoolSize,
+		BufferSize:         r.config.BufferPool.BufferSize,
+	}
+	for _, listener := range r.listeners {
+		summary.Listeners = append(summary.Listeners, listener.String())
+	}
+	return summary
+}
+
+// JSON returns the current report as a single line of JSON.
+func (r *StateReporter) JSON() (string, error) {
+	data, err := json.Marshal(r.Report())
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// ServeHTTP serves the current report for GET /state.
+func (r *StateReporter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, err := json.Marshal(r.Report())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(append(data, '\n'))
+}
+
+// KeyPairStates returns the configured key pairs in ListKeyPairs order with
+// the number of peers learned for each.
+func (pm *PeerManager) KeyPairStates() []KeyPairState {
+	keyPairs := pm.ListKeyPairs()
+
+	receivers := make(map[string]int)
+	publicKeyPeers := make(map[PublicKey]int)
+	unlock := pm.lockForRead()
+	pm.store.RangeReceiverPeers(func(receiverID ReceiverID, peer *Peer) bool {
+		receivers[peer.KeyPair]++
+		return true
+	})
+	pm.store.RangePublicKeyPeers(func(publicKey PublicKey, peers []*Peer) bool {
+		publicKeyPeers[publicKey] += len(peers)
+		return true
+	})
+	unlock()
+
+	states := make([]KeyPairState, 0, len(keyPairs))
+	for _, keyPair := range keyPairs {
+		// Unnamed pairs label their peers with the receiving key's prefix.
+		name, otherName := pm.KeyPairName(keyPair[0]), pm.KeyPairName(keyPair[1])
+		pairReceivers := receivers[name]
+		if otherName != name {
+			pairReceivers += receivers[otherName]
+		}
+		states = append(states, KeyPairState{
+			Name:           name,
+			Keys:           [2]string{redactPublicKey(keyPair[0]), redactPublicKey(keyPair[1])},
+			Receivers:      pairReceivers,
+			PublicKeyPeers: publicKeyPeers[keyPair[0]] + publicKeyPeers[keyPair[1]],
+			Persistent:     pm.persistentKeys[keyPair[0]],
+		})
+	}
+	return states
+}
+
+func redactPublicKey(publicKey PublicKey) string {
+	return base64.StdEncoding.EncodeToString(publicKey[:])[:8] + "..."
+}
+
+func durationMilliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
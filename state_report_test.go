@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func TestStateReportJSONShape(t *testing.T) {
+	pm, _ := newTestPeerManager(t, &captureSender{})
+	learnInitiator(t, pm, "192.0.2.1:51820", SenderID{1})
+	workerPool := NewWorkerPool(WorkerPoolConfig{MaxWorkers: 2}, pm.HandlePacket, NewLogger(LogLevelError))
+	config := &Config{}
+	config.Server.PeerExpiration = time.Minute
+	listeners := []Listener{{Addr: testAddr(t, "0.0.0.0:51820")}}
+	reporter := NewStateReporter(pm, workerPool, NewBufferPool(4, 1500), config, listeners, time.Now().Add(-time.Hour))
+
+	recorder := httptest.NewRecorder()
+	reporter.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/state", nil))
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("GET /state = %d %q", recorder.Code, recorder.Header().Get("Content-Type"))
+	}
+	body := recorder.Body.String()
+
+	var state map[string]any
+	if err := json.Unmarshal([]byte(body), &state); err != nil {
+		t.Fatalf("state is not a JSON object: %v", err)
+	}
+	wantKeys := []string{"buffer_pool", "config", "counters", "keypairs", "packets", "peers", "started_at", "uptime_seconds", "version", "workers"}
+	if got := sortedKeys(state); !slices.Equal(got, wantKeys) {
+		t.Errorf("top-level keys = %v, want %v", got, wantKeys)
+	}
+	if uptime, _ := state["uptime_seconds"].(float64); uptime < 3600 {
+		t.Errorf("uptime_seconds = %v, want at least an hour", state["uptime_seconds"])
+	}
+
+	keyPairs, _ := state["keypairs"].([]any)
+	if len(keyPairs) != 1 {
+		t.Fatalf("keypairs = %v, want one entry", state["keypairs"])
+	}
+	keyPair := keyPairs[0].(map[string]any)
+	if keyPair["name"] != "test" || keyPair["receivers"] != 1.0 || keyPair["public_key_peers"] != 1.0 {
+		t.Errorf("keypair = %v, want test with one receiver and one public key peer", keyPair)
+	}
+	if strings.Contains(body, testPublicKeyA) || strings.Contains(body, testPublicKeyB) {
+		t.Error("state contains a full public key")
+	}
+
+	packets := state["packets"].(map[string]any)
+	received := packets["received"].(map[string]any)
+	if got := sortedKeys(received); !slices.Equal(got, []string{"cookie_reply", "initiation", "response", "transport"}) {
+		t.Errorf("packets.received keys = %v", got)
+	}
+	if received["initiation"] != 1.0 {
+		t.Errorf("packets.received.initiation = %v, want 1", received["initiation"])
+	}
+	if listeners := state["config"].(map[string]any)["listeners"]; !slices.Equal(listeners.([]any), []any{"0.0.0.0:51820"}) {
+		t.Errorf("config.listeners = %v", listeners)
+	}
+
+	recorder = httptest.NewRecorder()
+	reporter.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/state", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /state = %d, want 405", recorder.Code)
+	}
+}
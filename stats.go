@@ -0,0 +1,431 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type packetTypeCounters struct {
+	received  atomic.Uint64
+	forwarded atomic.Uint64
+	dropped   atomic.Uint64
+}
+
+// PacketStats counts packet activity per WireGuard message type.
+type PacketStats struct {
+	types               [MessageTypeTransport]packetTypeCounters
+	authFailures        atomic.Uint64
+	unknownTypes        atomic.Uint64
+	truncated           atomic.Uint64
+	cookieReplies       atomic.Uint64
+	mac2Failures        atomic.Uint64
+	rateLimited         atomic.Uint64
+	loopsDetected       atomic.Uint64
+	reservedNonZero     atomic.Uint64
+	upstreamForwarded   atomic.Uint64
+	senderIDCollisions  atomic.Uint64
+	drainRejected       atomic.Uint64
+	pendingQueued       atomic.Uint64
+	pendingDelivered    atomic.Uint64
+	peerNotFound        atomic.Uint64
+	forwardingHeld      atomic.Uint64
+	shortWrites         atomic.Uint64
+	messageTooLong      atomic.Uint64
+	sourceDenied        atomic.Uint64
+	globalRateLimited   atomic.Uint64
+	memoryShed          atomic.Uint64
+	multiplePairedKeys  atomic.Uint64
+	senderIDRejected    atomic.Uint64
+	unverifiedForwarded atomic.Uint64
+	breakerOpen         atomic.Uint64
+	transportRoamed     atomic.Uint64
+	unverifiedLearned   atomic.Uint64
+	proxyInvalid        atomic.Uint64
+	keyPairs            sync.Map // key pair name -> *atomic.Uint64 forwarded count
+}
+
+type PacketStatsSnapshot struct {
+	Received            [MessageTypeTransport]uint64
+	Forwarded           [MessageTypeTransport]uint64
+	Dropped             [MessageTypeTransport]uint64
+	AuthFailures        uint64
+	UnknownTypes        uint64
+	Truncated           uint64
+	CookieReplies       uint64
+	MAC2Failures        uint64
+	RateLimited         uint64
+	LoopsDetected       uint64
+	ReservedNonZero     uint64
+	UpstreamForwarded   uint64
+	SenderIDCollisions  uint64
+	DrainRejected       uint64
+	PendingQueued       uint64
+	PendingDelivered    uint64
+	PeerNotFound        uint64
+	ForwardingHeld      uint64
+	ShortWrites         uint64
+	MessageTooLong      uint64
+	SourceDenied        uint64
+	GlobalRateLimited   uint64
+	MemoryShed          uint64
+	MultiplePairedKeys  uint64
+	SenderIDRejected    uint64
+	UnverifiedForwarded uint64
+	BreakerOpen         uint64
+	TransportRoamed     uint64
+	UnverifiedLearned   uint64
+	ProxyInvalid        uint64
+	KeyPairs            map[string]uint64
+}
+
+func (s *PacketStats) counters(messageType byte) *packetTypeCounters {
+	if messageType < MessageTypeInitiation || messageType > MessageTypeTransport {
+		return nil
+	}
+	return &s.types[messageType-1]
+}
+
+func (s *PacketStats) IncReceived(messageType byte) {
+	if c := s.counters(messageType); c != nil {
+		c.received.Add(1)
+	}
+}
+
+func (s *PacketStats) IncForwarded(messageType byte) {
+	if c := s.counters(messageType); c != nil {
+		c.forwarded.Add(1)
+	}
+}
+
+func (s *PacketStats) IncDropped(messageType byte) {
+	if c := s.counters(messageType); c != nil {
+		c.dropped.Add(1)
+	}
+}
+
+func (s *PacketStats) IncAuthFailures() {
+	s.authFailures.Add(1)
+}
+
+func (s *PacketStats) IncUnknownTypes() {
+	s.unknownTypes.Add(1)
+}
+
+func (s *PacketStats) IncTruncated() {
+	s.truncated.Add(1)
+}
+
+func (s *PacketStats) IncCookieReplies() {
+	s.cookieReplies.Add(1)
+}
+
+func (s *PacketStats) IncMAC2Failures() {
+	s.mac2Failures.Add(1)
+}
+
+func (s *PacketStats) IncRateLimited() {
+	s.rateLimited.Add(1)
+}
+
+func (s *PacketStats) IncLoopsDetected() {
+	s.loopsDetected.Add(1)
+}
+
+func (s *PacketStats) IncReservedNonZero() {
+	s.reservedNonZero.Add(1)
+}
+
+func (s *PacketStats) IncUpstreamForwarded() {
+	s.upstreamForwarded.Add(1)
+}
+
+func (s *PacketStats) IncSenderIDCollisions() {
+	s.senderIDCollisions.Add(1)
+}
+
+func (s *PacketStats) IncDrainRejected() {
+	s.drainRejected.Add(1)
+}
+
+func (s *PacketStats) IncPendingQueued() {
+	s.pendingQueued.Add(1)
+}
+
+func (s *PacketStats) IncPendingDelivered() {
+	s.pendingDelivered.Add(1)
+}
+
+func (s *PacketStats) IncPeerNotFound() {
+	s.peerNotFound.Add(1)
+}
+
+func (s *PacketStats) IncForwardingHeld() {
+	s.forwardingHeld.Add(1)
+}
+
+func (s *PacketStats) IncShortWrites() {
+	s.shortWrites.Add(1)
+}
+
+func (s *PacketStats) IncMessageTooLong() {
+	s.messageTooLong.Add(1)
+}
+
+func (s *PacketStats) IncSourceDenied() {
+	s.sourceDenied.Add(1)
+}
+
+func (s *PacketStats) IncGlobalRateLimited() {
+	s.globalRateLimited.Add(1)
+}
+
+func (s *PacketStats) IncMemoryShed() {
+	s.memoryShed.Add(1)
+}
+
+func (s *PacketStats) IncMultiplePairedKeys() {
+	s.multiplePairedKeys.Add(1)
+}
+
+func (s *PacketStats) IncSenderIDRejected() {
+	s.senderIDRejected.Add(1)
+}
+
+func (s *PacketStats) IncUnverifiedForwarded() {
+	s.unverifiedForwarded.Add(1)
+}
+
+func (s *PacketStats) IncBreakerOpen() {
+	s.breakerOpen.Add(1)
+}
+
+func (s *PacketStats) IncTransportRoamed() {
+	s.transportRoamed.Add(1)
+}
+
+func (s *PacketStats) IncUnverifiedLearned() {
+	s.unverifiedLearned.Add(1)
+}
+
+func (s *PacketStats) IncProxyInvalid() {
+	s.proxyInvalid.Add(1)
+}
+
+// IncKeyPairForwarded counts a packet forwarded to a peer of the named key pair.
+func (s *PacketStats) IncKeyPairForwarded(name string) {
+	if name == "" {
+		return
+	}
+
+	counter, ok := s.keyPairs.Load(name)
+	if !ok {
+		counter, _ = s.keyPairs.LoadOrStore(name, new(atomic.Uint64))
+	}
+	counter.(*atomic.Uint64).Add(1)
+}
+
+func (s *PacketStats) keyPairCounts(reset bool) map[string]uint64 {
+	counts := make(map[string]uint64)
+	s.keyPairs.Range(func(key, value any) bool {
+		counter := value.(*atomic.Uint64)
+		if reset {
+			counts[key.(string)] = counter.Swap(0)
+		} else {
+			counts[key.(string)] = counter.Load()
+		}
+		return true
+	})
+	return counts
+}
+
+// Snapshot returns the current counter values.
+func (s *PacketStats) Snapshot() PacketStatsSnapshot {
+	var snapshot PacketStatsSnapshot
+	for i := range s.types {
+		snapshot.Received[i] = s.types[i].received.Load()
+		snapshot.Forwarded[i] = s.types[i].forwarded.Load()
+		snapshot.Dropped[i] = s.types[i].dropped.Load()
+	}
+	snapshot.AuthFailures = s.authFailures.Load()
+	snapshot.UnknownTypes = s.unknownTypes.Load()
+	snapshot.Truncated = s.truncated.Load()
+	snapshot.CookieReplies = s.cookieReplies.Load()
+	snapshot.MAC2Failures = s.mac2Failures.Load()
+	snapshot.RateLimited = s.rateLimited.Load()
+	snapshot.LoopsDetected = s.loopsDetected.Load()
+	snapshot.ReservedNonZero = s.reservedNonZero.Load()
+	snapshot.UpstreamForwarded = s.upstreamForwarded.Load()
+	snapshot.SenderIDCollisions = s.senderIDCollisions.Load()
+	snapshot.DrainRejected = s.drainRejected.Load()
+	snapshot.PendingQueued = s.pendingQueued.Load()
+	snapshot.PendingDelivered = s.pendingDelivered.Load()
+	snapshot.PeerNotFound = s.peerNotFound.Load()
+	snapshot.ForwardingHeld = s.forwardingHeld.Load()
+	snapshot.ShortWrites = s.shortWrites.Load()
+	snapshot.MessageTooLong = s.messageTooLong.Load()
+	snapshot.SourceDenied = s.sourceDenied.Load()
+	snapshot.GlobalRateLimited = s.globalRateLimited.Load()
+	snapshot.MemoryShed = s.memoryShed.Load()
+	snapshot.MultiplePairedKeys = s.multiplePairedKeys.Load()
+	snapshot.SenderIDRejected = s.senderIDRejected.Load()
+	snapshot.UnverifiedForwarded = s.unverifiedForwarded.Load()
+	snapshot.BreakerOpen = s.breakerOpen.Load()
+	snapshot.TransportRoamed = s.transportRoamed.Load()
+	snapshot.UnverifiedLearned = s.unverifiedLearned.Load()
+	snapshot.ProxyInvalid = s.proxyInvalid.Load()
+	snapshot.KeyPairs = s.keyPairCounts(false)
+	return snapshot
+}
+
+// Reset returns the current counter values and zeroes them.
+func (s *PacketStats) Reset() PacketStatsSnapshot {
+	var snapshot PacketStatsSnapshot
+	for i := range s.types {
+		snapshot.Received[i] = s.types[i].received.Swap(0)
+		snapshot.Forwarded[i] = s.types[i].forwarded.Swap(0)
+		snapshot.Dropped[i] = s.types[i].dropped.Swap(0)
+	}
+	snapshot.AuthFailures = s.authFailures.Swap(0)
+	snapshot.UnknownTypes = s.unknownTypes.Swap(0)
+	snapshot.Truncated = s.truncated.Swap(0)
+	snapshot.CookieReplies = s.cookieReplies.Swap(0)
+	snapshot.MAC2Failures = s.mac2Failures.Swap(0)
+	snapshot.RateLimited = s.rateLimited.Swap(0)
+	snapshot.LoopsDetected = s.loopsDetected.Swap(0)
+	snapshot.ReservedNonZero = s.reservedNonZero.Swap(0)
+	snapshot.UpstreamForwarded = s.upstreamForwarded.Swap(0)
+	snapshot.SenderIDCollisions = s.senderIDCollisions.Swap(0)
+	snapshot.DrainRejected = s.drainRejected.Swap(0)
+	snapshot.PendingQueued = s.pendingQueued.Swap(0)
+	snapshot.PendingDelivered = s.pendingDelivered.Swap(0)
+	snapshot.PeerNotFound = s.peerNotFound.Swap(0)
+	snapshot.ForwardingHeld = s.forwardingHeld.Swap(0)
+	snapshot.ShortWrites = s.shortWrites.Swap(0)
+	snapshot.MessageTooLong = s.messageTooLong.Swap(0)
+	snapshot.SourceDenied = s.sourceDenied.Swap(0)
+	snapshot.GlobalRateLimited = s.globalRateLimited.Swap(0)
+	snapshot.MemoryShed = s.memoryShed.Swap(0)
+	snapshot.MultiplePairedKeys = s.multiplePairedKeys.Swap(0)
+	snapshot.SenderIDRejected = s.senderIDRejected.Swap(0)
+	snapshot.UnverifiedForwarded = s.unverifiedForwarded.Swap(0)
+	snapshot.BreakerOpen = s.breakerOpen.Swap(0)
+	snapshot.TransportRoamed = s.transportRoamed.Swap(0)
+	snapshot.UnverifiedLearned = s.unverifiedLearned.Swap(0)
+	snapshot.ProxyInvalid = s.proxyInvalid.Swap(0)
+	snapshot.KeyPairs = s.keyPairCounts(true)
+	return snapshot
+}
+
+func (s PacketStatsSnapshot) String() string {
+	names := make([]string, 0, len(s.KeyPairs))
+	for name := range s.KeyPairs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	keyPairs := make([]string, len(names))
+	for i, name := range names {
+		keyPairs[i] = fmt.Sprintf("%s:%d", name, s.KeyPairs[name])
+	}
+
+	counters := s.Counters()
+	parts := make([]string, len(counters))
+	for i, counter := range counters {
+		parts[i] = fmt.Sprintf("%s=%d", counter.Name, counter.Value)
+	}
+
+	return fmt.Sprintf("received=%v forwarded=%v dropped=%v %s keypair_forwarded=[%s]",
+		s.Received, s.Forwarded, s.Dropped, strings.Join(parts, " "), strings.Join(keyPairs, " "))
+}
+
+// StatCounter is one named counter of a PacketStatsSnapshot.
+type StatCounter struct {
+	Name  string
+	Value uint64
+}
+
+// Counters returns the counters other than the per type and per key pair ones.
+func (s PacketStatsSnapshot) Counters() []StatCounter {
+	return []StatCounter{
+		{"auth_failures", s.AuthFailures},
+		{"unknown_types", s.UnknownTypes},
+		{"truncated", s.Truncated},
+		{"cookie_replies", s.CookieReplies},
+		{"mac2_failures", s.MAC2Failures},
+		{"rate_limited", s.RateLimited},
+		{"loops_detected", s.LoopsDetected},
+		{"reserved_nonzero", s.ReservedNonZero},
+		{"upstream_forwarded", s.UpstreamForwarded},
+		{"sender_id_collisions", s.SenderIDCollisions},
+		{"drain_rejected", s.DrainRejected},
+		{"pending_queued", s.PendingQueued},
+		{"pending_delivered", s.PendingDelivered},
+		{"peer_not_found", s.PeerNotFound},
+		{"forwarding_held", s.ForwardingHeld},
+		{"short_writes", s.ShortWrites},
+		{"message_too_long", s.MessageTooLong},
+		{"source_denied", s.SourceDenied},
+		{"global_rate_limited", s.GlobalRateLimited},
+		{"memory_shed", s.MemoryShed},
+		{"multiple_paired_keys", s.MultiplePairedKeys},
+		{"sender_id_rejected", s.SenderIDRejected},
+		{"unverified_forwarded", s.UnverifiedForwarded},
+		{"breaker_open", s.BreakerOpen},
+		{"transport_roamed", s.TransportRoamed},
+		{"unverified_learned", s.UnverifiedLearned},
+		{"proxy_invalid", s.ProxyInvalid},
+	}
+}
+
+// Sub returns the counts accumulated since prev was taken. A counter lower
+// than in prev was reset in between and is returned as is.
+func (s PacketStatsSnapshot) Sub(prev PacketStatsSnapshot) PacketStatsSnapshot {
+	diff := s
+	for i := range diff.Received {
+		diff.Received[i] = since(s.Received[i], prev.Received[i])
+		diff.Forwarded[i] = since(s.Forwarded[i], prev.Forwarded[i])
+		diff.Dropped[i] = since(s.Dropped[i], prev.Dropped[i])
+	}
+	diff.AuthFailures = since(s.AuthFailures, prev.AuthFailures)
+	diff.UnknownTypes = since(s.UnknownTypes, prev.UnknownTypes)
+	diff.Truncated = since(s.Truncated, prev.Truncated)
+	diff.CookieReplies = since(s.CookieReplies, prev.CookieReplies)
+	diff.MAC2Failures = since(s.MAC2Failures, prev.MAC2Failures)
+	diff.RateLimited = since(s.RateLimited, prev.RateLimited)
+	diff.LoopsDetected = since(s.LoopsDetected, prev.LoopsDetected)
+	diff.ReservedNonZero = since(s.ReservedNonZero, prev.ReservedNonZero)
+	diff.UpstreamForwarded = since(s.UpstreamForwarded, prev.UpstreamForwarded)
+	diff.SenderIDCollisions = since(s.SenderIDCollisions, prev.SenderIDCollisions)
+	diff.DrainRejected = since(s.DrainRejected, prev.DrainRejected)
+	diff.PendingQueued = since(s.PendingQueued, prev.PendingQueued)
+	diff.PendingDelivered = since(s.PendingDelivered, prev.PendingDelivered)
+	diff.PeerNotFound = since(s.PeerNotFound, prev.PeerNotFound)
+	diff.ForwardingHeld = since(s.ForwardingHeld, prev.ForwardingHeld)
+	diff.ShortWrites = since(s.ShortWrites, prev.ShortWrites)
+	diff.MessageTooLong = since(s.MessageTooLong, prev.MessageTooLong)
+	diff.SourceDenied = since(s.SourceDenied, prev.SourceDenied)
+	diff.GlobalRateLimited = since(s.GlobalRateLimited, prev.GlobalRateLimited)
+	diff.MemoryShed = since(s.MemoryShed, prev.MemoryShed)
+	diff.MultiplePairedKeys = since(s.MultiplePairedKeys, prev.MultiplePairedKeys)
+	diff.SenderIDRejected = since(s.SenderIDRejected, prev.SenderIDRejected)
+	diff.UnverifiedForwarded = since(s.UnverifiedForwarded, prev.UnverifiedForwarded)
+	diff.BreakerOpen = since(s.BreakerOpen, prev.BreakerOpen)
+	diff.TransportRoamed = since(s.TransportRoamed, prev.TransportRoamed)
+	diff.UnverifiedLearned = since(s.UnverifiedLearned, prev.UnverifiedLearned)
+	diff.ProxyInvalid = since(s.ProxyInvalid, prev.ProxyInvalid)
+	diff.KeyPairs = make(map[string]uint64, len(s.KeyPairs))
+	for name, count := range s.KeyPairs {
+		diff.KeyPairs[name] = since(count, prev.KeyPairs[name])
+	}
+	return diff
+}
+
+func since(current, prev uint64) uint64 {
+	if current < prev {
+		return current
+	}
+	return current - prev
+}
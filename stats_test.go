@@ -0,0 +1,27 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPacketStatsTruncated(t *testing.T) {
+	var stats PacketStats
+	stats.IncTruncated()
+	stats.IncTruncated()
+
+	if got := stats.Snapshot().Truncated; got != 2 {
+		t.Errorf("Snapshot().Truncated = %d, want 2", got)
+	}
+
+	snapshot := stats.Reset()
+	if snapshot.Truncated != 2 {
+		t.Errorf("Reset().Truncated = %d, want 2", snapshot.Truncated)
+	}
+	if !strings.Contains(snapshot.String(), "truncated=2") {
+		t.Errorf("String() = %q, want it to report truncated=2", snapshot.String())
+	}
+	if got := stats.Snapshot().Truncated; got != 0 {
+		t.Errorf("Truncated after Reset = %d, want 0", got)
+	}
+}
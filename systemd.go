@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdListenFDsStart is the first file descriptor passed by systemd socket activation.
+const sdListenFDsStart = 3
+
+// SystemdListenUDPConn adopts the UDP socket passed by systemd socket activation.
+// It reports false when the process was not socket-activated, in which case the
+// caller should bind the socket itself.
+func SystemdListenUDPConn() (*net.UDPConn, bool, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, false, nil
+	}
+
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds < 1 {
+		return nil, false, nil
+	}
+
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	if fds > 1 {
+		return nil, true, fmt.Errorf("expected 1 socket from systemd, got %d", fds)
+	}
+
+	file := os.NewFile(uintptr(sdListenFDsStart), "LISTEN_FD_3")
+	defer file.Close()
+
+	packetConn, err := net.FilePacketConn(file)
+	if err != nil {
+		return nil, true, fmt.Errorf("failed to adopt systemd socket: %v", err)
+	}
+
+	conn, ok := packetConn.(*net.UDPConn)
+	if !ok {
+		packetConn.Close()
+		return nil, true, fmt.Errorf("systemd socket is not a UDP socket")
+	}
+
+	return conn, true, nil
+}
+
+// SdNotify sends state to the systemd notification socket.
+// It is a no-op returning false when NOTIFY_SOCKET is not set.
+func SdNotify(state string) (bool, error) {
+	socketAddr := &net.UnixAddr{
+		Name: os.Getenv("NOTIFY_SOCKET"),
+		Net:  "unixgram",
+	}
+
+	if socketAddr.Name == "" {
+		return false, nil
+	}
+
+	// A leading '@' denotes a socket in the abstract namespace.
+	if socketAddr.Name[0] == '@' {
+		socketAddr.Name = "\x00" + socketAddr.Name[1:]
+	}
+
+	conn, err := net.DialUnix(socketAddr.Net, nil, socketAddr)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// SdWatchdogInterval returns the watchdog timeout configured by WatchdogSec,
+// or 0 when the watchdog is not enabled for this process.
+func SdWatchdogInterval() (time.Duration, error) {
+	usecString := os.Getenv("WATCHDOG_USEC")
+	if usecString == "" {
+		return 0, nil
+	}
+
+	usec, err := strconv.ParseInt(usecString, 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, fmt.Errorf("invalid WATCHDOG_USEC: %s", usecString)
+	}
+
+	if pidString := os.Getenv("WATCHDOG_PID"); pidString != "" {
+		pid, err := strconv.Atoi(pidString)
+		if err != nil {
+			return 0, fmt.Errorf("invalid WATCHDOG_PID: %s", pidString)
+		}
+		if pid != os.Getpid() {
+			return 0, nil
+		}
+	}
+
+	return time.Duration(usec) * time.Microsecond, nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// tapQueueSize is how many mirrored packets may wait for the tap writer
+// before further packets are dropped.
+const tapQueueSize = 1024
+
+// pcap file format constants, see https://wiki.wireshark.org/Development/LibpcapFileFormat.
+const (
+	pcapMagic       = 0xa1b2c3d4
+	pcapSnapLen     = 65535
+	pcapLinkTypeRaw = 101 // raw IPv4/IPv6 packets
+)
+
+type tappedPacket struct {
+	at   time.Time
+	src  *net.UDPAddr
+	data []byte
+}
+
+// PacketTap mirrors a sample of received packets to a pcap file and/or a UDP
+// collector for passive analysis. Mirror never blocks: packets are copied to
+// a queue that a background writer drains, and dropped when it is full.
+type PacketTap struct {
+	sample  uint64
+	seen    atomic.Uint64
+	dropped atomic.Uint64
+	queue   chan tappedPacket
+	logger  LoggerInterface
+
+	// local is the destination address recorded in the pcap file.
+	local     *net.UDPAddr
+	pcap      *bufio.Writer
+	pcapFile  io.Closer
+	collector net.Conn
+}
+
+// NewPacketTap mirrors one in every sample packets (every packet when sample
+// is below 2) to pcapPath and/or collectorAddress; either may be empty.
+func NewPacketTap(pcapPath, collectorAddress string, sample int, local *net.UDPAddr, logger LoggerInterface) (*PacketTap, error) {
+	if sample < 1 {
+		sample = 1
+	}
+	tap := &PacketTap{
+		sample: uint64(sample),
+		queue:  make(chan tappedPacket, tapQueueSize),
+		logger: logger,
+		local:  local,
+	}
+
+	if collectorAddress != "" {
+		conn, err := net.Dial("udp", collectorAddress)
+		if err != nil {
+			return nil, fmt.Errorf("tap collector: %w", err)
+		}
+		tap.collector = conn
+	}
+
+	if pcapPath != "" {
+		file, err := os.Create(pcapPath)
+		if err != nil {
+			if tap.collector != nil {
+				tap.collector.Close()
+			}
+			return nil, fmt.Errorf("tap file: %w", err)
+		}
+		tap.pcapFile = file
+		tap.pcap = bufio.NewWriter(file)
+		if err := writePcapHeader(tap.pcap); err != nil {
+			tap.Close()
+			return nil, fmt.Errorf("tap file: %w", err)
+		}
+	}
+
+	return tap, nil
+}
+
+// Mirror queues a copy of payload received from src if it is sampled.
+func (t *PacketTap) Mirror(src *net.UDPAddr, payload []byte) {
+	if t.seen.Add(1)%t.sample != 0 {
+		return
+	}
+
+	data := make([]byte, len(payload))
+	copy(data, payload)
+
+	select {
+	case t.queue <- tappedPacket{at: time.Now(), src: src, data: data}:
+	default:
+		t.dropped.Add(1)
+	}
+}
+
+// Dropped returns how many sampled packets were not mirrored because the
+// writer fell behind.
+func (t *PacketTap) Dropped() uint64 {
+	return t.dropped.Load()
+}
+
+// Run writes queued packets until ctx is cancelled, then closes the outputs.
+func (t *PacketTap) Run(ctx context.Context) {
+	defer t.Close()
+
+	flush := time.NewTicker(time.Second)
+	defer flush.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flush.C:
+			if t.pcap != nil {
+				if err := t.pcap.Flush(); err != nil {
+					t.logger.Warning("Failed to flush tap file: %v", err)
+				}
+			}
+		case packet := <-t.queue:
+			t.write(packet)
+		}
+	}
+}
+
+func (t *PacketTap) write(packet tappedPacket) {
+	if t.collector != nil {
+		if _, err := t.collector.Write(packet.data); err != nil {
+			t.logger.Debug("Failed to mirror packet to tap collector: %v", err)
+		}
+	}
+	if t.pcap != nil {
+		if err := writePcapRecord(t.pcap, packet.at, buildUDPPacket(packet.src, t.local, packet.data)); err != nil {
+			t.logger.Warning("Failed to write tap file: %v", err)
+		}
+	}
+}
+
+// Close flushes and closes the outputs.
+func (t *PacketTap) Close() error {
+	var err error
+	if t.pcap != nil {
+		err = t.pcap.Flush()
+	}
+	if t.pcapFile != nil {
+		if closeErr := t.pcapFile.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if t.collector != nil {
+		t.collector.Close()
+	}
+	return err
+}
+
+func writePcapHeader(w io.Writer) error {
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:4], pcapMagic)
+	binary.LittleEndian.PutUint16(header[4:6], 2)
+	binary.LittleEndian.PutUint16(header[6:8], 4)
+	binary.LittleEndian.PutUint32(header[16:20], pcapSnapLen)
+	binary.LittleEndian.PutUint32(header[20:24], pcapLinkTypeRaw)
+	_, err := w.Write(header)
+	return err
+}
+
+func writePcapRecord(w io.Writer, at time.Time, packet []byte) error {
+	header := make([]byte, 16)
+	binary.LittleEndian.PutUint32(header[0:4], uint32(at.Unix()))
+	binary.LittleEndian.PutUint32(header[4:8], uint32(at.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(header[8:12], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(header[12:16], uint32(len(packet)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(packet)
+	return err
+}
+
+// buildUDPPacket wraps payload in IP and UDP headers from src to dst so the
+// pcap file can be read by standard tools. The UDP checksum is left zero.
+func buildUDPPacket(src, dst *net.UDPAddr, payload []byte) []byte {
+	udp := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint16(udp[0:2], uint16(src.Port))
+	binary.BigEndian.PutUint16(udp[2:4], uint16(dst.Port))
+	binary.BigEndian.PutUint16(udp[4:6], uint16(8+len(payload)))
+	udp = append(udp, payload...)
+
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	if srcIP != nil {
+		if dstIP == nil {
+			dstIP = net.IPv4zero.To4()
+		}
+		ip := make([]byte, 20, 20+len(udp))
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:4], uint16(20+len(udp)))
+		ip[8] = 64
+		ip[9] = 17 // UDP
+		copy(ip[12:16], srcIP)
+		copy(ip[16:20], dstIP)
+		binary.BigEndian.PutUint16(ip[10:12], ipv4Checksum(ip))
+		return append(ip, udp...)
+	}
+
+	dstIP = dst.IP.To16()
+	if dstIP == nil || dst.IP.To4() != nil {
+		dstIP = net.IPv6unspecified
+	}
+	ip := make([]byte, 40, 40+len(udp))
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:6], uint16(len(udp)))
+	ip[6] = 17 // UDP
+	ip[7] = 64
+	copy(ip[8:24], src.IP.To16())
+	copy(ip[24:40], dstIP)
+	return append(ip, udp...)
+}
+
+func ipv4Checksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i : i+2]))
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultTracingServiceName = "wg-knot"
+
+	tracingExportInterval = 5 * time.Second
+	tracingExportTimeout  = 10 * time.Second
+	tracingMaxPending     = 4096
+)
+
+// Tracer creates spans around packet handling. The default noopTracer records
+// nothing and allocates nothing, so tracing costs nothing unless configured.
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a single traced operation. Callers should only compute attribute
+// values when IsRecording reports true.
+type Span interface {
+	IsRecording() bool
+	SetAttribute(key string, value any)
+	SetError(err error)
+	End()
+}
+
+type noopTracer struct{}
+
+func (noopTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) IsRecording() bool                  { return false }
+func (noopSpan) SetAttribute(key string, value any) {}
+func (noopSpan) SetError(err error)                 {}
+func (noopSpan) End()                               {}
+
+type spanContextKey struct{}
+
+// OTLPTracer exports spans to an OpenTelemetry collector using OTLP over
+// HTTP with JSON encoding, e.g. http://collector:4318/v1/traces.
+type OTLPTracer struct {
+	sync.Mutex
+	endpoint    string
+	serviceName string
+	client      *http.Client
+	logger      LoggerInterface
+	pending     []*otlpSpan
+	dropped     uint64
+}
+
+func NewOTLPTracer(endpoint, serviceName string, logger LoggerInterface) *OTLPTracer {
+	if serviceName == "" {
+		serviceName = DefaultTracingServiceName
+	}
+	return &OTLPTracer{
+		endpoint:    endpoint,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: tracingExportTimeout},
+		logger:      logger,
+	}
+}
+
+type otlpSpan struct {
+	tracer     *OTLPTracer
+	traceID    [16]byte
+	spanID     [8]byte
+	parentID   [8]byte
+	hasParent  bool
+	name       string
+	start      time.Time
+	end        time.Time
+	attributes map[string]any
+	err        error
+}
+
+func (t *OTLPTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	span := &otlpSpan{tracer: t, name: name, start: time.Now()}
+
+	if parent, ok := ctx.Value(spanContextKey{}).(*otlpSpan); ok {
+		span.traceID = parent.traceID
+		span.parentID = parent.spanID
+		span.hasParent = true
+	} else {
+		putRandom(span.traceID[:])
+	}
+	putRandom(span.spanID[:])
+
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+func putRandom(b []byte) {
+	for i := range b {
+		b[i] = byte(rand.Uint32())
+	}
+}
+
+func (s *otlpSpan) IsRecording() bool { return true }
+
+func (s *otlpSpan) SetAttribute(key string, value any) {
+	if s.attributes == nil {
+		s.attributes = make(map[string]any)
+	}
+	s.attributes[key] = value
+}
+
+func (s *otlpSpan) SetError(err error) {
+	s.err = err
+}
+
+func (s *otlpSpan) End() {
+	s.end = time.Now()
+
+	t := s.tracer
+	t.Lock()
+	defer t.Unlock()
+
+	if len(t.pending) >= tracingMaxPending {
+		t.dropped++
+		return
+	}
+	t.pending = append(t.pending, s)
+}
+
+// Run exports finished spans periodically until ctx is done, then flushes once more.
+func (t *OTLPTracer) Run(ctx context.Context) {
+	ticker := time.NewTicker(tracingExportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			t.flush()
+			return
+		case <-ticker.C:
+			t.flush()
+		}
+	}
+}
+
+func (t *OTLPTracer) flush() {
+	t.Lock()
+	spans := t.pending
+	dropped := t.dropped
+	t.pending = nil
+	t.dropped = 0
+	t.Unlock()
+
+	if dropped > 0 {
+		t.logger.Warning("Dropped %d trace spans: export queue full", dropped)
+	}
+	if len(spans) == 0 {
+		return
+	}
+
+	if err := t.export(spans); err != nil {
+		t.logger.Warning("Failed to export %d trace spans: %v", len(spans), err)
+	}
+}
+
+func (t *OTLPTracer) export(spans []*otlpSpan) error {
+	encoded := make([]map[string]any, 0, len(spans))
+	for _, s := range spans {
+		span := map[string]any{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.spanID[:]),
+			"name":              s.name,
+			"kind":              1, // SPAN_KIND_INTERNAL
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attributes),
+		}
+		if s.hasParent {
+			span["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+		}
+		if s.err != nil {
+			span["status"] = map[string]any{"code": 2, "message": s.err.Error()} // STATUS_CODE_ERROR
+		}
+		encoded = append(encoded, span)
+	}
+
+	hostname, _ := os.Hostname()
+	request := map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": otlpAttributes(map[string]any{
+					"service.name":    t.serviceName,
+					"service.version": Version,
+					"host.name":       hostname,
+				}),
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "wg-knot", "version": Version},
+				"spans": encoded,
+			}},
+		}},
+	}
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+func otlpAttributes(attributes map[string]any) []map[string]any {
+	encoded := make([]map[string]any, 0, len(attributes))
+	for key, value := range attributes {
+		var v map[string]any
+		switch value := value.(type) {
+		case string:
+			v = map[string]any{"stringValue": value}
+		case bool:
+			v = map[string]any{"boolValue": value}
+		case int:
+			v = map[string]any{"intValue": strconv.Itoa(value)}
+		case uint8:
+			v = map[string]any{"intValue": strconv.Itoa(int(value))}
+		default:
+			v = map[string]any{"stringValue": fmt.Sprint(value)}
+		}
+		encoded = append(encoded, map[string]any{"key": key, "value": v})
+	}
+	return encoded
+}
+
+var _ Tracer = noopTracer{}
+var _ Tracer = (*OTLPTracer)(nil)
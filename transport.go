@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Transports the relay can listen on.
+const (
+	TransportUDP  = "udp"
+	TransportQUIC = "quic"
+)
+
+// Transport carries WireGuard messages between the relay and its peers. Each
+// message is read with the address of the peer that sent it and written to a
+// peer address, so the Receiver, UDPPacketSender and PeerManager work the same
+// on every transport.
+type Transport interface {
+	UDPConn
+	LocalAddr() net.Addr
+}
+
+var _ Transport = (*net.UDPConn)(nil)
+
+// ErrTransportNotImplemented is returned for transports that are recognised
+// but not available yet.
+var ErrTransportNotImplemented = errors.New("transport not implemented")
+
+// ValidateTransport checks a transport name; empty means TransportUDP.
+func ValidateTransport(name string) error {
+	switch name {
+	case TransportUDP, "", TransportQUIC:
+		return nil
+	default:
+		return fmt.Errorf("unknown transport: %s", name)
+	}
+}
+
+// ListenTransport listens on addr with the named transport.
+func ListenTransport(name string, addr *net.UDPAddr) (Transport, error) {
+	switch name {
+	case TransportUDP, "":
+		return net.ListenUDP("udp", addr)
+	case TransportQUIC:
+		return ListenQUIC(addr)
+	default:
+		return nil, fmt.Errorf("unknown transport: %s", name)
+	}
+}
+
+// ListenQUIC will carry the relay's datagrams inside QUIC sessions, for
+// networks that block arbitrary UDP but allow QUIC. It is a stub for now.
+func ListenQUIC(addr *net.UDPAddr) (Transport, error) {
+	return nil, fmt.Errorf("%w: %s", ErrTransportNotImplemented, TransportQUIC)
+}
@@ -0,0 +1,27 @@
+package main
+
+import "net"
+
+// NormalizeUDPAddr converts IPv4-mapped IPv6 addresses, as returned by
+// dual-stack sockets, to their 4-byte form so the same peer always has the
+// same representation. The zone is preserved so that replies to link-local
+// IPv6 peers leave through the interface they arrived on.
+func NormalizeUDPAddr(addr *net.UDPAddr) *net.UDPAddr {
+	if addr == nil {
+		return nil
+	}
+
+	if ip4 := addr.IP.To4(); ip4 != nil && len(addr.IP) == net.IPv6len {
+		return &net.UDPAddr{IP: ip4, Port: addr.Port, Zone: addr.Zone}
+	}
+
+	return addr
+}
+
+// UDPAddrEqual reports whether a and b refer to the same IP, port and zone.
+func UDPAddrEqual(a, b *net.UDPAddr) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	return a.Port == b.Port && a.Zone == b.Zone && a.IP.Equal(b.IP)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestNormalizeUDPAddr(t *testing.T) {
+	tests := []struct {
+		name string
+		addr *net.UDPAddr
+		want string
+	}{
+		{"ipv4", &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1).To4(), Port: 51820}, "192.0.2.1:51820"},
+		{"ipv4-mapped", &net.UDPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 51820}, "192.0.2.1:51820"},
+		{"ipv6", &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 51820}, "[2001:db8::1]:51820"},
+		{"ipv6 zone", &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 51820, Zone: "eth0"}, "[fe80::1%eth0]:51820"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := NormalizeUDPAddr(tt.addr)
+			if got.String() != tt.want {
+				t.Errorf("NormalizeUDPAddr(%s) = %s, want %s", tt.addr, got, tt.want)
+			}
+		})
+	}
+
+	if got := NormalizeUDPAddr(&net.UDPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 1}); len(got.IP) != net.IPv4len {
+		t.Errorf("IPv4-mapped address kept %d byte IP, want %d", len(got.IP), net.IPv4len)
+	}
+}
+
+func TestUDPAddrEqual(t *testing.T) {
+	base := &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 51820, Zone: "eth0"}
+	tests := []struct {
+		name  string
+		other *net.UDPAddr
+		want  bool
+	}{
+		{"same", &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 51820, Zone: "eth0"}, true},
+		{"other port", &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 51821, Zone: "eth0"}, false},
+		{"other zone", &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 51820, Zone: "eth1"}, false},
+		{"other ip", &net.UDPAddr{IP: net.ParseIP("fe80::2"), Port: 51820, Zone: "eth0"}, false},
+		{"nil", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := UDPAddrEqual(base, tt.other); got != tt.want {
+				t.Errorf("UDPAddrEqual(%s, %s) = %v, want %v", base, tt.other, got, tt.want)
+			}
+		})
+	}
+
+	ipv4 := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1}
+	if !UDPAddrEqual(ipv4, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1).To4(), Port: 1}) {
+		t.Error("16 and 4 byte forms of an IPv4 address compare unequal")
+	}
+}
+
+func TestLoadListenersResolvesIPv6(t *testing.T) {
+	listeners, err := LoadListenersFromConfig(ServerConfig{ListenAddress: "::1", Port: 52820}, nil)
+	if err != nil {
+		t.Fatalf("LoadListenersFromConfig: %v", err)
+	}
+	if len(listeners) != 1 || listeners[0].Addr.String() != "[::1]:52820" {
+		t.Errorf("listeners = %v, want [::1]:52820", listeners)
+	}
+}
+
+func TestRelayBetweenIPv6Peers(t *testing.T) {
+	publicKeyA, publicKeyB := testKeys(t)
+	sender := &captureSender{}
+	pm, _ := newTestPeerManager(t, sender)
+	ctx := context.Background()
+	addrA := &net.UDPAddr{IP: net.ParseIP("fe80::a"), Port: 51820, Zone: "eth0"}
+	addrB := &net.UDPAddr{IP: net.ParseIP("2001:db8::b"), Port: 51821}
+
+	// B's initiation teaches the relay where B is; A's then reaches it.
+	if err := pm.HandlePacket(ctx, addrB, mustBuildInitiation(t, publicKeyA, SenderID{2, 2, 2, 2})); err != nil {
+		t.Fatalf("initiation from B: %v", err)
+	}
+	if err := pm.HandlePacket(ctx, addrA, mustBuildInitiation(t, publicKeyB, SenderID{1, 1, 1, 1})); err != nil {
+		t.Fatalf("initiation from A: %v", err)
+	}
+	if err := pm.HandlePacket(ctx, addrB, mustBuildResponse(t, publicKeyA, SenderID{3, 3, 3, 3}, ReceiverID{1, 1, 1, 1})); err != nil {
+		t.Fatalf("response from B: %v", err)
+	}
+
+	sent := sender.Sent()
+	if len(sent) != 2 {
+		t.Fatalf("sent %d packets, want 2", len(sent))
+	}
+	if !UDPAddrEqual(sent[0].to, addrB) {
+		t.Errorf("initiation sent to %s, want %s", sent[0].to, addrB)
+	}
+	if sent[1].to.String() != "[fe80::a%eth0]:51820" {
+		t.Errorf("response sent to %s, want A with its zone", sent[1].to)
+	}
+}
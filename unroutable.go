@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+)
+
+// unroutableCounter counts packets dropped because no peer is known for their
+// receiver ID, the usual sign that one direction of a handshake never reached
+// the relay. It keeps the most recent receiver ID as a sample.
+type unroutableCounter struct {
+	count  atomic.Uint64
+	sample atomic.Uint32
+}
+
+func (c *unroutableCounter) record(receiverID ReceiverID) {
+	c.count.Add(1)
+	c.sample.Store(binary.BigEndian.Uint32(receiverID[:]))
+}
+
+// take returns the packets counted since the last call and the latest sample.
+func (c *unroutableCounter) take() (uint64, uint32) {
+	return c.count.Swap(0), c.sample.Load()
+}
+
+// runUnroutableLog logs every interval how many packets could not be routed
+// to a peer, until ctx is cancelled. Quiet intervals are not logged.
+func runUnroutableLog(ctx context.Context, pm *PeerManager, interval time.Duration, logger LoggerInterface) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if count, sample := pm.unroutable.take(); count > 0 {
+				logger.Info("%d packets in the last %v had no peer for their receiver ID (latest %08x): a handshake direction may be missing",
+					count, interval, sample)
+			}
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// upstreamDedupWindow is how long a payload sent to the upstreams is remembered,
+// so a copy that comes back through a chain of relays is not sent out again.
+const upstreamDedupWindow = 2 * time.Second
+
+type sourceAddrContextKey struct{}
+
+// sourceAddrFrom returns the source address attached by HandlePacket.
+func sourceAddrFrom(ctx context.Context) *net.UDPAddr {
+	addr, _ := ctx.Value(sourceAddrContextKey{}).(*net.UDPAddr)
+	return addr
+}
+
+// LoadUpstreamsFromConfig resolves the configured upstream relay addresses.
+func LoadUpstreamsFromConfig(upstreams []string) ([]*net.UDPAddr, error) {
+	addrs := make([]*net.UDPAddr, 0, len(upstreams))
+	for _, upstream := range upstreams {
+		addr, err := net.ResolveUDPAddr("udp", upstream)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream %q: %v", upstream, err)
+		}
+		if addr.IP == nil || addr.Port == 0 {
+			return nil, fmt.Errorf("upstream %q must include an IP and a port", upstream)
+		}
+		addrs = append(addrs, NormalizeUDPAddr(addr))
+	}
+	return addrs, nil
+}
+
+// SetUpstreams configures the relays that packets for unknown receiver IDs are
+// sent to. Every such packet is copied to each upstream, so an empty list
+// (the default) keeps dropping them.
+func (pm *PeerManager) SetUpstreams(upstreams []*net.UDPAddr) {
+	pm.upstreams = upstreams
+	if len(upstreams) > 0 && pm.upstreamSeen == nil {
+		pm.upstreamSeen = NewLoopDetector(upstreamDedupWindow)
+	}
+}
+
+// forwardToUpstreams sends a packet with no local receiver to the upstream
+// relays and reports whether it did. Packets received from an upstream, and
+// payloads already sent upstream within upstreamDedupWindow, are never sent
+// upstream again so chained relays cannot bounce a packet between them.
+func (pm *PeerManager) forwardToUpstreams(ctx context.Context, payload []byte) (bool, error) {
+	if len(pm.upstreams) == 0 {
+		return false, nil
+	}
+
+	source := sourceAddrFrom(ctx)
+	for _, upstream := range pm.upstreams {
+		if UDPAddrEqual(source, upstream) {
+			return false, nil
+		}
+	}
+
+	if pm.upstreamSeen.Seen(pm.upstreams[0], payload, pm.clock.Now()) {
+		pm.stats.IncLoopsDetected()
+		return true, nil
+	}
+
+	for _, upstream := range pm.upstreams {
+		if err := pm.ForwardPacket(ctx, upstream, payload); err != nil {
+			return false, err
+		}
+		pm.stats.IncUpstreamForwarded()
+	}
+
+	pm.loggerFrom(ctx).Debug("No local peer, forwarded to %d upstream relays", len(pm.upstreams))
+	return true, nil
+}
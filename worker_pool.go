@@ -2,46 +2,130 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"hash/maphash"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type PacketJob struct {
 	Addr *net.UDPAddr
 	Data []byte
+	// Submitted is when the job was queued, for latency measurement.
+	Submitted time.Time
+}
+
+// Worker affinity modes: every worker takes jobs from one shared queue, or
+// each worker has its own queue and handles all packets of the source
+// addresses hashed to it, in order.
+const (
+	WorkerAffinityNone   = "none"
+	WorkerAffinitySource = "source"
+)
+
+// ParseWorkerAffinity reports whether affinity routes packets by source
+// address. An empty affinity is WorkerAffinityNone.
+func ParseWorkerAffinity(affinity string) (bool, error) {
+	switch affinity {
+	case WorkerAffinityNone, "":
+		return false, nil
+	case WorkerAffinitySource:
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown worker affinity: %s", affinity)
+	}
 }
 
 type WorkerPool struct {
-	jobQueue   chan PacketJob
-	wg         sync.WaitGroup
-	maxWorkers int
-	logger     LoggerInterface
-	handler    func(context.Context, *net.UDPAddr, []byte) error
+	jobQueue chan PacketJob
+	// queues holds one queue per worker with source affinity, nil otherwise.
+	queues         []chan PacketJob
+	seed           maphash.Seed
+	wg             sync.WaitGroup
+	maxWorkers     int
+	handlerTimeout time.Duration
+	logger         LoggerInterface
+	handler        func(context.Context, *net.UDPAddr, []byte) error
+	errorLog       *ErrorLogAggregator
+	bufferPool     *BufferPool
+	// stop cancels the context workers run with, see ShutdownTimeout.
+	stop context.CancelFunc
+
+	latency       LatencyHistogram
+	slowThreshold time.Duration
+	slowLogged    atomic.Int64 // unix nanoseconds of the last slow job warning
+	slowSkipped   atomic.Uint64
+
+	// submitted and queueDropped count Submit calls for the queue full hook.
+	submitted          atomic.Uint64
+	queueDropped       atomic.Uint64
+	queueFullThreshold float64
+	queueFullWindow    time.Duration
+	onQueueFull        func(QueueDropStats)
 }
 
-func NewWorkerPool(maxWorkers int, handler func(context.Context, *net.UDPAddr, []byte) error, logger LoggerInterface) *WorkerPool {
+func NewWorkerPool(config WorkerPoolConfig, handler func(context.Context, *net.UDPAddr, []byte) error, logger LoggerInterface) *WorkerPool {
+	maxWorkers := config.MaxWorkers
 	if maxWorkers < 1 {
 		maxWorkers = 1
 	}
 
-	return &WorkerPool{
-		jobQueue:   make(chan PacketJob, maxWorkers*2),
-		maxWorkers: maxWorkers,
-		logger:     logger,
-		handler:    handler,
+	wp := &WorkerPool{
+		jobQueue:       make(chan PacketJob, maxWorkers*2),
+		maxWorkers:     maxWorkers,
+		handlerTimeout: config.HandlerTimeout,
+		logger:         logger,
+		handler:        handler,
+		slowThreshold:  config.SlowThreshold,
+	}
+
+	if bySource, _ := ParseWorkerAffinity(config.Affinity); bySource {
+		wp.jobQueue = nil
+		wp.seed = maphash.MakeSeed()
+		wp.queues = make([]chan PacketJob, maxWorkers)
+		for i := range wp.queues {
+			wp.queues[i] = make(chan PacketJob, maxWorkers*2)
+		}
 	}
+
+	if config.ErrorLogInterval > 0 {
+		wp.errorLog = NewErrorLogAggregator(config.ErrorLogInterval)
+	}
+
+	return wp
+}
+
+// SetBufferPool makes workers return each job's data to bufferPool once handled.
+// Handlers must then not retain the payload after returning.
+func (wp *WorkerPool) SetBufferPool(bufferPool *BufferPool) {
+	wp.bufferPool = bufferPool
 }
 
 func (wp *WorkerPool) Start(ctx context.Context) {
 	wp.logger.Info("Starting worker pool with %d workers", wp.maxWorkers)
+	ctx, wp.stop = context.WithCancel(ctx)
+
+	if wp.errorLog != nil {
+		go wp.errorLog.Run(ctx, wp.logger)
+	}
+	if wp.onQueueFull != nil {
+		go wp.watchQueue(ctx)
+	}
 
 	for i := 0; i < wp.maxWorkers; i++ {
+		queue := wp.jobQueue
+		if wp.queues != nil {
+			queue = wp.queues[i]
+		}
 		wp.wg.Add(1)
-		go wp.worker(ctx, i)
+		go wp.worker(ctx, i, queue)
 	}
 }
 
-func (wp *WorkerPool) worker(ctx context.Context, id int) {
+func (wp *WorkerPool) worker(ctx context.Context, id int, queue <-chan PacketJob) {
 	defer wp.wg.Done()
 
 	wp.logger.Debug("Worker %d started", id)
@@ -51,36 +135,149 @@ func (wp *WorkerPool) worker(ctx context.Context, id int) {
 		case <-ctx.Done():
 			wp.logger.Debug("Worker %d shutting down", id)
 			return
-		case job, ok := <-wp.jobQueue:
+		case job, ok := <-queue:
 			if !ok {
 				wp.logger.Debug("Worker %d: job queue closed", id)
 				return
 			}
 
-			err := wp.handler(ctx, job.Addr, job.Data)
-			if err != nil {
-				wp.logger.Error("Worker %d: failed to handle packet: %v", id, err)
+			started := time.Now()
+			if err := wp.handleJob(ctx, job); err != nil {
+				if wp.errorLog == nil || wp.errorLog.Allow(err) {
+					logger := wp.logger
+					var packetErr *PacketError
+					if errors.As(err, &packetErr) {
+						logger = logger.WithFields(packetErr.LogFields())
+					}
+					LogAtLevel(logger, LogLevelForError(err), "Worker %d: failed to handle packet: %v", id, err)
+				}
+			}
+			wp.observeLatency(job, started)
+
+			if wp.bufferPool != nil {
+				wp.bufferPool.Put(job.Data)
 			}
 		}
 	}
 }
 
+// handleJob runs the handler for a single job, bounded by handlerTimeout when set.
+func (wp *WorkerPool) handleJob(ctx context.Context, job PacketJob) error {
+	if wp.handlerTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, wp.handlerTimeout)
+		defer cancel()
+	}
+
+	return wp.handler(ctx, job.Addr, job.Data)
+}
+
+// observeLatency records the time from Submit to the end of handling and warns
+// when it exceeds slowThreshold, at most once per second.
+func (wp *WorkerPool) observeLatency(job PacketJob, started time.Time) {
+	now := time.Now()
+	total := now.Sub(job.Submitted)
+	wp.latency.Observe(total)
+
+	if wp.slowThreshold <= 0 || total <= wp.slowThreshold {
+		return
+	}
+
+	last := wp.slowLogged.Load()
+	if now.UnixNano()-last < int64(time.Second) || !wp.slowLogged.CompareAndSwap(last, now.UnixNano()) {
+		wp.slowSkipped.Add(1)
+		return
+	}
+
+	messageType := -1
+	if len(job.Data) > 0 {
+		messageType = int(job.Data[0])
+	}
+	wp.logger.Warning("Slow packet handling: type=%d total=%v handler=%v queued=%v (%d more slow packets not logged)",
+		messageType, total, now.Sub(started), started.Sub(job.Submitted), wp.slowSkipped.Swap(0))
+}
+
+// Latency returns the distribution of time from Submit to the end of handling.
+func (wp *WorkerPool) Latency() LatencySnapshot {
+	return wp.latency.Snapshot()
+}
+
 func (wp *WorkerPool) Submit(addr *net.UDPAddr, data []byte) bool {
 	job := PacketJob{
-		Addr: addr,
-		Data: data,
+		Addr:      addr,
+		Data:      data,
+		Submitted: time.Now(),
+	}
+
+	queue := wp.jobQueue
+	if wp.queues != nil {
+		queue = wp.queues[wp.workerFor(addr)]
 	}
-	
+
+	wp.submitted.Add(1)
 	select {
-	case wp.jobQueue <- job:
+	case queue <- job:
 		return true
 	default:
+		wp.queueDropped.Add(1)
 		return false
 	}
 }
 
+// workerFor returns the index of the worker handling packets from addr.
+func (wp *WorkerPool) workerFor(addr *net.UDPAddr) int {
+	var h maphash.Hash
+	h.SetSeed(wp.seed)
+	h.Write(addr.IP)
+	h.WriteByte(byte(addr.Port >> 8))
+	h.WriteByte(byte(addr.Port))
+	return int(h.Sum64() % uint64(len(wp.queues)))
+}
+
+// Shutdown closes the queues and waits until the workers have handled every
+// queued job.
 func (wp *WorkerPool) Shutdown() {
-	close(wp.jobQueue)
+	wp.closeQueues()
 	wp.wg.Wait()
+	if wp.stop != nil {
+		wp.stop()
+	}
 	wp.logger.Info("Worker pool shutdown complete")
 }
+
+// ShutdownTimeout is Shutdown, but once timeout expires the workers' context
+// is cancelled so that running handlers are stopped and the jobs still queued
+// are dropped. It reports whether every queued job was handled.
+func (wp *WorkerPool) ShutdownTimeout(timeout time.Duration) bool {
+	wp.closeQueues()
+	done := make(chan struct{})
+	go func() {
+		wp.wg.Wait()
+		close(done)
+	}()
+
+	drained := true
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		wp.logger.Warning("Worker pool did not drain within %v, stopping handlers", timeout)
+		drained = false
+		wp.stop()
+		<-done
+	}
+	if wp.stop != nil {
+		wp.stop()
+	}
+	wp.logger.Info("Worker pool shutdown complete")
+	return drained
+}
+
+func (wp *WorkerPool) closeQueues() {
+	if wp.queues != nil {
+		for _, queue := range wp.queues {
+			close(queue)
+		}
+	} else {
+		close(wp.jobQueue)
+	}
+}
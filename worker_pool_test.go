@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolHandlerTimeout(t *testing.T) {
+	handlerErr := make(chan error, 1)
+	slowHandler := func(ctx context.Context, addr *net.UDPAddr, payload []byte) error {
+		select {
+		case <-ctx.Done():
+			handlerErr <- ctx.Err()
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+			handlerErr <- nil
+			return nil
+		}
+	}
+
+	wp := NewWorkerPool(WorkerPoolConfig{MaxWorkers: 1, HandlerTimeout: 20 * time.Millisecond}, slowHandler, NewLogger(LogLevelError))
+	wp.Start(context.Background())
+	defer wp.Shutdown()
+
+	started := time.Now()
+	if !wp.Submit(testAddr(t, "192.0.2.1:51820"), []byte{MessageTypeTransport}) {
+		t.Fatal("Submit rejected the job")
+	}
+
+	select {
+	case err := <-handlerErr:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("handler finished with %v, want context.DeadlineExceeded", err)
+		}
+		if elapsed := time.Since(started); elapsed > time.Second {
+			t.Errorf("handler was cancelled after %v, want about 20ms", elapsed)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("slow handler was not cancelled")
+	}
+}
+
+func TestWorkerPoolWithoutHandlerTimeout(t *testing.T) {
+	hasDeadline := make(chan bool, 1)
+	handler := func(ctx context.Context, addr *net.UDPAddr, payload []byte) error {
+		_, ok := ctx.Deadline()
+		hasDeadline <- ok
+		return nil
+	}
+
+	wp := NewWorkerPool(WorkerPoolConfig{MaxWorkers: 1}, handler, NewLogger(LogLevelError))
+	wp.Start(context.Background())
+	defer wp.Shutdown()
+
+	wp.Submit(testAddr(t, "192.0.2.1:51820"), []byte{MessageTypeTransport})
+	if <-hasDeadline {
+		t.Error("handler context has a deadline although handler_timeout is 0")
+	}
+}
+
+func TestWorkerPoolSourceAffinity(t *testing.T) {
+	var mu sync.Mutex
+	inFlight := make(map[string]int)
+	lastSeq := make(map[string]int)
+	var violations []string
+	handler := func(ctx context.Context, addr *net.UDPAddr, payload []byte) error {
+		source := addr.String()
+		seq := int(payload[0])
+		mu.Lock()
+		inFlight[source]++
+		if inFlight[source] > 1 {
+			violations = append(violations, source+" handled by two workers at once")
+		}
+		if seq <= lastSeq[source] {
+			violations = append(violations, fmt.Sprintf("%s: packet %d handled after %d", source, seq, lastSeq[source]))
+		}
+		lastSeq[source] = seq
+		mu.Unlock()
+
+		time.Sleep(100 * time.Microsecond)
+
+		mu.Lock()
+		inFlight[source]--
+		mu.Unlock()
+		return nil
+	}
+
+	const sources, packets = 8, 20
+	wp := NewWorkerPool(WorkerPoolConfig{MaxWorkers: 4, Affinity: WorkerAffinitySource}, handler, NewLogger(LogLevelError))
+	wp.Start(context.Background())
+
+	addrs := make([]*net.UDPAddr, sources)
+	for i := range addrs {
+		addrs[i] = testAddr(t, fmt.Sprintf("192.0.2.%d:51820", i+1))
+	}
+	for seq := 1; seq <= packets; seq++ {
+		for _, addr := range addrs {
+			// Per-worker queues are short; wait for room instead of dropping.
+			for !wp.Submit(addr, []byte{byte(seq)}) {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+	wp.Shutdown()
+
+	for _, violation := range violations {
+		t.Error(violation)
+	}
+	for _, addr := range addrs {
+		if lastSeq[addr.String()] != packets {
+			t.Errorf("%s: last packet handled %d, want %d", addr, lastSeq[addr.String()], packets)
+		}
+	}
+}
+
+func TestWorkerPoolWorkerForIsStable(t *testing.T) {
+	wp := NewWorkerPool(WorkerPoolConfig{MaxWorkers: 4, Affinity: WorkerAffinitySource}, nil, NewLogger(LogLevelError))
+
+	used := make(map[int]bool)
+	for i := range 64 {
+		addr := testAddr(t, fmt.Sprintf("198.51.100.%d:51820", i+1))
+		worker := wp.workerFor(addr)
+		if again := wp.workerFor(testAddr(t, addr.String())); again != worker {
+			t.Fatalf("%s mapped to workers %d and %d", addr, worker, again)
+		}
+		used[worker] = true
+	}
+	if len(used) != 4 {
+		t.Errorf("64 sources used %d of 4 workers", len(used))
+	}
+}
+
+func TestWorkerPoolShutdownHandlesQueuedJobs(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var handled []byte
+	handler := func(ctx context.Context, addr *net.UDPAddr, payload []byte) error {
+		<-release
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		mu.Lock()
+		handled = append(handled, payload[0])
+		mu.Unlock()
+		return nil
+	}
+
+	wp := NewWorkerPool(WorkerPoolConfig{MaxWorkers: 1}, handler, NewLogger(LogLevelError))
+	wp.Start(context.Background())
+	for i := byte(1); i <= 2; i++ {
+		if !wp.Submit(testAddr(t, "192.0.2.1:51820"), []byte{i}) {
+			t.Fatalf("Submit rejected job %d", i)
+		}
+	}
+
+	drained := make(chan bool, 1)
+	go func() {
+		drained <- wp.ShutdownTimeout(5 * time.Second)
+	}()
+	close(release)
+
+	if !<-drained {
+		t.Error("ShutdownTimeout reported undrained queues")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(handled) != 2 {
+		t.Errorf("handled jobs %v after shutdown, want both queued jobs", handled)
+	}
+}
+
+func TestWorkerPoolShutdownTimeoutStopsHandlers(t *testing.T) {
+	handler := func(ctx context.Context, addr *net.UDPAddr, payload []byte) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	wp := NewWorkerPool(WorkerPoolConfig{MaxWorkers: 1}, handler, NewLogger(LogLevelError))
+	wp.Start(context.Background())
+	wp.Submit(testAddr(t, "192.0.2.1:51820"), []byte{MessageTypeTransport})
+
+	started := time.Now()
+	if wp.ShutdownTimeout(20 * time.Millisecond) {
+		t.Error("ShutdownTimeout reported drained queues with a blocked handler")
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("ShutdownTimeout returned after %v, want about 20ms", elapsed)
+	}
+}